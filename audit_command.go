@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/audit"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const auditUsage = "Usage: catalog_tower_persister audit source_id object_type source_ref\n" +
+	"  object_type is one of credential_types, credentials, inventories, service_offerings, service_plans, service_offering_nodes"
+
+// runAudit handles the audit sub command and returns the exit code
+// e.g. catalog_tower_persister audit 12 service_plans 7
+func runAudit(db *gorm.DB, log *logrus.Logger, args []string) int {
+	return printHistory(context.Background(), audit.NewGORMRepository(db), log.WithFields(logrus.Fields{"command": "audit"}), args, os.Stdout)
+}
+
+func printHistory(ctx context.Context, store audit.Repository, logger *logrus.Entry, args []string, out io.Writer) int {
+	if len(args) != 3 {
+		fmt.Fprintln(out, auditUsage)
+		return 2
+	}
+	sourceID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		fmt.Fprintln(out, auditUsage)
+		return 2
+	}
+	entries, err := store.History(ctx, sourceID, args[1], args[2])
+	if err != nil {
+		logger.Errorf("Audit history failed %v", err)
+		return 1
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(out, "No changes of %s %s in source %d\n", args[1], args[2], sourceID)
+	}
+	for _, e := range entries {
+		fmt.Fprintf(out, "%s %-7s id %d task %s request %s\n", e.CreatedAt.Format("2006-01-02T15:04:05Z07:00"), e.Action, e.ObjectID, e.TaskURL, e.RequestID)
+		for _, field := range []struct {
+			name  string
+			value []byte
+		}{{"changed", e.ChangedFields}, {"before", e.Before}, {"after", e.After}, {"diffs", e.Diffs}} {
+			if len(field.value) > 0 {
+				fmt.Fprintf(out, "  %-7s %s\n", field.name, field.value)
+			}
+		}
+	}
+	return 0
+}
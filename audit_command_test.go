@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/audit"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAuditLog struct {
+	entries []audit.Entry
+	err     error
+	query   []interface{}
+}
+
+func (fa *fakeAuditLog) Add(ctx context.Context, entries []audit.Entry) error {
+	fa.entries = append(fa.entries, entries...)
+	return fa.err
+}
+
+func (fa *fakeAuditLog) History(ctx context.Context, sourceID int64, objectType, sourceRef string) ([]audit.Entry, error) {
+	fa.query = []interface{}{sourceID, objectType, sourceRef}
+	return fa.entries, fa.err
+}
+
+func (fa *fakeAuditLog) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return 0, fa.err
+}
+
+func TestPrintHistory(t *testing.T) {
+	changedAt := time.Date(2021, 1, 8, 10, 22, 59, 0, time.UTC)
+	fa := &fakeAuditLog{entries: []audit.Entry{
+		{Action: "created", ObjectID: 12, TaskURL: "/tasks/1", RequestID: "abc", After: []byte(`{"name":"demo"}`), CreatedAt: changedAt},
+		{Action: "updated", ObjectID: 12, TaskURL: "/tasks/2", RequestID: "def", ChangedFields: []byte(`["create_json_schema"]`),
+			Diffs: []byte(`{"create_json_schema":[{"path":"/fields/0/label","before":"A","after":"B"}]}`), CreatedAt: changedAt.Add(time.Hour)},
+	}}
+	var out bytes.Buffer
+	assert.Equal(t, 0, printHistory(context.TODO(), fa, testhelper.TestLogger(), []string{"4", "service_plans", "7"}, &out))
+	assert.Equal(t, []interface{}{int64(4), "service_plans", "7"}, fa.query)
+	assert.Contains(t, out.String(), "2021-01-08T10:22:59Z created id 12 task /tasks/1 request abc")
+	assert.Contains(t, out.String(), `  after   {"name":"demo"}`)
+	assert.Contains(t, out.String(), "2021-01-08T11:22:59Z updated id 12 task /tasks/2 request def")
+	assert.Contains(t, out.String(), `"path":"/fields/0/label"`)
+}
+
+func TestPrintHistoryUsage(t *testing.T) {
+	var out bytes.Buffer
+	assert.Equal(t, 2, printHistory(context.TODO(), &fakeAuditLog{}, testhelper.TestLogger(), []string{"4"}, &out))
+	assert.Contains(t, out.String(), "Usage")
+
+	out.Reset()
+	assert.Equal(t, 2, printHistory(context.TODO(), &fakeAuditLog{}, testhelper.TestLogger(), []string{"four", "service_plans", "7"}, &out))
+	assert.Contains(t, out.String(), "Usage")
+}
+
+func TestPrintHistoryError(t *testing.T) {
+	var out bytes.Buffer
+	assert.Equal(t, 1, printHistory(context.TODO(), &fakeAuditLog{err: fmt.Errorf("kaboom")}, testhelper.TestLogger(), []string{"4", "service_plans", "7"}, &out))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/identity"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/audit"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/source"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// auditEntries makes an audit log entry for every object a refresh changed,
+// on behalf of the identity in ctx
+func auditEntries(ctx context.Context, logger *logrus.Entry, taskURL string, tenant *tenant.Tenant, source *source.Source, changes map[string][]base.Change) ([]audit.Entry, error) {
+	requestID := loggedRequestID(logger)
+	var id identity.Identity
+	if found, ok := identity.FromContext(ctx); ok {
+		id = *found
+	}
+	var result []audit.Entry
+	for _, objectType := range changeTypes {
+		for _, c := range changes[objectType] {
+			entry := audit.Entry{
+				TenantID:      tenant.ID,
+				SourceID:      source.ID,
+				ObjectType:    objectType,
+				ObjectID:      c.ID,
+				SourceRef:     c.SourceRef,
+				Action:        c.Action,
+				RequestID:     requestID,
+				TaskURL:       taskURL,
+				AccountNumber: id.AccountNumber,
+				OrgID:         id.OrgID,
+			}
+			var err error
+			if entry.ChangedFields, err = jsonOrNil(c.Changed); err != nil {
+				return nil, err
+			}
+			if entry.Before, err = jsonOrNil(c.Before); err != nil {
+				return nil, err
+			}
+			if entry.After, err = jsonOrNil(c.After); err != nil {
+				return nil, err
+			}
+			if entry.Diffs, err = jsonOrNil(c.Diffs); err != nil {
+				return nil, err
+			}
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+// jsonOrNil encodes v, empty values are stored as NULL
+func jsonOrNil(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return nil, err
+	}
+	return data, nil
+}
+
+// writeAuditLog adds the changes of a refresh to the audit log in the
+// transaction that commits the refresh
+func writeAuditLog(ctx context.Context, cfg *config.TowerPersisterConfig, tx *gorm.DB, logger *logrus.Entry, taskURL string, tenant *tenant.Tenant, source *source.Source, changes map[string][]base.Change) error {
+	if !cfg.AuditLog {
+		return nil
+	}
+	entries, err := auditEntries(ctx, logger, taskURL, tenant, source, changes)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Writing %d audit log entries", len(entries))
+	return audit.NewGORMRepository(tx).Add(ctx, entries)
+}
+
+// recordChanges writes the change events and the audit log of a refresh in
+// the transaction that commits it
+func recordChanges(ctx context.Context, cfg *config.TowerPersisterConfig, tx *gorm.DB, logger *logrus.Entry, taskURL string, tenant *tenant.Tenant, source *source.Source, changes map[string][]base.Change) error {
+	if err := writeChangeEvents(ctx, cfg, tx, logger, taskURL, tenant, source, changes); err != nil {
+		return err
+	}
+	return writeAuditLog(ctx, cfg, tx, logger, taskURL, tenant, source, changes)
+}
+
+// startAuditPurge deletes the audit log entries older than AuditRetention
+// every AuditPurgeInterval until shutdown, entries are kept forever when
+// the retention is 0
+func startAuditPurge(cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Logger, shutdown chan struct{}) {
+	if cfg.AuditRetention <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-shutdown
+		cancel()
+	}()
+	store := audit.NewGORMRepository(db.DB)
+	ticker := time.NewTicker(cfg.AuditPurgeInterval)
+	defer ticker.Stop()
+	for {
+		n, err := store.Purge(ctx, time.Now().Add(-cfg.AuditRetention))
+		if err != nil {
+			logger.Errorf("Error purging the audit log %v", err)
+		} else if n > 0 {
+			logger.Infof("Purged %d audit log entries older than %v", n, cfg.AuditRetention)
+		}
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+		}
+	}
+}
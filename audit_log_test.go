@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/source"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/datatypes"
+)
+
+func TestAuditEntries(t *testing.T) {
+	changes := map[string][]base.Change{
+		"service_plans": {{Action: base.ActionUpdated, ID: 20, SourceRef: "7", Changed: []string{"create_json_schema"},
+			Before: base.Attributes{"create_json_schema": datatypes.JSON(`{"a":1}`)},
+			After:  base.Attributes{"create_json_schema": datatypes.JSON(`{"a":2}`)},
+			Diffs:  map[string][]base.JSONChange{"create_json_schema": {{Path: "/a", Before: 1.0, After: 2.0}}}}},
+		"inventories": {{Action: base.ActionDeleted, ID: 11, SourceRef: "6"}},
+	}
+	entries, err := auditEntries(identityContext(testAccount), testhelper.TestLogger(), "/tasks/1", &tenant.Tenant{ID: 3}, &source.Source{ID: 4}, changes)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	deleted := entries[0]
+	assert.Equal(t, "inventories", deleted.ObjectType)
+	assert.Equal(t, base.ActionDeleted, deleted.Action)
+	assert.Nil(t, deleted.ChangedFields)
+	assert.Nil(t, deleted.Before, "A deleted object has no snapshots")
+
+	updated := entries[1]
+	assert.Equal(t, int64(3), updated.TenantID)
+	assert.Equal(t, int64(4), updated.SourceID)
+	assert.Equal(t, "service_plans", updated.ObjectType)
+	assert.Equal(t, int64(20), updated.ObjectID)
+	assert.Equal(t, "7", updated.SourceRef)
+	assert.Equal(t, "7888888", updated.RequestID)
+	assert.Equal(t, "/tasks/1", updated.TaskURL)
+	assert.Equal(t, testAccount, updated.AccountNumber)
+	assert.JSONEq(t, `["create_json_schema"]`, string(updated.ChangedFields))
+	assert.JSONEq(t, `{"create_json_schema":{"a":1}}`, string(updated.Before))
+	assert.JSONEq(t, `{"create_json_schema":{"a":2}}`, string(updated.After))
+	assert.JSONEq(t, `{"create_json_schema":[{"path":"/a","before":1,"after":2}]}`, string(updated.Diffs))
+}
+
+func TestWriteAuditLogDisabled(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+
+	err := recordChanges(context.TODO(), &config.TowerPersisterConfig{}, gdb, testhelper.TestLogger(), "/tasks/1", &tenant.Tenant{ID: 3}, &source.Source{ID: 4}, eventChanges)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet(), "Nothing should be written")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"expvar"
 	_ "expvar" // Register the expvar handlers
 	"fmt"
@@ -14,8 +15,17 @@ import (
 	"syscall"
 
 	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/catalogtask"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/database"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/logger"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/migrations"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/payload"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/sourcelock"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -37,55 +47,145 @@ func main() {
 		}
 	}()
 
+	if _, err := sourcelock.ParsePolicy(cfg.SourceLockPolicy); err != nil {
+		log.Fatalf("Invalid configuration %v", err)
+	}
+	if _, err := payload.ParseErrorPolicy(cfg.ObjectErrorPolicy); err != nil {
+		log.Fatalf("Invalid configuration %v", err)
+	}
+	if err := checkTaskReporter(cfg); err != nil {
+		log.Fatalf("Invalid configuration %v", err)
+	}
+	if err := checkRefreshMode(cfg); err != nil {
+		log.Fatalf("Invalid configuration %v", err)
+	}
+	if _, err := tenant.ParsePrecedence(cfg.TenantLookup); err != nil {
+		log.Fatalf("Invalid configuration %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		db, err := database.Connect(postgres.Open(databaseDSN(cfg)), cfg, log)
+		if err != nil {
+			log.Fatalf("Failed to connect database %v", err)
+		}
+		os.Exit(runMigrate(db, cfg.MigrationsDir, log, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		db, err := database.Connect(postgres.Open(databaseDSN(cfg)), cfg, log)
+		if err != nil {
+			log.Fatalf("Failed to connect database %v", err)
+		}
+		os.Exit(runAudit(db, log, os.Args[2:]))
+	}
+
 	isReady := &atomic.Value{}
 	isReady.Store(false)
 
 	go startPrometheus(cfg)
-	go startProbes(cfg, isReady)
+	dbHealth := database.NewHealth(cfg.DatabasePingTimeout)
+	go startProbes(cfg, isReady, dbHealth)
 
 	expvar.Publish("goroutines", expvar.Func(func() interface{} {
 		return fmt.Sprintf("%d", runtime.NumGoroutine())
 	}))
 
-	dsn := fmt.Sprintf(
-		"host=%s port=%d dbname=%s user=%s password=%s sslmode=%s",
-		cfg.DatabaseHostname,
-		cfg.DatabasePort,
-		cfg.DatabaseName,
-		cfg.DatabaseUsername,
-		cfg.DatabasePassword,
-		cfg.DatabaseSslMode,
-	)
-
-	if cfg.DatabaseRootCertPath != "" {
-		dsn += fmt.Sprintf(" sslrootcert=%s", cfg.DatabaseRootCertPath)
-	}
-
 	sigs := make(chan os.Signal, 1)
 	shutdown := make(chan struct{})
+	interrupt := make(chan struct{})
 	var workerGroup sync.WaitGroup
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := database.Connect(postgres.Open(databaseDSN(cfg)), cfg, log)
 	if err != nil {
-		panic("failed to connect database")
+		log.Fatalf("Failed to connect database %v", err)
 	}
 	fmt.Println("Connected to database")
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Fatalf("Failed to get the database connection pool %v", err)
+	}
+	prometheus.MustRegister(database.NewStatsCollector(sqlDB), sourceQueueDepth, supersededMessages, rejectedMessages)
+	prometheus.MustRegister(catalogtask.Collectors()...)
+	go dbHealth.Run(db, cfg.DatabasePingInterval, log, shutdown)
+
+	// Refuse to start on a schema this persister was not built for, the
+	// migrations are applied with "catalog_tower_persister migrate up"
+	migrator, err := migrations.NewMigrator(db, cfg.MigrationsDir)
+	if err != nil {
+		log.Fatalf("Failed to load the migrations %v", err)
+	}
+	if err := migrator.Check(context.Background()); err != nil {
+		log.Fatalf("Database schema check failed %v", err)
+	}
+	if err := checkTenantOrgID(context.Background(), cfg, DatabaseContext{DB: db}, logrus.NewEntry(log)); err != nil {
+		log.Fatalf("Tenant check failed %v", err)
+	}
 
 	dbContext := DatabaseContext{DB: db}
+	go startTaskRedelivery(cfg, dbContext, log, shutdown)
+	go startAuditPurge(cfg, dbContext, log, shutdown)
+
+	var publisher events.Publisher
+	if cfg.KafkaEventTopic != "" || cfg.KafkaChangeTopic != "" || cfg.KafkaTaskTopic != "" || cfg.KafkaDeadLetterTopic != "" {
+		publisher, err = events.NewKafkaPublisher(cfg.KafkaBrokers, log)
+		if err != nil {
+			log.Fatalf("Failed to create the Kafka producer %v", err)
+		}
+		defer publisher.Close()
+	}
+	if cfg.KafkaChangeTopic != "" {
+		go startOutboxRelay(cfg, dbContext, log, publisher, shutdown)
+	}
+
+	taskReportFile, err := openTaskReportFile(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open the task report file %v", err)
+	}
+	if taskReportFile != os.Stdout {
+		defer taskReportFile.Close()
+	}
+	reporters := &taskReporters{cfg: cfg, db: dbContext, publisher: publisher, sink: catalogtask.NewWriterSink(taskReportFile)}
 
 	workerGroup.Add(1)
-	go startKafkaListener(dbContext, log, shutdown, &workerGroup, isReady)
+	go startKafkaListener(cfg, dbContext, publisher, reporters, log, shutdown, interrupt, &workerGroup, isReady)
 	go func() {
 		sig := <-sigs
 		fmt.Println()
 		fmt.Println(sig)
 		close(shutdown)
 	}()
-	workerGroup.Wait()
+	listenerDone := make(chan struct{})
+	go func() {
+		workerGroup.Wait()
+		close(listenerDone)
+	}()
+	select {
+	case <-listenerDone:
+	case <-shutdown:
+		isReady.Store(false)
+		drainWorkers(log, &workerGroup, interrupt, cfg.DrainTimeout)
+	}
 	fmt.Println("exiting")
 }
 
+func databaseDSN(cfg *config.TowerPersisterConfig) string {
+	dsn := fmt.Sprintf(
+		"host=%s port=%d dbname=%s user=%s password=%s sslmode=%s",
+		cfg.DatabaseHostname,
+		cfg.DatabasePort,
+		cfg.DatabaseName,
+		cfg.DatabaseUsername,
+		cfg.DatabasePassword,
+		cfg.DatabaseSslMode,
+	)
+
+	if cfg.DatabaseRootCertPath != "" {
+		dsn += fmt.Sprintf(" sslrootcert=%s", cfg.DatabaseRootCertPath)
+	}
+
+	return dsn
+}
+
 func startPrometheus(cfg *config.TowerPersisterConfig) {
 	prometheusMux := http.NewServeMux()
 	prometheusMux.Handle("/metrics", promhttp.Handler())
@@ -95,7 +195,7 @@ func startPrometheus(cfg *config.TowerPersisterConfig) {
 	}
 }
 
-func startProbes(cfg *config.TowerPersisterConfig, isReady *atomic.Value) {
+func startProbes(cfg *config.TowerPersisterConfig, isReady *atomic.Value, dbHealth *database.Health) {
 	probeMux := http.NewServeMux()
 
 	probeMux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
@@ -103,7 +203,7 @@ func startProbes(cfg *config.TowerPersisterConfig, isReady *atomic.Value) {
 	})
 
 	probeMux.HandleFunc("/ready", func(w http.ResponseWriter, _ *http.Request) {
-		if !isReady.Load().(bool) {
+		if !isReady.Load().(bool) || !dbHealth.Healthy() {
 			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 			return
 		}
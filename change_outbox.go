@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/outbox"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/source"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// changeTypes is the order the change events of a refresh are written in,
+// objects come after the objects they link to
+var changeTypes = []string{"credential_types", "credentials", "inventories", "service_offerings", "service_plans", "service_offering_nodes"}
+
+var objectEventTypes = map[string]string{
+	base.ActionCreated: events.EventObjectCreated,
+	base.ActionUpdated: events.EventObjectUpdated,
+	base.ActionDeleted: events.EventObjectDeleted,
+}
+
+// changeEvents makes an outbox event for every object a refresh changed
+func changeEvents(cfg *config.TowerPersisterConfig, logger *logrus.Entry, taskURL string, tenant *tenant.Tenant, source *source.Source, changes map[string][]base.Change) ([]outbox.Event, error) {
+	requestID := loggedRequestID(logger)
+	now := time.Now().UTC()
+	var result []outbox.Event
+	for _, objectType := range changeTypes {
+		for _, c := range changes[objectType] {
+			event := &events.ObjectChanged{
+				EventType:     objectEventTypes[c.Action],
+				ObjectType:    objectType,
+				ID:            c.ID,
+				SourceRef:     c.SourceRef,
+				TenantID:      tenant.ID,
+				SourceID:      source.ID,
+				ChangedFields: c.Changed,
+				TaskURL:       taskURL,
+				RequestID:     requestID,
+				OccurredAt:    now,
+			}
+			msg, err := event.Message(cfg.KafkaChangeTopic)
+			if err != nil {
+				return nil, err
+			}
+			headers, err := json.Marshal(msg.Headers)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, outbox.Event{
+				Topic:     msg.Topic,
+				EventKey:  msg.Key,
+				EventType: event.EventType,
+				Payload:   msg.Value,
+				Headers:   headers,
+			})
+		}
+	}
+	return result, nil
+}
+
+// loggedRequestID is the request id of the message a worker is processing,
+// it is one of the fields of the worker's logger
+func loggedRequestID(logger *logrus.Entry) string {
+	requestID, _ := logger.Data["request_id"].(string)
+	return requestID
+}
+
+// writeChangeEvents adds the change events of a refresh to the outbox in the
+// transaction that commits the refresh, nothing is written when no change
+// topic is configured
+func writeChangeEvents(ctx context.Context, cfg *config.TowerPersisterConfig, tx *gorm.DB, logger *logrus.Entry, taskURL string, tenant *tenant.Tenant, source *source.Source, changes map[string][]base.Change) error {
+	if cfg.KafkaChangeTopic == "" {
+		return nil
+	}
+	outboxEvents, err := changeEvents(cfg, logger, taskURL, tenant, source, changes)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Writing %d change events to the outbox", len(outboxEvents))
+	return outbox.NewGORMRepository(tx).Add(ctx, outboxEvents)
+}
+
+// relayMessage turns an outbox event back into the message it was made from
+func relayMessage(e outbox.Event) (events.Message, error) {
+	msg := events.Message{Topic: e.Topic, Key: e.EventKey, Value: e.Payload}
+	if len(e.Headers) > 0 {
+		if err := json.Unmarshal(e.Headers, &msg.Headers); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+// relayOutbox publishes the waiting change events, batch by batch, until the
+// outbox is empty or an event can't be sent
+func relayOutbox(ctx context.Context, cfg *config.TowerPersisterConfig, store outbox.Repository, logger *logrus.Entry, publisher events.Publisher) {
+	publish := func(ctx context.Context, e outbox.Event) error {
+		msg, err := relayMessage(e)
+		if err != nil {
+			return err
+		}
+		publishCtx, cancel := context.WithTimeout(ctx, cfg.EventPublishTimeout)
+		defer cancel()
+		return publisher.Publish(publishCtx, msg)
+	}
+	for {
+		n, err := store.Relay(ctx, cfg.OutboxBatchSize, publish)
+		if n > 0 {
+			logger.Infof("Relayed %d change events", n)
+		}
+		if err != nil {
+			logger.Errorf("Error relaying change events %v", err)
+			return
+		}
+		if n < cfg.OutboxBatchSize {
+			return
+		}
+	}
+}
+
+// startOutboxRelay relays the change events written by the refreshes to
+// Kafka every OutboxRelayInterval until shutdown
+func startOutboxRelay(cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Logger, publisher events.Publisher, shutdown chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-shutdown
+		cancel()
+	}()
+	store := outbox.NewGORMRepository(db.DB)
+	ticker := time.NewTicker(cfg.OutboxRelayInterval)
+	defer ticker.Stop()
+	for {
+		relayOutbox(ctx, cfg, store, logrus.NewEntry(logger), publisher)
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/outbox"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/source"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOutbox relays its events in batches like the database
+type fakeOutbox struct {
+	events []outbox.Event
+}
+
+func (fo *fakeOutbox) Add(ctx context.Context, events []outbox.Event) error {
+	fo.events = append(fo.events, events...)
+	return nil
+}
+
+func (fo *fakeOutbox) Relay(ctx context.Context, limit int, publish outbox.PublishFunc) (int, error) {
+	n := 0
+	for n < limit && n < len(fo.events) {
+		if err := publish(ctx, fo.events[n]); err != nil {
+			fo.events = fo.events[n:]
+			return n, err
+		}
+		n++
+	}
+	fo.events = fo.events[n:]
+	return n, nil
+}
+
+func TestChangeEvents(t *testing.T) {
+	cfg := &config.TowerPersisterConfig{KafkaChangeTopic: "platform.catalog.object-events"}
+	changes := map[string][]base.Change{
+		"service_offerings": {{Action: base.ActionUpdated, ID: 20, SourceRef: "7", Changed: []string{"name"}}},
+		"inventories":       {{Action: base.ActionCreated, ID: 10, SourceRef: "5"}, {Action: base.ActionDeleted, ID: 11, SourceRef: "6"}},
+	}
+	result, err := changeEvents(cfg, testhelper.TestLogger(), "/tasks/1", &tenant.Tenant{ID: 3}, &source.Source{ID: 4}, changes)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(result))
+
+	var types []string
+	for _, e := range result {
+		types = append(types, e.EventType)
+		assert.Equal(t, "platform.catalog.object-events", e.Topic)
+		assert.Equal(t, "4", e.EventKey)
+	}
+	assert.Equal(t, []string{"catalog.object.created", "catalog.object.deleted", "catalog.object.updated"}, types, "The inventories should come before the offerings")
+
+	var updated events.ObjectChanged
+	assert.NoError(t, json.Unmarshal(result[2].Payload, &updated))
+	assert.Equal(t, "service_offerings", updated.ObjectType)
+	assert.Equal(t, int64(20), updated.ID)
+	assert.Equal(t, "7", updated.SourceRef)
+	assert.Equal(t, int64(3), updated.TenantID)
+	assert.Equal(t, []string{"name"}, updated.ChangedFields)
+	assert.Equal(t, "/tasks/1", updated.TaskURL)
+	assert.Equal(t, "7888888", updated.RequestID)
+
+	var headers map[string]string
+	assert.NoError(t, json.Unmarshal(result[2].Headers, &headers))
+	assert.Equal(t, map[string]string{"event_type": "catalog.object.updated", "x-rh-insights-request-id": "7888888"}, headers)
+}
+
+func TestWriteChangeEventsWithoutTopic(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+
+	err := writeChangeEvents(context.TODO(), &config.TowerPersisterConfig{}, gdb, testhelper.TestLogger(), "/tasks/1", &tenant.Tenant{ID: 3}, &source.Source{ID: 4}, eventChanges)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet(), "Nothing should be written to the outbox")
+}
+
+func TestRelayOutbox(t *testing.T) {
+	cfg := &config.TowerPersisterConfig{KafkaChangeTopic: "changes", OutboxBatchSize: 2, EventPublishTimeout: time.Second}
+	result, err := changeEvents(cfg, testhelper.TestLogger(), "/tasks/1", &tenant.Tenant{ID: 3}, &source.Source{ID: 4}, eventChanges)
+	assert.NoError(t, err)
+	store := &fakeOutbox{events: result}
+	fp := &fakePublisher{}
+
+	relayOutbox(context.TODO(), cfg, store, testhelper.TestLogger(), fp)
+	assert.Empty(t, store.events, "Every batch should be relayed")
+	assert.Equal(t, 4, len(fp.messages))
+	assert.Equal(t, "changes", fp.messages[0].Topic)
+	assert.Equal(t, "4", fp.messages[0].Key)
+	assert.Equal(t, "catalog.object.created", fp.messages[0].Headers["event_type"])
+	assert.Equal(t, []byte(result[0].Payload), fp.messages[0].Value)
+}
+
+func TestRelayOutboxFailure(t *testing.T) {
+	cfg := &config.TowerPersisterConfig{KafkaChangeTopic: "changes", OutboxBatchSize: 2, EventPublishTimeout: time.Second}
+	result, err := changeEvents(cfg, testhelper.TestLogger(), "/tasks/1", &tenant.Tenant{ID: 3}, &source.Source{ID: 4}, eventChanges)
+	assert.NoError(t, err)
+	store := &fakeOutbox{events: result}
+	fp := &fakePublisher{err: errors.New("kaboom")}
+
+	relayOutbox(context.TODO(), cfg, store, testhelper.TestLogger(), fp)
+	assert.Equal(t, 4, len(store.events), "The events should wait for the next relay")
+	assert.Equal(t, 1, len(fp.messages))
+}
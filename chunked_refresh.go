@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/identity"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/checkpoint"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/source"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/payload"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// checkpointStaleAfter is how long a claimed checkpoint is left alone before
+// another persister takes over, it is raised to outlast longer worker timeouts
+const checkpointStaleAfter = 20 * time.Minute
+
+// processStarted identifies this run of the persister in checkpoint claims
+var processStarted = time.Now().UTC()
+
+func claimant(cfg *config.TowerPersisterConfig) checkpoint.Claimant {
+	staleAfter := checkpointStaleAfter
+	if cfg.WorkerTimeout+time.Minute > staleAfter {
+		staleAfter = cfg.WorkerTimeout + time.Minute
+	}
+	return checkpoint.Claimant{Name: cfg.Hostname, StartedAt: processStarted, StaleAfter: staleAfter}
+}
+
+// processChunked refreshes a source in two steps. The pages of the tar file
+// are first staged, a chunk of pages per transaction, and the checkpoint
+// records how many pages have been staged so an interrupted refresh does not
+// download them again. The staged pages are then applied to the catalog, a
+// chunk of pages per transaction, and the checkpoint records how many pages
+// have been applied. The last transaction also does the links and deletes.
+// An interrupted refresh keeps its checkpoint and its task stays running
+// until the refresh is resumed.
+func processChunked(ctx context.Context, cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Entry, message MessagePayload, headers map[string]string, tenant *tenant.Tenant, source *source.Source, output map[string]interface{}, shutdown chan struct{}, p Persister) {
+	checkpoints := checkpoint.NewGORMRepository(db.DB)
+	hdrs, err := json.Marshal(headers)
+	if err != nil {
+		logger.Errorf("Error encoding headers %v", err)
+		return
+	}
+	cp := &checkpoint.Checkpoint{
+		TaskURL:  message.TaskURL,
+		TenantID: message.TenantID,
+		SourceID: message.SourceID,
+		DataURL:  message.DataURL,
+		Size:     message.Size,
+		Headers:  hdrs}
+	claimed, err := checkpoints.Claim(ctx, logger, cp, claimant(cfg))
+	if err != nil {
+		status, msg := failure(ctx, cfg, err)
+		if err := updateTask(logger, "completed", status, msg, output, p); err != nil {
+			logger.Errorf("Error updating task %v", err)
+		}
+		return
+	}
+	if !claimed {
+		logger.Infof("Task %s is being processed by another worker", message.TaskURL)
+		return
+	}
+
+	// Pages are only applied once all of them have been staged
+	if cp.PagesApplied == 0 {
+		err = p.StageTar(ctx, logger, checkpoints, cp, &http.Client{}, message.DataURL, cfg.ChunkSize, shutdown)
+		if err != nil {
+			stopChunked(ctx, cfg, checkpoints, logger, cp, err, output, p)
+			return
+		}
+	}
+
+	reporter := startProgressReporter(logger, p, cfg.ProgressInterval)
+	bol, err := applyChunks(ctx, cfg, db, logger, cp, tenant, source, reporter.report, p)
+	reporter.stop()
+	if err != nil {
+		stopChunked(ctx, cfg, checkpoints, logger, cp, err, output, p)
+		return
+	}
+	completeRefresh(ctx, cfg, logger, message.TaskURL, tenant, source, output, p, bol)
+}
+
+// applyChunks applies the staged pages of a task to the catalog, a chunk of
+// pages per transaction. Every transaction records the changes of its chunk
+// and moves the checkpoint, which renews the claim on the task. The last one
+// also removes the checkpoint. Like processAndCommit the transactions are
+// not tied to ctx, only their statements are.
+func applyChunks(ctx context.Context, cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Entry, cp *checkpoint.Checkpoint, tenant *tenant.Tenant, source *source.Source, onProgress payload.ProgressFunc, p Persister) (*payload.BillOfLading, error) {
+	tx := db.DB.Begin()
+	if tx.Error != nil {
+		logger.Errorf("Error starting a database transaction %v", tx.Error)
+		return nil, tx.Error
+	}
+	dbTransaction := tx.WithContext(ctx)
+	bol := newBillOfLading(cfg, logger, tenant, source, dbTransaction, onProgress)
+	recorded := make(map[string]int)
+	commit := func(applied int) (*gorm.DB, error) {
+		if err := recordChanges(ctx, cfg, dbTransaction, logger, cp.TaskURL, tenant, source, unrecorded(bol.Changes(), recorded)); err != nil {
+			return nil, err
+		}
+		if err := checkpoint.NewGORMRepository(dbTransaction).Applied(ctx, logger, cp, applied); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit().Error; err != nil {
+			logger.Errorf("Error committing database changes %v", err)
+			return nil, err
+		}
+		tx = db.DB.Begin()
+		if tx.Error != nil {
+			logger.Errorf("Error starting a database transaction %v", tx.Error)
+			return nil, tx.Error
+		}
+		dbTransaction = tx.WithContext(ctx)
+		bol.UseTransaction(dbTransaction)
+		return dbTransaction, nil
+	}
+
+	err := p.ProcessStaged(ctx, logger, bol, checkpoint.NewGORMRepository(db.DB), cp, cfg.ChunkSize, dbTransaction, commit)
+	if err == nil {
+		err = recordChanges(ctx, cfg, dbTransaction, logger, cp.TaskURL, tenant, source, unrecorded(bol.Changes(), recorded))
+	}
+	if err == nil {
+		err = checkpoint.NewGORMRepository(dbTransaction).Delete(ctx, logger, cp.TaskURL)
+	}
+	if err != nil {
+		logger.Errorf("Rolling back database changes %v", err)
+		tx.Rollback()
+		return bol, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		logger.Errorf("Error committing database changes %v", err)
+		return bol, err
+	}
+	logger.Info("Commited database changes")
+	return bol, nil
+}
+
+// unrecorded returns the changes that come after the ones already recorded
+// for every object type and moves recorded past them
+func unrecorded(changes map[string][]base.Change, recorded map[string]int) map[string][]base.Change {
+	result := make(map[string][]base.Change, len(changes))
+	for name, typeChanges := range changes {
+		result[name] = typeChanges[recorded[name]:]
+		recorded[name] = len(typeChanges)
+	}
+	return result
+}
+
+// stopChunked reports a chunked refresh that failed with err. A refresh
+// interrupted by a shutdown keeps its checkpoint and its task stays running,
+// a refresh whose task was taken over by another persister is left to that
+// persister. Any other failure discards the checkpoint, trying again would
+// fail the same way.
+func stopChunked(ctx context.Context, cfg *config.TowerPersisterConfig, checkpoints checkpoint.Repository, logger *logrus.Entry, cp *checkpoint.Checkpoint, err error, output map[string]interface{}, p Persister) {
+	switch {
+	case errors.Is(err, checkpoint.ErrClaimLost):
+		logger.Infof("Task %s was taken over by another persister", cp.TaskURL)
+		return
+	case errors.Is(err, payload.ErrShutdown) || errors.Is(err, context.Canceled):
+		logger.Infof("Shutting down, task %s will resume after %d staged and %d applied pages", cp.TaskURL, cp.PagesStaged, cp.PagesApplied)
+		msg := fmt.Sprintf("Refresh interrupted by shutdown after applying %d of %d staged pages, it will resume", cp.PagesApplied, cp.PagesStaged)
+		if err := updateTask(logger, "running", "ok", msg, output, p); err != nil {
+			logger.Errorf("Error updating task %v", err)
+		}
+		return
+	}
+	discardCheckpoint(checkpoints, logger, cp.TaskURL)
+	status, msg := failure(ctx, cfg, err)
+	if err := updateTask(logger, "completed", status, msg, output, p); err != nil {
+		logger.Errorf("Error updating task %v", err)
+	}
+}
+
+// resumable checks if the task of a message that was never started has the
+// checkpoint of an interrupted chunked refresh, the task stays running
+// until the refresh is resumed
+func resumable(cfg *config.TowerPersisterConfig, db DatabaseContext, qm queuedMessage) bool {
+	if !cfg.ChunkedRefresh {
+		return false
+	}
+	exists, err := checkpoint.NewGORMRepository(db.DB).Exists(context.Background(), qm.payload.TaskURL)
+	if err != nil {
+		qm.logger.Errorf("Error finding checkpoint for task %s %v", qm.payload.TaskURL, err)
+		return false
+	}
+	return exists
+}
+
+// checkRefreshMode makes sure chunked and staged refreshes are not both
+// enabled, a chunked refresh commits every chunk to the live tables
+func checkRefreshMode(cfg *config.TowerPersisterConfig) error {
+	if cfg.ChunkedRefresh && cfg.StagedRefresh {
+		return errors.New("ChunkedRefresh and StagedRefresh can not both be enabled")
+	}
+	return nil
+}
+
+// discardCheckpoint deletes the checkpoint of a failed refresh, it does not
+// use the context of the refresh which might have timed out
+func discardCheckpoint(checkpoints checkpoint.Repository, logger *logrus.Entry, taskURL string) {
+	if err := checkpoints.Delete(context.Background(), logger, taskURL); err != nil {
+		logger.Errorf("Error discarding checkpoint for task %s %v", taskURL, err)
+	}
+}
+
+// resumeCheckpoints dispatches a worker for every chunked refresh that was
+// interrupted, either by a restart of this persister or by a persister that
+// stopped renewing its claim. A checkpoint without a valid identity can
+// never be finished, it is rejected and discarded.
+func resumeCheckpoints(ctx context.Context, cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Logger, dispatcher *sourceDispatcher, dl *deadLetters, wg *sync.WaitGroup) {
+	checkpoints := checkpoint.NewGORMRepository(db.DB)
+	cps, err := checkpoints.Unfinished(ctx, claimant(cfg))
+	if err != nil {
+		logger.Errorf("Error finding unfinished checkpoints %v", err)
+		return
+	}
+	for _, cp := range cps {
+		headers := make(map[string]string)
+		if err := json.Unmarshal(cp.Headers, &headers); err != nil {
+			logger.Errorf("Error decoding headers of checkpoint for task %s %v", cp.TaskURL, err)
+			continue
+		}
+		logEntry := logger.WithFields(logrus.Fields{"request_id": headers["x-rh-insights-request-id"]})
+		message := MessagePayload{
+			TenantID: cp.TenantID,
+			SourceID: cp.SourceID,
+			TaskURL:  cp.TaskURL,
+			DataURL:  cp.DataURL,
+			Size:     cp.Size}
+		id, err := identity.Decode(headers["x-rh-identity"])
+		if err != nil {
+			value, _ := json.Marshal(message)
+			dl.reject(logEntry, strconv.FormatInt(cp.SourceID, 10), value, headers, err)
+			discardCheckpoint(checkpoints, logEntry, cp.TaskURL)
+			continue
+		}
+		logEntry = logEntry.WithFields(id.Fields())
+		logEntry.Infof("Resuming task %s", cp.TaskURL)
+		wg.Add(1)
+		dispatcher.dispatch(queuedMessage{logger: logEntry, payload: message, headers: headers, identity: id})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"time"
 
 	clowder "github.com/redhatinsights/app-common-go/pkg/api/v1"
 
@@ -13,30 +14,71 @@ import (
 
 // TowerPersisterConfig represents the runtime configuration
 type TowerPersisterConfig struct {
-	Hostname             string
-	DatabaseHostname     string
-	DatabasePort         int
-	DatabaseName         string
-	DatabaseUsername     string
-	DatabasePassword     string
-	DatabaseSslMode      string
-	DatabaseRootCertPath string
-	KafkaBrokers         []string
-	KafkaGroupID         string
-	KafkaTopic           string
-	WebPort              int
-	MetricsPort          int
-	Profile              bool
-	OpenshiftBuildCommit string
-	Version              string
-	LogGroup             string
-	LogLevel             string
-	AwsRegion            string
-	AwsAccessKeyID       string
-	AwsSecretAccessKey   string
-	Debug                bool
-	DebugUserAgent       *regexp.Regexp
-	UseClowder           bool
+	Hostname                  string
+	DatabaseHostname          string
+	DatabasePort              int
+	DatabaseName              string
+	DatabaseUsername          string
+	DatabasePassword          string
+	DatabaseSslMode           string
+	DatabaseRootCertPath      string
+	DatabaseMaxOpenConns      int
+	DatabaseMaxIdleConns      int
+	DatabaseConnMaxLifetime   time.Duration
+	DatabaseConnectRetries    int
+	DatabaseConnectBackoff    time.Duration
+	DatabaseMaxConnectBackoff time.Duration
+	DatabasePingInterval      time.Duration
+	DatabasePingTimeout       time.Duration
+	MigrationsDir             string
+	ChunkedRefresh            bool
+	ChunkSize                 int
+	StagedRefresh             bool
+	SourceLockPolicy          string
+	SourceQueueDepth          int
+	WorkerTimeout             time.Duration
+	DrainTimeout              time.Duration
+	ProgressInterval          time.Duration
+	ObjectErrorPolicy         string
+	MaxObjectErrors           int
+	TaskUpdateMaxAttempts     int
+	TaskUpdateBackoff         time.Duration
+	TaskUpdateMaxBackoff      time.Duration
+	TaskUpdateTimeout         time.Duration
+	TaskRedeliveryInterval    time.Duration
+	TaskUpdateMaxDeliveries   int
+	KafkaBrokers              []string
+	KafkaGroupID              string
+	KafkaTopic                string
+	KafkaEventTopic           string
+	RefreshEventSourceRefs    bool
+	EventPublishTimeout       time.Duration
+	KafkaChangeTopic          string
+	KafkaDeadLetterTopic      string
+	OutboxRelayInterval       time.Duration
+	OutboxBatchSize           int
+	AuditLog                  bool
+	AuditRetention            time.Duration
+	AuditPurgeInterval        time.Duration
+	TenantLookup              string
+	TenantOrgIDBackfill       bool
+	TaskReporter              string
+	TaskReporterHeader        string
+	KafkaTaskTopic            string
+	TaskReportFile            string
+	WebPort                   int
+	MetricsPort               int
+	Profile                   bool
+	OpenshiftBuildCommit      string
+	Version                   string
+	LogGroup                  string
+	LogLevel                  string
+	AwsRegion                 string
+	AwsAccessKeyID            string
+	AwsSecretAccessKey        string
+	Debug                     bool
+	DebugUserAgent            *regexp.Regexp
+	UseClowder                bool
 }
 
 // Get returns an initialized IngressConfig
@@ -91,7 +133,48 @@ func Get() *TowerPersisterConfig {
 		options.SetDefault("DatabaseSslMode", "disable")
 	}
 
+	options.SetDefault("DatabaseMaxOpenConns", 20)
+	options.SetDefault("DatabaseMaxIdleConns", 5)
+	options.SetDefault("DatabaseConnMaxLifetime", 30*time.Minute)
+	options.SetDefault("DatabaseConnectRetries", 10)
+	options.SetDefault("DatabaseConnectBackoff", time.Second)
+	options.SetDefault("DatabaseMaxConnectBackoff", 30*time.Second)
+	options.SetDefault("DatabasePingInterval", 10*time.Second)
+	options.SetDefault("DatabasePingTimeout", 5*time.Second)
+	options.SetDefault("MigrationsDir", "migrations")
+	options.SetDefault("ChunkedRefresh", false)
+	options.SetDefault("ChunkSize", 50)
+	options.SetDefault("StagedRefresh", false)
+	options.SetDefault("SourceLockPolicy", "wait")
+	options.SetDefault("SourceQueueDepth", 5)
+	options.SetDefault("WorkerTimeout", 15*time.Minute)
+	options.SetDefault("DrainTimeout", 20*time.Second)
+	options.SetDefault("ProgressInterval", 10*time.Second)
+	options.SetDefault("ObjectErrorPolicy", "skip")
+	options.SetDefault("MaxObjectErrors", 100)
+	options.SetDefault("TaskUpdateMaxAttempts", 5)
+	options.SetDefault("TaskUpdateBackoff", 500*time.Millisecond)
+	options.SetDefault("TaskUpdateMaxBackoff", 10*time.Second)
+	options.SetDefault("TaskUpdateTimeout", 10*time.Second)
+	options.SetDefault("TaskRedeliveryInterval", time.Minute)
+	options.SetDefault("TaskUpdateMaxDeliveries", 30)
 	options.SetDefault("KafkaGroupID", "tower_persister")
+	options.SetDefault("KafkaEventTopic", "")
+	options.SetDefault("RefreshEventSourceRefs", false)
+	options.SetDefault("EventPublishTimeout", 10*time.Second)
+	options.SetDefault("KafkaChangeTopic", "")
+	options.SetDefault("KafkaDeadLetterTopic", "")
+	options.SetDefault("OutboxRelayInterval", time.Second)
+	options.SetDefault("OutboxBatchSize", 100)
+	options.SetDefault("AuditLog", true)
+	options.SetDefault("AuditRetention", 90*24*time.Hour)
+	options.SetDefault("AuditPurgeInterval", time.Hour)
+	options.SetDefault("TenantLookup", "id,org_id,account")
+	options.SetDefault("TenantOrgIDBackfill", false)
+	options.SetDefault("TaskReporter", "rest")
+	options.SetDefault("TaskReporterHeader", "")
+	options.SetDefault("KafkaTaskTopic", "")
+	options.SetDefault("TaskReportFile", "")
 	options.SetDefault("LogLevel", "INFO")
 	options.SetDefault("OpenshiftBuildCommit", "notrunninginopenshift")
 	options.SetDefault("Profile", false)
@@ -105,29 +188,70 @@ func Get() *TowerPersisterConfig {
 	kubenv.AutomaticEnv()
 
 	return &TowerPersisterConfig{
-		Hostname:             kubenv.GetString("Hostname"),
-		DatabaseHostname:     options.GetString("DatabaseHostname"),
-		DatabasePort:         options.GetInt("DatabasePort"),
-		DatabaseName:         options.GetString("DatabaseName"),
-		DatabaseUsername:     options.GetString("DatabaseUsername"),
-		DatabasePassword:     options.GetString("DatabasePassword"),
-		DatabaseSslMode:      options.GetString("DatabaseSslMode"),
-		DatabaseRootCertPath: options.GetString("DatabaseRootCertPath"),
-		KafkaBrokers:         options.GetStringSlice("KafkaBrokers"),
-		KafkaGroupID:         options.GetString("KafkaGroupID"),
-		KafkaTopic:           options.GetString("KafkaTopic"),
-		WebPort:              options.GetInt("WebPort"),
-		MetricsPort:          options.GetInt("MetricsPort"),
-		Profile:              options.GetBool("Profile"),
-		Debug:                options.GetBool("Debug"),
-		DebugUserAgent:       regexp.MustCompile(options.GetString("DebugUserAgent")),
-		OpenshiftBuildCommit: kubenv.GetString("Openshift_Build_Commit"),
-		Version:              "1.0.0",
-		LogGroup:             options.GetString("LogGroup"),
-		LogLevel:             options.GetString("LogLevel"),
-		AwsRegion:            options.GetString("AwsRegion"),
-		AwsAccessKeyID:       options.GetString("AwsAccessKeyId"),
-		AwsSecretAccessKey:   options.GetString("AwsSecretAccessKey"),
-		UseClowder:           clowder.IsClowderEnabled(),
+		Hostname:                  kubenv.GetString("Hostname"),
+		DatabaseHostname:          options.GetString("DatabaseHostname"),
+		DatabasePort:              options.GetInt("DatabasePort"),
+		DatabaseName:              options.GetString("DatabaseName"),
+		DatabaseUsername:          options.GetString("DatabaseUsername"),
+		DatabasePassword:          options.GetString("DatabasePassword"),
+		DatabaseSslMode:           options.GetString("DatabaseSslMode"),
+		DatabaseRootCertPath:      options.GetString("DatabaseRootCertPath"),
+		DatabaseMaxOpenConns:      options.GetInt("DatabaseMaxOpenConns"),
+		DatabaseMaxIdleConns:      options.GetInt("DatabaseMaxIdleConns"),
+		DatabaseConnMaxLifetime:   options.GetDuration("DatabaseConnMaxLifetime"),
+		DatabaseConnectRetries:    options.GetInt("DatabaseConnectRetries"),
+		DatabaseConnectBackoff:    options.GetDuration("DatabaseConnectBackoff"),
+		DatabaseMaxConnectBackoff: options.GetDuration("DatabaseMaxConnectBackoff"),
+		DatabasePingInterval:      options.GetDuration("DatabasePingInterval"),
+		DatabasePingTimeout:       options.GetDuration("DatabasePingTimeout"),
+		MigrationsDir:             options.GetString("MigrationsDir"),
+		ChunkedRefresh:            options.GetBool("ChunkedRefresh"),
+		ChunkSize:                 options.GetInt("ChunkSize"),
+		StagedRefresh:             options.GetBool("StagedRefresh"),
+		SourceLockPolicy:          options.GetString("SourceLockPolicy"),
+		SourceQueueDepth:          options.GetInt("SourceQueueDepth"),
+		WorkerTimeout:             options.GetDuration("WorkerTimeout"),
+		DrainTimeout:              options.GetDuration("DrainTimeout"),
+		ProgressInterval:          options.GetDuration("ProgressInterval"),
+		ObjectErrorPolicy:         options.GetString("ObjectErrorPolicy"),
+		MaxObjectErrors:           options.GetInt("MaxObjectErrors"),
+		TaskUpdateMaxAttempts:     options.GetInt("TaskUpdateMaxAttempts"),
+		TaskUpdateBackoff:         options.GetDuration("TaskUpdateBackoff"),
+		TaskUpdateMaxBackoff:      options.GetDuration("TaskUpdateMaxBackoff"),
+		TaskUpdateTimeout:         options.GetDuration("TaskUpdateTimeout"),
+		TaskRedeliveryInterval:    options.GetDuration("TaskRedeliveryInterval"),
+		TaskUpdateMaxDeliveries:   options.GetInt("TaskUpdateMaxDeliveries"),
+		KafkaBrokers:              options.GetStringSlice("KafkaBrokers"),
+		KafkaGroupID:              options.GetString("KafkaGroupID"),
+		KafkaTopic:                options.GetString("KafkaTopic"),
+		KafkaEventTopic:           options.GetString("KafkaEventTopic"),
+		RefreshEventSourceRefs:    options.GetBool("RefreshEventSourceRefs"),
+		EventPublishTimeout:       options.GetDuration("EventPublishTimeout"),
+		KafkaChangeTopic:          options.GetString("KafkaChangeTopic"),
+		KafkaDeadLetterTopic:      options.GetString("KafkaDeadLetterTopic"),
+		OutboxRelayInterval:       options.GetDuration("OutboxRelayInterval"),
+		OutboxBatchSize:           options.GetInt("OutboxBatchSize"),
+		AuditLog:                  options.GetBool("AuditLog"),
+		AuditRetention:            options.GetDuration("AuditRetention"),
+		AuditPurgeInterval:        options.GetDuration("AuditPurgeInterval"),
+		TenantLookup:              options.GetString("TenantLookup"),
+		TenantOrgIDBackfill:       options.GetBool("TenantOrgIDBackfill"),
+		TaskReporter:              options.GetString("TaskReporter"),
+		TaskReporterHeader:        options.GetString("TaskReporterHeader"),
+		KafkaTaskTopic:            options.GetString("KafkaTaskTopic"),
+		TaskReportFile:            options.GetString("TaskReportFile"),
+		WebPort:                   options.GetInt("WebPort"),
+		MetricsPort:               options.GetInt("MetricsPort"),
+		Profile:                   options.GetBool("Profile"),
+		Debug:                     options.GetBool("Debug"),
+		DebugUserAgent:            regexp.MustCompile(options.GetString("DebugUserAgent")),
+		OpenshiftBuildCommit:      kubenv.GetString("Openshift_Build_Commit"),
+		Version:                   "1.0.0",
+		LogGroup:                  options.GetString("LogGroup"),
+		LogLevel:                  options.GetString("LogLevel"),
+		AwsRegion:                 options.GetString("AwsRegion"),
+		AwsAccessKeyID:            options.GetString("AwsAccessKeyId"),
+		AwsSecretAccessKey:        options.GetString("AwsSecretAccessKey"),
+		UseClowder:                clowder.IsClowderEnabled(),
 	}
 }
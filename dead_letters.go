@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/identity"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var rejectedMessages = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "catalog_tower_persister_rejected_messages_total",
+	Help: "The number of messages rejected because they can never be processed",
+})
+
+// deadLetters sends the messages that can never be processed, e.g. the ones
+// without a valid identity, to a dead letter topic instead of running them.
+// Without a topic they are only logged.
+type deadLetters struct {
+	publisher events.Publisher
+	topic     string
+	timeout   time.Duration
+}
+
+func newDeadLetters(cfg *config.TowerPersisterConfig, publisher events.Publisher) *deadLetters {
+	return &deadLetters{publisher: publisher, topic: cfg.KafkaDeadLetterTopic, timeout: cfg.EventPublishTimeout}
+}
+
+// reject drops a message, its task is not updated since the identity needed
+// to update it can not be trusted
+func (dl *deadLetters) reject(logger *logrus.Entry, key string, value []byte, headers map[string]string, reason error) {
+	rejectedMessages.Inc()
+	logger.Errorf("Rejecting message %v", reason)
+	if dl == nil || dl.publisher == nil || dl.topic == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dl.timeout)
+	defer cancel()
+	if err := dl.publisher.Publish(ctx, events.DeadLetter(dl.topic, key, value, headers, reason)); err != nil {
+		logger.Errorf("Error sending the rejected message to %s %v", dl.topic, err)
+	}
+}
+
+// checkIdentity makes sure the message of a refresh was sent on behalf of
+// the tenant it refreshes, the identity was decoded when it was received
+func checkIdentity(ctx context.Context, tenant *tenant.Tenant) error {
+	id, ok := identity.FromContext(ctx)
+	if !ok {
+		return identity.ErrMissing
+	}
+	return id.Check(tenant.ExternalTenant, tenant.OrgID)
+}
+
+// Reject sends the message of a refresh to the dead letter topic
+func (dp *defaultPersister) Reject(logger *logrus.Entry, message MessagePayload, headers map[string]string, reason error) {
+	value, err := json.Marshal(message)
+	if err != nil {
+		logger.Errorf("Error encoding the rejected message %v", err)
+	}
+	dp.deadLetters.reject(logger, strconv.FormatInt(message.SourceID, 10), value, headers, reason)
+}
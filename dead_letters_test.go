@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/identity"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+func TestReject(t *testing.T) {
+	fp := &fakePublisher{}
+	dl := &deadLetters{publisher: fp, topic: "dead", timeout: time.Second}
+	headers := map[string]string{"x-rh-insights-request-id": "abc"}
+
+	dl.reject(testhelper.TestLogger(), "777", []byte(`{"source_id":777}`), headers, identity.ErrMismatch)
+	assert.Len(t, fp.messages, 1)
+	assert.Equal(t, "dead", fp.messages[0].Topic)
+	assert.Equal(t, "777", fp.messages[0].Key)
+	assert.Equal(t, `{"source_id":777}`, string(fp.messages[0].Value))
+	assert.Equal(t, "abc", fp.messages[0].Headers["x-rh-insights-request-id"])
+	assert.Equal(t, identity.ErrMismatch.Error(), fp.messages[0].Headers["rejection_reason"])
+}
+
+func TestRejectWithoutTopic(t *testing.T) {
+	fp := &fakePublisher{}
+	dl := &deadLetters{publisher: fp, timeout: time.Second}
+
+	dl.reject(testhelper.TestLogger(), "777", nil, nil, identity.ErrMissing)
+	assert.Empty(t, fp.messages, "Without a topic the message is only logged")
+}
+
+func TestRejectPublishFailure(t *testing.T) {
+	fp := &fakePublisher{err: errors.New("Kaboom")}
+	dl := &deadLetters{publisher: fp, topic: "dead", timeout: time.Second}
+
+	dl.reject(testhelper.TestLogger(), "777", nil, nil, identity.ErrMissing)
+	assert.Len(t, fp.messages, 1)
+}
+
+func TestPersisterReject(t *testing.T) {
+	fp := &fakePublisher{}
+	dp := &defaultPersister{deadLetters: newDeadLetters(&config.TowerPersisterConfig{KafkaDeadLetterTopic: "dead", EventPublishTimeout: time.Second}, fp)}
+
+	dp.Reject(testhelper.TestLogger(), MessagePayload{TenantID: 888, SourceID: 777}, nil, identity.ErrMismatch)
+	assert.Len(t, fp.messages, 1)
+	assert.Equal(t, "777", fp.messages[0].Key)
+	assert.Contains(t, string(fp.messages[0].Value), `"source_id":777`)
+}
+
+func TestProcessMessageWithoutIdentity(t *testing.T) {
+	fp := &fakePublisher{}
+	dl := &deadLetters{publisher: fp, topic: "dead", timeout: time.Second}
+	km := &kafka.Message{
+		Key:     []byte("777"),
+		Value:   []byte(`{"tenant_id":888,"source_id":777}`),
+		Headers: []kafka.Header{{Key: "x-rh-insights-request-id", Value: []byte("abc")}},
+	}
+	var wg sync.WaitGroup
+
+	// A nil dispatcher would panic if the message was dispatched
+	processMessage(context.TODO(), &config.TowerPersisterConfig{}, DatabaseContext{}, logrus.New(), nil, dl, &wg, km)
+	assert.Len(t, fp.messages, 1)
+	assert.Equal(t, identity.ErrMissing.Error(), fp.messages[0].Headers["rejection_reason"])
+	assert.Equal(t, "777", fp.messages[0].Key)
+}
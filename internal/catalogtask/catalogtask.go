@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/taskupdate"
 	"github.com/sirupsen/logrus"
 )
 
@@ -16,19 +21,54 @@ type CatalogTask interface {
 	Update(data map[string]interface{}, client *http.Client) error
 }
 
+// RetryPolicy decides how often a task update is attempted. The wait between
+// attempts starts at Backoff and doubles up to MaxBackoff, with jitter. A
+// pending update is given up after MaxDeliveries failed deliveries, zero
+// keeps it until it is acknowledged.
+type RetryPolicy struct {
+	MaxAttempts    int
+	Backoff        time.Duration
+	MaxBackoff     time.Duration
+	AttemptTimeout time.Duration
+	MaxDeliveries  int
+}
+
 type defaultCatalogTask struct {
 	url     string
 	ctx     context.Context
 	logger  *logrus.Entry
 	headers map[string]string
+	policy  RetryPolicy
+	store   taskupdate.Repository
+}
+
+// permanentError is a failed update that would fail the same way again
+type permanentError struct {
+	err error
+}
+
+func (pe *permanentError) Error() string {
+	return pe.err.Error()
 }
 
 const xRHIdentity = "x-rh-identity"
 const xRHInsightsRequestID = "x-rh-insights-request-id"
 
-// MakeCatalogTask creates a new Catalog Task object
-func MakeCatalogTask(ctx context.Context, logger *logrus.Entry, url string, headers map[string]string) CatalogTask {
-	return &defaultCatalogTask{ctx: ctx, url: url, logger: logger, headers: headers}
+// sleep waits between attempts, it is replaced in the tests
+var sleep = func(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// MakeCatalogTask creates a new Catalog Task object. Updates are attempted
+// according to policy and, when store is not nil, kept in store until they
+// are acknowledged.
+func MakeCatalogTask(ctx context.Context, logger *logrus.Entry, url string, headers map[string]string, policy RetryPolicy, store taskupdate.Repository) CatalogTask {
+	return &defaultCatalogTask{ctx: ctx, url: url, logger: logger, headers: headers, policy: policy, store: store}
 }
 
 // Update the Task object in the cloud
@@ -39,18 +79,122 @@ func (ct *defaultCatalogTask) Update(data map[string]interface{}, client *http.C
 		ct.logger.Errorf("Error Marshaling Payload %v", err)
 		return err
 	}
-	//client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPatch, ct.url, bytes.NewBuffer(payload))
-	if err != nil {
-		ct.logger.Errorf("Error creating a new request %v", err)
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
 	if _, ok := ct.headers[xRHIdentity]; !ok {
 		err = fmt.Errorf("X_RH_IDENTITY is not set message headers")
 		ct.logger.Errorf("%v", err)
 		return err
 	}
+
+	var pending *taskupdate.PendingUpdate
+	if ct.store != nil {
+		hdrs, err := json.Marshal(ct.headers)
+		if err != nil {
+			ct.logger.Errorf("Error Marshaling Headers %v", err)
+			return err
+		}
+		pending = &taskupdate.PendingUpdate{TaskURL: ct.url, Payload: payload, Headers: hdrs}
+		err = ct.store.Save(ct.ctx, pending)
+		if errors.Is(err, taskupdate.ErrSuperseded) {
+			ct.logger.Infof("Not sending update %s of task %s, a newer update has been saved", string(payload), ct.url)
+			return nil
+		}
+		if err != nil {
+			// The update can still be delivered, it just can not be
+			// delivered again later
+			ct.logger.Errorf("Error saving pending task update %v", err)
+			pending = nil
+		}
+	}
+	return ct.deliver(pending, payload, client)
+}
+
+// deliver sends an update and acknowledges or records the failure of the
+// pending update. An update Catalog Inventory rejected, or that failed too
+// often, is discarded instead of being delivered again.
+func (ct *defaultCatalogTask) deliver(pending *taskupdate.PendingUpdate, payload []byte, client *http.Client) error {
+	err := ct.patch(payload, client)
+	if pending == nil {
+		return err
+	}
+	if err != nil {
+		var pe *permanentError
+		if errors.As(err, &pe) {
+			ct.discard(pending, err)
+			return err
+		}
+		if err := ct.store.Failed(ct.ctx, pending, err.Error()); err != nil {
+			ct.logger.Errorf("Error recording failed task update %v", err)
+			return err
+		}
+		if ct.policy.MaxDeliveries > 0 && pending.Attempts >= ct.policy.MaxDeliveries {
+			ct.discard(pending, err)
+		}
+		return err
+	}
+	if err := ct.store.Acknowledge(ct.ctx, pending); err != nil {
+		ct.logger.Errorf("Error acknowledging task update %v", err)
+	}
+	return nil
+}
+
+// discard gives up on a pending update, its payload is logged so the task
+// can still be fixed by hand
+func (ct *defaultCatalogTask) discard(pending *taskupdate.PendingUpdate, reason error) {
+	ct.logger.Errorf("Giving up on update %s of task %s after %d failed deliveries %v", string(pending.Payload), pending.TaskURL, pending.Attempts, reason)
+	updatesDiscarded.Inc()
+	if err := ct.store.Discard(ct.ctx, pending); err != nil {
+		ct.logger.Errorf("Error discarding task update %v", err)
+	}
+}
+
+// patch sends an update, retrying network errors, timeouts, 429 and 5xx
+// responses until the policy runs out of attempts
+func (ct *defaultCatalogTask) patch(payload []byte, client *http.Client) error {
+	backoff := ct.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		retryAfter, err := ct.patchOnce(payload, client)
+		updateDuration.Observe(time.Since(started).Seconds())
+		if err == nil {
+			return nil
+		}
+		var pe *permanentError
+		if errors.As(err, &pe) || attempt >= ct.policy.MaxAttempts {
+			updateFailures.Inc()
+			return err
+		}
+		wait := jitter(backoff)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		ct.logger.Errorf("Task update attempt %d failed, retrying in %v %v", attempt, wait, err)
+		updateRetries.Inc()
+		if err := sleep(ct.ctx, wait); err != nil {
+			updateFailures.Inc()
+			return err
+		}
+		backoff *= 2
+		if backoff > ct.policy.MaxBackoff {
+			backoff = ct.policy.MaxBackoff
+		}
+	}
+}
+
+// patchOnce makes one attempt, a 429 response can ask for a longer wait
+// before the next attempt
+func (ct *defaultCatalogTask) patchOnce(payload []byte, client *http.Client) (time.Duration, error) {
+	ctx := ct.ctx
+	if ct.policy.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ct.policy.AttemptTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, ct.url, bytes.NewBuffer(payload))
+	if err != nil {
+		ct.logger.Errorf("Error creating a new request %v", err)
+		return 0, &permanentError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set(xRHIdentity, ct.headers[xRHIdentity])
 	if val, ok := ct.headers[xRHInsightsRequestID]; ok {
 		req.Header.Set(xRHInsightsRequestID, val)
@@ -58,21 +202,85 @@ func (ct *defaultCatalogTask) Update(data map[string]interface{}, client *http.C
 	resp, err := client.Do(req)
 	if err != nil {
 		ct.logger.Errorf("Error processing request %v", err)
-		return err
+		return 0, err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		ct.logger.Errorf("Error reading body %v", err)
-		return err
+		return 0, err
 	}
 	if resp.StatusCode != http.StatusNoContent {
 		err = fmt.Errorf("Invalid HTTP Status code from post %d", resp.StatusCode)
 		ct.logger.Errorf("Error %v", err)
-		return err
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return retryAfter(resp), err
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return 0, err
+		}
+		return 0, &permanentError{err: err}
 	}
 	ct.logger.Infof("Task Update Statue Code %d", resp.StatusCode)
 
 	ct.logger.Infof("Response from Patch %s", string(body))
-	return nil
+	return 0, nil
+}
+
+// retryAfter reads the seconds to wait from a Retry-After header
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// jitter picks a wait between half of backoff and backoff
+func jitter(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
+
+// Redeliver sends the updates that were saved before olderThan ago and never
+// acknowledged again, e.g. because Catalog Inventory was down for longer than
+// the retries lasted or the persister restarted. Each update is locked while
+// it is sent, an update that was replaced since it was read is skipped so it
+// can not overwrite the newer state of its task.
+func Redeliver(ctx context.Context, logger *logrus.Entry, store taskupdate.Repository, policy RetryPolicy, client *http.Client, olderThan time.Duration) {
+	updates, err := store.Unacknowledged(ctx, time.Now().UTC().Add(-olderThan))
+	if err != nil {
+		logger.Errorf("Error finding pending task updates %v", err)
+		return
+	}
+	for i := range updates {
+		pending := &updates[i]
+		headers := make(map[string]string)
+		if err := json.Unmarshal(pending.Headers, &headers); err != nil {
+			logger.Errorf("Error decoding headers of pending update for task %s %v", pending.TaskURL, err)
+			continue
+		}
+		taskLogger := logger.WithFields(logrus.Fields{"request_id": headers[xRHInsightsRequestID]})
+		var deliverErr error
+		current, err := store.WhileCurrent(ctx, pending, func(locked taskupdate.Repository) error {
+			ct := &defaultCatalogTask{ctx: ctx, url: pending.TaskURL, logger: taskLogger, headers: headers, policy: policy, store: locked}
+			taskLogger.Infof("Redelivering update for task %s after %d failed attempts", pending.TaskURL, pending.Attempts)
+			deliverErr = ct.deliver(pending, pending.Payload, client)
+			return nil
+		})
+		if err != nil {
+			taskLogger.Errorf("Error locking pending update for task %s %v", pending.TaskURL, err)
+			continue
+		}
+		if !current {
+			taskLogger.Infof("Skipping update for task %s, it has been replaced or is being delivered", pending.TaskURL)
+			continue
+		}
+		if deliverErr != nil {
+			taskLogger.Errorf("Error redelivering update for task %s %v", pending.TaskURL, deliverErr)
+		}
+	}
 }
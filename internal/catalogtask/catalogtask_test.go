@@ -3,11 +3,16 @@ package catalogtask
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/taskupdate"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
 	"github.com/stretchr/testify/assert"
 )
@@ -51,7 +56,7 @@ var headers = map[string]string{
 
 func TestUpdateSuccess(t *testing.T) {
 	ctx := context.TODO()
-	ctask := MakeCatalogTask(ctx, testhelper.TestLogger(), url, headers)
+	ctask := MakeCatalogTask(ctx, testhelper.TestLogger(), url, headers, RetryPolicy{}, nil)
 	body := []string{"Created"}
 	fc := fakeClient(t, body, http.StatusNoContent)
 	err := ctask.Update(data, fc)
@@ -63,7 +68,7 @@ func TestUpdateMissingHeaders(t *testing.T) {
 	headers := map[string]string{
 		"abc": "id",
 	}
-	ctask := MakeCatalogTask(ctx, testhelper.TestLogger(), url, headers)
+	ctask := MakeCatalogTask(ctx, testhelper.TestLogger(), url, headers, RetryPolicy{}, nil)
 	body := []string{"Created"}
 	fc := fakeClient(t, body, http.StatusNoContent)
 	err := ctask.Update(data, fc)
@@ -76,7 +81,7 @@ func TestUpdateMissingHeaders(t *testing.T) {
 
 func TestUpdateBadStatus(t *testing.T) {
 	ctx := context.TODO()
-	ctask := MakeCatalogTask(ctx, testhelper.TestLogger(), url, headers)
+	ctask := MakeCatalogTask(ctx, testhelper.TestLogger(), url, headers, RetryPolicy{}, nil)
 	body := []string{"Error Body"}
 	fc := fakeClient(t, body, http.StatusBadRequest)
 	err := ctask.Update(data, fc)
@@ -86,3 +91,241 @@ func TestUpdateBadStatus(t *testing.T) {
 		t.Fatalf("Error message should have contained %s", errMsg)
 	}
 }
+
+// sequenceTransport answers with one status after the other, a zero status
+// fails the request
+type sequenceTransport struct {
+	statuses []int
+	requests int
+}
+
+func (st *sequenceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := st.statuses[st.requests]
+	st.requests++
+	if status == 0 {
+		return nil, fmt.Errorf("connection reset by peer")
+	}
+	resp := &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       ioutil.NopCloser(bytes.NewBufferString("")),
+		Header:     http.Header{},
+	}
+	if status == http.StatusTooManyRequests {
+		resp.Header.Set("Retry-After", "7")
+	}
+	return resp, nil
+}
+
+// memoryStore keeps the pending updates in memory
+type memoryStore struct {
+	pending      map[string]*taskupdate.PendingUpdate
+	acknowledged int
+	failed       int
+	discarded    int
+	// replaced are the tasks with a newer update saved after they were read
+	replaced map[string]bool
+}
+
+func (ms *memoryStore) Save(ctx context.Context, pu *taskupdate.PendingUpdate) error {
+	pu.UpdatedAt = time.Now()
+	ms.pending[pu.TaskURL] = pu
+	return nil
+}
+
+func (ms *memoryStore) Acknowledge(ctx context.Context, pu *taskupdate.PendingUpdate) error {
+	ms.acknowledged++
+	delete(ms.pending, pu.TaskURL)
+	return nil
+}
+
+func (ms *memoryStore) Failed(ctx context.Context, pu *taskupdate.PendingUpdate, reason string) error {
+	ms.failed++
+	pu.Attempts++
+	pu.LastError = reason
+	return nil
+}
+
+func (ms *memoryStore) Discard(ctx context.Context, pu *taskupdate.PendingUpdate) error {
+	ms.discarded++
+	delete(ms.pending, pu.TaskURL)
+	return nil
+}
+
+func (ms *memoryStore) Unacknowledged(ctx context.Context, before time.Time) ([]taskupdate.PendingUpdate, error) {
+	var updates []taskupdate.PendingUpdate
+	for _, pu := range ms.pending {
+		updates = append(updates, *pu)
+	}
+	return updates, nil
+}
+
+func (ms *memoryStore) WhileCurrent(ctx context.Context, pu *taskupdate.PendingUpdate, fn func(store taskupdate.Repository) error) (bool, error) {
+	if ms.replaced[pu.TaskURL] {
+		return false, nil
+	}
+	return true, fn(ms)
+}
+
+var policy = RetryPolicy{MaxAttempts: 3, Backoff: time.Second, MaxBackoff: 2 * time.Second}
+
+// recordSleeps replaces sleep for the duration of a test
+func recordSleeps(t *testing.T) *[]time.Duration {
+	var waits []time.Duration
+	saved := sleep
+	sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	t.Cleanup(func() { sleep = saved })
+	return &waits
+}
+
+func TestUpdateRetries(t *testing.T) {
+	waits := recordSleeps(t)
+	st := &sequenceTransport{statuses: []int{0, http.StatusServiceUnavailable, http.StatusNoContent}}
+	store := &memoryStore{pending: make(map[string]*taskupdate.PendingUpdate)}
+	ctask := MakeCatalogTask(context.TODO(), testhelper.TestLogger(), url, headers, policy, store)
+	err := ctask.Update(data, &http.Client{Transport: st})
+
+	assert.Nil(t, err, "Update failed")
+	assert.Equal(t, 3, st.requests)
+	assert.Equal(t, 2, len(*waits))
+	assert.True(t, (*waits)[0] >= 500*time.Millisecond && (*waits)[0] <= time.Second, "The first wait should be jittered around the backoff")
+	assert.True(t, (*waits)[1] >= time.Second && (*waits)[1] <= 2*time.Second, "The second wait should be doubled")
+	assert.Equal(t, 1, store.acknowledged)
+	assert.Empty(t, store.pending, "The acknowledged update should be removed")
+}
+
+func TestUpdateRetryAfter(t *testing.T) {
+	waits := recordSleeps(t)
+	st := &sequenceTransport{statuses: []int{http.StatusTooManyRequests, http.StatusNoContent}}
+	ctask := MakeCatalogTask(context.TODO(), testhelper.TestLogger(), url, headers, policy, nil)
+	err := ctask.Update(data, &http.Client{Transport: st})
+
+	assert.Nil(t, err, "Update failed")
+	assert.Equal(t, []time.Duration{7 * time.Second}, *waits)
+}
+
+func TestUpdateGivesUp(t *testing.T) {
+	recordSleeps(t)
+	st := &sequenceTransport{statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}}
+	store := &memoryStore{pending: make(map[string]*taskupdate.PendingUpdate)}
+	ctask := MakeCatalogTask(context.TODO(), testhelper.TestLogger(), url, headers, policy, store)
+	err := ctask.Update(data, &http.Client{Transport: st})
+
+	assert.NotNil(t, err, "Update should have failed")
+	assert.Equal(t, 3, st.requests)
+	assert.Equal(t, 1, store.failed)
+	assert.Equal(t, 1, len(store.pending), "The update should be kept for redelivery")
+}
+
+func TestUpdateNoRetryOnClientError(t *testing.T) {
+	waits := recordSleeps(t)
+	st := &sequenceTransport{statuses: []int{http.StatusBadRequest}}
+	ctask := MakeCatalogTask(context.TODO(), testhelper.TestLogger(), url, headers, policy, nil)
+	err := ctask.Update(data, &http.Client{Transport: st})
+
+	assert.NotNil(t, err, "Update should have failed")
+	assert.Equal(t, 1, st.requests)
+	assert.Empty(t, *waits)
+}
+
+func TestRedeliver(t *testing.T) {
+	recordSleeps(t)
+	store := &memoryStore{pending: make(map[string]*taskupdate.PendingUpdate)}
+	store.pending[url] = &taskupdate.PendingUpdate{TaskURL: url, Payload: []byte(`{"state":"completed"}`), Headers: []byte(`{"x-rh-identity":"abc"}`), Attempts: 5}
+	st := &sequenceTransport{statuses: []int{http.StatusNoContent}}
+	Redeliver(context.TODO(), testhelper.TestLogger(), store, policy, &http.Client{Transport: st}, time.Minute)
+
+	assert.Equal(t, 1, st.requests)
+	assert.Equal(t, 1, store.acknowledged)
+	assert.Empty(t, store.pending)
+}
+
+var saveStr = `INSERT INTO tower_persister_pending_task_updates`
+var failedStr = `UPDATE "tower_persister_pending_task_updates" SET "attempts"=attempts + 1,"last_error"=$1,"updated_at"=$2 WHERE task_url = $3 AND updated_at = $4`
+var lockStr = `SELECT * FROM "tower_persister_pending_task_updates" WHERE task_url = $1 AND updated_at = $2 FOR UPDATE SKIP LOCKED`
+var deleteStr = `DELETE FROM "tower_persister_pending_task_updates" WHERE task_url = $1 AND updated_at = $2`
+
+func TestUpdateDiscardsRejectedUpdate(t *testing.T) {
+	recordSleeps(t)
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	mock.ExpectExec(regexp.QuoteMeta(saveStr)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(deleteStr)).WithArgs(url, testhelper.AnyTime{}).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	st := &sequenceTransport{statuses: []int{http.StatusBadRequest}}
+	ctask := MakeCatalogTask(context.TODO(), testhelper.TestLogger(), url, headers, policy, taskupdate.NewGORMRepository(gdb))
+	err := ctask.Update(data, &http.Client{Transport: st})
+
+	assert.NotNil(t, err, "Update should have failed")
+	assert.Equal(t, 1, st.requests)
+	assert.NoError(t, mock.ExpectationsWereMet(), "The rejected update should not be delivered again")
+}
+
+func TestRedeliverGivesUp(t *testing.T) {
+	recordSleeps(t)
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	updatedAt := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "tower_persister_pending_task_updates" WHERE updated_at < $1 ORDER BY updated_at`)).
+		WithArgs(testhelper.AnyTime{}).
+		WillReturnRows(sqlmock.NewRows([]string{"task_url", "payload", "headers", "attempts", "updated_at"}).
+			AddRow(url, []byte(`{"state":"completed"}`), []byte(`{"x-rh-identity":"abc"}`), 4, updatedAt))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(lockStr)).
+		WithArgs(url, updatedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"task_url", "updated_at"}).AddRow(url, updatedAt))
+	mock.ExpectExec(regexp.QuoteMeta(failedStr)).
+		WithArgs("Invalid HTTP Status code from post 503", testhelper.AnyTime{}, url, updatedAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(deleteStr)).WithArgs(url, testhelper.AnyTime{}).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	st := &sequenceTransport{statuses: []int{http.StatusServiceUnavailable}}
+	capped := RetryPolicy{MaxAttempts: 1, MaxDeliveries: 5}
+	Redeliver(context.TODO(), testhelper.TestLogger(), taskupdate.NewGORMRepository(gdb), capped, &http.Client{Transport: st}, time.Minute)
+
+	assert.Equal(t, 1, st.requests)
+	assert.NoError(t, mock.ExpectationsWereMet(), "The update should be discarded after its last delivery")
+}
+
+func TestRedeliverKeepsFailedUpdate(t *testing.T) {
+	recordSleeps(t)
+	store := &memoryStore{pending: make(map[string]*taskupdate.PendingUpdate)}
+	store.pending[url] = &taskupdate.PendingUpdate{TaskURL: url, Payload: []byte(`{"state":"completed"}`), Headers: []byte(`{"x-rh-identity":"abc"}`), Attempts: 3}
+	st := &sequenceTransport{statuses: []int{http.StatusServiceUnavailable}}
+	Redeliver(context.TODO(), testhelper.TestLogger(), store, RetryPolicy{MaxAttempts: 1, MaxDeliveries: 5}, &http.Client{Transport: st}, time.Minute)
+
+	assert.Equal(t, 1, store.failed)
+	assert.Equal(t, 0, store.discarded)
+	assert.Equal(t, 1, len(store.pending), "The update should be kept until it runs out of deliveries")
+}
+
+func TestRedeliverSkipsReplacedUpdate(t *testing.T) {
+	recordSleeps(t)
+	store := &memoryStore{pending: make(map[string]*taskupdate.PendingUpdate), replaced: map[string]bool{url: true}}
+	store.pending[url] = &taskupdate.PendingUpdate{TaskURL: url, Payload: []byte(`{"state":"running"}`), Headers: []byte(`{"x-rh-identity":"abc"}`), Attempts: 2}
+	st := &sequenceTransport{statuses: []int{http.StatusNoContent}}
+	Redeliver(context.TODO(), testhelper.TestLogger(), store, policy, &http.Client{Transport: st}, time.Minute)
+
+	assert.Equal(t, 0, st.requests, "A replaced update should not overwrite the newer state of the task")
+	assert.Equal(t, 0, store.acknowledged)
+}
+
+func TestUpdateSuperseded(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	mock.ExpectExec(regexp.QuoteMeta(saveStr)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	st := &sequenceTransport{statuses: []int{http.StatusNoContent}}
+	ctask := MakeCatalogTask(context.TODO(), testhelper.TestLogger(), url, headers, policy, taskupdate.NewGORMRepository(gdb))
+	err := ctask.Update(data, &http.Client{Transport: st})
+
+	assert.Nil(t, err, "Update failed")
+	assert.Equal(t, 0, st.requests, "An update older than the saved one should not be sent")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
@@ -0,0 +1,27 @@
+package catalogtask
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	updateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "catalog_tower_persister_task_update_duration_seconds",
+		Help: "The time taken by an attempt to update a task",
+	})
+	updateRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "catalog_tower_persister_task_update_retries_total",
+		Help: "The number of task update attempts that failed and were retried",
+	})
+	updateFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "catalog_tower_persister_task_update_failures_total",
+		Help: "The number of task updates that failed after all attempts",
+	})
+	updatesDiscarded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "catalog_tower_persister_task_updates_discarded_total",
+		Help: "The number of pending task updates given up on without being acknowledged",
+	})
+)
+
+// Collectors returns the Prometheus metrics of the task updates
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{updateDuration, updateRetries, updateFailures, updatesDiscarded}
+}
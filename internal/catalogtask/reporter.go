@@ -0,0 +1,130 @@
+package catalogtask
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
+)
+
+// Reporter sends the updates of a task to whoever follows its progress
+type Reporter interface {
+	Report(data map[string]interface{}) error
+}
+
+// Backend names a kind of Reporter
+type Backend string
+
+const (
+	// BackendREST patches the task in Catalog Inventory
+	BackendREST Backend = "rest"
+	// BackendKafka publishes the updates to a status topic
+	BackendKafka Backend = "kafka"
+	// BackendFile writes the updates to a file or stdout, for CLI runs
+	BackendFile Backend = "file"
+)
+
+// EventTaskUpdated is the event type of the updates published to Kafka
+const EventTaskUpdated = "catalog.task.updated"
+
+// ParseBackend validates the name of a Backend
+func ParseBackend(name string) (Backend, error) {
+	switch b := Backend(name); b {
+	case BackendREST, BackendKafka, BackendFile:
+		return b, nil
+	}
+	return "", fmt.Errorf("unknown task reporter %q, expected rest, kafka or file", name)
+}
+
+// taskUpdate is an update as it is published or written, the fields of the
+// update are next to the task they belong to
+func taskUpdate(taskURL string, data map[string]interface{}) ([]byte, error) {
+	update := map[string]interface{}{"task_url": taskURL, "updated_at": time.Now().UTC()}
+	for k, v := range data {
+		update[k] = v
+	}
+	return json.Marshal(update)
+}
+
+type restReporter struct {
+	task   CatalogTask
+	client *http.Client
+}
+
+// NewRESTReporter reports with the PATCH requests of a CatalogTask
+func NewRESTReporter(task CatalogTask, client *http.Client) Reporter {
+	return &restReporter{task: task, client: client}
+}
+
+func (rr *restReporter) Report(data map[string]interface{}) error {
+	return rr.task.Update(data, rr.client)
+}
+
+type kafkaReporter struct {
+	publisher events.Publisher
+	topic     string
+	taskURL   string
+	headers   map[string]string
+	timeout   time.Duration
+}
+
+// NewKafkaReporter publishes the updates of a task to a status topic, keyed
+// by the task URL so the updates of a task are delivered in order. The
+// identity and request id of the message are passed on in the headers.
+func NewKafkaReporter(publisher events.Publisher, topic, taskURL string, headers map[string]string, timeout time.Duration) Reporter {
+	return &kafkaReporter{publisher: publisher, topic: topic, taskURL: taskURL, headers: headers, timeout: timeout}
+}
+
+func (kr *kafkaReporter) Report(data map[string]interface{}) error {
+	value, err := taskUpdate(kr.taskURL, data)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{"event_type": EventTaskUpdated}
+	for _, name := range []string{xRHIdentity, xRHInsightsRequestID} {
+		if v, ok := kr.headers[name]; ok {
+			headers[name] = v
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kr.timeout)
+	defer cancel()
+	return kr.publisher.Publish(ctx, events.Message{Topic: kr.topic, Key: kr.taskURL, Headers: headers, Value: value})
+}
+
+// WriterSink writes the updates of all the tasks as JSON lines, one update
+// per line, to a file or stdout
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink creates a sink writing to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Reporter makes the Reporter of a task
+func (ws *WriterSink) Reporter(taskURL string) Reporter {
+	return &writerReporter{sink: ws, taskURL: taskURL}
+}
+
+type writerReporter struct {
+	sink    *WriterSink
+	taskURL string
+}
+
+func (wr *writerReporter) Report(data map[string]interface{}) error {
+	line, err := taskUpdate(wr.taskURL, data)
+	if err != nil {
+		return err
+	}
+	wr.sink.mu.Lock()
+	defer wr.sink.mu.Unlock()
+	_, err = wr.sink.w.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,85 @@
+package catalogtask
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakePublisher struct {
+	messages []events.Message
+	err      error
+}
+
+func (fp *fakePublisher) Publish(ctx context.Context, msg events.Message) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return fmt.Errorf("publishing without a timeout")
+	}
+	fp.messages = append(fp.messages, msg)
+	return fp.err
+}
+
+func (fp *fakePublisher) Close() {}
+
+func TestParseBackend(t *testing.T) {
+	for _, name := range []string{"rest", "kafka", "file"} {
+		b, err := ParseBackend(name)
+		assert.NoError(t, err)
+		assert.Equal(t, Backend(name), b)
+	}
+	_, err := ParseBackend("carrier_pigeon")
+	assert.EqualError(t, err, `unknown task reporter "carrier_pigeon", expected rest, kafka or file`)
+}
+
+func TestRESTReporter(t *testing.T) {
+	ctask := MakeCatalogTask(context.TODO(), testhelper.TestLogger(), url, headers, RetryPolicy{}, nil)
+	r := NewRESTReporter(ctask, fakeClient(t, []string{"Created"}, http.StatusNoContent))
+	assert.NoError(t, r.Report(data))
+}
+
+func TestKafkaReporter(t *testing.T) {
+	fp := &fakePublisher{}
+	r := NewKafkaReporter(fp, "platform.catalog.task-updates", url, map[string]string{xRHIdentity: "abc", xRHInsightsRequestID: "id", "event_type": "save"}, time.Second)
+	assert.NoError(t, r.Report(map[string]interface{}{"state": "completed", "status": "ok"}))
+
+	assert.Len(t, fp.messages, 1)
+	msg := fp.messages[0]
+	assert.Equal(t, "platform.catalog.task-updates", msg.Topic)
+	assert.Equal(t, url, msg.Key)
+	assert.Equal(t, map[string]string{"event_type": EventTaskUpdated, xRHIdentity: "abc", xRHInsightsRequestID: "id"}, msg.Headers)
+	var update map[string]interface{}
+	assert.NoError(t, json.Unmarshal(msg.Value, &update))
+	assert.Equal(t, url, update["task_url"])
+	assert.Equal(t, "completed", update["state"])
+	assert.Equal(t, "ok", update["status"])
+	assert.Contains(t, update, "updated_at")
+}
+
+func TestKafkaReporterError(t *testing.T) {
+	fp := &fakePublisher{err: fmt.Errorf("kaboom")}
+	r := NewKafkaReporter(fp, "updates", url, headers, time.Second)
+	assert.EqualError(t, r.Report(data), "kaboom")
+}
+
+func TestWriterReporter(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewWriterSink(&out)
+	assert.NoError(t, sink.Reporter("/tasks/1").Report(map[string]interface{}{"state": "running"}))
+	assert.NoError(t, sink.Reporter("/tasks/2").Report(map[string]interface{}{"state": "completed"}))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	var update map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &update))
+	assert.Equal(t, "/tasks/2", update["task_url"])
+	assert.Equal(t, "completed", update["state"])
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// sleep is replaced in the tests
+var sleep = time.Sleep
+
+// Connect opens the database and configures the connection pool. The
+// database might not be reachable yet when the pod starts, so failed attempts
+// are retried with an exponential backoff before giving up.
+func Connect(dialector gorm.Dialector, cfg *config.TowerPersisterConfig, logger *logrus.Logger) (*gorm.DB, error) {
+	backoff := cfg.DatabaseConnectBackoff
+	for attempt := 1; ; attempt++ {
+		db, err := gorm.Open(dialector, &gorm.Config{})
+		if err == nil {
+			err = configurePool(db, cfg)
+			if err == nil {
+				return db, nil
+			}
+		}
+		if attempt > cfg.DatabaseConnectRetries {
+			return nil, fmt.Errorf("connecting to the database failed after %d attempts: %w", attempt, err)
+		}
+		logger.Errorf("Error connecting to the database, attempt %d, retrying in %v %v", attempt, backoff, err)
+		sleep(backoff)
+		backoff *= 2
+		if backoff > cfg.DatabaseMaxConnectBackoff {
+			backoff = cfg.DatabaseMaxConnectBackoff
+		}
+	}
+}
+
+func configurePool(db *gorm.DB, cfg *config.TowerPersisterConfig) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	sqlDB.SetMaxOpenConns(cfg.DatabaseMaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.DatabaseMaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.DatabaseConnMaxLifetime)
+	return nil
+}
+
+// Health tracks if the database answers pings, it feeds the readiness probe.
+// The database is unhealthy until it has been connected to and pinged.
+type Health struct {
+	timeout time.Duration
+	healthy int32
+}
+
+// NewHealth creates a Health where each ping waits at most timeout
+func NewHealth(timeout time.Duration) *Health {
+	return &Health{timeout: timeout}
+}
+
+// Healthy reports the result of the last ping
+func (h *Health) Healthy() bool {
+	return atomic.LoadInt32(&h.healthy) == 1
+}
+
+// Check pings the database and records the result
+func (h *Health) Check(ctx context.Context, db *gorm.DB, logger *logrus.Logger) bool {
+	err := h.ping(ctx, db)
+	if err != nil {
+		logger.Errorf("Database ping failed %v", err)
+		atomic.StoreInt32(&h.healthy, 0)
+		return false
+	}
+	atomic.StoreInt32(&h.healthy, 1)
+	return true
+}
+
+// Run pings the database right away and then every interval until shutdown
+// is closed
+func (h *Health) Run(db *gorm.DB, interval time.Duration, logger *logrus.Logger, shutdown chan struct{}) {
+	h.Check(context.Background(), db, logger)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			h.Check(context.Background(), db, logger)
+		}
+	}
+}
+
+func (h *Health) ping(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func testConfig() *config.TowerPersisterConfig {
+	return &config.TowerPersisterConfig{
+		DatabaseMaxOpenConns:      7,
+		DatabaseMaxIdleConns:      3,
+		DatabaseConnMaxLifetime:   time.Minute,
+		DatabaseConnectRetries:    3,
+		DatabaseConnectBackoff:    time.Second,
+		DatabaseMaxConnectBackoff: 3 * time.Second,
+	}
+}
+
+func TestConnectRetries(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	assert.Nil(t, err)
+	defer db.Close()
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { sleep = time.Sleep }()
+
+	mock.ExpectPing().WillReturnError(fmt.Errorf("connection refused"))
+	mock.ExpectPing().WillReturnError(fmt.Errorf("connection refused"))
+	mock.ExpectPing().WillReturnError(fmt.Errorf("connection refused"))
+	mock.ExpectPing()
+
+	gdb, err := Connect(postgres.New(postgres.Config{Conn: db}), testConfig(), logrus.New())
+	assert.Nil(t, err, "Connect failed")
+	assert.NotNil(t, gdb)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, slept)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestConnectGivesUp(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	assert.Nil(t, err)
+	defer db.Close()
+	sleep = func(d time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+
+	for i := 0; i < 4; i++ {
+		mock.ExpectPing().WillReturnError(fmt.Errorf("connection refused"))
+	}
+
+	_, err = Connect(postgres.New(postgres.Config{Conn: db}), testConfig(), logrus.New())
+	assert.NotNil(t, err, "Connect should have failed")
+	assert.Contains(t, err.Error(), "after 4 attempts")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestHealth(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	assert.Nil(t, err)
+	defer db.Close()
+	// gorm pings when opening the database
+	mock.ExpectPing()
+	gdb, err := gorm.Open(postgres.New(postgres.Config{Conn: db}), &gorm.Config{})
+	assert.Nil(t, err)
+
+	h := NewHealth(time.Second)
+	assert.False(t, h.Healthy(), "Should be unhealthy before the first ping")
+	mock.ExpectPing()
+	assert.True(t, h.Check(context.TODO(), gdb, logrus.New()))
+	assert.True(t, h.Healthy())
+	mock.ExpectPing().WillReturnError(fmt.Errorf("kaboom"))
+	assert.False(t, h.Check(context.TODO(), gdb, logrus.New()))
+	assert.False(t, h.Healthy())
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestStatsCollector(t *testing.T) {
+	db, _, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(9)
+
+	reg := prometheus.NewRegistry()
+	assert.Nil(t, reg.Register(NewStatsCollector(db)))
+	families, err := reg.Gather()
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(families))
+	for _, f := range families {
+		if f.GetName() == "catalog_tower_persister_db_max_open_connections" {
+			assert.Equal(t, float64(9), f.GetMetric()[0].GetGauge().GetValue())
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "catalog_tower_persister"
+
+var (
+	maxOpenDesc = prometheus.NewDesc(namespace+"_db_max_open_connections",
+		"Maximum number of open connections to the database", nil, nil)
+	openDesc = prometheus.NewDesc(namespace+"_db_open_connections",
+		"The number of established connections both in use and idle", nil, nil)
+	inUseDesc = prometheus.NewDesc(namespace+"_db_in_use_connections",
+		"The number of connections currently in use", nil, nil)
+	idleDesc = prometheus.NewDesc(namespace+"_db_idle_connections",
+		"The number of idle connections", nil, nil)
+	waitCountDesc = prometheus.NewDesc(namespace+"_db_wait_count_total",
+		"The total number of connections waited for", nil, nil)
+	waitDurationDesc = prometheus.NewDesc(namespace+"_db_wait_duration_seconds_total",
+		"The total time blocked waiting for a new connection", nil, nil)
+	maxIdleClosedDesc = prometheus.NewDesc(namespace+"_db_max_idle_closed_total",
+		"The total number of connections closed due to SetMaxIdleConns", nil, nil)
+	maxLifetimeClosedDesc = prometheus.NewDesc(namespace+"_db_max_lifetime_closed_total",
+		"The total number of connections closed due to SetConnMaxLifetime", nil, nil)
+)
+
+// statsCollector exports the sql.DBStats of a connection pool to Prometheus
+type statsCollector struct {
+	db *sql.DB
+}
+
+// NewStatsCollector creates a Prometheus collector for the connection pool
+// statistics of a database
+func NewStatsCollector(db *sql.DB) prometheus.Collector {
+	return &statsCollector{db: db}
+}
+
+// Describe sends the descriptors of all the pool metrics
+func (sc *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- maxOpenDesc
+	ch <- openDesc
+	ch <- inUseDesc
+	ch <- idleDesc
+	ch <- waitCountDesc
+	ch <- waitDurationDesc
+	ch <- maxIdleClosedDesc
+	ch <- maxLifetimeClosedDesc
+}
+
+// Collect reads the current pool statistics
+func (sc *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := sc.db.Stats()
+	ch <- prometheus.MustNewConstMetric(maxOpenDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(openDesc, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(inUseDesc, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(idleDesc, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(waitCountDesc, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(waitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(maxIdleClosedDesc, prometheus.CounterValue, float64(stats.MaxIdleClosed))
+	ch <- prometheus.MustNewConstMetric(maxLifetimeClosedDesc, prometheus.CounterValue, float64(stats.MaxLifetimeClosed))
+}
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// EventSourceRefreshed is published after the refresh of a source is committed
+const EventSourceRefreshed = "catalog.source.refreshed"
+
+const xRHInsightsRequestID = "x-rh-insights-request-id"
+
+// Message is an event ready to be sent
+type Message struct {
+	Topic   string
+	Key     string
+	Headers map[string]string
+	Value   []byte
+}
+
+// Publisher sends events to the services interested in the catalog
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+	Close()
+}
+
+// Counts are the number of objects of a type a refresh changed
+type Counts struct {
+	Adds    int `json:"adds"`
+	Updates int `json:"updates"`
+	Deletes int `json:"deletes"`
+}
+
+// SourceRefs are the Tower ids of the objects of a type a refresh changed
+type SourceRefs struct {
+	Created []string `json:"created"`
+	Updated []string `json:"updated"`
+	Deleted []string `json:"deleted"`
+}
+
+// SourceRefreshed tells other services, e.g. search indexing or
+// notifications, that the catalog of a source has changed. The counts and
+// source refs are keyed by the catalog object type.
+type SourceRefreshed struct {
+	EventType   string                `json:"event_type"`
+	TenantID    int64                 `json:"tenant_id"`
+	SourceID    int64                 `json:"source_id"`
+	TaskURL     string                `json:"task_url"`
+	RequestID   string                `json:"request_id"`
+	Status      string                `json:"status"`
+	Changes     map[string]Counts     `json:"changes"`
+	SourceRefs  map[string]SourceRefs `json:"source_refs,omitempty"`
+	RefreshedAt time.Time             `json:"refreshed_at"`
+}
+
+// Message encodes the event, it is keyed by the source so the events of a
+// source are delivered in order
+func (e *SourceRefreshed) Message(topic string) (Message, error) {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Topic:   topic,
+		Key:     strconv.FormatInt(e.SourceID, 10),
+		Headers: map[string]string{"event_type": e.EventType, xRHInsightsRequestID: e.RequestID},
+		Value:   value,
+	}, nil
+}
+
+// Events of the catalog objects changed by a refresh, they are relayed from
+// the outbox
+const (
+	EventObjectCreated = "catalog.object.created"
+	EventObjectUpdated = "catalog.object.updated"
+	EventObjectDeleted = "catalog.object.deleted"
+)
+
+// ObjectChanged tells other services that a catalog object was created,
+// updated or deleted. ObjectType is the catalog object type, e.g.
+// service_offering, and ChangedFields lists the columns of an updated object
+// that changed.
+type ObjectChanged struct {
+	EventType     string    `json:"event_type"`
+	ObjectType    string    `json:"object_type"`
+	ID            int64     `json:"id"`
+	SourceRef     string    `json:"source_ref"`
+	TenantID      int64     `json:"tenant_id"`
+	SourceID      int64     `json:"source_id"`
+	ChangedFields []string  `json:"changed_fields,omitempty"`
+	TaskURL       string    `json:"task_url"`
+	RequestID     string    `json:"request_id"`
+	OccurredAt    time.Time `json:"occurred_at"`
+}
+
+// Message encodes the event, it is keyed by the source like the refreshed
+// event so the events of a source are delivered in order
+func (e *ObjectChanged) Message(topic string) (Message, error) {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Topic:   topic,
+		Key:     strconv.FormatInt(e.SourceID, 10),
+		Headers: map[string]string{"event_type": e.EventType, xRHInsightsRequestID: e.RequestID},
+		Value:   value,
+	}, nil
+}
+
+// headerRejectionReason tells why a dead letter was rejected
+const headerRejectionReason = "rejection_reason"
+
+// DeadLetter wraps a message that will never be processed so it can be
+// inspected or replayed from a dead letter topic, the original value and
+// headers are kept
+func DeadLetter(topic, key string, value []byte, headers map[string]string, reason error) Message {
+	hdrs := map[string]string{headerRejectionReason: reason.Error()}
+	for k, v := range headers {
+		hdrs[k] = v
+	}
+	return Message{Topic: topic, Key: key, Headers: hdrs, Value: value}
+}
@@ -0,0 +1,84 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceRefreshedMessage(t *testing.T) {
+	event := &SourceRefreshed{
+		EventType:   EventSourceRefreshed,
+		TenantID:    3,
+		SourceID:    45,
+		TaskURL:     "/api/catalog-inventory/v1.0/tasks/9",
+		RequestID:   "abc",
+		Status:      "ok",
+		Changes:     map[string]Counts{"inventories": {Adds: 1}},
+		RefreshedAt: time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	msg, err := event.Message("platform.catalog.source-events")
+	assert.NoError(t, err)
+	assert.Equal(t, "platform.catalog.source-events", msg.Topic)
+	assert.Equal(t, "45", msg.Key)
+	assert.Equal(t, map[string]string{"event_type": "catalog.source.refreshed", "x-rh-insights-request-id": "abc"}, msg.Headers)
+
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal(msg.Value, &decoded))
+	assert.Equal(t, map[string]interface{}{
+		"event_type":   "catalog.source.refreshed",
+		"tenant_id":    3.0,
+		"source_id":    45.0,
+		"task_url":     "/api/catalog-inventory/v1.0/tasks/9",
+		"request_id":   "abc",
+		"status":       "ok",
+		"changes":      map[string]interface{}{"inventories": map[string]interface{}{"adds": 1.0, "updates": 0.0, "deletes": 0.0}},
+		"refreshed_at": "2021-03-04T05:06:07Z",
+	}, decoded, "The source refs are left out when they are not wanted")
+}
+
+func TestObjectChangedMessage(t *testing.T) {
+	event := &ObjectChanged{
+		EventType:     EventObjectUpdated,
+		ObjectType:    "service_offerings",
+		ID:            12,
+		SourceRef:     "7",
+		TenantID:      3,
+		SourceID:      45,
+		ChangedFields: []string{"name"},
+		TaskURL:       "/api/catalog-inventory/v1.0/tasks/9",
+		RequestID:     "abc",
+		OccurredAt:    time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	msg, err := event.Message("platform.catalog.object-events")
+	assert.NoError(t, err)
+	assert.Equal(t, "platform.catalog.object-events", msg.Topic)
+	assert.Equal(t, "45", msg.Key)
+	assert.Equal(t, map[string]string{"event_type": "catalog.object.updated", "x-rh-insights-request-id": "abc"}, msg.Headers)
+
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal(msg.Value, &decoded))
+	assert.Equal(t, map[string]interface{}{
+		"event_type":     "catalog.object.updated",
+		"object_type":    "service_offerings",
+		"id":             12.0,
+		"source_ref":     "7",
+		"tenant_id":      3.0,
+		"source_id":      45.0,
+		"changed_fields": []interface{}{"name"},
+		"task_url":       "/api/catalog-inventory/v1.0/tasks/9",
+		"request_id":     "abc",
+		"occurred_at":    "2021-03-04T05:06:07Z",
+	}, decoded)
+}
+
+func TestDeadLetter(t *testing.T) {
+	msg := DeadLetter("platform.catalog.dead-letters", "45", []byte(`{"source_id":45}`), map[string]string{"event_type": "save"}, errors.New("x-rh-identity header is missing"))
+	assert.Equal(t, "platform.catalog.dead-letters", msg.Topic)
+	assert.Equal(t, "45", msg.Key)
+	assert.Equal(t, `{"source_id":45}`, string(msg.Value))
+	assert.Equal(t, map[string]string{"event_type": "save", "rejection_reason": "x-rh-identity header is missing"}, msg.Headers)
+}
@@ -0,0 +1,94 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// flushTimeoutMs is how long Close waits for the queued events to be sent
+const flushTimeoutMs = 5000
+
+// producer is the part of the kafka.Producer used to publish, it is replaced
+// in the tests
+type producer interface {
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+	Events() chan kafka.Event
+	Flush(timeoutMs int) int
+	Close()
+}
+
+type kafkaPublisher struct {
+	producer producer
+	logger   *logrus.Logger
+}
+
+// NewKafkaPublisher creates a Publisher with a Kafka producer that connects
+// to the same brokers as the consumer
+func NewKafkaPublisher(brokers []string, logger *logrus.Logger) (Publisher, error) {
+	p, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers": strings.Join(brokers, ","),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newKafkaPublisher(p, logger), nil
+}
+
+func newKafkaPublisher(p producer, logger *logrus.Logger) *kafkaPublisher {
+	kp := &kafkaPublisher{producer: p, logger: logger}
+	// Delivery reports go to the channel of each message, the producer
+	// reports its own errors here
+	go func() {
+		for e := range p.Events() {
+			if err, ok := e.(kafka.Error); ok {
+				logger.Errorf("Kafka producer error %v", err)
+			}
+		}
+	}()
+	return kp
+}
+
+// Publish sends a message and waits until Kafka has it or ctx is done
+func (kp *kafkaPublisher) Publish(ctx context.Context, msg Message) error {
+	km := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &msg.Topic, Partition: kafka.PartitionAny},
+		Key:            []byte(msg.Key),
+		Value:          msg.Value,
+	}
+	keys := make([]string, 0, len(msg.Headers))
+	for k := range msg.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		km.Headers = append(km.Headers, kafka.Header{Key: k, Value: []byte(msg.Headers[k])})
+	}
+
+	delivered := make(chan kafka.Event, 1)
+	if err := kp.producer.Produce(km, delivered); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case e := <-delivered:
+		m, ok := e.(*kafka.Message)
+		if !ok {
+			return fmt.Errorf("unexpected delivery report %v", e)
+		}
+		return m.TopicPartition.Error
+	}
+}
+
+// Close sends the queued messages and closes the producer
+func (kp *kafkaPublisher) Close() {
+	if n := kp.producer.Flush(flushTimeoutMs); n > 0 {
+		kp.logger.Errorf("%d events were not sent before closing", n)
+	}
+	kp.producer.Close()
+}
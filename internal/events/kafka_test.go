@@ -0,0 +1,105 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+type fakeProducer struct {
+	produced   []*kafka.Message
+	produceErr error
+	deliverErr error
+	deliver    bool
+	events     chan kafka.Event
+	flushed    bool
+	closed     bool
+}
+
+func (fp *fakeProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	if fp.produceErr != nil {
+		return fp.produceErr
+	}
+	fp.produced = append(fp.produced, msg)
+	if fp.deliver {
+		report := *msg
+		report.TopicPartition.Error = fp.deliverErr
+		deliveryChan <- &report
+	}
+	return nil
+}
+
+func (fp *fakeProducer) Events() chan kafka.Event {
+	return fp.events
+}
+
+func (fp *fakeProducer) Flush(timeoutMs int) int {
+	fp.flushed = true
+	return 0
+}
+
+func (fp *fakeProducer) Close() {
+	fp.closed = true
+	close(fp.events)
+}
+
+func newFakeProducer() *fakeProducer {
+	return &fakeProducer{deliver: true, events: make(chan kafka.Event)}
+}
+
+var testMessage = Message{Topic: "events", Key: "45", Headers: map[string]string{"event_type": "test", "a": "b"}, Value: []byte(`{}`)}
+
+func TestPublish(t *testing.T) {
+	fp := newFakeProducer()
+	kp := newKafkaPublisher(fp, logrus.New())
+	defer kp.Close()
+
+	assert.NoError(t, kp.Publish(context.TODO(), testMessage))
+	assert.Len(t, fp.produced, 1)
+	km := fp.produced[0]
+	assert.Equal(t, "events", *km.TopicPartition.Topic)
+	assert.Equal(t, []byte("45"), km.Key)
+	assert.Equal(t, []kafka.Header{{Key: "a", Value: []byte("b")}, {Key: "event_type", Value: []byte("test")}}, km.Headers)
+}
+
+func TestPublishNotDelivered(t *testing.T) {
+	fp := newFakeProducer()
+	fp.deliverErr = errors.New("kaboom")
+	kp := newKafkaPublisher(fp, logrus.New())
+	defer kp.Close()
+
+	assert.EqualError(t, kp.Publish(context.TODO(), testMessage), "kaboom")
+}
+
+func TestPublishProduceError(t *testing.T) {
+	fp := newFakeProducer()
+	fp.produceErr = errors.New("queue full")
+	kp := newKafkaPublisher(fp, logrus.New())
+	defer kp.Close()
+
+	assert.EqualError(t, kp.Publish(context.TODO(), testMessage), "queue full")
+}
+
+func TestPublishCancelled(t *testing.T) {
+	fp := newFakeProducer()
+	fp.deliver = false
+	kp := newKafkaPublisher(fp, logrus.New())
+	defer kp.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.True(t, errors.Is(kp.Publish(ctx, testMessage), context.Canceled))
+}
+
+func TestClose(t *testing.T) {
+	fp := newFakeProducer()
+	kp := newKafkaPublisher(fp, logrus.New())
+	kp.Close()
+
+	assert.True(t, fp.flushed)
+	assert.True(t, fp.closed)
+}
@@ -0,0 +1,98 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrMissing is returned when a message has no x-rh-identity header
+var ErrMissing = errors.New("x-rh-identity header is missing")
+
+// ErrInvalid is returned when the x-rh-identity header can not be decoded or
+// does not identify an account or organization
+var ErrInvalid = errors.New("x-rh-identity header is invalid")
+
+// ErrMismatch is returned when the identity does not belong to the tenant of
+// the message
+var ErrMismatch = errors.New("x-rh-identity does not belong to the tenant")
+
+// validTypes are the kinds of principal allowed to start a refresh
+var validTypes = map[string]bool{"User": true, "System": true, "Associate": true, "ServiceAccount": true}
+
+// Identity is the decoded x-rh-identity header of a message
+type Identity struct {
+	AccountNumber string `json:"account_number"`
+	OrgID         string `json:"org_id"`
+	Type          string `json:"type"`
+	Internal      struct {
+		OrgID string `json:"org_id"`
+	} `json:"internal"`
+}
+
+type xRHID struct {
+	Identity Identity `json:"identity"`
+}
+
+// Decode decodes and validates an x-rh-identity header, the base64 encoding
+// of {"identity": {...}}. Older identities only carry the org id in the
+// internal section, it is copied to OrgID.
+func Decode(header string) (*Identity, error) {
+	if header == "" {
+		return nil, ErrMissing
+	}
+	data, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	var id xRHID
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if id.Identity.OrgID == "" {
+		id.Identity.OrgID = id.Identity.Internal.OrgID
+	}
+	if !validTypes[id.Identity.Type] {
+		return nil, fmt.Errorf("%w: unknown identity type %q", ErrInvalid, id.Identity.Type)
+	}
+	if id.Identity.AccountNumber == "" && id.Identity.OrgID == "" {
+		return nil, fmt.Errorf("%w: no account number or org id", ErrInvalid)
+	}
+	return &id.Identity, nil
+}
+
+// Check makes sure the identity belongs to a tenant. When both have an org
+// id it decides, otherwise the external tenant of a Catalog Inventory tenant
+// is the account number or the org id.
+func (id *Identity) Check(externalTenant, orgID string) error {
+	if orgID != "" && id.OrgID != "" {
+		if orgID == id.OrgID {
+			return nil
+		}
+	} else if externalTenant != "" && (externalTenant == id.AccountNumber || externalTenant == id.OrgID) {
+		return nil
+	}
+	return fmt.Errorf("%w: account %q org %q tenant %q org %q", ErrMismatch, id.AccountNumber, id.OrgID, externalTenant, orgID)
+}
+
+// Fields are the log fields of the identity
+func (id *Identity) Fields() logrus.Fields {
+	return logrus.Fields{"account_number": id.AccountNumber, "org_id": id.OrgID, "identity_type": id.Type}
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying an identity
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity carried by a context
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(*Identity)
+	return id, ok && id != nil
+}
@@ -0,0 +1,69 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestDecode(t *testing.T) {
+	id, err := Decode(encode(`{"identity": {"account_number": "12345", "org_id": "67890", "type": "User"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", id.AccountNumber)
+	assert.Equal(t, "67890", id.OrgID)
+	assert.Equal(t, "User", id.Type)
+}
+
+func TestDecodeInternalOrgID(t *testing.T) {
+	id, err := Decode(encode(`{"identity": {"type": "System", "internal": {"org_id": "67890"}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "", id.AccountNumber)
+	assert.Equal(t, "67890", id.OrgID)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		err    error
+	}{
+		{"missing", "", ErrMissing},
+		{"not base64", "abc!", ErrInvalid},
+		{"not json", encode("abc"), ErrInvalid},
+		{"unknown type", encode(`{"identity": {"account_number": "12345", "type": "Robot"}}`), ErrInvalid},
+		{"no account", encode(`{"identity": {"type": "User"}}`), ErrInvalid},
+	}
+	for _, c := range cases {
+		_, err := Decode(c.header)
+		assert.True(t, errors.Is(err, c.err), "%s: unexpected error %v", c.name, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	id := &Identity{AccountNumber: "12345", OrgID: "67890", Type: "User"}
+	assert.NoError(t, id.Check("12345", ""))
+	assert.NoError(t, id.Check("67890", ""))
+	assert.NoError(t, id.Check("99999", "67890"))
+	assert.NoError(t, (&Identity{AccountNumber: "12345"}).Check("12345", "67890"), "Without an org id the account decides")
+	err := id.Check("99999", "")
+	assert.True(t, errors.Is(err, ErrMismatch))
+	assert.EqualError(t, err, `x-rh-identity does not belong to the tenant: account "12345" org "67890" tenant "99999" org ""`)
+	assert.Error(t, id.Check("12345", "11111"), "The org id decides when both have one")
+	assert.Error(t, (&Identity{OrgID: "67890"}).Check("", ""), "An empty external tenant never matches")
+}
+
+func TestContext(t *testing.T) {
+	_, ok := FromContext(context.TODO())
+	assert.False(t, ok)
+	id := &Identity{AccountNumber: "12345"}
+	found, ok := FromContext(NewContext(context.TODO(), id))
+	assert.True(t, ok)
+	assert.Equal(t, id, found)
+}
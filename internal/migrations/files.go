@@ -0,0 +1,75 @@
+package migrations
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFile is the name of a migration file,
+// e.g. 0002_unique_source_refs.up.sql
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations from the SQL files in dir, in version order. A
+// migration is a <version>_<name>.up.sql file and an optional
+// <version>_<name>.down.sql file, a migration without a down file is
+// irreversible. The files are shipped in the image next to the binary, the
+// go-toolset image we build with predates go:embed.
+func Load(dir string) ([]Migration, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations: %w", err)
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %s should be named <version>_<name>.up.sql or <version>_<name>.down.sql", entry.Name())
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration file %s: %w", entry.Name(), err)
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = mig
+		} else if mig.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, mig.Name, match[2])
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading migration: %w", err)
+		}
+		if match[3] == "up" {
+			mig.Up = string(content)
+		} else {
+			mig.Down = string(content)
+		}
+	}
+
+	result := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		result = append(result, *mig)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	for i, mig := range result {
+		if mig.Version != int64(i+1) {
+			return nil, fmt.Errorf("migration %d is missing in %s", i+1, dir)
+		}
+		if strings.TrimSpace(mig.Up) == "" {
+			return nil, fmt.Errorf("migration %d %s has no up file", mig.Version, mig.Name)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no migrations found in %s", dir)
+	}
+	return result, nil
+}
@@ -0,0 +1,254 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// versionTable records the applied migrations, it is not called
+// schema_migrations since that belongs to the Catalog Inventory service
+const versionTable = "tower_persister_schema_migrations"
+
+// ErrSchemaMismatch is returned by Check when the database schema is not the
+// one this version of the persister was built for
+var ErrSchemaMismatch = errors.New("database schema mismatch")
+
+// externalTables are owned by the Catalog Inventory service, the migrations
+// refer to them but never create them
+var externalTables = []string{"tenants", "sources"}
+
+// ErrIrreversible is returned by Down when the latest migration cannot be
+// reverted
+var ErrIrreversible = errors.New("migration cannot be reverted")
+
+// Migration is a versioned change to the database schema, Up applies the
+// change and Down reverts it. A migration without Down is irreversible.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status of a Migration in the database, migrations that have not been
+// applied have a null AppliedAt. Migrations applied by a newer persister are
+// included with just their Version and Name.
+type Status struct {
+	Migration
+	AppliedAt sql.NullTime
+	Unknown   bool
+}
+
+type appliedMigration struct {
+	Version   int64
+	Name      string
+	AppliedAt time.Time
+}
+
+// Migrator applies, reverts and checks the migrations of the persister
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+	external   []string
+}
+
+// NewMigrator creates a Migrator for the migrations of the persister in dir
+func NewMigrator(db *gorm.DB, dir string) (*Migrator, error) {
+	migrations, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, external: externalTables}, nil
+}
+
+// Up applies all the pending migrations in version order, each one in its own
+// transaction
+func (m *Migrator) Up(ctx context.Context, logger *logrus.Entry) error {
+	if err := m.checkExternalTables(ctx); err != nil {
+		return err
+	}
+	if err := m.createVersionTable(ctx); err != nil {
+		return err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+		err := m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(mig.Up).Error; err != nil {
+				return err
+			}
+			return tx.Exec("INSERT INTO "+versionTable+" (version, name, applied_at) VALUES (?, ?, ?)", mig.Version, mig.Name, tx.NowFunc()).Error
+		})
+		if err != nil {
+			return fmt.Errorf("applying migration %d %s: %w", mig.Version, mig.Name, err)
+		}
+		logger.Infof("Applied migration %d %s", mig.Version, mig.Name)
+	}
+	return nil
+}
+
+// Down reverts the latest applied migration
+func (m *Migrator) Down(ctx context.Context, logger *logrus.Entry) error {
+	if err := m.createVersionTable(ctx); err != nil {
+		return err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	var latest *appliedMigration
+	for _, a := range applied {
+		if latest == nil || a.Version > latest.Version {
+			latest = a
+		}
+	}
+	if latest == nil {
+		logger.Info("No migrations to revert")
+		return nil
+	}
+	mig, ok := m.find(latest.Version)
+	if !ok {
+		return fmt.Errorf("%w: migration %d %s is unknown to this persister", ErrSchemaMismatch, latest.Version, latest.Name)
+	}
+	if mig.Down == "" {
+		return fmt.Errorf("%w: %d %s", ErrIrreversible, mig.Version, mig.Name)
+	}
+	err = m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(mig.Down).Error; err != nil {
+			return err
+		}
+		return tx.Exec("DELETE FROM "+versionTable+" WHERE version = ?", mig.Version).Error
+	})
+	if err != nil {
+		return fmt.Errorf("reverting migration %d %s: %w", mig.Version, mig.Name, err)
+	}
+	logger.Infof("Reverted migration %d %s", mig.Version, mig.Name)
+	return nil
+}
+
+// Status lists every migration of the persister and any unknown migration
+// found in the database, in version order
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.appliedIfAny(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result []Status
+	for _, mig := range m.migrations {
+		s := Status{Migration: mig}
+		if a, ok := applied[mig.Version]; ok {
+			s.AppliedAt = sql.NullTime{Time: a.AppliedAt, Valid: true}
+			delete(applied, mig.Version)
+		}
+		result = append(result, s)
+	}
+	for _, a := range applied {
+		result = append(result, Status{
+			Migration: Migration{Version: a.Version, Name: a.Name},
+			AppliedAt: sql.NullTime{Time: a.AppliedAt, Valid: true},
+			Unknown:   true})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result, nil
+}
+
+// Check returns ErrSchemaMismatch if any migration is pending, if the
+// database has migrations this persister does not know about or if a table
+// owned by Catalog Inventory does not exist
+func (m *Migrator) Check(ctx context.Context) error {
+	if err := m.checkExternalTables(ctx); err != nil {
+		return err
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	var pending, unknown []int64
+	for _, s := range statuses {
+		switch {
+		case s.Unknown:
+			unknown = append(unknown, s.Version)
+		case !s.AppliedAt.Valid:
+			pending = append(pending, s.Version)
+		}
+	}
+	if len(pending) > 0 || len(unknown) > 0 {
+		return fmt.Errorf("%w: pending migrations %v unknown migrations %v", ErrSchemaMismatch, pending, unknown)
+	}
+	return nil
+}
+
+func (m *Migrator) find(version int64) (Migration, bool) {
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			return mig, true
+		}
+	}
+	return Migration{}, false
+}
+
+// checkExternalTables makes sure the tables owned by Catalog Inventory exist
+func (m *Migrator) checkExternalTables(ctx context.Context) error {
+	var missing []string
+	for _, table := range m.external {
+		ok, err := m.hasTable(ctx, table)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: tables %v are created by Catalog Inventory and do not exist", ErrSchemaMismatch, missing)
+	}
+	return nil
+}
+
+func (m *Migrator) hasTable(ctx context.Context, table string) (bool, error) {
+	var count int64
+	err := m.db.WithContext(ctx).Raw("SELECT count(*) FROM information_schema.tables WHERE table_schema = CURRENT_SCHEMA() AND table_name = ?", table).Scan(&count).Error
+	return count > 0, err
+}
+
+func (m *Migrator) createVersionTable(ctx context.Context) error {
+	return m.db.WithContext(ctx).Exec("CREATE TABLE IF NOT EXISTS " + versionTable + " (version bigint PRIMARY KEY, name text NOT NULL, applied_at timestamp NOT NULL)").Error
+}
+
+// appliedIfAny is applied for a database that might never have been
+// migrated, it does not create the version table
+func (m *Migrator) appliedIfAny(ctx context.Context) (map[int64]*appliedMigration, error) {
+	ok, err := m.hasTable(ctx, versionTable)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return map[int64]*appliedMigration{}, nil
+	}
+	return m.applied(ctx)
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int64]*appliedMigration, error) {
+	var rows []*appliedMigration
+	err := m.db.WithContext(ctx).Raw("SELECT version, name, applied_at FROM " + versionTable + " ORDER BY version").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int64]*appliedMigration, len(rows))
+	for _, r := range rows {
+		result[r.Version] = r
+	}
+	return result, nil
+}
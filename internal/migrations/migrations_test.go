@@ -0,0 +1,248 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+var testMigrations = []Migration{
+	{Version: 1, Name: "first", Up: "CREATE TABLE first (id bigint)", Down: ""},
+	{Version: 2, Name: "second", Up: "CREATE TABLE second (id bigint)", Down: "DROP TABLE second"},
+}
+
+var createVersionTableStr = `CREATE TABLE IF NOT EXISTS tower_persister_schema_migrations (version bigint PRIMARY KEY, name text NOT NULL, applied_at timestamp NOT NULL)`
+var appliedStr = `SELECT version, name, applied_at FROM tower_persister_schema_migrations ORDER BY version`
+var hasTableStr = `SELECT count(*) FROM information_schema.tables WHERE table_schema = CURRENT_SCHEMA() AND table_name = $1`
+var insertVersionStr = `INSERT INTO tower_persister_schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`
+var deleteVersionStr = `DELETE FROM tower_persister_schema_migrations WHERE version = $1`
+var appliedColumns = []string{"version", "name", "applied_at"}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load("../../migrations")
+	assert.Nil(t, err, "Load failed")
+	for i, mig := range migrations {
+		assert.Equal(t, int64(i+1), mig.Version, "Migrations should be numbered in order")
+		assert.NotEmpty(t, mig.Name)
+		assert.NotEmpty(t, mig.Up)
+	}
+	assert.Equal(t, "create_tower_tables", migrations[0].Name)
+	assert.Empty(t, migrations[0].Down, "The tables may be owned by Catalog Inventory")
+	for _, table := range externalTables {
+		assert.NotContains(t, migrations[0].Up, "CREATE TABLE IF NOT EXISTS "+table+" ", "The table belongs to Catalog Inventory")
+	}
+}
+
+func TestUniqueSourceRefsKeepsDuplicates(t *testing.T) {
+	migrations, err := Load("../../migrations")
+	assert.Nil(t, err, "Load failed")
+	sql := migrations[1].Up
+	assert.NotContains(t, sql, "DELETE", "The rows may be referenced by Catalog Inventory")
+	for _, table := range []string{"service_inventories", "service_offerings", "service_offering_nodes", "service_plans", "service_credential_types", "service_credentials"} {
+		assert.Contains(t, sql, "RAISE EXCEPTION '"+table+" has duplicated source refs")
+		assert.Contains(t, sql, "CREATE UNIQUE INDEX IF NOT EXISTS index_"+table+"_on_tenant_source_ref ON "+table+" (tenant_id, source_id, source_ref)")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		files map[string]string
+		err   string
+	}{
+		{files: map[string]string{"0001_first.up.sql": "x", "0003_third.up.sql": "x"}, err: "migration 2 is missing"},
+		{files: map[string]string{"0001_first.down.sql": "x"}, err: "migration 1 first has no up file"},
+		{files: map[string]string{"0001_first.up.sql": "x", "0001_other.down.sql": "x"}, err: "migration 1 is named both"},
+		{files: map[string]string{"first.sql": "x"}, err: "migration file first.sql should be named"},
+		{files: map[string]string{"README": "x"}, err: "no migrations found"},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "migrations")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+		for name, content := range tt.files {
+			assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		}
+		_, err = Load(dir)
+		if assert.Error(t, err, tt.err) {
+			assert.Contains(t, err.Error(), tt.err)
+		}
+	}
+}
+
+func TestUpWithoutExternalTables(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	m := &Migrator{db: gdb, migrations: testMigrations, external: externalTables}
+
+	mock.ExpectQuery(regexp.QuoteMeta(hasTableStr)).
+		WithArgs("tenants").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(1)))
+	mock.ExpectQuery(regexp.QuoteMeta(hasTableStr)).
+		WithArgs("sources").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(0)))
+
+	err := m.Up(context.TODO(), testhelper.TestLogger())
+	assert.True(t, errors.Is(err, ErrSchemaMismatch), "Up should have failed")
+	assert.Contains(t, err.Error(), "tables [sources] are created by Catalog Inventory")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestUp(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	m := &Migrator{db: gdb, migrations: testMigrations}
+
+	mock.ExpectExec(regexp.QuoteMeta(createVersionTableStr)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(appliedStr)).
+		WillReturnRows(sqlmock.NewRows(appliedColumns).AddRow(int64(1), "first", time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(testMigrations[1].Up)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(insertVersionStr)).
+		WithArgs(int64(2), "second", testhelper.AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := m.Up(context.TODO(), testhelper.TestLogger())
+	assert.Nil(t, err, "Up failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestUpError(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	m := &Migrator{db: gdb, migrations: testMigrations}
+	kaboom := fmt.Errorf("kaboom")
+
+	mock.ExpectExec(regexp.QuoteMeta(createVersionTableStr)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(appliedStr)).WillReturnRows(sqlmock.NewRows(appliedColumns))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(testMigrations[0].Up)).WillReturnError(kaboom)
+	mock.ExpectRollback()
+
+	err := m.Up(context.TODO(), testhelper.TestLogger())
+	assert.True(t, errors.Is(err, kaboom), "Up should have failed")
+	assert.Contains(t, err.Error(), "applying migration 1 first")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestDown(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	m := &Migrator{db: gdb, migrations: testMigrations}
+
+	mock.ExpectExec(regexp.QuoteMeta(createVersionTableStr)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(appliedStr)).
+		WillReturnRows(sqlmock.NewRows(appliedColumns).
+			AddRow(int64(1), "first", time.Now()).
+			AddRow(int64(2), "second", time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(testMigrations[1].Down)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(deleteVersionStr)).WithArgs(int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := m.Down(context.TODO(), testhelper.TestLogger())
+	assert.Nil(t, err, "Down failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestDownIrreversible(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	m := &Migrator{db: gdb, migrations: testMigrations}
+
+	mock.ExpectExec(regexp.QuoteMeta(createVersionTableStr)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(appliedStr)).
+		WillReturnRows(sqlmock.NewRows(appliedColumns).AddRow(int64(1), "first", time.Now()))
+
+	err := m.Down(context.TODO(), testhelper.TestLogger())
+	assert.True(t, errors.Is(err, ErrIrreversible), "Down should have failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestStatus(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	m := &Migrator{db: gdb, migrations: testMigrations}
+
+	mock.ExpectQuery(regexp.QuoteMeta(hasTableStr)).
+		WithArgs("tower_persister_schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(1)))
+	mock.ExpectQuery(regexp.QuoteMeta(appliedStr)).
+		WillReturnRows(sqlmock.NewRows(appliedColumns).
+			AddRow(int64(1), "first", time.Now()).
+			AddRow(int64(3), "third", time.Now()))
+
+	statuses, err := m.Status(context.TODO())
+	assert.Nil(t, err, "Status failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	assert.Equal(t, 3, len(statuses))
+	assert.True(t, statuses[0].AppliedAt.Valid)
+	assert.False(t, statuses[1].AppliedAt.Valid)
+	assert.Equal(t, "third", statuses[2].Name)
+	assert.True(t, statuses[2].Unknown)
+}
+
+func TestCheck(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	m := &Migrator{db: gdb, migrations: testMigrations, external: externalTables}
+
+	for _, table := range externalTables {
+		mock.ExpectQuery(regexp.QuoteMeta(hasTableStr)).
+			WithArgs(table).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(1)))
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(hasTableStr)).
+		WithArgs("tower_persister_schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(1)))
+	mock.ExpectQuery(regexp.QuoteMeta(appliedStr)).
+		WillReturnRows(sqlmock.NewRows(appliedColumns).
+			AddRow(int64(1), "first", time.Now()).
+			AddRow(int64(2), "second", time.Now()))
+
+	err := m.Check(context.TODO())
+	assert.Nil(t, err, "Check failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestCheckNeverMigrated(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	m := &Migrator{db: gdb, migrations: testMigrations}
+
+	mock.ExpectQuery(regexp.QuoteMeta(hasTableStr)).
+		WithArgs("tower_persister_schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(0)))
+
+	err := m.Check(context.TODO())
+	assert.True(t, errors.Is(err, ErrSchemaMismatch), "Check should have failed")
+	assert.Contains(t, err.Error(), "pending migrations [1 2]")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestCheckWithoutExternalTables(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	m := &Migrator{db: gdb, migrations: testMigrations, external: externalTables}
+
+	for _, table := range externalTables {
+		mock.ExpectQuery(regexp.QuoteMeta(hasTableStr)).
+			WithArgs(table).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(0)))
+	}
+
+	err := m.Check(context.TODO())
+	assert.True(t, errors.Is(err, ErrSchemaMismatch), "Check should have failed")
+	assert.Contains(t, err.Error(), "tables [tenants sources] are created by Catalog Inventory")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
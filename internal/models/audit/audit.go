@@ -0,0 +1,94 @@
+package audit
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// addBatchSize limits the number of entries sent in a single INSERT so that
+// a refresh that changes a whole catalog stays under the bind parameter
+// limit of PostgreSQL
+const addBatchSize = 500
+
+// Entry records a change a refresh made to a catalog object. Before and
+// After hold the values of the changed columns, Diffs what changed inside
+// the changed JSON columns, e.g. the survey of a service plan. AccountNumber
+// and OrgID identify who requested the refresh.
+type Entry struct {
+	ID            int64 `gorm:"primaryKey"`
+	TenantID      int64
+	SourceID      int64
+	ObjectType    string
+	ObjectID      int64
+	SourceRef     string
+	Action        string
+	ChangedFields datatypes.JSON
+	Before        datatypes.JSON
+	After         datatypes.JSON
+	Diffs         datatypes.JSON
+	RequestID     string
+	TaskURL       string
+	AccountNumber string
+	OrgID         string
+	CreatedAt     time.Time
+}
+
+// TableName of the audit log
+func (Entry) TableName() string {
+	return "tower_persister_audit_log"
+}
+
+// Repository interface supports operations on the audit log
+type Repository interface {
+	Add(ctx context.Context, entries []Entry) error
+	History(ctx context.Context, sourceID int64, objectType, sourceRef string) ([]Entry, error)
+	Purge(ctx context.Context, before time.Time) (int64, error)
+}
+
+type gormRepository struct {
+	db *gorm.DB
+}
+
+// NewGORMRepository creates a new repository object, entries are added in
+// the transaction of the db it is given
+func NewGORMRepository(db *gorm.DB) Repository {
+	return &gormRepository{db: db}
+}
+
+// Add writes entries to the audit log
+func (gr *gormRepository) Add(ctx context.Context, entries []Entry) error {
+	now := gr.db.NowFunc()
+	for i := range entries {
+		entries[i].CreatedAt = now
+	}
+	for start := 0; start < len(entries); start += addBatchSize {
+		end := start + addBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		batch := entries[start:end]
+		if err := gr.db.WithContext(ctx).Create(&batch).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// History finds the changes of an object, oldest first
+func (gr *gormRepository) History(ctx context.Context, sourceID int64, objectType, sourceRef string) ([]Entry, error) {
+	var entries []Entry
+	err := gr.db.WithContext(ctx).
+		Where("source_id = ? AND object_type = ? AND source_ref = ?", sourceID, objectType, sourceRef).
+		Order("created_at, id").Find(&entries).Error
+	return entries, err
+}
+
+// Purge deletes the entries recorded before a time and returns how many
+// were deleted
+func (gr *gormRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	result := gr.db.WithContext(ctx).Where("created_at < ?", before).Delete(&Entry{})
+	return result.RowsAffected, result.Error
+}
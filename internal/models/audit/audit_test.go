@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdd(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	insertStr := `INSERT INTO "tower_persister_audit_log" ("tenant_id","source_id","object_type","object_id","source_ref","action","changed_fields","before","after","diffs","request_id","task_url","account_number","org_id","created_at") ` +
+		`VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15) RETURNING "id"`
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(insertStr)).
+		WithArgs(3, 4, "service_plans", 12, "7", "updated", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "abc", "/tasks/1", "0000001", "1234", testhelper.AnyTime{}).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	entries := []Entry{{TenantID: 3, SourceID: 4, ObjectType: "service_plans", ObjectID: 12, SourceRef: "7", Action: "updated",
+		ChangedFields: []byte(`["create_json_schema"]`), Before: []byte(`{}`), After: []byte(`{}`), Diffs: []byte(`{}`), RequestID: "abc", TaskURL: "/tasks/1", AccountNumber: "0000001", OrgID: "1234"}}
+	err := NewGORMRepository(gdb).Add(context.TODO(), entries)
+	assert.Nil(t, err, "Add failed")
+	assert.Equal(t, int64(1), entries[0].ID)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestAddInBatches(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	for _, n := range []int{addBatchSize, 1} {
+		rows := sqlmock.NewRows([]string{"id"})
+		for i := 0; i < n; i++ {
+			rows.AddRow(i + 1)
+		}
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "tower_persister_audit_log"`)).WillReturnRows(rows)
+		mock.ExpectCommit()
+	}
+
+	err := NewGORMRepository(gdb).Add(context.TODO(), make([]Entry, addBatchSize+1))
+	assert.Nil(t, err, "Add failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestHistory(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	selectStr := `SELECT * FROM "tower_persister_audit_log" WHERE source_id = $1 AND object_type = $2 AND source_ref = $3 ORDER BY created_at, id`
+	mock.ExpectQuery(regexp.QuoteMeta(selectStr)).
+		WithArgs(4, "service_plans", "7").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "action"}).AddRow(1, "created").AddRow(2, "updated"))
+
+	entries, err := NewGORMRepository(gdb).History(context.TODO(), 4, "service_plans", "7")
+	assert.Nil(t, err, "History failed")
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "updated", entries[1].Action)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestPurge(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	before := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "tower_persister_audit_log" WHERE created_at < $1`)).
+		WithArgs(before).WillReturnResult(sqlmock.NewResult(0, 5))
+	mock.ExpectCommit()
+
+	n, err := NewGORMRepository(gdb).Purge(context.TODO(), before)
+	assert.Nil(t, err, "Purge failed")
+	assert.Equal(t, int64(5), n)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
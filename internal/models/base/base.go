@@ -2,14 +2,14 @@ package base
 
 import (
 	"database/sql"
-	"fmt"
 	"sort"
-	"strings"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+const towerTimeWithoutZone = "2006-01-02T15:04:05.999999999"
+
 //ResultIDRef stores the DB ID and the external tower id
 type ResultIDRef struct {
 	ID        int64
@@ -33,13 +33,30 @@ type Tower struct {
 	LastSeenAt sql.NullTime
 }
 
-//TowerTime converts datetime from Tower to UTC
+//TowerTime converts datetime from Tower to UTC, keeping the sub seconds and
+//honoring any timezone offset e.g. 2020-01-08T10:22:59.423585Z or
+//2020-01-08T15:52:59.423585+05:30. Timestamps without an offset are assumed
+//to be in UTC. The result is rounded to microseconds which is the precision
+//of the timestamp columns in the database
 func TowerTime(str string) (time.Time, error) {
-	//"2020-01-08T10:22:59.423585Z"
-	// Drop the subseconds
-	s := fmt.Sprintf("%sZ", strings.Split(str, ".")[0])
-	t, err := time.Parse(time.RFC3339, s)
-	return t, err
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		var err2 error
+		t, err2 = time.Parse(towerTimeWithoutZone, str)
+		if err2 != nil {
+			return t, err
+		}
+	}
+	return t.UTC().Round(time.Microsecond), nil
+}
+
+//SecondPrecisionEqual checks if a timestamp stored by older versions of the
+//persister, which dropped the sub seconds, refers to the same Tower time.
+//Tower reports microseconds, so only a stored time without sub seconds for a
+//Tower time with sub seconds is taken to be one of those, a Tower time on the
+//whole second has to match exactly.
+func SecondPrecisionEqual(stored, towerTime time.Time) bool {
+	return stored.Nanosecond() == 0 && towerTime.Nanosecond() != 0 && stored.Equal(towerTime.Truncate(time.Second))
 }
 
 //SourceRefExists check if a tower id defined in srcRef exists in an array of sorted
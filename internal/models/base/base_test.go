@@ -0,0 +1,58 @@
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var towerTimeCases = []struct {
+	input    string
+	expected time.Time
+}{
+	{"2020-01-08T10:22:59.423585Z", time.Date(2020, 1, 8, 10, 22, 59, 423585000, time.UTC)},
+	{"2020-01-08T10:22:59Z", time.Date(2020, 1, 8, 10, 22, 59, 0, time.UTC)},
+	{"2020-01-08T15:52:59.423585+05:30", time.Date(2020, 1, 8, 10, 22, 59, 423585000, time.UTC)},
+	{"2020-01-08T05:22:59.1-05:00", time.Date(2020, 1, 8, 10, 22, 59, 100000000, time.UTC)},
+	{"2020-01-08T10:22:59.423585", time.Date(2020, 1, 8, 10, 22, 59, 423585000, time.UTC)},
+	{"2020-01-08T10:22:59.4235856Z", time.Date(2020, 1, 8, 10, 22, 59, 423586000, time.UTC)},
+}
+
+func TestTowerTime(t *testing.T) {
+	for _, tt := range towerTimeCases {
+		result, err := TowerTime(tt.input)
+		assert.Nil(t, err, tt.input)
+		assert.True(t, tt.expected.Equal(result), "%s parsed as %v", tt.input, result)
+		assert.Equal(t, time.UTC, result.Location(), tt.input)
+	}
+}
+
+func TestTowerTimeBadInput(t *testing.T) {
+	_, err := TowerTime("gobbledegook")
+	assert.NotNil(t, err, "Should have failed parsing")
+	assert.Contains(t, err.Error(), "parsing time")
+}
+
+func TestTowerTimeSameSecond(t *testing.T) {
+	t1, _ := TowerTime("2020-01-08T10:22:59.100000Z")
+	t2, _ := TowerTime("2020-01-08T10:22:59.900000Z")
+	changed, err := DetectChanges(Attributes{"source_updated_at": t1}, Attributes{"source_updated_at": t2})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"source_updated_at"}, changed)
+}
+
+func TestSecondPrecisionEqual(t *testing.T) {
+	stored := time.Date(2020, 1, 8, 10, 22, 59, 0, time.UTC)
+	tower, _ := TowerTime("2020-01-08T10:22:59.423585Z")
+	assert.True(t, SecondPrecisionEqual(stored, tower))
+	assert.False(t, SecondPrecisionEqual(stored, tower.Add(time.Second)))
+	assert.False(t, SecondPrecisionEqual(tower.Add(-time.Millisecond), tower))
+	assert.False(t, SecondPrecisionEqual(stored, stored), "A Tower time on the whole second has no sub seconds to drop")
+
+	changed, err := DetectChanges(Attributes{"source_updated_at": stored}, Attributes{"source_updated_at": tower})
+	assert.Nil(t, err)
+	assert.Nil(t, changed, "Legacy second precision rows should not be updated")
+	refined := Attributes{"source_updated_at": stored, "source_created_at": tower}.Refined(Attributes{"source_updated_at": tower, "source_created_at": tower})
+	assert.Equal(t, []string{"source_updated_at"}, refined, "The legacy timestamp should get its precise value")
+}
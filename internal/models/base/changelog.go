@@ -0,0 +1,136 @@
+package base
+
+import (
+	"sort"
+	"strconv"
+
+	"gorm.io/datatypes"
+)
+
+// Actions done to a catalog object by a refresh
+const (
+	ActionCreated = "created"
+	ActionUpdated = "updated"
+	ActionDeleted = "deleted"
+)
+
+// Change is a catalog object that was created, updated or deleted
+type Change struct {
+	Action    string
+	ID        int64
+	SourceRef string
+	// Changed lists the columns of an updated object that changed
+	Changed []string
+	// Before and After are the values of the changed columns, a created
+	// object has all its columns in After
+	Before Attributes
+	After  Attributes
+	// Diffs lists what changed inside the changed JSON columns
+	Diffs map[string][]JSONChange
+}
+
+// JSONChange is a value inside a JSON column that was added, changed or
+// removed. Path points to it like a JSON pointer, e.g. /fields/0/label.
+type JSONChange struct {
+	Path   string      `json:"path"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Created describes a new object
+func Created(attrs Attributes) Change {
+	return Change{Action: ActionCreated, After: attrs}
+}
+
+// Updated describes an update from the existing and new attributes of an
+// object and the columns that changed
+func Updated(changed []string, existing, newAttrs Attributes) (Change, error) {
+	c := Change{Action: ActionUpdated, Changed: changed, Before: existing.Values(changed), After: newAttrs.Values(changed)}
+	for _, column := range changed {
+		before, ok1 := existing[column].(datatypes.JSON)
+		after, ok2 := newAttrs[column].(datatypes.JSON)
+		if !ok1 || !ok2 {
+			continue
+		}
+		diff, err := DiffJSON(before, after)
+		if err != nil {
+			return c, err
+		}
+		if c.Diffs == nil {
+			c.Diffs = make(map[string][]JSONChange)
+		}
+		c.Diffs[column] = diff
+	}
+	return c, nil
+}
+
+// DiffJSON compares two JSON documents and returns the values that differ,
+// in path order
+func DiffJSON(before, after datatypes.JSON) ([]JSONChange, error) {
+	b, err := normalizeJSON(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := normalizeJSON(after)
+	if err != nil {
+		return nil, err
+	}
+	var changes []JSONChange
+	diffValues("", b, a, &changes)
+	return changes, nil
+}
+
+func diffValues(path string, before, after interface{}, changes *[]JSONChange) {
+	switch b := before.(type) {
+	case map[string]interface{}:
+		if a, ok := after.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(b)+len(a))
+			for k := range b {
+				keys = append(keys, k)
+			}
+			for k := range a {
+				if _, ok := b[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				diffValues(path+"/"+k, b[k], a[k], changes)
+			}
+			return
+		}
+	case []interface{}:
+		if a, ok := after.([]interface{}); ok {
+			for i := 0; i < len(b) || i < len(a); i++ {
+				var bv, av interface{}
+				if i < len(b) {
+					bv = b[i]
+				}
+				if i < len(a) {
+					av = a[i]
+				}
+				diffValues(path+"/"+strconv.Itoa(i), bv, av, changes)
+			}
+			return
+		}
+	}
+	if same, _ := equalValues(before, after); !same {
+		*changes = append(*changes, JSONChange{Path: path, Before: before, After: after})
+	}
+}
+
+// ChangeLog records the changes a repository made, repositories embed it to
+// provide the Changes method of their interface
+type ChangeLog struct {
+	changes []Change
+}
+
+// Record adds a change to the log
+func (cl *ChangeLog) Record(c Change) {
+	cl.changes = append(cl.changes, c)
+}
+
+// Changes returns the changes in the order they were made
+func (cl *ChangeLog) Changes() []Change {
+	return cl.changes
+}
@@ -0,0 +1,40 @@
+package base
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/datatypes"
+)
+
+func TestUpdated(t *testing.T) {
+	existing := Attributes{"name": "demo", "description": "old", "create_json_schema": datatypes.JSON(`{"fields":[{"name":"a","label":"A"}]}`)}
+	newAttrs := Attributes{"name": "demo", "description": "new", "create_json_schema": datatypes.JSON(`{"fields":[{"name":"a","label":"Alpha"},{"name":"b"}]}`)}
+	c, err := Updated([]string{"create_json_schema", "description"}, existing, newAttrs)
+	assert.NoError(t, err)
+	assert.Equal(t, ActionUpdated, c.Action)
+	assert.Equal(t, Attributes{"description": "old", "create_json_schema": existing["create_json_schema"]}, c.Before)
+	assert.Equal(t, Attributes{"description": "new", "create_json_schema": newAttrs["create_json_schema"]}, c.After)
+	assert.Equal(t, map[string][]JSONChange{"create_json_schema": {
+		{Path: "/fields/0/label", Before: "A", After: "Alpha"},
+		{Path: "/fields/1", Before: nil, After: map[string]interface{}{"name": "b"}},
+	}}, c.Diffs, "Only the JSON columns should be diffed")
+}
+
+func TestDiffJSON(t *testing.T) {
+	diff, err := DiffJSON(datatypes.JSON(`{"a": 1, "b": {"c": true}, "d": [1, 2]}`), datatypes.JSON(`{"b": {"c": false}, "d": [1], "e": "x"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []JSONChange{
+		{Path: "/a", Before: 1.0, After: nil},
+		{Path: "/b/c", Before: true, After: false},
+		{Path: "/d/1", Before: 2.0, After: nil},
+		{Path: "/e", Before: nil, After: "x"},
+	}, diff)
+
+	diff, err = DiffJSON(datatypes.JSON(`{"a": 1}`), datatypes.JSON(`{ "a" : 1 }`))
+	assert.NoError(t, err)
+	assert.Empty(t, diff)
+
+	_, err = DiffJSON(datatypes.JSON(`{`), datatypes.JSON(`{}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package base
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// Attributes stores the column values of a Tower object that we use for
+// change detection, keyed by the database column name
+type Attributes map[string]interface{}
+
+// Hash returns a digest of the normalized attributes, two objects with the
+// same content will always have the same hash irrespective of key order in
+// their JSON columns or the timezone of their timestamps
+func (a Attributes) Hash() (string, error) {
+	normalized := make(map[string]interface{}, len(a))
+	for k, v := range a {
+		nv, err := normalize(v)
+		if err != nil {
+			return "", err
+		}
+		normalized[k] = nv
+	}
+	// json.Marshal sorts the map keys so the output is stable
+	data, err := json.Marshal(normalized)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Changed returns the sorted column names whose values differ between the
+// existing attributes and the new ones. Existing timestamps that were stored
+// at second precision are considered unchanged if they match the new value
+// truncated to the second, so that upgrading does not update every object.
+func (a Attributes) Changed(newAttrs Attributes) ([]string, error) {
+	var changed []string
+	for k, nv := range newAttrs {
+		same, err := equalValues(a[k], nv)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// Refined returns the sorted timestamp columns that are only unchanged
+// because the existing value was stored at second precision, they are written
+// again with the precision of the new value by RefineTimestamps
+func (a Attributes) Refined(newAttrs Attributes) []string {
+	var refined []string
+	for k, nv := range newAttrs {
+		t1, ok1 := a[k].(time.Time)
+		t2, ok2 := nv.(time.Time)
+		if ok1 && ok2 && !t1.Equal(t2) && SecondPrecisionEqual(t1, t2) {
+			refined = append(refined, k)
+		}
+	}
+	sort.Strings(refined)
+	return refined
+}
+
+// Values returns only the named columns, used to build a partial update
+func (a Attributes) Values(columns []string) map[string]interface{} {
+	values := make(map[string]interface{}, len(columns))
+	for _, c := range columns {
+		if v, ok := a[c]; ok {
+			values[c] = v
+		}
+	}
+	return values
+}
+
+// DetectChanges compares the existing attributes with the new attributes
+// and returns the list of changed columns, nil if the objects are in sync
+func DetectChanges(existing, newAttrs Attributes) ([]string, error) {
+	oldHash, err := existing.Hash()
+	if err != nil {
+		return nil, err
+	}
+	newHash, err := newAttrs.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if oldHash == newHash {
+		return nil, nil
+	}
+	return existing.Changed(newAttrs)
+}
+
+func equalValues(v1, v2 interface{}) (bool, error) {
+	t1, ok1 := v1.(time.Time)
+	t2, ok2 := v2.(time.Time)
+	if ok1 && ok2 {
+		return t1.Equal(t2) || SecondPrecisionEqual(t1, t2), nil
+	}
+	n1, err := normalize(v1)
+	if err != nil {
+		return false, err
+	}
+	n2, err := normalize(v2)
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(n1, n2), nil
+}
+
+// normalize converts JSON columns into generic values so that key ordering
+// and whitespace are ignored, and timestamps into UTC
+func normalize(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case datatypes.JSON:
+		return normalizeJSON(val)
+	case time.Time:
+		return val.UTC().Format(time.RFC3339Nano), nil
+	}
+	return v, nil
+}
+
+func normalizeJSON(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var result interface{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,56 @@
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/datatypes"
+)
+
+var changeCases = []struct {
+	name     string
+	existing Attributes
+	newAttrs Attributes
+	changed  []string
+}{
+	{"identical",
+		Attributes{"name": "demo", "extra": datatypes.JSON(`{"a":1,"b":true}`)},
+		Attributes{"name": "demo", "extra": datatypes.JSON(`{"a":1,"b":true}`)},
+		nil},
+	{"json key order and whitespace",
+		Attributes{"extra": datatypes.JSON(`{"b": true, "a": 1}`)},
+		Attributes{"extra": datatypes.JSON(`{"a":1,"b":true}`)},
+		nil},
+	{"same instant in different zones",
+		Attributes{"source_updated_at": time.Date(2020, 1, 8, 15, 52, 59, 0, time.FixedZone("IST", 19800))},
+		Attributes{"source_updated_at": time.Date(2020, 1, 8, 10, 22, 59, 0, time.UTC)},
+		nil},
+	{"extra changed",
+		Attributes{"name": "demo", "extra": datatypes.JSON(`{"survey_enabled":false}`)},
+		Attributes{"name": "demo", "extra": datatypes.JSON(`{"survey_enabled":true}`)},
+		[]string{"extra"}},
+	{"multiple columns",
+		Attributes{"name": "demo", "description": "old", "kind": "ssh"},
+		Attributes{"name": "demo2", "description": "new", "kind": "ssh"},
+		[]string{"description", "name"}},
+}
+
+func TestDetectChanges(t *testing.T) {
+	for _, tt := range changeCases {
+		changed, err := DetectChanges(tt.existing, tt.newAttrs)
+		assert.Nil(t, err, tt.name)
+		assert.Equal(t, tt.changed, changed, tt.name)
+	}
+}
+
+func TestDetectChangesBadJSON(t *testing.T) {
+	_, err := DetectChanges(Attributes{"extra": datatypes.JSON(`gobbledegook`)}, Attributes{"extra": datatypes.JSON(`{}`)})
+	assert.NotNil(t, err, "Should have failed parsing JSON")
+}
+
+func TestValues(t *testing.T) {
+	attrs := Attributes{"name": "demo", "description": "openshift", "kind": "ssh"}
+	values := attrs.Values([]string{"name", "kind", "missing"})
+	assert.Equal(t, map[string]interface{}{"name": "demo", "kind": "ssh"}, values)
+}
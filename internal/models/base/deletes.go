@@ -0,0 +1,54 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// DeleteUnwanted soft deletes, in a single statement, every object of a
+// tenant and source in a table whose Tower id is not in keepSourceRefs. The
+// keep list is sent as one text array parameter so the statement stays the
+// same size no matter how many objects a source has. The ids and Tower ids
+// of the deleted objects are returned.
+func DeleteUnwanted(ctx context.Context, tx *gorm.DB, table string, tenantID, sourceID int64, keepSourceRefs []string) ([]ResultIDRef, error) {
+	return archive(ctx, tx, table, "NOT (source_ref = ANY (?::text[]))", tenantID, sourceID, keepSourceRefs)
+}
+
+// DeleteSourceRefs soft deletes, in a single statement, the objects of a
+// tenant and source in a table with the given Tower ids. The ids and Tower ids
+// of the deleted objects are returned.
+func DeleteSourceRefs(ctx context.Context, tx *gorm.DB, table string, tenantID, sourceID int64, sourceRefs []string) ([]ResultIDRef, error) {
+	if len(sourceRefs) == 0 {
+		return nil, nil
+	}
+	return archive(ctx, tx, table, "source_ref = ANY (?::text[])", tenantID, sourceID, sourceRefs)
+}
+
+func archive(ctx context.Context, tx *gorm.DB, table, condition string, tenantID, sourceID int64, sourceRefs []string) ([]ResultIDRef, error) {
+	var result []ResultIDRef
+	sql := fmt.Sprintf("UPDATE %s SET archived_at = ? WHERE tenant_id = ? AND source_id = ? AND archived_at IS NULL AND %s RETURNING id, source_ref", table, condition)
+	err := tx.WithContext(ctx).Raw(sql, tx.NowFunc(), tenantID, sourceID, textArray(sourceRefs)).Scan(&result).Error
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// textArray formats strings as a Postgres array literal e.g. {"1","2"}
+func textArray(values []string) string {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteByte('"')
+		sb.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
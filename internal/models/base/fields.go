@@ -0,0 +1,118 @@
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// FieldError is returned when a field of a Tower object is missing, null or
+// does not have the expected type
+type FieldError struct {
+	Field    string
+	Expected string
+	Value    interface{}
+}
+
+func (e *FieldError) Error() string {
+	if e.Value == nil {
+		return fmt.Sprintf("Field %s should be %s, got null", e.Field, e.Expected)
+	}
+	return fmt.Sprintf("Field %s should be %s, got %T %v", e.Field, e.Expected, e.Value, e.Value)
+}
+
+// FieldReader reads typed fields from the attributes of a Tower object. The
+// first field that can not be read is kept in Err and the zero value is
+// returned for it and every field read after it, so a makeObject can read
+// all its fields and check Err once.
+type FieldReader struct {
+	attrs map[string]interface{}
+	err   error
+}
+
+// NewFieldReader creates a FieldReader for the attributes of a Tower object
+func NewFieldReader(attrs map[string]interface{}) *FieldReader {
+	return &FieldReader{attrs: attrs}
+}
+
+// Err returns the first field that could not be read
+func (fr *FieldReader) Err() error {
+	return fr.err
+}
+
+func (fr *FieldReader) fail(field, expected string) {
+	if fr.err == nil {
+		fr.err = &FieldError{Field: field, Expected: expected, Value: fr.attrs[field]}
+	}
+}
+
+// String reads a string field
+func (fr *FieldReader) String(field string) string {
+	if fr.err != nil {
+		return ""
+	}
+	s, ok := fr.attrs[field].(string)
+	if !ok {
+		fr.fail(field, "a string")
+	}
+	return s
+}
+
+// Bool reads a boolean field
+func (fr *FieldReader) Bool(field string) bool {
+	if fr.err != nil {
+		return false
+	}
+	b, ok := fr.attrs[field].(bool)
+	if !ok {
+		fr.fail(field, "a boolean")
+	}
+	return b
+}
+
+// Int64 reads an integer field
+func (fr *FieldReader) Int64(field string) int64 {
+	if fr.err != nil {
+		return 0
+	}
+	n, ok := fr.attrs[field].(json.Number)
+	if !ok {
+		fr.fail(field, "an integer")
+		return 0
+	}
+	i, err := n.Int64()
+	if err != nil {
+		fr.fail(field, "an integer")
+	}
+	return i
+}
+
+// ID reads the Tower id of the object
+func (fr *FieldReader) ID() string {
+	if fr.err != nil {
+		return ""
+	}
+	n, ok := fr.attrs["id"].(json.Number)
+	if !ok {
+		fr.fail("id", "an integer")
+		return ""
+	}
+	if _, err := n.Int64(); err != nil {
+		fr.fail("id", "an integer")
+		return ""
+	}
+	return n.String()
+}
+
+// Time reads a Tower timestamp with TowerTime
+func (fr *FieldReader) Time(field string) time.Time {
+	s := fr.String(field)
+	if fr.err != nil {
+		return time.Time{}
+	}
+	t, err := TowerTime(s)
+	if err != nil {
+		fr.err = err
+	}
+	return t
+}
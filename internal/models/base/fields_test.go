@@ -0,0 +1,39 @@
+package base
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldReader(t *testing.T) {
+	fr := NewFieldReader(map[string]interface{}{
+		"id":       json.Number("4"),
+		"name":     "demo",
+		"enabled":  true,
+		"count":    json.Number("3"),
+		"modified": "2020-01-08T10:22:59.423585Z"})
+	assert.Equal(t, "4", fr.ID())
+	assert.Equal(t, "demo", fr.String("name"))
+	assert.True(t, fr.Bool("enabled"))
+	assert.Equal(t, int64(3), fr.Int64("count"))
+	assert.Equal(t, time.Date(2020, 1, 8, 10, 22, 59, 423585000, time.UTC), fr.Time("modified"))
+	assert.NoError(t, fr.Err())
+}
+
+func TestFieldReaderFirstError(t *testing.T) {
+	fr := NewFieldReader(map[string]interface{}{"id": json.Number("4"), "name": nil, "enabled": "yes"})
+	assert.Equal(t, "", fr.String("name"))
+	assert.False(t, fr.Bool("enabled"))
+	assert.Equal(t, "", fr.ID(), "Nothing is read after an error")
+	assert.EqualError(t, fr.Err(), "Field name should be a string, got null")
+
+	fr = NewFieldReader(map[string]interface{}{"enabled": "yes", "id": json.Number("4.5")})
+	fr.Bool("enabled")
+	assert.EqualError(t, fr.Err(), "Field enabled should be a boolean, got string yes")
+	fr = NewFieldReader(map[string]interface{}{"id": json.Number("4.5")})
+	fr.ID()
+	assert.EqualError(t, fr.Err(), "Field id should be an integer, got json.Number 4.5")
+}
@@ -0,0 +1,35 @@
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// InvalidObjectError is returned when a Tower object can not be converted
+// into a catalog object, nothing has been written to the database yet so
+// the other objects of the batch can still be saved without it
+type InvalidObjectError struct {
+	// Index is the position of the object in the batch
+	Index int
+	// SourceRef is the Tower id of the object, empty when it has none
+	SourceRef string
+	Reason    error
+}
+
+// NewInvalidObjectError wraps the reason an object at index in a batch is invalid
+func NewInvalidObjectError(index int, attrs map[string]interface{}, reason error) *InvalidObjectError {
+	sourceRef := ""
+	if id, ok := attrs["id"].(json.Number); ok {
+		sourceRef = id.String()
+	}
+	return &InvalidObjectError{Index: index, SourceRef: sourceRef, Reason: reason}
+}
+
+func (e *InvalidObjectError) Error() string {
+	return fmt.Sprintf("Invalid object source ref %s: %v", e.SourceRef, e.Reason)
+}
+
+// Unwrap returns the reason the object is invalid
+func (e *InvalidObjectError) Unwrap() error {
+	return e.Reason
+}
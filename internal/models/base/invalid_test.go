@@ -0,0 +1,27 @@
+package base
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidObjectError(t *testing.T) {
+	reason := errors.New("Missing Required Attribute description")
+	var err error = fmt.Errorf("Error adding: %w", NewInvalidObjectError(2, map[string]interface{}{"id": json.Number("73")}, reason))
+
+	var invalid *InvalidObjectError
+	assert.True(t, errors.As(err, &invalid))
+	assert.Equal(t, 2, invalid.Index)
+	assert.Equal(t, "73", invalid.SourceRef)
+	assert.True(t, errors.Is(err, reason))
+	assert.Equal(t, "Invalid object source ref 73: Missing Required Attribute description", invalid.Error())
+}
+
+func TestInvalidObjectErrorWithoutID(t *testing.T) {
+	invalid := NewInvalidObjectError(0, map[string]interface{}{}, errors.New("No type provided"))
+	assert.Equal(t, "", invalid.SourceRef)
+}
@@ -0,0 +1,28 @@
+package base
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// lastSeenBatchSize limits the number of ids sent in a single UPDATE
+const lastSeenBatchSize = 1000
+
+// UpdateLastSeen sets last_seen_at for all the objects that were seen during
+// a refresh, irrespective of whether they were created, updated or unchanged.
+// We use UpdateColumn so that updated_at is not bumped for unchanged objects.
+func UpdateLastSeen(ctx context.Context, tx *gorm.DB, table string, ids []int64, seenAt time.Time) error {
+	for start := 0; start < len(ids); start += lastSeenBatchSize {
+		end := start + lastSeenBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		err := tx.WithContext(ctx).Table(table).Where("id IN ?", ids[start:end]).UpdateColumn("last_seen_at", seenAt).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
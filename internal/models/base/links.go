@@ -0,0 +1,46 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// linkBatchSize limits the number of rows in a single UPDATE ... FROM (VALUES ...)
+const linkBatchSize = 1000
+
+// Link points the object with ID at the object with TargetID
+type Link struct {
+	ID       int64
+	TargetID int64
+}
+
+// UpdateLinks sets a foreign key column on many objects of a table in
+// batches with UPDATE ... FROM (VALUES ...), the update is restricted to the
+// objects of the tenant and source
+func UpdateLinks(ctx context.Context, tx *gorm.DB, table, column string, tenantID, sourceID int64, links []Link) error {
+	// Keep the statements stable irrespective of how the links were collected
+	sort.Slice(links, func(i, j int) bool { return links[i].ID < links[j].ID })
+	for start := 0; start < len(links); start += linkBatchSize {
+		end := start + linkBatchSize
+		if end > len(links) {
+			end = len(links)
+		}
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, 2*(end-start)+2)
+		for _, l := range links[start:end] {
+			values = append(values, "(?::bigint, ?::bigint)")
+			args = append(args, l.ID, l.TargetID)
+		}
+		args = append(args, tenantID, sourceID)
+		sql := fmt.Sprintf("UPDATE %s AS t SET %s = v.target_id FROM (VALUES %s) AS v(id, target_id) WHERE t.id = v.id AND t.tenant_id = ? AND t.source_id = ?",
+			table, column, strings.Join(values, ", "))
+		if err := tx.WithContext(ctx).Exec(sql, args...).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
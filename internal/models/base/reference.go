@@ -0,0 +1,64 @@
+package base
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+)
+
+var relatedURLRe = regexp.MustCompile(`\/api\/v2\/([a-z_]+)\/(\d+)\/?`)
+var numericRe = regexp.MustCompile(`^\d+$`)
+
+// ReferenceID gets the Tower id of a related object from the attributes of
+// a Tower object. Tower can send the reference as a number, as a related URL
+// e.g. /api/v2/inventories/12/ or only in the summary_fields, we check all of
+// them in that order. The resource is the collection name used in the URL
+// (inventories, credential_types ...), an empty string is returned when there
+// is no reference
+func ReferenceID(attrs map[string]interface{}, field string, resource string) string {
+	if id := parseReference(attrs[field], resource); id != "" {
+		return id
+	}
+
+	if related, ok := attrs["related"].(map[string]interface{}); ok {
+		if id := parseReference(related[field], resource); id != "" {
+			return id
+		}
+	}
+
+	if summary, ok := attrs["summary_fields"].(map[string]interface{}); ok {
+		if obj, ok := summary[field].(map[string]interface{}); ok {
+			if id := parseReference(obj["id"], resource); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// parseReference converts a single value into a Tower id
+func parseReference(v interface{}, resource string) string {
+	switch val := v.(type) {
+	case json.Number:
+		if _, err := val.Int64(); err == nil {
+			return val.String()
+		}
+	case float64:
+		if val == float64(int64(val)) {
+			return strconv.FormatInt(int64(val), 10)
+		}
+	case int:
+		return strconv.Itoa(val)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case string:
+		if numericRe.MatchString(val) {
+			return val
+		}
+		s := relatedURLRe.FindStringSubmatch(val)
+		if len(s) > 2 && s[1] == resource {
+			return s[2]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package base
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var referenceCases = []struct {
+	name     string
+	attrs    map[string]interface{}
+	field    string
+	resource string
+	expected string
+}{
+	{"json number", map[string]interface{}{"inventory": json.Number("12")}, "inventory", "inventories", "12"},
+	{"float", map[string]interface{}{"inventory": float64(7)}, "inventory", "inventories", "7"},
+	{"int", map[string]interface{}{"inventory": 3}, "inventory", "inventories", "3"},
+	{"numeric string", map[string]interface{}{"inventory": "42"}, "inventory", "inventories", "42"},
+	{"single digit url", map[string]interface{}{"inventory": "/api/v2/inventories/1/"}, "inventory", "inventories", "1"},
+	{"multi digit url", map[string]interface{}{"inventory": "/api/v2/inventories/123/"}, "inventory", "inventories", "123"},
+	{"url without trailing slash", map[string]interface{}{"inventory": "/api/v2/inventories/55"}, "inventory", "inventories", "55"},
+	{"url for another resource", map[string]interface{}{"inventory": "/api/v2/credentials/5/"}, "inventory", "inventories", ""},
+	{"null", map[string]interface{}{"inventory": nil}, "inventory", "inventories", ""},
+	{"missing", map[string]interface{}{}, "inventory", "inventories", ""},
+	{"bad number", map[string]interface{}{"inventory": json.Number("1.5")}, "inventory", "inventories", ""},
+	{"related url",
+		map[string]interface{}{"inventory": nil,
+			"related": map[string]interface{}{"inventory": "/api/v2/inventories/18/"}},
+		"inventory", "inventories", "18"},
+	{"summary fields",
+		map[string]interface{}{
+			"summary_fields": map[string]interface{}{
+				"inventory": map[string]interface{}{"id": json.Number("27"), "name": "Demo"}}},
+		"inventory", "inventories", "27"},
+	{"value takes precedence over summary fields",
+		map[string]interface{}{"credential_type": json.Number("14"),
+			"summary_fields": map[string]interface{}{
+				"credential_type": map[string]interface{}{"id": json.Number("99")}}},
+		"credential_type", "credential_types", "14"},
+	{"workflow job template url",
+		map[string]interface{}{"workflow_job_template": "/api/v2/workflow_job_templates/10/"},
+		"workflow_job_template", "workflow_job_templates", "10"},
+}
+
+func TestReferenceID(t *testing.T) {
+	for _, tt := range referenceCases {
+		assert.Equal(t, tt.expected, ReferenceID(tt.attrs, tt.field, tt.resource), tt.name)
+	}
+}
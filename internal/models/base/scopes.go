@@ -0,0 +1,23 @@
+package base
+
+import (
+	"gorm.io/gorm"
+)
+
+// TenantScope restricts a query to the objects that belong to a tenant and
+// source. Every query on the Tower objects should go through this scope so
+// that we never touch objects from another tenant even if a source id is
+// wrong or reused.
+func TenantScope(tenantID, sourceID int64) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("tenant_id = ? AND source_id = ?", tenantID, sourceID)
+	}
+}
+
+// SourceRefScope restricts a query to a single Tower object in a tenant and
+// source identified by its Tower id
+func SourceRefScope(tenantID, sourceID int64, sourceRef string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("tenant_id = ? AND source_id = ? AND source_ref = ?", tenantID, sourceID, sourceRef)
+	}
+}
@@ -0,0 +1,104 @@
+package base
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// upsertBatchSize limits the number of rows sent in a single INSERT so that
+// we stay well below the Postgres limit of 65535 bind parameters
+const upsertBatchSize = 500
+
+// conflictColumns is the unique key of every Tower object table. The unique
+// index it needs is created by schema migration 2 unique_source_refs, the
+// persister does not start until that migration has been applied.
+var conflictColumns = []clause.Column{{Name: "tenant_id"}, {Name: "source_id"}, {Name: "source_ref"}}
+
+// Columns returns the sorted column names of the attributes
+func (a Attributes) Columns() []string {
+	columns := make([]string, 0, len(a))
+	for k := range a {
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// BulkUpsert inserts a slice of objects in batches using
+// INSERT ... ON CONFLICT (tenant_id, source_id, source_ref) DO UPDATE, existing rows get
+// the listed columns and updated_at overwritten. An archived row that shows up
+// in Tower again is restored by clearing archived_at. Postgres cannot update
+// a row twice in one statement, so an object repeated in objs is written once
+// with its last occurrence. The ID of every object is filled in from the
+// RETURNING clause.
+func BulkUpsert(ctx context.Context, tx *gorm.DB, objs interface{}, columns []string) error {
+	updates := append(append([]string{}, columns...), "updated_at", "archived_at")
+	onConflict := clause.OnConflict{Columns: conflictColumns, DoUpdates: clause.AssignmentColumns(updates)}
+
+	all := reflect.ValueOf(objs)
+	v, positions := uniqueSourceRefs(all)
+	for start := 0; start < v.Len(); start += upsertBatchSize {
+		end := start + upsertBatchSize
+		if end > v.Len() {
+			end = v.Len()
+		}
+		err := tx.WithContext(ctx).Clauses(onConflict).Create(v.Slice(start, end).Interface()).Error
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; i < all.Len(); i++ {
+		obj := all.Index(i).Elem()
+		obj.FieldByName("ID").SetInt(v.Index(positions[obj.FieldByName("SourceRef").String()]).Elem().FieldByName("ID").Int())
+	}
+	return nil
+}
+
+// uniqueSourceRefs returns the objects with the last occurrence of every
+// source ref, in the order the source refs first appear, along with the
+// position of every source ref in the result
+func uniqueSourceRefs(objs reflect.Value) (reflect.Value, map[string]int) {
+	positions := make(map[string]int, objs.Len())
+	unique := reflect.MakeSlice(objs.Type(), 0, objs.Len())
+	for i := 0; i < objs.Len(); i++ {
+		sourceRef := objs.Index(i).Elem().FieldByName("SourceRef").String()
+		if pos, ok := positions[sourceRef]; ok {
+			unique.Index(pos).Set(objs.Index(i))
+			continue
+		}
+		positions[sourceRef] = unique.Len()
+		unique = reflect.Append(unique, objs.Index(i))
+	}
+	return unique, positions
+}
+
+// SourceRefIDs fetches the database ids of the objects in a table with the
+// given Tower ids, keyed by the Tower id
+func SourceRefIDs(ctx context.Context, tx *gorm.DB, table string, tenantID, sourceID int64, sourceRefs []string) (map[string]int64, error) {
+	ids := make(map[string]int64, len(sourceRefs))
+	if len(sourceRefs) == 0 {
+		return ids, nil
+	}
+	var result []ResultIDRef
+	err := tx.WithContext(ctx).Table(table).Select("id, source_ref").Scopes(TenantScope(tenantID, sourceID)).Where("source_ref IN ? AND archived_at IS NULL", sourceRefs).Scan(&result).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range result {
+		ids[res.SourceRef] = res.ID
+	}
+	return ids, nil
+}
+
+// RefineTimestamps writes the precise values of timestamps an object in sync
+// with Tower had stored at second precision by older versions of the
+// persister. It is not a change of the object, updated_at is kept and no
+// change is recorded. Once every object has been refreshed the
+// SecondPrecisionEqual fallback is no longer needed.
+func RefineTimestamps(ctx context.Context, tx *gorm.DB, table string, id int64, values map[string]interface{}) error {
+	return tx.WithContext(ctx).Table(table).Where("id = ?", id).UpdateColumns(values).Error
+}
@@ -0,0 +1,56 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"gorm.io/gorm"
+)
+
+// benchUpserts is the number of objects in a Tower page
+const benchUpserts = 200
+
+// writeEach saves the objects the way the repositories did before the
+// upserts, a lookup by Tower id followed by an insert or an update
+func writeEach(ctx context.Context, tx *gorm.DB, objs []*upsertObject) error {
+	for _, obj := range objs {
+		var instance upsertObject
+		err := tx.WithContext(ctx).Where(&upsertObject{TenantID: obj.TenantID, SourceID: obj.SourceID, Tower: Tower{SourceRef: obj.SourceRef}}).First(&instance).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = tx.WithContext(ctx).Create(obj).Error
+		} else if err == nil {
+			obj.ID = instance.ID
+			err = tx.WithContext(ctx).Save(obj).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BenchmarkBulkUpsert compares writing a page of new objects one at a time
+// with a batched upsert and reports the number of statements sent to the
+// database
+func BenchmarkBulkUpsert(b *testing.B) {
+	write := map[string]func(context.Context, *gorm.DB, []*upsertObject) error{
+		"each": writeEach,
+		"upsert": func(ctx context.Context, tx *gorm.DB, objs []*upsertObject) error {
+			return BulkUpsert(ctx, tx, objs, []string{"name"})
+		},
+	}
+	for _, name := range []string{"each", "upsert"} {
+		b.Run(name, func(b *testing.B) {
+			gdb, cc := testhelper.CountingDBSetup(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := write[name](context.TODO(), gdb, makeUpsertObjects(benchUpserts)); err != nil {
+					b.Fatalf("Error writing objects %v", err)
+				}
+			}
+			b.ReportMetric(float64(cc.Statements())/float64(b.N), "statements/op")
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+type upsertObject struct {
+	Base
+	Tower
+	Name     string
+	TenantID int64
+	SourceID int64
+}
+
+var upsertRe = `^INSERT INTO "upsert_objects" .* ON CONFLICT \("tenant_id","source_id","source_ref"\) DO UPDATE SET "name"="excluded"."name","updated_at"="excluded"."updated_at","archived_at"="excluded"."archived_at" RETURNING "id"`
+
+func makeUpsertObjects(count int) []*upsertObject {
+	objs := make([]*upsertObject, count)
+	for i := range objs {
+		objs[i] = &upsertObject{Tower: Tower{SourceRef: strconv.Itoa(i)}, Name: "test", TenantID: 99, SourceID: 1}
+	}
+	return objs
+}
+
+func TestColumns(t *testing.T) {
+	attrs := Attributes{"name": "a", "description": "b", "extra": "c"}
+	assert.Equal(t, []string{"description", "extra", "name"}, attrs.Columns())
+}
+
+func TestBulkUpsert(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	objs := makeUpsertObjects(upsertBatchSize + 1)
+
+	rows := sqlmock.NewRows([]string{"id"})
+	for i := 0; i < upsertBatchSize; i++ {
+		rows.AddRow(int64(i + 1))
+	}
+	mock.ExpectQuery(upsertRe).WillReturnRows(rows)
+	mock.ExpectQuery(upsertRe).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(upsertBatchSize + 1)))
+
+	err := BulkUpsert(context.TODO(), gdb, objs, []string{"name"})
+	assert.Nil(t, err, "BulkUpsert failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	for i, obj := range objs {
+		assert.Equal(t, int64(i+1), obj.ID)
+	}
+}
+
+func TestBulkUpsertError(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	kaboom := fmt.Errorf("kaboom")
+	mock.ExpectQuery(upsertRe).WillReturnError(kaboom)
+
+	err := BulkUpsert(context.TODO(), gdb, makeUpsertObjects(2), []string{"name"})
+	assert.Equal(t, kaboom, err)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestBulkUpsertRepeatedSourceRef(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	objs := makeUpsertObjects(3)
+	objs[2].SourceRef = "0"
+	objs[2].Name = "renamed"
+	mock.ExpectQuery(upsertRe).
+		WithArgs(testhelper.AnyTime{}, testhelper.AnyTime{}, nil, "0", testhelper.AnyTime{}, testhelper.AnyTime{}, nil, "renamed", 99, 1,
+			testhelper.AnyTime{}, testhelper.AnyTime{}, nil, "1", testhelper.AnyTime{}, testhelper.AnyTime{}, nil, "test", 99, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(7)).AddRow(int64(8)))
+
+	err := BulkUpsert(context.TODO(), gdb, objs, []string{"name"})
+	assert.Nil(t, err, "BulkUpsert failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	assert.Equal(t, []int64{7, 8, 7}, []int64{objs[0].ID, objs[1].ID, objs[2].ID}, "A repeated source ref gets the id of the row written")
+}
+
+func TestSourceRefIDs(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	str := `SELECT id, source_ref FROM "upsert_objects" WHERE (tenant_id = $1 AND source_id = $2) AND (source_ref IN ($3,$4) AND archived_at IS NULL)`
+	mock.ExpectQuery(regexp.QuoteMeta(str)).
+		WithArgs(int64(99), int64(1), "10", "11").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "source_ref"}).AddRow(int64(5), "10"))
+
+	ids, err := SourceRefIDs(context.TODO(), gdb, "upsert_objects", 99, 1, []string{"10", "11"})
+	assert.Nil(t, err, "SourceRefIDs failed")
+	assert.Equal(t, map[string]int64{"10": 5}, ids)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestSourceRefIDsEmpty(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+
+	ids, err := SourceRefIDs(context.TODO(), gdb, "upsert_objects", 99, 1, nil)
+	assert.Nil(t, err, "SourceRefIDs failed")
+	assert.Empty(t, ids)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestUpdateLinks(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	links := make([]Link, linkBatchSize+1)
+	for i := range links {
+		// Added in reverse order, the update is sorted by id
+		links[i] = Link{ID: int64(len(links) - i), TargetID: 7}
+	}
+	mock.ExpectExec(`^UPDATE upsert_objects AS t SET parent_id = v.target_id FROM \(VALUES \(\$1::bigint, \$2::bigint\), .* AS v\(id, target_id\) WHERE t.id = v.id AND t.tenant_id = \$2001 AND t.source_id = \$2002$`).
+		WillReturnResult(sqlmock.NewResult(0, linkBatchSize))
+	str := `UPDATE upsert_objects AS t SET parent_id = v.target_id FROM (VALUES ($1::bigint, $2::bigint)) AS v(id, target_id) WHERE t.id = v.id AND t.tenant_id = $3 AND t.source_id = $4`
+	mock.ExpectExec(regexp.QuoteMeta(str)).
+		WithArgs(int64(linkBatchSize+1), int64(7), int64(99), int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := UpdateLinks(context.TODO(), gdb, "upsert_objects", "parent_id", 99, 1, links)
+	assert.Nil(t, err, "UpdateLinks failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestUpdateLinksError(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	kaboom := fmt.Errorf("kaboom")
+	mock.ExpectExec("^UPDATE upsert_objects").WillReturnError(kaboom)
+
+	err := UpdateLinks(context.TODO(), gdb, "upsert_objects", "parent_id", 99, 1, []Link{{ID: 1, TargetID: 2}})
+	assert.Equal(t, kaboom, err)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestTextArray(t *testing.T) {
+	assert.Equal(t, `{}`, textArray(nil))
+	assert.Equal(t, `{"1","22"}`, textArray([]string{"1", "22"}))
+	assert.Equal(t, `{"a\"b","c\\d","e,f"}`, textArray([]string{`a"b`, `c\d`, "e,f"}))
+}
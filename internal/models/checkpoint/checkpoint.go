@@ -0,0 +1,205 @@
+package checkpoint
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// stagedPageBatch is the number of staged pages read from the database at a time
+const stagedPageBatch = 20
+
+// ErrClaimLost is returned when the checkpoint of a task was taken over by
+// another persister
+var ErrClaimLost = errors.New("checkpoint claimed by another persister")
+
+// Checkpoint records how far a chunked refresh of a task has got, the pages
+// staged so far are kept as StagedPages until the refresh is done and
+// PagesApplied of them have been committed to the catalog. It carries the
+// Kafka message so that an interrupted refresh can be resumed.
+type Checkpoint struct {
+	TaskURL      string `gorm:"primaryKey"`
+	TenantID     int64
+	SourceID     int64
+	DataURL      string
+	Size         int64
+	Headers      datatypes.JSON
+	PagesStaged  int
+	PagesApplied int
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	ClaimedAt    time.Time
+	ClaimedBy    string
+}
+
+// TableName of the checkpoints
+func (Checkpoint) TableName() string {
+	return "tower_persister_checkpoints"
+}
+
+// StagedPage is a page from the tar file of a task, in tar file order
+type StagedPage struct {
+	TaskURL  string `gorm:"primaryKey;autoIncrement:false"`
+	Position int    `gorm:"primaryKey;autoIncrement:false"`
+	Name     string
+	Content  []byte
+}
+
+// TableName of the staged pages
+func (StagedPage) TableName() string {
+	return "tower_persister_staged_pages"
+}
+
+// Claimant is a persister process working on checkpoints. A checkpoint can
+// be claimed when its claim is older than StaleAfter, or when it was claimed
+// by an earlier run of the same host that has since restarted.
+type Claimant struct {
+	Name       string
+	StartedAt  time.Time
+	StaleAfter time.Duration
+}
+
+// Repository interface supports operations on the checkpoints of chunked refreshes
+type Repository interface {
+	Claim(ctx context.Context, logger *logrus.Entry, cp *Checkpoint, c Claimant) (bool, error)
+	StagePages(ctx context.Context, logger *logrus.Entry, cp *Checkpoint, pages []StagedPage) error
+	Applied(ctx context.Context, logger *logrus.Entry, cp *Checkpoint, applied int) error
+	EachPage(ctx context.Context, taskURL string, fn func(page *StagedPage) error) error
+	Delete(ctx context.Context, logger *logrus.Entry, taskURL string) error
+	Exists(ctx context.Context, taskURL string) (bool, error)
+	Unfinished(ctx context.Context, c Claimant) ([]Checkpoint, error)
+}
+
+type gormRepository struct {
+	db *gorm.DB
+}
+
+// NewGORMRepository creates a new repository object
+func NewGORMRepository(db *gorm.DB) Repository {
+	return &gormRepository{db: db}
+}
+
+// Claim creates the checkpoint of a task or takes over an existing one, the
+// number of pages already staged and applied is set in the checkpoint. It
+// returns false if another worker is busy with the task.
+func (gr *gormRepository) Claim(ctx context.Context, logger *logrus.Entry, cp *Checkpoint, c Claimant) (bool, error) {
+	now := gr.db.NowFunc()
+	var claimed []Checkpoint
+	err := gr.db.WithContext(ctx).Raw(`INSERT INTO tower_persister_checkpoints (task_url, tenant_id, source_id, data_url, size, headers, pages_staged, created_at, updated_at, claimed_at, claimed_by) `+
+		`VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?) `+
+		`ON CONFLICT (task_url) DO UPDATE SET claimed_at = excluded.claimed_at, claimed_by = excluded.claimed_by, updated_at = excluded.updated_at `+
+		`WHERE tower_persister_checkpoints.claimed_at < ? OR (tower_persister_checkpoints.claimed_by = ? AND tower_persister_checkpoints.claimed_at < ?) `+
+		`RETURNING pages_staged, pages_applied`,
+		cp.TaskURL, cp.TenantID, cp.SourceID, cp.DataURL, cp.Size, cp.Headers, now, now, now, c.Name,
+		now.Add(-c.StaleAfter), c.Name, c.StartedAt).Scan(&claimed).Error
+	if err != nil {
+		logger.Errorf("Error claiming checkpoint for task %s %v", cp.TaskURL, err)
+		return false, err
+	}
+	if len(claimed) == 0 {
+		return false, nil
+	}
+	cp.PagesStaged = claimed[0].PagesStaged
+	cp.PagesApplied = claimed[0].PagesApplied
+	cp.ClaimedAt = now
+	cp.ClaimedBy = c.Name
+	return true, nil
+}
+
+// StagePages saves a chunk of pages and moves the checkpoint past them in one
+// transaction, which also renews the claim
+func (gr *gormRepository) StagePages(ctx context.Context, logger *logrus.Entry, cp *Checkpoint, pages []StagedPage) error {
+	if len(pages) == 0 {
+		return nil
+	}
+	staged := cp.PagesStaged + len(pages)
+	err := gr.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&pages).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Checkpoint{}).Where("task_url = ?", cp.TaskURL).
+			Updates(map[string]interface{}{"pages_staged": staged, "claimed_at": tx.NowFunc()}).Error
+	})
+	if err != nil {
+		logger.Errorf("Error staging pages for task %s %v", cp.TaskURL, err)
+		return err
+	}
+	cp.PagesStaged = staged
+	logger.Infof("Staged %d pages for task %s", staged, cp.TaskURL)
+	return nil
+}
+
+// Applied moves the checkpoint past the staged pages that have been applied
+// to the catalog and renews the claim. It is called in the transaction that
+// applied the pages, so the checkpoint never gets ahead of the catalog, and
+// fails with ErrClaimLost if another persister took over the task.
+func (gr *gormRepository) Applied(ctx context.Context, logger *logrus.Entry, cp *Checkpoint, applied int) error {
+	result := gr.db.WithContext(ctx).Model(&Checkpoint{}).Where("task_url = ? AND claimed_by = ?", cp.TaskURL, cp.ClaimedBy).
+		Updates(map[string]interface{}{"pages_applied": applied, "claimed_at": gr.db.NowFunc()})
+	if result.Error != nil {
+		logger.Errorf("Error saving checkpoint for task %s %v", cp.TaskURL, result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		logger.Errorf("Checkpoint for task %s was claimed by another persister", cp.TaskURL)
+		return ErrClaimLost
+	}
+	cp.PagesApplied = applied
+	logger.Infof("Applied %d pages for task %s", applied, cp.TaskURL)
+	return nil
+}
+
+// EachPage calls fn with every staged page of a task in tar file order
+func (gr *gormRepository) EachPage(ctx context.Context, taskURL string, fn func(page *StagedPage) error) error {
+	last := -1
+	for {
+		var pages []StagedPage
+		err := gr.db.WithContext(ctx).Where("task_url = ? AND position > ?", taskURL, last).
+			Order("position").Limit(stagedPageBatch).Find(&pages).Error
+		if err != nil {
+			return err
+		}
+		for i := range pages {
+			if err := fn(&pages[i]); err != nil {
+				return err
+			}
+			last = pages[i].Position
+		}
+		if len(pages) < stagedPageBatch {
+			return nil
+		}
+	}
+}
+
+// Delete removes the checkpoint of a task together with its staged pages
+func (gr *gormRepository) Delete(ctx context.Context, logger *logrus.Entry, taskURL string) error {
+	err := gr.db.WithContext(ctx).Where("task_url = ?", taskURL).Delete(&Checkpoint{}).Error
+	if err != nil {
+		logger.Errorf("Error deleting checkpoint for task %s %v", taskURL, err)
+		return err
+	}
+	return nil
+}
+
+// Exists checks if a task has a checkpoint
+func (gr *gormRepository) Exists(ctx context.Context, taskURL string) (bool, error) {
+	var count int64
+	err := gr.db.WithContext(ctx).Model(&Checkpoint{}).Where("task_url = ?", taskURL).Count(&count).Error
+	return count > 0, err
+}
+
+// Unfinished lists the checkpoints that the claimant can take over
+func (gr *gormRepository) Unfinished(ctx context.Context, c Claimant) ([]Checkpoint, error) {
+	var cps []Checkpoint
+	err := gr.db.WithContext(ctx).
+		Where("claimed_at < ? OR (claimed_by = ? AND claimed_at < ?)", gr.db.NowFunc().Add(-c.StaleAfter), c.Name, c.StartedAt).
+		Order("created_at").Find(&cps).Error
+	if err != nil {
+		return nil, err
+	}
+	return cps, nil
+}
@@ -0,0 +1,212 @@
+package checkpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+const taskURL = "http://www.example.com/task/1"
+
+var claimant = Claimant{Name: "persister-1", StartedAt: time.Now(), StaleAfter: 20 * time.Minute}
+
+var claimStr = `INSERT INTO tower_persister_checkpoints (task_url, tenant_id, source_id, data_url, size, headers, pages_staged, created_at, updated_at, claimed_at, claimed_by) ` +
+	`VALUES ($1, $2, $3, $4, $5, $6, 0, $7, $8, $9, $10) ` +
+	`ON CONFLICT (task_url) DO UPDATE SET claimed_at = excluded.claimed_at, claimed_by = excluded.claimed_by, updated_at = excluded.updated_at ` +
+	`WHERE tower_persister_checkpoints.claimed_at < $11 OR (tower_persister_checkpoints.claimed_by = $12 AND tower_persister_checkpoints.claimed_at < $13) ` +
+	`RETURNING pages_staged, pages_applied`
+
+func makeCheckpoint() *Checkpoint {
+	return &Checkpoint{TaskURL: taskURL, TenantID: 99, SourceID: 1, DataURL: "http://www.example.com/data", Size: 900, Headers: []byte(`{}`)}
+}
+
+func expectClaim(mock sqlmock.Sqlmock) *sqlmock.ExpectedQuery {
+	return mock.ExpectQuery(regexp.QuoteMeta(claimStr)).
+		WithArgs(taskURL, int64(99), int64(1), "http://www.example.com/data", int64(900), sqlmock.AnyArg(),
+			testhelper.AnyTime{}, testhelper.AnyTime{}, testhelper.AnyTime{}, "persister-1",
+			testhelper.AnyTime{}, "persister-1", testhelper.AnyTime{})
+}
+
+func TestClaimResume(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	expectClaim(mock).WillReturnRows(sqlmock.NewRows([]string{"pages_staged", "pages_applied"}).AddRow(7, 5))
+
+	cp := makeCheckpoint()
+	claimed, err := NewGORMRepository(gdb).Claim(context.TODO(), testhelper.TestLogger(), cp, claimant)
+	assert.Nil(t, err, "Claim failed")
+	assert.True(t, claimed)
+	assert.Equal(t, 7, cp.PagesStaged)
+	assert.Equal(t, 5, cp.PagesApplied)
+	assert.Equal(t, "persister-1", cp.ClaimedBy)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestClaimBusy(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	expectClaim(mock).WillReturnRows(sqlmock.NewRows([]string{"pages_staged", "pages_applied"}))
+
+	claimed, err := NewGORMRepository(gdb).Claim(context.TODO(), testhelper.TestLogger(), makeCheckpoint(), claimant)
+	assert.Nil(t, err, "Claim failed")
+	assert.False(t, claimed)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestClaimError(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	kaboom := fmt.Errorf("kaboom")
+	expectClaim(mock).WillReturnError(kaboom)
+
+	claimed, err := NewGORMRepository(gdb).Claim(context.TODO(), testhelper.TestLogger(), makeCheckpoint(), claimant)
+	assert.True(t, errors.Is(err, kaboom), "Claim should have failed")
+	assert.False(t, claimed)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestStagePages(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	insertStr := `INSERT INTO "tower_persister_staged_pages" ("task_url","position","name","content") VALUES ($1,$2,$3,$4),($5,$6,$7,$8)`
+	updateStr := `UPDATE "tower_persister_checkpoints" SET "claimed_at"=$1,"pages_staged"=$2,"updated_at"=$3 WHERE task_url = $4`
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(insertStr)).
+		WithArgs(taskURL, 3, "page3.json", []byte("3"), taskURL, 4, "page4.json", []byte("4")).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(updateStr)).
+		WithArgs(testhelper.AnyTime{}, 4, testhelper.AnyTime{}, taskURL).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	cp := makeCheckpoint()
+	cp.PagesStaged = 2
+	pages := []StagedPage{
+		{TaskURL: taskURL, Position: 3, Name: "page3.json", Content: []byte("3")},
+		{TaskURL: taskURL, Position: 4, Name: "page4.json", Content: []byte("4")},
+	}
+	err := NewGORMRepository(gdb).StagePages(context.TODO(), testhelper.TestLogger(), cp, pages)
+	assert.Nil(t, err, "StagePages failed")
+	assert.Equal(t, 4, cp.PagesStaged)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestStagePagesError(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	kaboom := fmt.Errorf("kaboom")
+	mock.ExpectBegin()
+	mock.ExpectExec(`^INSERT INTO "tower_persister_staged_pages"`).WillReturnError(kaboom)
+	mock.ExpectRollback()
+
+	cp := makeCheckpoint()
+	err := NewGORMRepository(gdb).StagePages(context.TODO(), testhelper.TestLogger(), cp,
+		[]StagedPage{{TaskURL: taskURL, Position: 1, Name: "page1.json", Content: []byte("1")}})
+	assert.Equal(t, kaboom, err)
+	assert.Equal(t, 0, cp.PagesStaged, "The checkpoint should not move")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+var appliedStr = `UPDATE "tower_persister_checkpoints" SET "claimed_at"=$1,"pages_applied"=$2,"updated_at"=$3 WHERE task_url = $4 AND claimed_by = $5`
+
+func TestApplied(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	mock.ExpectExec(regexp.QuoteMeta(appliedStr)).
+		WithArgs(testhelper.AnyTime{}, 10, testhelper.AnyTime{}, taskURL, "persister-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	cp := makeCheckpoint()
+	cp.ClaimedBy = "persister-1"
+	err := NewGORMRepository(gdb).Applied(context.TODO(), testhelper.TestLogger(), cp, 10)
+	assert.Nil(t, err, "Applied failed")
+	assert.Equal(t, 10, cp.PagesApplied)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestAppliedClaimLost(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	mock.ExpectExec(regexp.QuoteMeta(appliedStr)).
+		WithArgs(testhelper.AnyTime{}, 10, testhelper.AnyTime{}, taskURL, "persister-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	cp := makeCheckpoint()
+	cp.ClaimedBy = "persister-1"
+	err := NewGORMRepository(gdb).Applied(context.TODO(), testhelper.TestLogger(), cp, 10)
+	assert.Equal(t, ErrClaimLost, err)
+	assert.Equal(t, 0, cp.PagesApplied, "The checkpoint should not move")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestExists(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	countStr := `SELECT count(1) FROM "tower_persister_checkpoints" WHERE task_url = $1`
+	mock.ExpectQuery(regexp.QuoteMeta(countStr)).WithArgs(taskURL).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	exists, err := NewGORMRepository(gdb).Exists(context.TODO(), taskURL)
+	assert.Nil(t, err, "Exists failed")
+	assert.True(t, exists)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestEachPage(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	pageStr := `SELECT * FROM "tower_persister_staged_pages" WHERE task_url = $1 AND position > $2 ORDER BY position LIMIT 20`
+	columns := []string{"task_url", "position", "name", "content"}
+	rows := sqlmock.NewRows(columns)
+	for i := 1; i <= stagedPageBatch; i++ {
+		rows.AddRow(taskURL, i, fmt.Sprintf("page%d.json", i), []byte("{}"))
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(pageStr)).WithArgs(taskURL, -1).WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta(pageStr)).WithArgs(taskURL, stagedPageBatch).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(taskURL, stagedPageBatch+1, "last.json", []byte("{}")))
+
+	var names []string
+	err := NewGORMRepository(gdb).EachPage(context.TODO(), taskURL, func(page *StagedPage) error {
+		names = append(names, page.Name)
+		return nil
+	})
+	assert.Nil(t, err, "EachPage failed")
+	assert.Equal(t, stagedPageBatch+1, len(names))
+	assert.Equal(t, "last.json", names[stagedPageBatch])
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestDelete(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	deleteStr := `DELETE FROM "tower_persister_checkpoints" WHERE task_url = $1`
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(deleteStr)).WithArgs(taskURL).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := NewGORMRepository(gdb).Delete(context.TODO(), testhelper.TestLogger(), taskURL)
+	assert.Nil(t, err, "Delete failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestUnfinished(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	unfinishedStr := `SELECT * FROM "tower_persister_checkpoints" WHERE claimed_at < $1 OR (claimed_by = $2 AND claimed_at < $3) ORDER BY created_at`
+	mock.ExpectQuery(regexp.QuoteMeta(unfinishedStr)).
+		WithArgs(testhelper.AnyTime{}, "persister-1", testhelper.AnyTime{}).
+		WillReturnRows(sqlmock.NewRows([]string{"task_url", "pages_staged"}).AddRow(taskURL, 3))
+
+	cps, err := NewGORMRepository(gdb).Unfinished(context.TODO(), claimant)
+	assert.Nil(t, err, "Unfinished failed")
+	assert.Equal(t, 1, len(cps))
+	assert.Equal(t, 3, cps[0].PagesStaged)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
@@ -5,18 +5,22 @@ import (
 	"encoding/json"
 	"reflect"
 	"strconv"
+	"time"
 
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/servicecredential"
 	"github.com/sirupsen/logrus"
 )
 
 // MockServiceCredentialRepository used for testing
 type MockServiceCredentialRepository struct {
-	DeletesCalled int
-	AddsCalled    int
-	UpdatesCalled int
-	DeleteError   error
-	AddError      error
+	DeletesCalled  int
+	AddsCalled     int
+	UpdatesCalled  int
+	DeleteError    error
+	AddError       error
+	MarkSeenCalled bool
+	base.ChangeLog
 }
 
 //DeleteUnwanted deleted unwanted objects given a list of objects to keep
@@ -48,9 +52,28 @@ func (mscr *MockServiceCredentialRepository) CreateOrUpdate(ctx context.Context,
 	return mscr.AddError
 }
 
+//BulkCreateOrUpdate objects from a page
+func (mscr *MockServiceCredentialRepository) BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*servicecredential.ServiceCredential, error) {
+	var objs []*servicecredential.ServiceCredential
+	for _, attrs := range attrsList {
+		sc := &servicecredential.ServiceCredential{TenantID: tenantID, SourceID: sourceID}
+		if err := mscr.CreateOrUpdate(ctx, logger, sc, attrs); err != nil {
+			return nil, err
+		}
+		objs = append(objs, sc)
+	}
+	return objs, nil
+}
+
 //Stats get the adds/updates/deletes
 func (mscr *MockServiceCredentialRepository) Stats() map[string]int {
-	return map[string]int{"adds": mscr.AddsCalled, "deletes": mscr.DeletesCalled, "updates": mscr.UpdatesCalled}
+	return map[string]int{"adds": mscr.AddsCalled, "deletes": mscr.DeletesCalled, "updates": mscr.UpdatesCalled, "seen": mscr.AddsCalled}
+}
+
+//MarkSeen records that last seen was updated
+func (mscr *MockServiceCredentialRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	mscr.MarkSeenCalled = true
+	return nil
 }
 
 func setServiceCredentialString(sc *servicecredential.ServiceCredential, field string, value string) {
@@ -2,18 +2,22 @@ package mocks
 
 import (
 	"context"
+	"time"
 
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/servicecredentialtype"
 	"github.com/sirupsen/logrus"
 )
 
 //MockServiceCredentialTypeRepository used for tests
 type MockServiceCredentialTypeRepository struct {
-	DeletesCalled int
-	AddsCalled    int
-	UpdatesCalled int
-	AddError      error
-	DeleteError   error
+	DeletesCalled  int
+	AddsCalled     int
+	UpdatesCalled  int
+	AddError       error
+	DeleteError    error
+	MarkSeenCalled bool
+	base.ChangeLog
 }
 
 //DeleteUnwanted objects given a list of objects to keep
@@ -32,7 +36,26 @@ func (msctr *MockServiceCredentialTypeRepository) CreateOrUpdate(ctx context.Con
 	return msctr.AddError
 }
 
+//BulkCreateOrUpdate objects from a page
+func (msctr *MockServiceCredentialTypeRepository) BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*servicecredentialtype.ServiceCredentialType, error) {
+	var objs []*servicecredentialtype.ServiceCredentialType
+	for _, attrs := range attrsList {
+		sct := &servicecredentialtype.ServiceCredentialType{TenantID: tenantID, SourceID: sourceID}
+		if err := msctr.CreateOrUpdate(ctx, logger, sct, attrs); err != nil {
+			return nil, err
+		}
+		objs = append(objs, sct)
+	}
+	return objs, nil
+}
+
 //Stats get the count for adds/updates/deletes
 func (msctr *MockServiceCredentialTypeRepository) Stats() map[string]int {
-	return map[string]int{"adds": msctr.AddsCalled, "deletes": msctr.DeletesCalled, "updates": msctr.UpdatesCalled}
+	return map[string]int{"adds": msctr.AddsCalled, "deletes": msctr.DeletesCalled, "updates": msctr.UpdatesCalled, "seen": msctr.AddsCalled}
+}
+
+//MarkSeen records that last seen was updated
+func (msctr *MockServiceCredentialTypeRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	msctr.MarkSeenCalled = true
+	return nil
 }
@@ -2,18 +2,22 @@ package mocks
 
 import (
 	"context"
+	"time"
 
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceinventory"
 	"github.com/sirupsen/logrus"
 )
 
 //MockServiceInventoryRepository used for testing
 type MockServiceInventoryRepository struct {
-	DeletesCalled int
-	AddsCalled    int
-	UpdatesCalled int
-	AddError      error
-	DeleteError   error
+	DeletesCalled  int
+	AddsCalled     int
+	UpdatesCalled  int
+	AddError       error
+	DeleteError    error
+	MarkSeenCalled bool
+	base.ChangeLog
 }
 
 //DeleteUnwanted objects given a list of objects to keep
@@ -32,7 +36,26 @@ func (msir *MockServiceInventoryRepository) CreateOrUpdate(ctx context.Context,
 	return msir.AddError
 }
 
+//BulkCreateOrUpdate objects from a page
+func (msir *MockServiceInventoryRepository) BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*serviceinventory.ServiceInventory, error) {
+	var objs []*serviceinventory.ServiceInventory
+	for _, attrs := range attrsList {
+		si := &serviceinventory.ServiceInventory{TenantID: tenantID, SourceID: sourceID}
+		if err := msir.CreateOrUpdate(ctx, logger, si, attrs); err != nil {
+			return nil, err
+		}
+		objs = append(objs, si)
+	}
+	return objs, nil
+}
+
 //Stats get the number of adds/updates/deletes
 func (msir *MockServiceInventoryRepository) Stats() map[string]int {
-	return map[string]int{"adds": msir.AddsCalled, "deletes": msir.DeletesCalled, "updates": msir.UpdatesCalled}
+	return map[string]int{"adds": msir.AddsCalled, "deletes": msir.DeletesCalled, "updates": msir.UpdatesCalled, "seen": msir.AddsCalled}
+}
+
+//MarkSeen records that last seen was updated
+func (msir *MockServiceInventoryRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	msir.MarkSeenCalled = true
+	return nil
 }
@@ -5,18 +5,22 @@ import (
 	"encoding/json"
 	"reflect"
 	"strconv"
+	"time"
 
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceofferingnode"
 	"github.com/sirupsen/logrus"
 )
 
 //MockServiceOfferingNodeRepository for testing
 type MockServiceOfferingNodeRepository struct {
-	DeletesCalled int
-	AddsCalled    int
-	UpdatesCalled int
-	AddError      error
-	DeleteError   error
+	DeletesCalled  int
+	AddsCalled     int
+	UpdatesCalled  int
+	AddError       error
+	DeleteError    error
+	MarkSeenCalled bool
+	base.ChangeLog
 }
 
 //DeleteUnwanted objects given a list of objects to keep
@@ -48,9 +52,28 @@ func (msonr *MockServiceOfferingNodeRepository) CreateOrUpdate(ctx context.Conte
 	return msonr.AddError
 }
 
+//BulkCreateOrUpdate objects from a page
+func (msonr *MockServiceOfferingNodeRepository) BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*serviceofferingnode.ServiceOfferingNode, error) {
+	var objs []*serviceofferingnode.ServiceOfferingNode
+	for _, attrs := range attrsList {
+		son := &serviceofferingnode.ServiceOfferingNode{TenantID: tenantID, SourceID: sourceID}
+		if err := msonr.CreateOrUpdate(ctx, logger, son, attrs); err != nil {
+			return nil, err
+		}
+		objs = append(objs, son)
+	}
+	return objs, nil
+}
+
 //Stats get the number of adds/updates/deletes
 func (msonr *MockServiceOfferingNodeRepository) Stats() map[string]int {
-	return map[string]int{"adds": msonr.AddsCalled, "deletes": msonr.DeletesCalled, "updates": msonr.UpdatesCalled}
+	return map[string]int{"adds": msonr.AddsCalled, "deletes": msonr.DeletesCalled, "updates": msonr.UpdatesCalled, "seen": msonr.AddsCalled}
+}
+
+//MarkSeen records that last seen was updated
+func (msonr *MockServiceOfferingNodeRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	msonr.MarkSeenCalled = true
+	return nil
 }
 
 func setServiceOfferingNodeString(son *serviceofferingnode.ServiceOfferingNode, field string, value string) {
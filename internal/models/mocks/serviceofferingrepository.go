@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"reflect"
 	"strconv"
+	"time"
 
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceoffering"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceplan"
 	"github.com/sirupsen/logrus"
@@ -13,11 +15,13 @@ import (
 
 //MockServiceOfferingRepository for testing
 type MockServiceOfferingRepository struct {
-	DeletesCalled int
-	AddsCalled    int
-	UpdatesCalled int
-	AddError      error
-	DeleteError   error
+	DeletesCalled  int
+	AddsCalled     int
+	UpdatesCalled  int
+	AddError       error
+	DeleteError    error
+	MarkSeenCalled bool
+	base.ChangeLog
 }
 
 //DeleteUnwanted objects given a list of objects to keep
@@ -49,9 +53,28 @@ func (msor *MockServiceOfferingRepository) CreateOrUpdate(ctx context.Context, l
 	return msor.AddError
 }
 
+//BulkCreateOrUpdate objects from a page
+func (msor *MockServiceOfferingRepository) BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}, spr serviceplan.Repository) ([]*serviceoffering.ServiceOffering, error) {
+	var objs []*serviceoffering.ServiceOffering
+	for _, attrs := range attrsList {
+		so := &serviceoffering.ServiceOffering{TenantID: tenantID, SourceID: sourceID}
+		if err := msor.CreateOrUpdate(ctx, logger, so, attrs, spr); err != nil {
+			return nil, err
+		}
+		objs = append(objs, so)
+	}
+	return objs, nil
+}
+
 //Stats get the number of adds/updates/deletes
 func (msor *MockServiceOfferingRepository) Stats() map[string]int {
-	return map[string]int{"adds": msor.AddsCalled, "deletes": msor.DeletesCalled, "updates": msor.UpdatesCalled}
+	return map[string]int{"adds": msor.AddsCalled, "deletes": msor.DeletesCalled, "updates": msor.UpdatesCalled, "seen": msor.AddsCalled}
+}
+
+//MarkSeen records that last seen was updated
+func (msor *MockServiceOfferingRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	msor.MarkSeenCalled = true
+	return nil
 }
 
 func setServiceOfferingString(so *serviceoffering.ServiceOffering, field string, value string) {
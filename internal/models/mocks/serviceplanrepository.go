@@ -3,18 +3,22 @@ package mocks
 import (
 	"context"
 	"io"
+	"time"
 
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceplan"
 	"github.com/sirupsen/logrus"
 )
 
 //MockServicePlanRepository for testing
 type MockServicePlanRepository struct {
-	DeletesCalled int
-	AddsCalled    int
-	UpdatesCalled int
-	AddError      error
-	DeleteError   error
+	DeletesCalled  int
+	AddsCalled     int
+	UpdatesCalled  int
+	AddError       error
+	DeleteError    error
+	MarkSeenCalled bool
+	base.ChangeLog
 }
 
 //Delete a ServicePlan
@@ -25,6 +29,14 @@ func (mspr *MockServicePlanRepository) Delete(ctx context.Context, logger *logru
 	return mspr.DeleteError
 }
 
+//DeleteBySourceRefs deletes the ServicePlans of many ServiceOfferings
+func (mspr *MockServicePlanRepository) DeleteBySourceRefs(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, sourceRefs []string) error {
+	if mspr.DeleteError == nil {
+		mspr.DeletesCalled += len(sourceRefs)
+	}
+	return mspr.DeleteError
+}
+
 //CreateOrUpdate object
 func (mspr *MockServicePlanRepository) CreateOrUpdate(ctx context.Context, logger *logrus.Entry, sp *serviceplan.ServicePlan, converter serviceplan.DDFConverter, attrs map[string]interface{}, r io.Reader) error {
 	if mspr.AddError == nil {
@@ -35,5 +47,11 @@ func (mspr *MockServicePlanRepository) CreateOrUpdate(ctx context.Context, logge
 
 //Stats get the number of adds/updates/deletes
 func (mspr *MockServicePlanRepository) Stats() map[string]int {
-	return map[string]int{"adds": mspr.AddsCalled, "deletes": mspr.DeletesCalled, "updates": mspr.UpdatesCalled}
+	return map[string]int{"adds": mspr.AddsCalled, "deletes": mspr.DeletesCalled, "updates": mspr.UpdatesCalled, "seen": mspr.AddsCalled}
+}
+
+//MarkSeen records that last seen was updated
+func (mspr *MockServicePlanRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	mspr.MarkSeenCalled = true
+	return nil
 }
@@ -0,0 +1,120 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// relayLock is the key of the transaction level advisory lock that lets one
+// persister at a time relay the events, so they are sent in the order they
+// were written. The two part key does not clash with the source locks which
+// use a single key.
+const (
+	relayLockClass = 0x54504f42
+	relayLockID    = 1
+)
+
+// addBatchSize limits the number of events sent in a single INSERT so that
+// a refresh that changes a whole catalog stays under the bind parameter
+// limit of PostgreSQL
+const addBatchSize = 1000
+
+// Event is a message waiting to be relayed to Kafka. It is written in the
+// transaction that makes the change it describes, so it is only relayed
+// if the change is committed.
+type Event struct {
+	ID        int64 `gorm:"primaryKey"`
+	Topic     string
+	EventKey  string
+	EventType string
+	Payload   datatypes.JSON
+	Headers   datatypes.JSON
+	CreatedAt time.Time
+}
+
+// TableName of the outbox
+func (Event) TableName() string {
+	return "tower_persister_outbox"
+}
+
+// PublishFunc sends an event, the event stays in the outbox when it fails
+type PublishFunc func(ctx context.Context, e Event) error
+
+// Repository interface supports operations on the outbox
+type Repository interface {
+	Add(ctx context.Context, events []Event) error
+	Relay(ctx context.Context, limit int, publish PublishFunc) (int, error)
+}
+
+type gormRepository struct {
+	db *gorm.DB
+}
+
+// NewGORMRepository creates a new repository object, events are added in
+// the transaction of the db it is given
+func NewGORMRepository(db *gorm.DB) Repository {
+	return &gormRepository{db: db}
+}
+
+// Add writes events to the outbox
+func (gr *gormRepository) Add(ctx context.Context, events []Event) error {
+	now := gr.db.NowFunc()
+	for i := range events {
+		events[i].CreatedAt = now
+	}
+	for start := 0; start < len(events); start += addBatchSize {
+		end := start + addBatchSize
+		if end > len(events) {
+			end = len(events)
+		}
+		batch := events[start:end]
+		if err := gr.db.WithContext(ctx).Create(&batch).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Relay publishes up to limit of the oldest events in order and deletes the
+// ones that were sent. It stops at the first event that can't be sent so
+// the order is kept, that event is tried again by the next Relay. Nothing
+// is relayed while another persister is relaying. An event can be sent
+// more than once if deleting it fails, consumers should expect duplicates.
+func (gr *gormRepository) Relay(ctx context.Context, limit int, publish PublishFunc) (int, error) {
+	relayed := 0
+	var publishErr error
+	err := gr.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?, ?)", relayLockClass, relayLockID).Row().Scan(&locked); err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+		var events []Event
+		if err := tx.Order("id").Limit(limit).Find(&events).Error; err != nil {
+			return err
+		}
+		var sent []int64
+		for _, e := range events {
+			if publishErr = publish(ctx, e); publishErr != nil {
+				break
+			}
+			sent = append(sent, e.ID)
+		}
+		if len(sent) > 0 {
+			if err := tx.Where("id IN ?", sent).Delete(&Event{}).Error; err != nil {
+				return err
+			}
+		}
+		relayed = len(sent)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return relayed, publishErr
+}
@@ -0,0 +1,116 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+const lockStr = `SELECT pg_try_advisory_xact_lock($1, $2)`
+const selectStr = `SELECT * FROM "tower_persister_outbox" ORDER BY id LIMIT 10`
+
+func outboxRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "topic", "event_key", "event_type", "payload"}).
+		AddRow(1, "changes", "45", "catalog.object.created", []byte(`{}`)).
+		AddRow(2, "changes", "45", "catalog.object.updated", []byte(`{}`)).
+		AddRow(3, "changes", "45", "catalog.object.deleted", []byte(`{}`))
+}
+
+func TestAdd(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	insertStr := `INSERT INTO "tower_persister_outbox" ("topic","event_key","event_type","payload","headers","created_at") VALUES ($1,$2,$3,$4,$5,$6),($7,$8,$9,$10,$11,$12) RETURNING "id"`
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(insertStr)).
+		WithArgs("changes", "45", "catalog.object.created", sqlmock.AnyArg(), sqlmock.AnyArg(), testhelper.AnyTime{},
+			"changes", "45", "catalog.object.deleted", sqlmock.AnyArg(), sqlmock.AnyArg(), testhelper.AnyTime{}).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectCommit()
+
+	events := []Event{
+		{Topic: "changes", EventKey: "45", EventType: "catalog.object.created", Payload: []byte(`{}`)},
+		{Topic: "changes", EventKey: "45", EventType: "catalog.object.deleted", Payload: []byte(`{}`)},
+	}
+	err := NewGORMRepository(gdb).Add(context.TODO(), events)
+	assert.Nil(t, err, "Add failed")
+	assert.Equal(t, int64(2), events[1].ID)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestAddNothing(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+
+	err := NewGORMRepository(gdb).Add(context.TODO(), nil)
+	assert.Nil(t, err, "Add failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestRelay(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(lockStr)).WithArgs(relayLockClass, relayLockID).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(selectStr)).WillReturnRows(outboxRows())
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "tower_persister_outbox" WHERE id IN ($1,$2,$3)`)).
+		WithArgs(1, 2, 3).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	var sent []string
+	n, err := NewGORMRepository(gdb).Relay(context.TODO(), 10, func(ctx context.Context, e Event) error {
+		sent = append(sent, e.EventType)
+		return nil
+	})
+	assert.Nil(t, err, "Relay failed")
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []string{"catalog.object.created", "catalog.object.updated", "catalog.object.deleted"}, sent)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestRelayStopsAtFailure(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(lockStr)).WithArgs(relayLockClass, relayLockID).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(selectStr)).WillReturnRows(outboxRows())
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "tower_persister_outbox" WHERE id IN ($1)`)).
+		WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	calls := 0
+	n, err := NewGORMRepository(gdb).Relay(context.TODO(), 10, func(ctx context.Context, e Event) error {
+		calls++
+		if e.ID == 2 {
+			return errors.New("kaboom")
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "kaboom")
+	assert.Equal(t, 1, n, "The events after the failed one should wait")
+	assert.Equal(t, 2, calls)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestRelayLocked(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(lockStr)).WithArgs(relayLockClass, relayLockID).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(false))
+	mock.ExpectCommit()
+
+	n, err := NewGORMRepository(gdb).Relay(context.TODO(), 10, func(ctx context.Context, e Event) error {
+		t.Fatal("Another persister is relaying")
+		return nil
+	})
+	assert.Nil(t, err, "Relay failed")
+	assert.Equal(t, 0, n)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
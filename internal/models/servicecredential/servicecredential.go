@@ -3,10 +3,9 @@ package servicecredential
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"sort"
+	"time"
 
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/sirupsen/logrus"
@@ -31,7 +30,10 @@ type ServiceCredential struct {
 type Repository interface {
 	DeleteUnwanted(ctx context.Context, logger *logrus.Entry, sc *ServiceCredential, keepSourceRefs []string) error
 	CreateOrUpdate(ctx context.Context, logger *logrus.Entry, sc *ServiceCredential, attrs map[string]interface{}) error
+	BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*ServiceCredential, error)
+	MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error
 	Stats() map[string]int
+	Changes() []base.Change
 }
 
 // gormRepository struct stores the DB handle and counters
@@ -40,6 +42,9 @@ type gormRepository struct {
 	updates int
 	creates int
 	deletes int
+	seen    int
+	seenIDs []int64
+	base.ChangeLog
 }
 
 // NewGORMRepository creates a new repository object
@@ -47,74 +52,152 @@ func NewGORMRepository(db *gorm.DB) Repository {
 	return &gormRepository{db: db}
 }
 
+// UseTransaction makes the repository work in another transaction, the
+// stats and changes so far are kept
+func (gr *gormRepository) UseTransaction(db *gorm.DB) {
+	gr.db = db
+}
+
 // Stats returns a map with the number of adds/updates/deletes
 func (gr *gormRepository) Stats() map[string]int {
-	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes}
+	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes, "seen": gr.seen}
+}
+
+// MarkSeen sets last_seen_at on all the objects that were seen in this refresh
+func (gr *gormRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	err := base.UpdateLastSeen(ctx, gr.db, "service_credentials", gr.seenIDs, seenAt)
+	if err != nil {
+		logger.Errorf("Error updating last seen for service credentials %v", err)
+		return err
+	}
+	gr.seenIDs = nil
+	return nil
 }
 
-// CreateOrUpdate a ServiceCredential Object in the Database
+// CreateOrUpdate a single ServiceCredential Object in the Database
 func (gr *gormRepository) CreateOrUpdate(ctx context.Context, logger *logrus.Entry, sc *ServiceCredential, attrs map[string]interface{}) error {
-	err := sc.makeObject(attrs)
+	objs, err := gr.BulkCreateOrUpdate(ctx, logger, sc.TenantID, sc.SourceID, []map[string]interface{}{attrs})
 	if err != nil {
-		logger.Errorf("Error creating a new service credential object %v", err)
 		return err
 	}
+	*sc = *objs[0]
+	return nil
+}
+
+// BulkCreateOrUpdate all the ServiceCredential Objects from a page, the existing
+// objects are fetched in one query and the new or changed objects are written
+// with a batched upsert
+func (gr *gormRepository) BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*ServiceCredential, error) {
+	objs := make([]*ServiceCredential, 0, len(attrsList))
+	sourceRefs := make([]string, 0, len(attrsList))
+	for i, attrs := range attrsList {
+		sc := &ServiceCredential{TenantID: tenantID, SourceID: sourceID}
+		err := sc.makeObject(attrs)
+		if err != nil {
+			logger.Errorf("Error creating a new service credential object %v", err)
+			return nil, base.NewInvalidObjectError(i, attrs, err)
+		}
+		objs = append(objs, sc)
+		sourceRefs = append(sourceRefs, sc.SourceRef)
+	}
+	if len(objs) == 0 {
+		return objs, nil
+	}
 
-	var instance ServiceCredential
-	err = gr.db.Where(&ServiceCredential{SourceID: sc.SourceID, Tower: base.Tower{SourceRef: sc.SourceRef}}).First(&instance).Error
+	var instances []ServiceCredential
+	err := gr.db.WithContext(ctx).Scopes(base.TenantScope(tenantID, sourceID)).Where("source_ref IN ?", sourceRefs).Find(&instances).Error
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		logger.Errorf("Error locating Credentials %v", err)
+		return nil, err
+	}
+	existing := make(map[string]*ServiceCredential, len(instances))
+	for i := range instances {
+		existing[instances[i].SourceRef] = &instances[i]
+	}
+
+	var upserts []*ServiceCredential
+	var pending []base.Change
+	creates, updates := 0, 0
+	for _, sc := range objs {
+		instance, ok := existing[sc.SourceRef]
+		if !ok {
 			logger.Infof("Creating a new Credential %s", sc.SourceRef)
-			if result := gr.db.Create(sc); result.Error != nil {
-				return fmt.Errorf("Error creating service credential : %v", result.Error.Error())
-			}
-			gr.creates++
-		} else {
-			logger.Errorf("Error locating Credential %s %v", sc.SourceRef, err)
-			return err
+			upserts = append(upserts, sc)
+			creates++
+			pending = append(pending, base.Created(sc.attributes()))
+			continue
+		}
+		changed, err := base.DetectChanges(instance.attributes(), sc.attributes())
+		if err != nil {
+			logger.Errorf("Error comparing Credential %s %v", sc.SourceRef, err)
+			return nil, err
 		}
-	} else {
-		logger.Infof("Service Credential %s exists in DB with ID %d", sc.SourceRef, instance.ID)
-		sc.ID = instance.ID // Get the Existing ID for the object
-		instance.Description = sc.Description
-		instance.Name = sc.Name
-		instance.ServiceCredentialTypeSourceRef = sc.ServiceCredentialTypeSourceRef
-
-		if instance.SourceUpdatedAt != sc.SourceUpdatedAt {
-			instance.SourceUpdatedAt = sc.SourceUpdatedAt
-			logger.Infof("Saving Service Credential source_ref %s", sc.SourceRef)
-			err := gr.db.Save(&instance).Error
+		if len(changed) > 0 {
+			logger.Infof("Updating Credential %s exists in DB with ID %d changed fields %v", sc.SourceRef, instance.ID, changed)
+			upserts = append(upserts, sc)
+			updates++
+			change, err := base.Updated(changed, instance.attributes(), sc.attributes())
 			if err != nil {
-				logger.Errorf("Error Updating Service Credential  source_ref %s", sc.SourceRef)
-				return err
+				logger.Errorf("Error comparing Credential %s %v", sc.SourceRef, err)
+				return nil, err
+			}
+			pending = append(pending, change)
+		} else {
+			logger.Infof("Credential %s is in sync with Tower", sc.SourceRef)
+			sc.ID = instance.ID // Get the Existing ID for the object
+			if refined := instance.attributes().Refined(sc.attributes()); len(refined) > 0 {
+				err := base.RefineTimestamps(ctx, gr.db, "service_credentials", instance.ID, sc.attributes().Values(refined))
+				if err != nil {
+					logger.Errorf("Error refining timestamps of Credential %s %v", sc.SourceRef, err)
+					return nil, err
+				}
 			}
-			gr.updates++
 		}
 	}
-	return nil
+
+	if err := base.BulkUpsert(ctx, gr.db, upserts, (&ServiceCredential{}).attributes().Columns()); err != nil {
+		return nil, fmt.Errorf("Error saving service credentials : %v", err.Error())
+	}
+	gr.creates += creates
+	gr.updates += updates
+	for i, obj := range upserts {
+		pending[i].ID, pending[i].SourceRef = obj.ID, obj.SourceRef
+		gr.Record(pending[i])
+	}
+	for _, sc := range objs {
+		gr.seen++
+		gr.seenIDs = append(gr.seenIDs, sc.ID)
+	}
+	return objs, nil
 }
 
 // DeleteUnwanted deletes any objects not listed in the keepSourceRefs
 // This is used to delete ServiceCredentials that exist in our database but have been
 // deleted from the Ansible Tower
 func (gr *gormRepository) DeleteUnwanted(ctx context.Context, logger *logrus.Entry, sc *ServiceCredential, keepSourceRefs []string) error {
-	results, err := sc.getDeleteIDs(ctx, logger, gr.db, keepSourceRefs)
+	results, err := base.DeleteUnwanted(ctx, gr.db, "service_credentials", sc.TenantID, sc.SourceID, keepSourceRefs)
 	if err != nil {
-		logger.Errorf("Error getting Delete IDs for service credentials %v", err)
+		logger.Errorf("Error deleting Service Credentials %v", err)
 		return err
 	}
 	for _, res := range results {
-		logger.Infof("Attempting to delete ServiceCredential with ID %d Source ref %s", res.ID, res.SourceRef)
-		result := gr.db.Delete(&ServiceCredential{SourceID: sc.SourceID, TenantID: sc.TenantID, Tower: base.Tower{SourceRef: res.SourceRef}}, res.ID)
-		if result.Error != nil {
-			logger.Errorf("Error deleting Service Credential %d %s %v", res.ID, res.SourceRef, result.Error)
-			return result.Error
-		}
-		gr.deletes++
+		gr.Record(base.Change{Action: base.ActionDeleted, ID: res.ID, SourceRef: res.SourceRef})
+		logger.Infof("Deleted ServiceCredential with ID %d Source ref %s", res.ID, res.SourceRef)
 	}
+	gr.deletes += len(results)
 	return nil
 }
 
+// attributes returns the columns that we compare to detect changes
+func (sc *ServiceCredential) attributes() base.Attributes {
+	return base.Attributes{
+		"name":              sc.Name,
+		"description":       sc.Description,
+		"source_created_at": sc.SourceCreatedAt,
+		"source_updated_at": sc.SourceUpdatedAt,
+	}
+}
+
 func (sc *ServiceCredential) validateAttributes(attrs map[string]interface{}) error {
 	requiredAttrs := []string{"created",
 		"modified",
@@ -136,34 +219,15 @@ func (sc *ServiceCredential) makeObject(attrs map[string]interface{}) error {
 		return err
 	}
 
-	sc.SourceCreatedAt, err = base.TowerTime(attrs["created"].(string))
-	if err != nil {
-		return err
-	}
-	sc.SourceUpdatedAt, err = base.TowerTime(attrs["modified"].(string))
-	if err != nil {
+	fields := base.NewFieldReader(attrs)
+	sc.SourceCreatedAt = fields.Time("created")
+	sc.SourceUpdatedAt = fields.Time("modified")
+	sc.Description = fields.String("description")
+	sc.Name = fields.String("name")
+	sc.SourceRef = fields.ID()
+	if err := fields.Err(); err != nil {
 		return err
 	}
-	sc.Description = attrs["description"].(string)
-	sc.Name = attrs["name"].(string)
-	sc.SourceRef = attrs["id"].(json.Number).String()
-	sc.ServiceCredentialTypeSourceRef = attrs["credential_type"].(json.Number).String()
+	sc.ServiceCredentialTypeSourceRef = base.ReferenceID(attrs, "credential_type", "credential_types")
 	return nil
 }
-
-func (sc *ServiceCredential) getDeleteIDs(ctx context.Context, logger *logrus.Entry, tx *gorm.DB, keepSourceRefs []string) ([]base.ResultIDRef, error) {
-	var result []base.ResultIDRef
-	var deleteResultIDRef []base.ResultIDRef
-	sort.Strings(keepSourceRefs)
-	length := len(keepSourceRefs)
-	if err := tx.Table("service_credentials").Select("id, source_ref").Where("source_id = ? AND archived_at IS NULL", sc.SourceID).Scan(&result).Error; err != nil {
-		logger.Errorf("Error fetching ServiceCredential %v", err)
-		return deleteResultIDRef, err
-	}
-	for _, res := range result {
-		if !base.SourceRefExists(res.SourceRef, keepSourceRefs, length) {
-			deleteResultIDRef = append(deleteResultIDRef, res)
-		}
-	}
-	return deleteResultIDRef, nil
-}
@@ -3,6 +3,7 @@ package servicecredential
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -13,7 +14,6 @@ import (
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/gorm"
 )
 
 var objectType = "credential"
@@ -28,6 +28,11 @@ var defaultAttrs = map[string]interface{}{
 	"credential_type": json.Number("14"),
 }
 
+// upsertRe matches the batched INSERT ... ON CONFLICT used for creates and updates
+// its RETURNING clause lists the id and the nullable foreign keys in no fixed
+// order, so mocked rows carry the id in every column
+var upsertRe = `^INSERT INTO "service_credentials" .* ON CONFLICT \("tenant_id","source_id","source_ref"\) DO UPDATE SET`
+
 var columns = []string{"id", "tenant_id", "source_id", "source_ref", "name", "type_name",
 	"description", "source_created_at", "source_updated_at", "created_at", "updated_at",
 	"service_credential_type_id"}
@@ -82,10 +87,10 @@ func TestCreateErrorLocatingRecord(t *testing.T) {
 	scr := NewGORMRepository(gdb)
 	srcRef := "4"
 	sc := ServiceCredential{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_credentials" WHERE "service_credentials"."source_ref" = $1 AND "service_credentials"."source_id" = $2 AND "service_credentials"."archived_at" IS NULL ORDER BY "service_credentials"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credentials" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credentials"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnError(fmt.Errorf("kaboom"))
 
 	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sc, defaultAttrs)
@@ -99,11 +104,11 @@ func TestCreateError(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	srcRef := "4"
-	str := `SELECT * FROM "service_credentials" WHERE "service_credentials"."source_ref" = $1 AND "service_credentials"."source_id" = $2 AND "service_credentials"."archived_at" IS NULL ORDER BY "service_credentials"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credentials" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credentials"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(gorm.ErrRecordNotFound)
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
 	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "service_credentials"`)).
 		WithArgs(testhelper.AnyTime{}, testhelper.AnyTime{}, nil, srcRef, testhelper.AnyTime{}, testhelper.AnyTime{}, sqlmock.AnyArg(), "demo", sqlmock.AnyArg(), "openshift", tenantID, 1).
 		WillReturnError(fmt.Errorf("kaboom"))
@@ -122,11 +127,11 @@ func TestCreate(t *testing.T) {
 	srcRef := "4"
 	newID := int64(78)
 	sc := ServiceCredential{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_credentials" WHERE "service_credentials"."source_ref" = $1 AND "service_credentials"."source_id" = $2 AND "service_credentials"."archived_at" IS NULL ORDER BY "service_credentials"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credentials" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credentials"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(gorm.ErrRecordNotFound)
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
 	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "service_credentials"`)).
 		WithArgs(testhelper.AnyTime{}, testhelper.AnyTime{}, nil, srcRef, testhelper.AnyTime{}, testhelper.AnyTime{}, sqlmock.AnyArg(), "demo", sqlmock.AnyArg(), "openshift", tenantID, 1).
 		WillReturnRows(sqlmock.NewRows([]string{"service_credential_type_id", "id"}).AddRow(5, newID))
@@ -155,11 +160,11 @@ func TestCreateOrUpdateError(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sc := ServiceCredential{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_credentials" WHERE "service_credentials"."source_ref" = $1 AND "service_credentials"."source_id" = $2 AND "service_credentials"."archived_at" IS NULL ORDER BY "service_credentials"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credentials" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credentials"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnError(fmt.Errorf("kaboom"))
+	mock.ExpectQuery(upsertRe).WillReturnError(fmt.Errorf("kaboom"))
 
 	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sc, defaultAttrs)
 
@@ -176,11 +181,11 @@ func TestCreateOrUpdate(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sc := ServiceCredential{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_credentials" WHERE "service_credentials"."source_ref" = $1 AND "service_credentials"."source_id" = $2 AND "service_credentials"."archived_at" IS NULL ORDER BY "service_credentials"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credentials" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credentials"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(upsertRe).WillReturnRows(sqlmock.NewRows([]string{"id", "service_credential_type_id"}).AddRow(id, id))
 	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sc, defaultAttrs)
 
 	assert.Nil(t, err, "CreateOrUpdate failed")
@@ -198,14 +203,15 @@ func TestNoChange(t *testing.T) {
 	id := int64(1)
 	srcRef := "4"
 	mt, _ := base.TowerTime(modifiedDateTime)
+	ct, _ := base.TowerTime(defaultAttrs["created"].(string))
 	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, srcRef, "Test", "", "Test Description", time.Now(), mt, time.Now(), time.Now(), nil)
+		AddRow(id, tenantID, sourceID, srcRef, "demo", "", "openshift", ct, mt, time.Now(), time.Now(), nil)
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sc := ServiceCredential{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_credentials" WHERE "service_credentials"."source_ref" = $1 AND "service_credentials"."source_id" = $2 AND "service_credentials"."archived_at" IS NULL ORDER BY "service_credentials"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credentials" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credentials"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
 	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sc, defaultAttrs)
 
@@ -217,23 +223,23 @@ func TestNoChange(t *testing.T) {
 	assert.Equal(t, stats["deletes"], 0)
 }
 
+// archiveStr is the set-based soft delete of the objects that are gone from Tower
+var archiveStr = `UPDATE service_credentials SET archived_at = $1 WHERE tenant_id = $2 AND source_id = $3 AND archived_at IS NULL AND NOT (source_ref = ANY ($4::text[])) RETURNING id, source_ref`
+
+var archiveColumns = []string{"id", "source_ref"}
+
 func TestDeleteUnwantedMissing(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	id := int64(1)
-	sourceRef := "2"
-
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, sourceRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), time.Now(), nil)
+	srcRef := "2"
 
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sc := ServiceCredential{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_credentials" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-	sourceRefs := []string{sourceRef}
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"2"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns))
+	sourceRefs := []string{srcRef}
 	err := scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &sc, sourceRefs)
 
 	assert.Nil(t, err, "DeleteUnwantedMissing failed")
@@ -248,23 +254,14 @@ func TestDeleteUnwanted(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
 	id := int64(1)
-	sourceRef := "2"
-
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, sourceRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), time.Now(), nil)
+	srcRef := "2"
 
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sc := ServiceCredential{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_credentials" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	markAsArchived := `UPDATE "service_credentials" SET "archived_at"=$1 WHERE "service_credentials"."id" = $2 AND "service_credentials"."archived_at" IS NULL`
-	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, sourceID).
-		WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns).AddRow(id, srcRef))
 
 	keep := "4"
 	sourceRefs := []string{keep}
@@ -277,50 +274,41 @@ func TestDeleteUnwanted(t *testing.T) {
 	assert.Equal(t, stats["deletes"], 1)
 }
 
-func TestDeleteUnwantedError(t *testing.T) {
+func TestDeleteUnwantedKeepList(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
 
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sc := ServiceCredential{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_credentials" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnError(fmt.Errorf("kaboom"))
+	// The whole keep list is sent as a single array parameter
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4","5","6"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns).AddRow(int64(1), "2").AddRow(int64(3), "3"))
 
-	keep := "4"
-	sourceRefs := []string{keep}
+	sourceRefs := []string{"4", "5", "6"}
 	err := scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &sc, sourceRefs)
-	checkErrors(t, err, mock, scr, "DeleteUnwantedError", "kaboom")
+	assert.Nil(t, err, "DeleteUnwanted failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteUnwanted")
+	stats := scr.Stats()
+	assert.Equal(t, stats["deletes"], 2)
 }
 
-func TestDeleteUnwantedErrorInDelete(t *testing.T) {
+func TestDeleteUnwantedError(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	id := int64(1)
-	sourceRef := "2"
-
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, sourceRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), time.Now(), nil)
 
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sc := ServiceCredential{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_credentials" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	markAsArchived := `UPDATE "service_credentials" SET "archived_at"=$1 WHERE "service_credentials"."id" = $2 AND "service_credentials"."archived_at" IS NULL`
-	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, sourceID).
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4"}`).
 		WillReturnError(fmt.Errorf("kaboom"))
 
 	keep := "4"
 	sourceRefs := []string{keep}
 	err := scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &sc, sourceRefs)
-	checkErrors(t, err, mock, scr, "DeleteUnwantedErrorInDelete", "kaboom")
+	checkErrors(t, err, mock, scr, "DeleteUnwantedError", "kaboom")
 }
 
 func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, scr Repository, where string, errMessage string) {
@@ -336,3 +324,33 @@ func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, scr Repository,
 	assert.Equal(t, stats["updates"], 0)
 	assert.Equal(t, stats["deletes"], 0)
 }
+
+func TestMakeObjectInvalidFields(t *testing.T) {
+	cases := []struct {
+		field string
+		value interface{}
+	}{
+		{"id", nil},
+		{"id", "4"},
+		{"id", json.Number("4.5")},
+		{"created", nil},
+		{"modified", json.Number("1")},
+		{"name", nil},
+		{"name", json.Number("1")},
+		{"description", nil},
+		{"description", false},
+	}
+	for _, tc := range cases {
+		attrs := make(map[string]interface{})
+		for k, v := range defaultAttrs {
+			attrs[k] = v
+		}
+		attrs[tc.field] = tc.value
+		sc := ServiceCredential{}
+		err := sc.makeObject(attrs)
+		var fieldErr *base.FieldError
+		if assert.True(t, errors.As(err, &fieldErr), "%s %v should be invalid", tc.field, tc.value) {
+			assert.Equal(t, tc.field, fieldErr.Field)
+		}
+	}
+}
@@ -2,10 +2,9 @@ package servicecredentialtype
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"sort"
+	"time"
 
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/sirupsen/logrus"
@@ -29,7 +28,10 @@ type ServiceCredentialType struct {
 type Repository interface {
 	DeleteUnwanted(ctx context.Context, logger *logrus.Entry, sct *ServiceCredentialType, keepSourceRefs []string) error
 	CreateOrUpdate(ctx context.Context, logger *logrus.Entry, sct *ServiceCredentialType, attrs map[string]interface{}) error
+	BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*ServiceCredentialType, error)
+	MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error
 	Stats() map[string]int
+	Changes() []base.Change
 }
 
 // gormRepository struct stores the DB handle and counters
@@ -38,6 +40,9 @@ type gormRepository struct {
 	updates int
 	creates int
 	deletes int
+	seen    int
+	seenIDs []int64
+	base.ChangeLog
 }
 
 // NewGORMRepository creates a new repository object
@@ -45,76 +50,154 @@ func NewGORMRepository(db *gorm.DB) Repository {
 	return &gormRepository{db: db}
 }
 
+// UseTransaction makes the repository work in another transaction, the
+// stats and changes so far are kept
+func (gr *gormRepository) UseTransaction(db *gorm.DB) {
+	gr.db = db
+}
+
 // Stats returns a map with the number of adds/updates/deletes
 func (gr *gormRepository) Stats() map[string]int {
-	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes}
+	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes, "seen": gr.seen}
 }
 
-// CreateOrUpdate a ServiceCredentialType Object in the Database
+// MarkSeen sets last_seen_at on all the objects that were seen in this refresh
+func (gr *gormRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	err := base.UpdateLastSeen(ctx, gr.db, "service_credential_types", gr.seenIDs, seenAt)
+	if err != nil {
+		logger.Errorf("Error updating last seen for service credential types %v", err)
+		return err
+	}
+	gr.seenIDs = nil
+	return nil
+}
+
+// CreateOrUpdate a single ServiceCredentialType Object in the Database
 func (gr *gormRepository) CreateOrUpdate(ctx context.Context, logger *logrus.Entry, sct *ServiceCredentialType, attrs map[string]interface{}) error {
-	err := sct.makeObject(attrs)
+	objs, err := gr.BulkCreateOrUpdate(ctx, logger, sct.TenantID, sct.SourceID, []map[string]interface{}{attrs})
 	if err != nil {
-		logger.Errorf("Error creating a new credential type object %v", err)
 		return err
 	}
+	*sct = *objs[0]
+	return nil
+}
 
-	var instance ServiceCredentialType
+// BulkCreateOrUpdate all the ServiceCredentialType Objects from a page, the existing
+// objects are fetched in one query and the new or changed objects are written
+// with a batched upsert
+func (gr *gormRepository) BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*ServiceCredentialType, error) {
+	objs := make([]*ServiceCredentialType, 0, len(attrsList))
+	sourceRefs := make([]string, 0, len(attrsList))
+	for i, attrs := range attrsList {
+		sct := &ServiceCredentialType{TenantID: tenantID, SourceID: sourceID}
+		err := sct.makeObject(attrs)
+		if err != nil {
+			logger.Errorf("Error creating a new credential type object %v", err)
+			return nil, base.NewInvalidObjectError(i, attrs, err)
+		}
+		objs = append(objs, sct)
+		sourceRefs = append(sourceRefs, sct.SourceRef)
+	}
+	if len(objs) == 0 {
+		return objs, nil
+	}
 
-	err = gr.db.Where(&ServiceCredentialType{SourceID: sct.SourceID, Tower: base.Tower{SourceRef: sct.SourceRef}}).First(&instance).Error
+	var instances []ServiceCredentialType
+	err := gr.db.WithContext(ctx).Scopes(base.TenantScope(tenantID, sourceID)).Where("source_ref IN ?", sourceRefs).Find(&instances).Error
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		logger.Errorf("Error locating Credential Types %v", err)
+		return nil, err
+	}
+	existing := make(map[string]*ServiceCredentialType, len(instances))
+	for i := range instances {
+		existing[instances[i].SourceRef] = &instances[i]
+	}
+
+	var upserts []*ServiceCredentialType
+	var pending []base.Change
+	creates, updates := 0, 0
+	for _, sct := range objs {
+		instance, ok := existing[sct.SourceRef]
+		if !ok {
 			logger.Infof("Creating a new Credential Type %s", sct.SourceRef)
-			if result := gr.db.Create(sct); result.Error != nil {
-				return fmt.Errorf("Error creating service credential type : %v", result.Error.Error())
-			}
-			gr.creates++
-		} else {
-			logger.Errorf("Error locating Credential Type %s %v", sct.SourceRef, err)
-			return err
+			upserts = append(upserts, sct)
+			creates++
+			pending = append(pending, base.Created(sct.attributes()))
+			continue
 		}
-
-	} else {
-		logger.Infof("Service Credential Type %s exists in DB with ID %d", sct.SourceRef, instance.ID)
-		sct.ID = instance.ID // Get the Existing ID for the object
-		instance.Description = sct.Description
-		instance.Name = sct.Name
-		instance.Namespace = sct.Namespace
-		instance.Kind = sct.Kind
-
-		if instance.SourceUpdatedAt != sct.SourceUpdatedAt {
-			instance.SourceUpdatedAt = sct.SourceUpdatedAt
-			logger.Infof("Saving Service Credential Type source_ref %s", sct.SourceRef)
-			err := gr.db.Save(&instance).Error
+		changed, err := base.DetectChanges(instance.attributes(), sct.attributes())
+		if err != nil {
+			logger.Errorf("Error comparing Credential Type %s %v", sct.SourceRef, err)
+			return nil, err
+		}
+		if len(changed) > 0 {
+			logger.Infof("Updating Credential Type %s exists in DB with ID %d changed fields %v", sct.SourceRef, instance.ID, changed)
+			upserts = append(upserts, sct)
+			updates++
+			change, err := base.Updated(changed, instance.attributes(), sct.attributes())
 			if err != nil {
-				logger.Errorf("Error Updating Service Credential Type source_ref %s", sct.SourceRef)
-				return err
+				logger.Errorf("Error comparing Credential Type %s %v", sct.SourceRef, err)
+				return nil, err
+			}
+			pending = append(pending, change)
+		} else {
+			logger.Infof("Credential Type %s is in sync with Tower", sct.SourceRef)
+			sct.ID = instance.ID // Get the Existing ID for the object
+			if refined := instance.attributes().Refined(sct.attributes()); len(refined) > 0 {
+				err := base.RefineTimestamps(ctx, gr.db, "service_credential_types", instance.ID, sct.attributes().Values(refined))
+				if err != nil {
+					logger.Errorf("Error refining timestamps of Credential Type %s %v", sct.SourceRef, err)
+					return nil, err
+				}
 			}
-			gr.updates++
 		}
 	}
-	return nil
+
+	if err := base.BulkUpsert(ctx, gr.db, upserts, (&ServiceCredentialType{}).attributes().Columns()); err != nil {
+		return nil, fmt.Errorf("Error saving service credential types : %v", err.Error())
+	}
+	gr.creates += creates
+	gr.updates += updates
+	for i, obj := range upserts {
+		pending[i].ID, pending[i].SourceRef = obj.ID, obj.SourceRef
+		gr.Record(pending[i])
+	}
+	for _, sct := range objs {
+		gr.seen++
+		gr.seenIDs = append(gr.seenIDs, sct.ID)
+	}
+	return objs, nil
 }
 
 // DeleteUnwanted deletes any objects not listed in the keepSourceRefs
 // This is used to delete ServiceCredentialTypes that exist in our database but have been
 // deleted from the Ansible Tower
 func (gr *gormRepository) DeleteUnwanted(ctx context.Context, logger *logrus.Entry, sct *ServiceCredentialType, keepSourceRefs []string) error {
-	results, err := sct.getDeleteIDs(ctx, logger, gr.db, keepSourceRefs)
+	results, err := base.DeleteUnwanted(ctx, gr.db, "service_credential_types", sct.TenantID, sct.SourceID, keepSourceRefs)
 	if err != nil {
-		logger.Errorf("Error getting Delete IDs for service credential types %v", err)
+		logger.Errorf("Error deleting Service Credential Types %v", err)
 		return err
 	}
 	for _, res := range results {
-		logger.Infof("Attempting to delete ServiceCredentialType with ID %d Source ref %s", res.ID, res.SourceRef)
-		result := gr.db.Delete(&ServiceCredentialType{SourceID: sct.SourceID, TenantID: sct.TenantID, Tower: base.Tower{SourceRef: res.SourceRef}}, res.ID)
-		if result.Error != nil {
-			logger.Errorf("Error deleting Service CredentialType %d %s %v", res.ID, res.SourceRef, result.Error)
-			return result.Error
-		}
-		gr.deletes++
+		gr.Record(base.Change{Action: base.ActionDeleted, ID: res.ID, SourceRef: res.SourceRef})
+		logger.Infof("Deleted ServiceCredentialType with ID %d Source ref %s", res.ID, res.SourceRef)
 	}
+	gr.deletes += len(results)
 	return nil
 }
+
+// attributes returns the columns that we compare to detect changes
+func (sct *ServiceCredentialType) attributes() base.Attributes {
+	return base.Attributes{
+		"name":              sct.Name,
+		"description":       sct.Description,
+		"kind":              sct.Kind,
+		"namespace":         sct.Namespace,
+		"source_created_at": sct.SourceCreatedAt,
+		"source_updated_at": sct.SourceUpdatedAt,
+	}
+}
+
 func (sct *ServiceCredentialType) validateAttributes(attrs map[string]interface{}) error {
 	requiredAttrs := []string{"kind",
 		"namespace",
@@ -137,35 +220,13 @@ func (sct *ServiceCredentialType) makeObject(attrs map[string]interface{}) error
 		return err
 	}
 
-	sct.SourceCreatedAt, err = base.TowerTime(attrs["created"].(string))
-	if err != nil {
-		return err
-	}
-	sct.SourceUpdatedAt, err = base.TowerTime(attrs["modified"].(string))
-	if err != nil {
-		return err
-	}
-	sct.Description = attrs["description"].(string)
-	sct.Kind = attrs["kind"].(string)
+	fields := base.NewFieldReader(attrs)
+	sct.SourceCreatedAt = fields.Time("created")
+	sct.SourceUpdatedAt = fields.Time("modified")
+	sct.Description = fields.String("description")
+	sct.Kind = fields.String("kind")
 	sct.Namespace = base.ToSafeString(attrs["namespace"])
-	sct.Name = attrs["name"].(string)
-	sct.SourceRef = attrs["id"].(json.Number).String()
-	return nil
-}
-
-func (sct *ServiceCredentialType) getDeleteIDs(ctx context.Context, logger *logrus.Entry, tx *gorm.DB, keepSourceRefs []string) ([]base.ResultIDRef, error) {
-	var result []base.ResultIDRef
-	var deleteResultIDRef []base.ResultIDRef
-	sort.Strings(keepSourceRefs)
-	length := len(keepSourceRefs)
-	if err := tx.Table("service_credential_types").Select("id, source_ref").Where("source_id = ? AND archived_at IS NULL", sct.SourceID).Scan(&result).Error; err != nil {
-		logger.Errorf("Error fetching ServiceCredentialType %v", err)
-		return deleteResultIDRef, err
-	}
-	for _, res := range result {
-		if !base.SourceRefExists(res.SourceRef, keepSourceRefs, length) {
-			deleteResultIDRef = append(deleteResultIDRef, res)
-		}
-	}
-	return deleteResultIDRef, nil
+	sct.Name = fields.String("name")
+	sct.SourceRef = fields.ID()
+	return fields.Err()
 }
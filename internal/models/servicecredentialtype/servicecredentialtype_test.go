@@ -3,6 +3,7 @@ package servicecredentialtype
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -13,7 +14,6 @@ import (
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/gorm"
 )
 
 var objectType = "credential_type"
@@ -29,6 +29,9 @@ var defaultAttrs = map[string]interface{}{
 	"kind":        "test",
 }
 
+// upsertRe matches the batched INSERT ... ON CONFLICT used for creates and updates
+var upsertRe = `^INSERT INTO "service_credential_types" .* ON CONFLICT \("tenant_id","source_id","source_ref"\) DO UPDATE SET`
+
 var columns = []string{"id", "created_at", "updated_at", "archived_at", "source_ref",
 	"source_created_at", "source_updated_at", "last_seen_at", "name", "description", "kind",
 	"namespace", "tenant_id", "source_id"}
@@ -96,11 +99,11 @@ func TestCreateNilNamespace(t *testing.T) {
 	srcRef := "4"
 	newID := int64(78)
 	sct := ServiceCredentialType{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_credential_types" WHERE "service_credential_types"."source_ref" = $1 AND "service_credential_types"."source_id" = $2 AND "service_credential_types"."archived_at" IS NULL ORDER BY "service_credential_types"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credential_types" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credential_types"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(gorm.ErrRecordNotFound)
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
 	insertStr := `INSERT INTO "service_credential_types" ("created_at","updated_at","archived_at","source_ref","source_created_at","source_updated_at","last_seen_at","name","description","kind","namespace","tenant_id","source_id") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)`
 
 	mock.ExpectQuery(regexp.QuoteMeta(insertStr)).
@@ -128,10 +131,10 @@ func TestCreateErrorLocatingRecord(t *testing.T) {
 	scr := NewGORMRepository(gdb)
 	srcRef := "4"
 	sct := ServiceCredentialType{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_credential_types" WHERE "service_credential_types"."source_ref" = $1 AND "service_credential_types"."source_id" = $2 AND "service_credential_types"."archived_at" IS NULL ORDER BY "service_credential_types"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credential_types" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credential_types"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnError(fmt.Errorf("kaboom"))
 
 	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sct, defaultAttrs)
@@ -145,11 +148,11 @@ func TestCreateError(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	srcRef := "4"
-	str := `SELECT * FROM "service_credential_types" WHERE "service_credential_types"."source_ref" = $1 AND "service_credential_types"."source_id" = $2 AND "service_credential_types"."archived_at" IS NULL ORDER BY "service_credential_types"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credential_types" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credential_types"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(gorm.ErrRecordNotFound)
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
 	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "service_credential_types"`)).
 		WithArgs(testhelper.AnyTime{}, testhelper.AnyTime{}, nil, srcRef, testhelper.AnyTime{}, testhelper.AnyTime{}, sqlmock.AnyArg(), defaultAttrs["name"], defaultAttrs["description"], defaultAttrs["kind"], defaultAttrs["namespace"], tenantID, sourceID).
 		WillReturnError(fmt.Errorf("kaboom"))
@@ -168,11 +171,11 @@ func TestCreate(t *testing.T) {
 	srcRef := "4"
 	newID := int64(78)
 	sct := ServiceCredentialType{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_credential_types" WHERE "service_credential_types"."source_ref" = $1 AND "service_credential_types"."source_id" = $2 AND "service_credential_types"."archived_at" IS NULL ORDER BY "service_credential_types"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credential_types" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credential_types"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(gorm.ErrRecordNotFound)
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
 	insertStr := `INSERT INTO "service_credential_types" ("created_at","updated_at","archived_at","source_ref","source_created_at","source_updated_at","last_seen_at","name","description","kind","namespace","tenant_id","source_id") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)`
 
 	mock.ExpectQuery(regexp.QuoteMeta(insertStr)).
@@ -203,11 +206,11 @@ func TestCreateOrUpdateError(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sct := ServiceCredentialType{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_credential_types" WHERE "service_credential_types"."source_ref" = $1 AND "service_credential_types"."source_id" = $2 AND "service_credential_types"."archived_at" IS NULL ORDER BY "service_credential_types"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credential_types" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credential_types"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnError(fmt.Errorf("kaboom"))
+	mock.ExpectQuery(upsertRe).WillReturnError(fmt.Errorf("kaboom"))
 
 	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sct, defaultAttrs)
 
@@ -224,11 +227,11 @@ func TestCreateOrUpdate(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sct := ServiceCredentialType{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_credential_types" WHERE "service_credential_types"."source_ref" = $1 AND "service_credential_types"."source_id" = $2 AND "service_credential_types"."archived_at" IS NULL ORDER BY "service_credential_types"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credential_types" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credential_types"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(upsertRe).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
 	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sct, defaultAttrs)
 
 	assert.Nil(t, err, "CreateOrUpdate failed")
@@ -246,14 +249,15 @@ func TestNoChange(t *testing.T) {
 	id := int64(1)
 	srcRef := "4"
 	mt, _ := base.TowerTime(modifiedDateTime)
+	ct, _ := base.TowerTime(defaultAttrs["created"].(string))
 	rows := sqlmock.NewRows(columns).
-		AddRow(id, time.Now(), time.Now(), nil, srcRef, time.Now(), mt, time.Now(), "test_name", "test_desc", "test_kind", "test_ns", tenantID, sourceID)
+		AddRow(id, time.Now(), time.Now(), nil, srcRef, ct, mt, time.Now(), "demo", "openshift", "test", "demo", tenantID, sourceID)
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sct := ServiceCredentialType{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_credential_types" WHERE "service_credential_types"."source_ref" = $1 AND "service_credential_types"."source_id" = $2 AND "service_credential_types"."archived_at" IS NULL ORDER BY "service_credential_types"."id" LIMIT 1`
+	str := `SELECT * FROM "service_credential_types" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credential_types"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
 	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sct, defaultAttrs)
 
@@ -265,22 +269,53 @@ func TestNoChange(t *testing.T) {
 	assert.Equal(t, stats["deletes"], 0)
 }
 
-func TestDeleteUnwantedMissing(t *testing.T) {
+func TestNoChangeRefinesTimestamps(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
 	id := int64(1)
-	srcRef := "2"
-
+	srcRef := "4"
+	mt, _ := base.TowerTime(modifiedDateTime)
+	ct, _ := base.TowerTime(defaultAttrs["created"].(string))
+	// Stored by an older persister that dropped the sub seconds
 	rows := sqlmock.NewRows(columns).
-		AddRow(id, time.Now(), time.Now(), nil, srcRef, time.Now(), time.Now(), time.Now(), "test_name", "test_desc", "test_kind", "test_ns", tenantID, sourceID)
-
+		AddRow(id, time.Now(), time.Now(), nil, srcRef, ct, mt.Truncate(time.Second), time.Now(), "demo", "openshift", "test", "demo", tenantID, sourceID)
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sct := ServiceCredentialType{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_credential_types" WHERE source_id = $1 AND archived_at IS NULL`
+	str := `SELECT * FROM "service_credential_types" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_credential_types"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "service_credential_types" SET "source_updated_at"=$1 WHERE id = $2`)).
+		WithArgs(mt, id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sct, defaultAttrs)
+
+	assert.Nil(t, err, "CreateOrUpdate failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	stats := scr.Stats()
+	assert.Equal(t, stats["updates"], 0)
+	assert.Empty(t, scr.Changes(), "Refining a timestamp is not a change")
+}
+
+// archiveStr is the set-based soft delete of the objects that are gone from Tower
+var archiveStr = `UPDATE service_credential_types SET archived_at = $1 WHERE tenant_id = $2 AND source_id = $3 AND archived_at IS NULL AND NOT (source_ref = ANY ($4::text[])) RETURNING id, source_ref`
+
+var archiveColumns = []string{"id", "source_ref"}
+
+func TestDeleteUnwantedMissing(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	srcRef := "2"
+
+	ctx := context.TODO()
+	scr := NewGORMRepository(gdb)
+	sct := ServiceCredentialType{SourceID: sourceID, TenantID: tenantID}
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"2"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns))
 	sourceRefs := []string{srcRef}
 	err := scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &sct, sourceRefs)
 
@@ -298,21 +333,12 @@ func TestDeleteUnwanted(t *testing.T) {
 	id := int64(1)
 	srcRef := "2"
 
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, time.Now(), time.Now(), nil, srcRef, time.Now(), time.Now(), time.Now(), "test_name", "test_desc", "test_kind", "test_ns", tenantID, sourceID)
-
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sct := ServiceCredentialType{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_credential_types" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	markAsArchived := `UPDATE "service_credential_types" SET "archived_at"=$1 WHERE "service_credential_types"."id" = $2 AND "service_credential_types"."archived_at" IS NULL`
-	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, sourceID).
-		WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns).AddRow(id, srcRef))
 
 	keep := "4"
 	sourceRefs := []string{keep}
@@ -325,50 +351,41 @@ func TestDeleteUnwanted(t *testing.T) {
 	assert.Equal(t, stats["deletes"], 1)
 }
 
-func TestDeleteUnwantedError(t *testing.T) {
+func TestDeleteUnwantedKeepList(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
 
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sct := ServiceCredentialType{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_credential_types" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnError(fmt.Errorf("kaboom"))
+	// The whole keep list is sent as a single array parameter
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4","5","6"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns).AddRow(int64(1), "2").AddRow(int64(3), "3"))
 
-	keep := "4"
-	sourceRefs := []string{keep}
+	sourceRefs := []string{"4", "5", "6"}
 	err := scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &sct, sourceRefs)
-	checkErrors(t, err, mock, scr, "DeleteUnwantedError", "kaboom")
+	assert.Nil(t, err, "DeleteUnwanted failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteUnwanted")
+	stats := scr.Stats()
+	assert.Equal(t, stats["deletes"], 2)
 }
 
-func TestDeleteUnwantedErrorInDelete(t *testing.T) {
+func TestDeleteUnwantedError(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	id := int64(1)
-	srcRef := "2"
-
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, time.Now(), time.Now(), nil, srcRef, time.Now(), time.Now(), time.Now(), "test_name", "test_desc", "test_kind", "test_ns", tenantID, sourceID)
 
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sct := ServiceCredentialType{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_credential_types" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	markAsArchived := `UPDATE "service_credential_types" SET "archived_at"=$1 WHERE "service_credential_types"."id" = $2 AND "service_credential_types"."archived_at" IS NULL`
-	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, sourceID).
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4"}`).
 		WillReturnError(fmt.Errorf("kaboom"))
 
 	keep := "4"
 	sourceRefs := []string{keep}
 	err := scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &sct, sourceRefs)
-	checkErrors(t, err, mock, scr, "DeleteUnwantedErrorInDelete", "kaboom")
+	checkErrors(t, err, mock, scr, "DeleteUnwantedError", "kaboom")
 }
 
 func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, scr Repository, where string, errMessage string) {
@@ -384,3 +401,35 @@ func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, scr Repository,
 	assert.Equal(t, stats["updates"], 0)
 	assert.Equal(t, stats["deletes"], 0)
 }
+
+func TestMakeObjectInvalidFields(t *testing.T) {
+	cases := []struct {
+		field string
+		value interface{}
+	}{
+		{"id", nil},
+		{"id", "4"},
+		{"id", json.Number("4.5")},
+		{"created", nil},
+		{"modified", json.Number("1")},
+		{"name", nil},
+		{"name", json.Number("1")},
+		{"description", nil},
+		{"description", false},
+		{"kind", nil},
+		{"kind", json.Number("1")},
+	}
+	for _, tc := range cases {
+		attrs := make(map[string]interface{})
+		for k, v := range defaultAttrs {
+			attrs[k] = v
+		}
+		attrs[tc.field] = tc.value
+		sct := ServiceCredentialType{}
+		err := sct.makeObject(attrs)
+		var fieldErr *base.FieldError
+		if assert.True(t, errors.As(err, &fieldErr), "%s %v should be invalid", tc.field, tc.value) {
+			assert.Equal(t, tc.field, fieldErr.Field)
+		}
+	}
+}
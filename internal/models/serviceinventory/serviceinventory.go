@@ -5,8 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"reflect"
-	"sort"
+	"time"
 
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/sirupsen/logrus"
@@ -19,7 +18,10 @@ import (
 type Repository interface {
 	DeleteUnwanted(ctx context.Context, logger *logrus.Entry, sc *ServiceInventory, keepSourceRefs []string) error
 	CreateOrUpdate(ctx context.Context, logger *logrus.Entry, sc *ServiceInventory, attrs map[string]interface{}) error
+	BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*ServiceInventory, error)
+	MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error
 	Stats() map[string]int
+	Changes() []base.Change
 }
 
 // gormRepository struct stores the DB handle and counters
@@ -28,6 +30,9 @@ type gormRepository struct {
 	updates int
 	creates int
 	deletes int
+	seen    int
+	seenIDs []int64
+	base.ChangeLog
 }
 
 // NewGORMRepository creates a new repository object
@@ -35,9 +40,26 @@ func NewGORMRepository(db *gorm.DB) Repository {
 	return &gormRepository{db: db}
 }
 
+// UseTransaction makes the repository work in another transaction, the
+// stats and changes so far are kept
+func (gr *gormRepository) UseTransaction(db *gorm.DB) {
+	gr.db = db
+}
+
 // Stats returns a map with the number of adds/updates/deletes
 func (gr *gormRepository) Stats() map[string]int {
-	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes}
+	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes, "seen": gr.seen}
+}
+
+// MarkSeen sets last_seen_at on all the objects that were seen in this refresh
+func (gr *gormRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	err := base.UpdateLastSeen(ctx, gr.db, "service_inventories", gr.seenIDs, seenAt)
+	if err != nil {
+		logger.Errorf("Error updating last seen for service inventories %v", err)
+		return err
+	}
+	gr.seenIDs = nil
+	return nil
 }
 
 // ServiceInventory maps an Inventory object in Ansible Tower
@@ -51,6 +73,17 @@ type ServiceInventory struct {
 	SourceID    int64
 }
 
+// attributes returns the columns that we compare to detect changes
+func (si *ServiceInventory) attributes() base.Attributes {
+	return base.Attributes{
+		"name":              si.Name,
+		"description":       si.Description,
+		"extra":             si.Extra,
+		"source_created_at": si.SourceCreatedAt,
+		"source_updated_at": si.SourceUpdatedAt,
+	}
+}
+
 func (si *ServiceInventory) validateAttributes(attrs map[string]interface{}) error {
 	requiredAttrs := []string{"kind",
 		"type",
@@ -78,121 +111,145 @@ func (si *ServiceInventory) makeObject(attrs map[string]interface{}) error {
 		return err
 	}
 	extra := make(map[string]interface{})
-	extra["kind"] = attrs["kind"].(string)
-	extra["type"] = attrs["type"].(string)
-	extra["variables"] = attrs["variables"].(string)
+	fields := base.NewFieldReader(attrs)
+	extra["kind"] = fields.String("kind")
+	extra["type"] = fields.String("type")
+	extra["variables"] = fields.String("variables")
 
-	if reflect.TypeOf(attrs["host_filter"]) == reflect.TypeOf("string") {
-		extra["host_filter"] = attrs["host_filter"].(string)
+	if attrs["host_filter"] != nil {
+		extra["host_filter"] = fields.String("host_filter")
 	}
 
-	extra["pending_deletion"] = attrs["pending_deletion"].(bool)
-	orgID, err := attrs["organization"].(json.Number).Int64()
-	if err != nil {
-		return err
-	}
-	extra["organization_id"] = orgID
+	extra["pending_deletion"] = fields.Bool("pending_deletion")
+	extra["organization_id"] = fields.Int64("organization")
+	extra["inventory_sources_with_failures"] = fields.Int64("inventory_sources_with_failures")
 
-	failures, err := attrs["inventory_sources_with_failures"].(json.Number).Int64()
-	if err != nil {
+	si.SourceCreatedAt = fields.Time("created")
+	si.SourceUpdatedAt = fields.Time("modified")
+	si.Description = fields.String("description")
+	si.Name = fields.String("name")
+	si.SourceRef = fields.ID()
+	if err := fields.Err(); err != nil {
 		return err
 	}
-	extra["inventory_sources_with_failures"] = failures
-
 	valueString, err := json.Marshal(extra)
 	if err != nil {
 		return err
 	}
 	si.Extra = datatypes.JSON([]byte(valueString))
-	si.SourceCreatedAt, err = base.TowerTime(attrs["created"].(string))
-	if err != nil {
-		return err
-	}
-	si.SourceUpdatedAt, err = base.TowerTime(attrs["modified"].(string))
-	if err != nil {
-		return err
-	}
-	si.Description = attrs["description"].(string)
-	si.Name = attrs["name"].(string)
-	si.SourceRef = attrs["id"].(json.Number).String()
 	return nil
 }
 
+// CreateOrUpdate a single ServiceInventory Object in the Database
 func (gr *gormRepository) CreateOrUpdate(ctx context.Context, logger *logrus.Entry, si *ServiceInventory, attrs map[string]interface{}) error {
-	err := si.makeObject(attrs)
+	objs, err := gr.BulkCreateOrUpdate(ctx, logger, si.TenantID, si.SourceID, []map[string]interface{}{attrs})
 	if err != nil {
-		logger.Errorf("Error creating a new service inventory object %v", err)
 		return err
 	}
-	var instance ServiceInventory
-	err = gr.db.Where(&ServiceInventory{SourceID: si.SourceID, Tower: base.Tower{SourceRef: si.SourceRef}}).First(&instance).Error
+	*si = *objs[0]
+	return nil
+}
+
+// BulkCreateOrUpdate all the ServiceInventory Objects from a page, the existing
+// objects are fetched in one query and the new or changed objects are written
+// with a batched upsert
+func (gr *gormRepository) BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*ServiceInventory, error) {
+	objs := make([]*ServiceInventory, 0, len(attrsList))
+	sourceRefs := make([]string, 0, len(attrsList))
+	for i, attrs := range attrsList {
+		si := &ServiceInventory{TenantID: tenantID, SourceID: sourceID}
+		err := si.makeObject(attrs)
+		if err != nil {
+			logger.Errorf("Error creating a new service inventory object %v", err)
+			return nil, base.NewInvalidObjectError(i, attrs, err)
+		}
+		objs = append(objs, si)
+		sourceRefs = append(sourceRefs, si.SourceRef)
+	}
+	if len(objs) == 0 {
+		return objs, nil
+	}
+
+	var instances []ServiceInventory
+	err := gr.db.WithContext(ctx).Scopes(base.TenantScope(tenantID, sourceID)).Where("source_ref IN ?", sourceRefs).Find(&instances).Error
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		logger.Errorf("Error locating Inventories %v", err)
+		return nil, err
+	}
+	existing := make(map[string]*ServiceInventory, len(instances))
+	for i := range instances {
+		existing[instances[i].SourceRef] = &instances[i]
+	}
+
+	var upserts []*ServiceInventory
+	var pending []base.Change
+	creates, updates := 0, 0
+	for _, si := range objs {
+		instance, ok := existing[si.SourceRef]
+		if !ok {
 			logger.Infof("Creating a new Inventory %s", si.SourceRef)
-			if result := gr.db.Create(si); result.Error != nil {
-				return fmt.Errorf("Error creating inventory : %v", result.Error.Error())
-			}
-			gr.creates++
-		} else {
-			logger.Errorf("Error locating Inventory %s %v", si.SourceRef, err)
-			return err
+			upserts = append(upserts, si)
+			creates++
+			pending = append(pending, base.Created(si.attributes()))
+			continue
+		}
+		changed, err := base.DetectChanges(instance.attributes(), si.attributes())
+		if err != nil {
+			logger.Errorf("Error comparing Inventory %s %v", si.SourceRef, err)
+			return nil, err
 		}
-	} else {
-		logger.Infof("Inventory %s exists in DB with ID %d", si.SourceRef, instance.ID)
-		si.ID = instance.ID // Get the Existing ID for the object
-
-		if instance.SourceUpdatedAt != si.SourceUpdatedAt {
-			logger.Infof("Updating Inventory %s exists in DB with ID %d", si.SourceRef, instance.ID)
-			instance.Name = si.Name
-			instance.Description = si.Description
-			instance.Extra = si.Extra
-			instance.SourceUpdatedAt = si.SourceUpdatedAt
-			logger.Infof("Saving Inventory source ref %s", si.SourceRef)
-			err := gr.db.Save(&instance).Error
+		if len(changed) > 0 {
+			logger.Infof("Updating Inventory %s exists in DB with ID %d changed fields %v", si.SourceRef, instance.ID, changed)
+			upserts = append(upserts, si)
+			updates++
+			change, err := base.Updated(changed, instance.attributes(), si.attributes())
 			if err != nil {
-				logger.Errorf("Error Updating Service Inventory %s %v", si.SourceRef, err)
-				return err
+				logger.Errorf("Error comparing Inventory %s %v", si.SourceRef, err)
+				return nil, err
+			}
+			pending = append(pending, change)
+		} else {
+			logger.Infof("Inventory %s is in sync with Tower", si.SourceRef)
+			si.ID = instance.ID // Get the Existing ID for the object
+			if refined := instance.attributes().Refined(si.attributes()); len(refined) > 0 {
+				err := base.RefineTimestamps(ctx, gr.db, "service_inventories", instance.ID, si.attributes().Values(refined))
+				if err != nil {
+					logger.Errorf("Error refining timestamps of Inventory %s %v", si.SourceRef, err)
+					return nil, err
+				}
 			}
-			gr.updates++
 		}
 	}
-	return nil
+
+	if err := base.BulkUpsert(ctx, gr.db, upserts, (&ServiceInventory{}).attributes().Columns()); err != nil {
+		return nil, fmt.Errorf("Error saving inventories : %v", err.Error())
+	}
+	gr.creates += creates
+	gr.updates += updates
+	for i, obj := range upserts {
+		pending[i].ID, pending[i].SourceRef = obj.ID, obj.SourceRef
+		gr.Record(pending[i])
+	}
+	for _, si := range objs {
+		gr.seen++
+		gr.seenIDs = append(gr.seenIDs, si.ID)
+	}
+	return objs, nil
 }
 
 // DeleteUnwanted deletes any objects not listed in the keepSourceRefs
 // This is used to delete ServiceInventory that exist in our database but have been
 // deleted from the Ansible Tower
 func (gr *gormRepository) DeleteUnwanted(ctx context.Context, logger *logrus.Entry, si *ServiceInventory, keepSourceRefs []string) error {
-	results, err := si.getDeleteIDs(ctx, logger, gr.db, keepSourceRefs)
+	results, err := base.DeleteUnwanted(ctx, gr.db, "service_inventories", si.TenantID, si.SourceID, keepSourceRefs)
 	if err != nil {
-		logger.Errorf("Error getting Delete IDs for service inventories %v", err)
+		logger.Errorf("Error deleting Service Inventories %v", err)
 		return err
 	}
 	for _, res := range results {
-		logger.Infof("Attempting to delete ServiceInventory with ID %d Source ref %s", res.ID, res.SourceRef)
-		result := gr.db.Delete(&ServiceInventory{SourceID: si.SourceID, TenantID: si.TenantID, Tower: base.Tower{SourceRef: res.SourceRef}}, res.ID)
-		if result.Error != nil {
-			logger.Errorf("Error deleting Service Inventory %d %s %v", res.ID, res.SourceRef, result.Error)
-			return result.Error
-		}
-		gr.deletes++
+		gr.Record(base.Change{Action: base.ActionDeleted, ID: res.ID, SourceRef: res.SourceRef})
+		logger.Infof("Deleted ServiceInventory with ID %d Source ref %s", res.ID, res.SourceRef)
 	}
+	gr.deletes += len(results)
 	return nil
 }
-
-func (si *ServiceInventory) getDeleteIDs(ctx context.Context, logger *logrus.Entry, tx *gorm.DB, keepSourceRefs []string) ([]base.ResultIDRef, error) {
-	var result []base.ResultIDRef
-	var deleteResultIDRef []base.ResultIDRef
-	sort.Strings(keepSourceRefs)
-	length := len(keepSourceRefs)
-	if err := tx.Table("service_inventories").Select("id, source_ref").Where("source_id = ? AND archived_at IS NULL", si.SourceID).Scan(&result).Error; err != nil {
-		logger.Errorf("Error fetching ServiceInventory %v", err)
-		return deleteResultIDRef, err
-	}
-	for _, res := range result {
-		if !base.SourceRefExists(res.SourceRef, keepSourceRefs, length) {
-			deleteResultIDRef = append(deleteResultIDRef, res)
-		}
-	}
-	return deleteResultIDRef, nil
-}
@@ -3,6 +3,7 @@ package serviceinventory
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -13,7 +14,6 @@ import (
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/gorm"
 )
 
 var objectType = "inventory"
@@ -33,6 +33,9 @@ var defaultAttrs = map[string]interface{}{
 	"host_filter":                     "abc",
 }
 
+// upsertRe matches the batched INSERT ... ON CONFLICT used for creates and updates
+var upsertRe = `^INSERT INTO "service_inventories" .* ON CONFLICT \("tenant_id","source_id","source_ref"\) DO UPDATE SET`
+
 var columns = []string{"id", "created_at", "updated_at", "archived_at", "source_ref",
 	"source_created_at", "source_updated_at", "last_seen_at", "name", "description", "extra",
 	"tenant_id", "source_id"}
@@ -103,10 +106,10 @@ func TestCreateErrorLocatingRecord(t *testing.T) {
 	scr := NewGORMRepository(gdb)
 	srcRef := "4"
 	si := ServiceInventory{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_inventories" WHERE "service_inventories"."source_ref" = $1 AND "service_inventories"."source_id" = $2 AND "service_inventories"."archived_at" IS NULL ORDER BY "service_inventories"."id" LIMIT 1`
+	str := `SELECT * FROM "service_inventories" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_inventories"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnError(fmt.Errorf("kaboom"))
 
 	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &si, defaultAttrs)
@@ -120,11 +123,11 @@ func TestCreateError(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	srcRef := "4"
-	str := `SELECT * FROM "service_inventories" WHERE "service_inventories"."source_ref" = $1 AND "service_inventories"."source_id" = $2 AND "service_inventories"."archived_at" IS NULL ORDER BY "service_inventories"."id" LIMIT 1`
+	str := `SELECT * FROM "service_inventories" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_inventories"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(gorm.ErrRecordNotFound)
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
 	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "service_inventories"`)).
 		WithArgs(testhelper.AnyTime{}, testhelper.AnyTime{}, nil, srcRef, testhelper.AnyTime{}, testhelper.AnyTime{}, sqlmock.AnyArg(), defaultAttrs["name"], defaultAttrs["description"], sqlmock.AnyArg(), tenantID, sourceID).
 		WillReturnError(fmt.Errorf("kaboom"))
@@ -134,6 +137,53 @@ func TestCreateError(t *testing.T) {
 	checkErrors(t, err, mock, scr, "Expecting create failure", "kaboom")
 }
 
+func TestCreateSameSourceRefInOtherTenant(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+
+	ctx := context.TODO()
+	scr := NewGORMRepository(gdb)
+	srcRef := "4"
+	otherTenantID := int64(100)
+	str := `SELECT * FROM "service_inventories" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_inventories"."archived_at" IS NULL`
+
+	// The same source ref exists for another tenant, the lookup must not find it
+	mock.ExpectQuery(regexp.QuoteMeta(str)).
+		WithArgs(otherTenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "service_inventories"`)).
+		WithArgs(testhelper.AnyTime{}, testhelper.AnyTime{}, nil, srcRef, testhelper.AnyTime{}, testhelper.AnyTime{}, sqlmock.AnyArg(), defaultAttrs["name"], defaultAttrs["description"], sqlmock.AnyArg(), otherTenantID, sourceID).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+
+	si := ServiceInventory{SourceID: sourceID, TenantID: otherTenantID}
+	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &si, defaultAttrs)
+	assert.Nil(t, err, "CreateOrUpdate failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	stats := scr.Stats()
+	assert.Equal(t, stats["adds"], 1)
+	assert.Equal(t, stats["updates"], 0)
+}
+
+func TestDeleteUnwantedOtherTenant(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+
+	ctx := context.TODO()
+	scr := NewGORMRepository(gdb)
+	otherTenantID := int64(100)
+	si := ServiceInventory{SourceID: sourceID, TenantID: otherTenantID}
+	// Objects owned by tenantID are not matched so nothing gets archived
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, otherTenantID, sourceID, `{}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns))
+
+	err := scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &si, []string{})
+	assert.Nil(t, err, "DeleteUnwanted failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteUnwanted")
+	stats := scr.Stats()
+	assert.Equal(t, stats["deletes"], 0)
+}
+
 func TestCreate(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
@@ -143,11 +193,11 @@ func TestCreate(t *testing.T) {
 	srcRef := "4"
 	newID := int64(78)
 	si := ServiceInventory{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_inventories" WHERE "service_inventories"."source_ref" = $1 AND "service_inventories"."source_id" = $2 AND "service_inventories"."archived_at" IS NULL ORDER BY "service_inventories"."id" LIMIT 1`
+	str := `SELECT * FROM "service_inventories" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_inventories"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(gorm.ErrRecordNotFound)
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
 	insertStr := `INSERT INTO "service_inventories" ("created_at","updated_at","archived_at","source_ref","source_created_at","source_updated_at","last_seen_at","name","description","extra","tenant_id","source_id") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)`
 
 	mock.ExpectQuery(regexp.QuoteMeta(insertStr)).
@@ -181,11 +231,11 @@ func TestCreateOrUpdateError(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	si := ServiceInventory{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_inventories" WHERE "service_inventories"."source_ref" = $1 AND "service_inventories"."source_id" = $2 AND "service_inventories"."archived_at" IS NULL ORDER BY "service_inventories"."id" LIMIT 1`
+	str := `SELECT * FROM "service_inventories" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_inventories"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnError(fmt.Errorf("kaboom"))
+	mock.ExpectQuery(upsertRe).WillReturnError(fmt.Errorf("kaboom"))
 
 	err = scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &si, defaultAttrs)
 
@@ -206,11 +256,11 @@ func TestCreateOrUpdate(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	si := ServiceInventory{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_inventories" WHERE "service_inventories"."source_ref" = $1 AND "service_inventories"."source_id" = $2 AND "service_inventories"."archived_at" IS NULL ORDER BY "service_inventories"."id" LIMIT 1`
+	str := `SELECT * FROM "service_inventories" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_inventories"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(upsertRe).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
 	err = scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &si, defaultAttrs)
 
 	assert.Nil(t, err, "CreateOrUpdate failed")
@@ -219,7 +269,15 @@ func TestCreateOrUpdate(t *testing.T) {
 	assert.Equal(t, stats["adds"], 0)
 	assert.Equal(t, stats["updates"], 1)
 	assert.Equal(t, stats["deletes"], 0)
-
+	changes := scr.Changes()
+	assert.Len(t, changes, 1)
+	assert.Equal(t, base.ActionUpdated, changes[0].Action)
+	assert.Equal(t, id, changes[0].ID)
+	assert.Equal(t, srcRef, changes[0].SourceRef)
+	assert.Equal(t, []string{"description", "extra", "name", "source_created_at", "source_updated_at"}, changes[0].Changed)
+	assert.Equal(t, "test_desc", changes[0].Before["description"])
+	assert.Equal(t, "openshift", changes[0].After["description"])
+	assert.Contains(t, changes[0].Diffs["extra"], base.JSONChange{Path: "/host_filter", Before: nil, After: "abc"})
 }
 
 func TestNoChange(t *testing.T) {
@@ -227,21 +285,21 @@ func TestNoChange(t *testing.T) {
 	defer teardown()
 	id := int64(1)
 	srcRef := "4"
-	encodedExtra, err := json.Marshal(extra)
-	if err != nil {
-		t.Fatalf("Error encoding extra data")
-	}
+	// Same content as defaultAttrs but with a different key order
+	encodedExtra := []byte(`{"variables": "", "type": "inventory", "pending_deletion": false,
+		"organization_id": 1, "kind": "test", "inventory_sources_with_failures": 0, "host_filter": "abc"}`)
 	mt, _ := base.TowerTime(modifiedDateTime)
+	ct, _ := base.TowerTime(defaultAttrs["created"].(string))
 	rows := sqlmock.NewRows(columns).
-		AddRow(id, time.Now(), time.Now(), nil, srcRef, time.Now(), mt, time.Now(), "test_name", "test_desc", encodedExtra, tenantID, sourceID)
+		AddRow(id, time.Now(), time.Now(), nil, srcRef, ct, mt, time.Now(), "demo", "openshift", encodedExtra, tenantID, sourceID)
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	si := ServiceInventory{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_inventories" WHERE "service_inventories"."source_ref" = $1 AND "service_inventories"."source_id" = $2 AND "service_inventories"."archived_at" IS NULL ORDER BY "service_inventories"."id" LIMIT 1`
+	str := `SELECT * FROM "service_inventories" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_inventories"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	err = scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &si, defaultAttrs)
+	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &si, defaultAttrs)
 
 	assert.Nil(t, err, "CreateOrUpdate failed")
 	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
@@ -251,28 +309,67 @@ func TestNoChange(t *testing.T) {
 	assert.Equal(t, stats["deletes"], 0)
 }
 
-func TestDeleteUnwantedMissing(t *testing.T) {
+func TestBulkCreateOrUpdate(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	id := int64(1)
-	srcRef := "2"
-
-	encodedExtra, err := json.Marshal(extra)
-	if err != nil {
-		t.Fatalf("Error encoding extra data")
+	encodedExtra := []byte(`{"variables": "", "type": "inventory", "pending_deletion": false,
+		"organization_id": 1, "kind": "test", "inventory_sources_with_failures": 0, "host_filter": "abc"}`)
+	mt, _ := base.TowerTime(modifiedDateTime)
+	ct, _ := base.TowerTime(defaultAttrs["created"].(string))
+
+	var attrsList []map[string]interface{}
+	for _, srcRef := range []string{"4", "5", "6"} {
+		attrs := make(map[string]interface{})
+		for k, v := range defaultAttrs {
+			attrs[k] = v
+		}
+		attrs["id"] = json.Number(srcRef)
+		attrsList = append(attrsList, attrs)
 	}
+	// 4 is in sync, 5 has a different name and 6 is new
 	rows := sqlmock.NewRows(columns).
-		AddRow(id, time.Now(), time.Now(), nil, srcRef, time.Now(), time.Now(), time.Now(), "test_name", "test_desc", encodedExtra, tenantID, sourceID)
-
+		AddRow(int64(1), time.Now(), time.Now(), nil, "4", ct, mt, time.Now(), "demo", "openshift", encodedExtra, tenantID, sourceID).
+		AddRow(int64(2), time.Now(), time.Now(), nil, "5", ct, mt, time.Now(), "old_name", "openshift", encodedExtra, tenantID, sourceID)
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
-	si := ServiceInventory{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_inventories" WHERE source_id = $1 AND archived_at IS NULL`
+	str := `SELECT * FROM "service_inventories" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3,$4,$5) AND "service_inventories"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
+		WithArgs(tenantID, sourceID, "4", "5", "6").
 		WillReturnRows(rows)
+	mock.ExpectQuery(upsertRe).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(2)).AddRow(int64(3)))
+	sis, err := scr.BulkCreateOrUpdate(ctx, testhelper.TestLogger(), tenantID, sourceID, attrsList)
+
+	assert.Nil(t, err, "BulkCreateOrUpdate failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	assert.Equal(t, 3, len(sis))
+	for i, si := range sis {
+		assert.Equal(t, int64(i+1), si.ID)
+	}
+	stats := scr.Stats()
+	assert.Equal(t, stats["adds"], 1)
+	assert.Equal(t, stats["updates"], 1)
+	assert.Equal(t, stats["deletes"], 0)
+}
+
+// archiveStr is the set-based soft delete of the objects that are gone from Tower
+var archiveStr = `UPDATE service_inventories SET archived_at = $1 WHERE tenant_id = $2 AND source_id = $3 AND archived_at IS NULL AND NOT (source_ref = ANY ($4::text[])) RETURNING id, source_ref`
+
+var archiveColumns = []string{"id", "source_ref"}
+
+func TestDeleteUnwantedMissing(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	srcRef := "2"
+
+	ctx := context.TODO()
+	scr := NewGORMRepository(gdb)
+	si := ServiceInventory{SourceID: sourceID, TenantID: tenantID}
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"2"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns))
 	sourceRefs := []string{srcRef}
-	err = scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &si, sourceRefs)
+	err := scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &si, sourceRefs)
 
 	assert.Nil(t, err, "DeleteUnwantedMissing failed")
 	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteUnwanted")
@@ -288,85 +385,60 @@ func TestDeleteUnwanted(t *testing.T) {
 	id := int64(1)
 	srcRef := "2"
 
-	encodedExtra, err := json.Marshal(extra)
-	if err != nil {
-		t.Fatalf("Error encoding extra data")
-	}
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, time.Now(), time.Now(), nil, srcRef, time.Now(), time.Now(), time.Now(), "test_name", "test_desc", encodedExtra, tenantID, sourceID)
-
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	si := ServiceInventory{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_inventories" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	markAsArchived := `UPDATE "service_inventories" SET "archived_at"=$1 WHERE "service_inventories"."id" = $2 AND "service_inventories"."archived_at" IS NULL`
-	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, sourceID).
-		WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns).AddRow(id, srcRef))
 
 	keep := "4"
 	sourceRefs := []string{keep}
-	err = scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &si, sourceRefs)
+	err := scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &si, sourceRefs)
 	assert.Nil(t, err, "DeleteUnwanted failed")
 	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteUnwanted")
 	stats := scr.Stats()
 	assert.Equal(t, stats["adds"], 0)
 	assert.Equal(t, stats["updates"], 0)
 	assert.Equal(t, stats["deletes"], 1)
+	assert.Equal(t, []base.Change{{Action: base.ActionDeleted, ID: id, SourceRef: srcRef}}, scr.Changes())
 }
 
-func TestDeleteUnwantedError(t *testing.T) {
+func TestDeleteUnwantedKeepList(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
 
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	si := ServiceInventory{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_inventories" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnError(fmt.Errorf("kaboom"))
+	// The whole keep list is sent as a single array parameter
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4","5","6"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns).AddRow(int64(1), "2").AddRow(int64(3), "3"))
 
-	keep := "4"
-	sourceRefs := []string{keep}
+	sourceRefs := []string{"4", "5", "6"}
 	err := scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &si, sourceRefs)
-	checkErrors(t, err, mock, scr, "DeleteUnwantedError", "kaboom")
+	assert.Nil(t, err, "DeleteUnwanted failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteUnwanted")
+	stats := scr.Stats()
+	assert.Equal(t, stats["deletes"], 2)
 }
 
-func TestDeleteUnwantedErrorInDelete(t *testing.T) {
+func TestDeleteUnwantedError(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	id := int64(1)
-	srcRef := "2"
-
-	encodedExtra, err := json.Marshal(extra)
-	if err != nil {
-		t.Fatalf("Error encoding extra data")
-	}
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, time.Now(), time.Now(), nil, srcRef, time.Now(), time.Now(), time.Now(), "test_name", "test_desc", encodedExtra, tenantID, sourceID)
 
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	si := ServiceInventory{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_inventories" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	markAsArchived := `UPDATE "service_inventories" SET "archived_at"=$1 WHERE "service_inventories"."id" = $2 AND "service_inventories"."archived_at" IS NULL`
-	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, sourceID).
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4"}`).
 		WillReturnError(fmt.Errorf("kaboom"))
 
 	keep := "4"
 	sourceRefs := []string{keep}
-	err = scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &si, sourceRefs)
-	checkErrors(t, err, mock, scr, "DeleteUnwantedErrorInDelete", "kaboom")
+	err := scr.DeleteUnwanted(ctx, testhelper.TestLogger(), &si, sourceRefs)
+	checkErrors(t, err, mock, scr, "DeleteUnwantedError", "kaboom")
 }
 
 func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, scr Repository, where string, errMessage string) {
@@ -382,3 +454,87 @@ func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, scr Repository,
 	assert.Equal(t, stats["updates"], 0)
 	assert.Equal(t, stats["deletes"], 0)
 }
+
+func TestMarkSeen(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	id := int64(1)
+	srcRef := "4"
+	encodedExtra := []byte(`{"variables": "", "type": "inventory", "pending_deletion": false,
+		"organization_id": 1, "kind": "test", "inventory_sources_with_failures": 0, "host_filter": "abc"}`)
+	mt, _ := base.TowerTime(modifiedDateTime)
+	ct, _ := base.TowerTime(defaultAttrs["created"].(string))
+	rows := sqlmock.NewRows(columns).
+		AddRow(id, time.Now(), time.Now(), nil, srcRef, ct, mt, time.Now(), "demo", "openshift", encodedExtra, tenantID, sourceID)
+	ctx := context.TODO()
+	scr := NewGORMRepository(gdb)
+	si := ServiceInventory{SourceID: sourceID, TenantID: tenantID}
+	str := `SELECT * FROM "service_inventories" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_inventories"."archived_at" IS NULL`
+	mock.ExpectQuery(regexp.QuoteMeta(str)).
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(rows)
+	seenAt := time.Now().UTC()
+	updateStr := `UPDATE "service_inventories" SET "last_seen_at"=$1 WHERE id IN ($2)`
+	mock.ExpectExec(regexp.QuoteMeta(updateStr)).
+		WithArgs(seenAt, id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &si, defaultAttrs)
+	assert.Nil(t, err, "CreateOrUpdate failed")
+	err = scr.MarkSeen(ctx, testhelper.TestLogger(), seenAt)
+	assert.Nil(t, err, "MarkSeen failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	stats := scr.Stats()
+	assert.Equal(t, stats["updates"], 0)
+	assert.Equal(t, stats["seen"], 1)
+}
+
+func TestMarkSeenError(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := context.TODO()
+	scr := &gormRepository{db: gdb, seenIDs: []int64{1, 2}}
+	mock.ExpectExec("^UPDATE").WillReturnError(fmt.Errorf("kaboom"))
+
+	err := scr.MarkSeen(ctx, testhelper.TestLogger(), time.Now())
+	assert.NotNil(t, err, "MarkSeen should have failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestMakeObjectInvalidFields(t *testing.T) {
+	cases := []struct {
+		field string
+		value interface{}
+	}{
+		{"id", nil},
+		{"id", "4"},
+		{"id", json.Number("4.5")},
+		{"created", nil},
+		{"modified", json.Number("1")},
+		{"name", nil},
+		{"name", json.Number("1")},
+		{"description", nil},
+		{"description", false},
+		{"kind", nil},
+		{"type", nil},
+		{"variables", nil},
+		{"host_filter", json.Number("1")},
+		{"pending_deletion", nil},
+		{"organization", nil},
+		{"organization", "1"},
+		{"inventory_sources_with_failures", json.Number("x")},
+	}
+	for _, tc := range cases {
+		attrs := make(map[string]interface{})
+		for k, v := range defaultAttrs {
+			attrs[k] = v
+		}
+		attrs[tc.field] = tc.value
+		si := ServiceInventory{}
+		err := si.makeObject(attrs)
+		var fieldErr *base.FieldError
+		if assert.True(t, errors.As(err, &fieldErr), "%s %v should be invalid", tc.field, tc.value) {
+			assert.Equal(t, tc.field, fieldErr.Field)
+		}
+	}
+}
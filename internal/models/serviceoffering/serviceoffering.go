@@ -6,8 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"regexp"
-	"sort"
+	"time"
 
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceinventory"
@@ -18,8 +17,6 @@ import (
 	"gorm.io/gorm"
 )
 
-var inventoriesRe = regexp.MustCompile(`\/api\/v2\/inventories\/(\w)\/`)
-
 // ServiceOffering maps a Job Template or a Workflow from Ansible Tower
 type ServiceOffering struct {
 	base.Base
@@ -39,7 +36,10 @@ type ServiceOffering struct {
 type Repository interface {
 	DeleteUnwanted(ctx context.Context, logger *logrus.Entry, so *ServiceOffering, keepSourceRefs []string, spr serviceplan.Repository) error
 	CreateOrUpdate(ctx context.Context, logger *logrus.Entry, so *ServiceOffering, attrs map[string]interface{}, spr serviceplan.Repository) error
+	BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}, spr serviceplan.Repository) ([]*ServiceOffering, error)
+	MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error
 	Stats() map[string]int
+	Changes() []base.Change
 }
 
 // gormRepository struct stores the DB handle and counters
@@ -48,6 +48,9 @@ type gormRepository struct {
 	updates int
 	creates int
 	deletes int
+	seen    int
+	seenIDs []int64
+	base.ChangeLog
 }
 
 // NewGORMRepository creates a new repository object
@@ -55,91 +58,169 @@ func NewGORMRepository(db *gorm.DB) Repository {
 	return &gormRepository{db: db}
 }
 
+// UseTransaction makes the repository work in another transaction, the
+// stats and changes so far are kept
+func (gr *gormRepository) UseTransaction(db *gorm.DB) {
+	gr.db = db
+}
+
 // Stats returns a map with the number of adds/updates/deletes
 func (gr *gormRepository) Stats() map[string]int {
-	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes}
+	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes, "seen": gr.seen}
+}
+
+// MarkSeen sets last_seen_at on all the objects that were seen in this refresh
+func (gr *gormRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	err := base.UpdateLastSeen(ctx, gr.db, "service_offerings", gr.seenIDs, seenAt)
+	if err != nil {
+		logger.Errorf("Error updating last seen for service offerings %v", err)
+		return err
+	}
+	gr.seenIDs = nil
+	return nil
 }
 
+// CreateOrUpdate a single ServiceOffering Object in the Database
 func (gr *gormRepository) CreateOrUpdate(ctx context.Context, logger *logrus.Entry, so *ServiceOffering, attrs map[string]interface{}, spr serviceplan.Repository) error {
-	err := so.makeObject(attrs)
+	objs, err := gr.BulkCreateOrUpdate(ctx, logger, so.TenantID, so.SourceID, []map[string]interface{}{attrs}, spr)
 	if err != nil {
-		logger.Errorf("Error creating a new service offering object %v", err)
 		return err
 	}
-	instance, err := so.getInstance(ctx, logger, gr.db)
+	*so = *objs[0]
+	return nil
+}
+
+// BulkCreateOrUpdate all the ServiceOffering Objects from a page, the existing
+// objects are fetched in one query and the new or changed objects are written
+// with a batched upsert
+func (gr *gormRepository) BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}, spr serviceplan.Repository) ([]*ServiceOffering, error) {
+	objs := make([]*ServiceOffering, 0, len(attrsList))
+	sourceRefs := make([]string, 0, len(attrsList))
+	for i, attrs := range attrsList {
+		so := &ServiceOffering{TenantID: tenantID, SourceID: sourceID}
+		err := so.makeObject(attrs)
+		if err != nil {
+			logger.Errorf("Error creating a new service offering object %v", err)
+			return nil, base.NewInvalidObjectError(i, attrs, err)
+		}
+		objs = append(objs, so)
+		sourceRefs = append(sourceRefs, so.SourceRef)
+	}
+	if len(objs) == 0 {
+		return objs, nil
+	}
+
+	var instances []ServiceOffering
+	err := gr.db.WithContext(ctx).Preload("ServiceInventory").Scopes(base.TenantScope(tenantID, sourceID)).Where("source_ref IN ?", sourceRefs).Find(&instances).Error
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		logger.Errorf("Error locating job templates %v", err)
+		return nil, err
+	}
+	existing := make(map[string]*ServiceOffering, len(instances))
+	for i := range instances {
+		existing[instances[i].SourceRef] = &instances[i]
+	}
+
+	var upserts []*ServiceOffering
+	var pending []base.Change
+	creates, updates := 0, 0
+	for _, so := range objs {
+		instance, ok := existing[so.SourceRef]
+		if !ok {
 			logger.Infof("Creating a new Job Template %s", so.SourceRef)
-			if result := gr.db.Create(so); result.Error != nil {
-				return fmt.Errorf("Error creating job template: %v", result.Error.Error())
-			}
-		} else {
-			logger.Errorf("Error locating job template  %s %v", so.SourceRef, err)
-			return err
+			upserts = append(upserts, so)
+			creates++
+			pending = append(pending, base.Created(so.attributes()))
+			continue
+		}
+		instance.SurveyEnabled, err = surveyEnabled(instance.Extra)
+		if err != nil {
+			logger.Errorf("Error parsing extra in service offering source ref %s", so.SourceRef)
+			return nil, err
 		}
-		gr.creates++
-	} else {
-		logger.Infof("Job Template %s exists in DB with ID %d", so.SourceRef, instance.ID)
-		so.ID = instance.ID // Get the Existing ID for the object
 
-		if instance.SourceUpdatedAt != so.SourceUpdatedAt {
-			logger.Infof("Updating Job Template %s exists in DB with ID %d", so.SourceRef, instance.ID)
-			instance.Name = so.Name
-			instance.SourceUpdatedAt = so.SourceUpdatedAt
-			instance.Description = so.Description
-			instance.ServiceInventory = serviceinventory.ServiceInventory{}
+		changed, err := base.DetectChanges(instance.attributes(), so.attributes())
+		if err != nil {
+			logger.Errorf("Error comparing Job Template %s %v", so.SourceRef, err)
+			return nil, err
+		}
+		if instance.ServiceInventory.SourceRef != so.ServiceInventorySourceRef {
+			// The upsert clears the link to the old inventory, the link to a new
+			// inventory is established in ProcessLinks
+			changed = append(changed, "service_inventory_id")
+		}
+
+		if len(changed) > 0 {
+			logger.Infof("Updating Job Template %s exists in DB with ID %d changed fields %v", so.SourceRef, instance.ID, changed)
 			if !so.SurveyEnabled && instance.SurveyEnabled {
 				logger.Infof("Deleting Service Plan for Job Template %s", so.SourceRef)
 				// Delete the Service Plan if any that is connected to this ServiceOffering
 				err := so.deleteServicePlan(ctx, logger, spr)
 				if err != nil {
-					logger.Errorf("Error deleting Service Plan for Service Offering %d %s %v", so.ID, so.SourceRef, err)
-					return err
+					logger.Errorf("Error deleting Service Plan for Service Offering %d %s %v", instance.ID, so.SourceRef, err)
+					return nil, err
 				}
 			}
-			logger.Infof("Saving Job Template source ref %s", so.SourceRef)
-			err := gr.db.Save(&instance).Error
+			upserts = append(upserts, so)
+			updates++
+			change, err := base.Updated(changed, instance.attributes(), so.attributes())
 			if err != nil {
-				logger.Errorf("Error Updating Service Offering %s", so.SourceRef)
-				return err
+				logger.Errorf("Error comparing Job Template %s %v", so.SourceRef, err)
+				return nil, err
 			}
-			gr.updates++
+			pending = append(pending, change)
 		} else {
 			logger.Infof("Job Template %s is in sync with Tower", so.SourceRef)
+			so.ID = instance.ID // Get the Existing ID for the object
+			if refined := instance.attributes().Refined(so.attributes()); len(refined) > 0 {
+				err := base.RefineTimestamps(ctx, gr.db, "service_offerings", instance.ID, so.attributes().Values(refined))
+				if err != nil {
+					logger.Errorf("Error refining timestamps of Job Template %s %v", so.SourceRef, err)
+					return nil, err
+				}
+			}
 		}
 	}
-	return nil
+
+	columns := append((&ServiceOffering{}).attributes().Columns(), "service_inventory_id")
+	if err := base.BulkUpsert(ctx, gr.db, upserts, columns); err != nil {
+		return nil, fmt.Errorf("Error saving job templates: %v", err.Error())
+	}
+	gr.creates += creates
+	gr.updates += updates
+	for i, obj := range upserts {
+		pending[i].ID, pending[i].SourceRef = obj.ID, obj.SourceRef
+		gr.Record(pending[i])
+	}
+	for _, so := range objs {
+		gr.seen++
+		gr.seenIDs = append(gr.seenIDs, so.ID)
+	}
+	return objs, nil
 }
 
+// DeleteUnwanted deletes any objects not listed in the keepSourceRefs
+// This is used to delete ServiceOffering that exist in our database but have been
+// deleted from the Ansible Tower, along with their ServicePlans
 func (gr *gormRepository) DeleteUnwanted(ctx context.Context, logger *logrus.Entry, so *ServiceOffering, keepSourceRefs []string, spr serviceplan.Repository) error {
-	results, err := so.getDeleteIDs(ctx, logger, gr.db, keepSourceRefs)
+	results, err := base.DeleteUnwanted(ctx, gr.db, "service_offerings", so.TenantID, so.SourceID, keepSourceRefs)
 	if err != nil {
-		logger.Errorf("Error getting Delete IDs for service offerings %v", err)
+		logger.Errorf("Error deleting Service Offerings %v", err)
 		return err
 	}
+	deletedSourceRefs := make([]string, 0, len(results))
 	for _, res := range results {
-		logger.Infof("Attempting to delete ServiceOffering with ID %d Source ref %s", res.ID, res.SourceRef)
+		gr.Record(base.Change{Action: base.ActionDeleted, ID: res.ID, SourceRef: res.SourceRef})
+		logger.Infof("Deleted ServiceOffering with ID %d Source ref %s", res.ID, res.SourceRef)
+		deletedSourceRefs = append(deletedSourceRefs, res.SourceRef)
+	}
+	gr.deletes += len(results)
 
-		dso := &ServiceOffering{SourceID: so.SourceID, TenantID: so.TenantID, Tower: base.Tower{SourceRef: res.SourceRef}}
-		instance, err := dso.getInstance(ctx, logger, gr.db)
-		if err != nil {
-			logger.Errorf("Error fetching service offering instance %v", err)
-			return err
-		}
-		result := gr.db.Delete(dso, res.ID)
-		if result.Error != nil {
-			logger.Errorf("Error deleting Service Offering %d %s %v", res.ID, res.SourceRef, result.Error)
-			return result.Error
-		}
-		gr.deletes++
-		// Delete the Service Plan if any that is connected to this ServiceOffering
-		if instance.SurveyEnabled {
-			err = dso.deleteServicePlan(ctx, logger, spr)
-			if err != nil {
-				logger.Errorf("Error deleting Service Plan for Service Offering %d %s %v", res.ID, res.SourceRef, err)
-				return err
-			}
-		}
+	// Only ServiceOfferings with a survey have a ServicePlan, it shares the Tower id
+	err = spr.DeleteBySourceRefs(ctx, logger, so.TenantID, so.SourceID, deletedSourceRefs)
+	if err != nil {
+		logger.Errorf("Error deleting Service Plans for Service Offerings %v", err)
+		return err
 	}
 	return nil
 }
@@ -149,6 +230,17 @@ func (so *ServiceOffering) deleteServicePlan(ctx context.Context, logger *logrus
 	return spr.Delete(ctx, logger, &sp)
 }
 
+// attributes returns the columns that we compare to detect changes
+func (so *ServiceOffering) attributes() base.Attributes {
+	return base.Attributes{
+		"name":              so.Name,
+		"description":       so.Description,
+		"extra":             so.Extra,
+		"source_created_at": so.SourceCreatedAt,
+		"source_updated_at": so.SourceUpdatedAt,
+	}
+}
+
 func (so *ServiceOffering) validateAttributes(attrs map[string]interface{}) error {
 	requiredAttrs := []string{"name",
 		"ask_inventory_on_launch",
@@ -182,75 +274,44 @@ func (so *ServiceOffering) makeObject(attrs map[string]interface{}) error {
 		"ask_limit_on_launch",
 		"ask_verbosity_on_launch"}
 
+	fields := base.NewFieldReader(attrs)
 	for _, s := range optionals {
 		if _, ok := attrs[s]; ok {
-			extra[s] = attrs[s].(bool)
+			extra[s] = fields.Bool(s)
 		}
 	}
 
-	extra["ask_inventory_on_launch"] = attrs["ask_inventory_on_launch"].(bool)
-	extra["survey_enabled"] = attrs["survey_enabled"].(bool)
-	so.SurveyEnabled = attrs["survey_enabled"].(bool)
-	extra["ask_variables_on_launch"] = attrs["ask_variables_on_launch"].(bool)
+	extra["ask_inventory_on_launch"] = fields.Bool("ask_inventory_on_launch")
+	extra["survey_enabled"] = fields.Bool("survey_enabled")
+	so.SurveyEnabled = fields.Bool("survey_enabled")
+	extra["ask_variables_on_launch"] = fields.Bool("ask_variables_on_launch")
 
-	extra["type"] = attrs["type"].(string)
+	extra["type"] = fields.String("type")
 
-	valueString, err := json.Marshal(extra)
-	if err != nil {
-		return err
-	}
-	so.Extra = datatypes.JSON(valueString)
-	so.SourceCreatedAt, err = base.TowerTime(attrs["created"].(string))
-	if err != nil {
+	so.SourceCreatedAt = fields.Time("created")
+	so.SourceUpdatedAt = fields.Time("modified")
+	so.Description = fields.String("description")
+	so.Name = fields.String("name")
+	so.SourceRef = fields.ID()
+	if err := fields.Err(); err != nil {
 		return err
 	}
-	so.SourceUpdatedAt, err = base.TowerTime(attrs["modified"].(string))
+	valueString, err := json.Marshal(extra)
 	if err != nil {
 		return err
 	}
-	so.Description = attrs["description"].(string)
-	so.Name = attrs["name"].(string)
-	so.SourceRef = attrs["id"].(json.Number).String()
-
-	switch attrs["inventory"].(type) {
-	case string:
-		s := inventoriesRe.FindStringSubmatch(attrs["inventory"].(string))
-		if len(s) > 0 {
-			so.ServiceInventorySourceRef = s[1]
-		}
-	}
+	so.Extra = datatypes.JSON(valueString)
+	so.ServiceInventorySourceRef = base.ReferenceID(attrs, "inventory", "inventories")
 	return nil
 }
 
-func (so *ServiceOffering) getDeleteIDs(ctx context.Context, logger *logrus.Entry, tx *gorm.DB, keepSourceRefs []string) ([]base.ResultIDRef, error) {
-	var result []base.ResultIDRef
-	var deleteResultIDRef []base.ResultIDRef
-	sort.Strings(keepSourceRefs)
-	length := len(keepSourceRefs)
-	if err := tx.Table("service_offerings").Select("id, source_ref").Where("source_id = ? AND archived_at IS NULL", so.SourceID).Scan(&result).Error; err != nil {
-		logger.Errorf("Error fetching ServiceOffering %v", err)
-		return deleteResultIDRef, err
-	}
-	for _, res := range result {
-		if !base.SourceRefExists(res.SourceRef, keepSourceRefs, length) {
-			deleteResultIDRef = append(deleteResultIDRef, res)
-		}
-	}
-	return deleteResultIDRef, nil
-}
-
-func (so *ServiceOffering) getInstance(ctx context.Context, logger *logrus.Entry, db *gorm.DB) (*ServiceOffering, error) {
-	var instance ServiceOffering
-	err := db.Preload("ServiceInventory").Where(&ServiceOffering{SourceID: so.SourceID, Tower: base.Tower{SourceRef: so.SourceRef}}).First(&instance).Error
-	if err != nil {
-		return nil, err
-	}
+// surveyEnabled reads the survey flag stored in extra
+func surveyEnabled(extra datatypes.JSON) (bool, error) {
 	var resp map[string]interface{}
-	err = json.Unmarshal(instance.Extra, &resp)
+	err := json.Unmarshal(extra, &resp)
 	if err != nil {
-		logger.Errorf("Error parsing extra in service offering source ref %s", so.SourceRef)
-		return nil, err
+		return false, err
 	}
-	instance.SurveyEnabled = resp["survey_enabled"].(bool)
-	return &instance, nil
+	enabled, _ := resp["survey_enabled"].(bool)
+	return enabled, nil
 }
@@ -3,6 +3,7 @@ package serviceoffering
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
@@ -16,7 +17,6 @@ import (
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/gorm"
 )
 
 type MockConverter struct {
@@ -31,6 +31,7 @@ func (mc *MockConverter) Convert(ctx context.Context, logger *logrus.Entry, r io
 type MockServicePlanRepository struct {
 	deletesCalled int
 	err           error
+	base.ChangeLog
 }
 
 func (mspr *MockServicePlanRepository) Delete(ctx context.Context, logger *logrus.Entry, sp *serviceplan.ServicePlan) error {
@@ -40,10 +41,21 @@ func (mspr *MockServicePlanRepository) Delete(ctx context.Context, logger *logru
 	return mspr.err
 }
 
+func (mspr *MockServicePlanRepository) DeleteBySourceRefs(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, sourceRefs []string) error {
+	if mspr.err == nil {
+		mspr.deletesCalled += len(sourceRefs)
+	}
+	return mspr.err
+}
+
 func (mspr *MockServicePlanRepository) CreateOrUpdate(ctx context.Context, logger *logrus.Entry, sp *serviceplan.ServicePlan, converter serviceplan.DDFConverter, attrs map[string]interface{}, r io.Reader) error {
 	return nil
 }
 
+func (mspr *MockServicePlanRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	return nil
+}
+
 func (mspr *MockServicePlanRepository) Stats() map[string]int {
 	return map[string]int{"add": 0}
 }
@@ -66,6 +78,11 @@ func makeDefaultAttrs(id string, survey bool) map[string]interface{} {
 	}
 }
 
+// upsertRe matches the batched INSERT ... ON CONFLICT used for creates and updates
+// its RETURNING clause lists the id and the nullable foreign keys in no fixed
+// order, so mocked rows carry the id in every column
+var upsertRe = `^INSERT INTO "service_offerings" .* ON CONFLICT \("tenant_id","source_id","source_ref"\) DO UPDATE SET`
+
 var columns = []string{"id", "tenant_id", "source_id", "source_ref", "name", "type_name",
 	"description", "source_created_at", "source_updated_at", "created_at", "updated_at",
 	"extra"}
@@ -124,10 +141,10 @@ func TestCreateErrorLocatingRecord(t *testing.T) {
 	sor := NewGORMRepository(gdb)
 	srcRef := "4"
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offerings" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offerings"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnError(fmt.Errorf("kaboom"))
 	err := sor.CreateOrUpdate(ctx, testhelper.TestLogger(), &so, makeDefaultAttrs(srcRef, true), &MockServicePlanRepository{})
 	checkErrors(t, err, mock, sor, "Expecting create failure", "kaboom")
@@ -140,11 +157,11 @@ func TestCreateError(t *testing.T) {
 	sor := NewGORMRepository(gdb)
 	srcRef := "4"
 	defaultAttrs := makeDefaultAttrs(srcRef, true)
-	str := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offerings" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offerings"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(gorm.ErrRecordNotFound)
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
 	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "service_offerings"`)).
 		WithArgs(testhelper.AnyTime{}, testhelper.AnyTime{}, nil, srcRef, testhelper.AnyTime{}, testhelper.AnyTime{}, sqlmock.AnyArg(), defaultAttrs["name"], defaultAttrs["description"], sqlmock.AnyArg(), tenantID, sourceID).
 		WillReturnError(fmt.Errorf("kaboom"))
@@ -163,11 +180,11 @@ func TestCreate(t *testing.T) {
 	newID := int64(78)
 	defaultAttrs := makeDefaultAttrs(srcRef, true)
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offerings" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offerings"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(gorm.ErrRecordNotFound)
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
 	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "service_offerings"`)).
 		WithArgs(testhelper.AnyTime{}, testhelper.AnyTime{}, nil, srcRef, testhelper.AnyTime{}, testhelper.AnyTime{}, sqlmock.AnyArg(), defaultAttrs["name"], defaultAttrs["description"], sqlmock.AnyArg(), tenantID, sourceID).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "service_inventory_id"}).AddRow(newID, 6))
@@ -198,9 +215,9 @@ func TestCreateOrUpdateExtraError(t *testing.T) {
 	ctx := context.TODO()
 	sor := NewGORMRepository(gdb)
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offerings" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offerings"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
 	err := sor.CreateOrUpdate(ctx, testhelper.TestLogger(), &so, defaultAttrs, &MockServicePlanRepository{})
 	errMsg := `invalid character 'g' looking for beginning of value`
@@ -228,11 +245,11 @@ func TestCreateOrUpdateError(t *testing.T) {
 	ctx := context.TODO()
 	sor := NewGORMRepository(gdb)
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offerings" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offerings"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnError(fmt.Errorf("kaboom"))
+	mock.ExpectQuery(upsertRe).WillReturnError(fmt.Errorf("kaboom"))
 
 	err = sor.CreateOrUpdate(ctx, testhelper.TestLogger(), &so, defaultAttrs, &MockServicePlanRepository{})
 
@@ -261,11 +278,11 @@ func TestCreateOrUpdate(t *testing.T) {
 	ctx := context.TODO()
 	sor := NewGORMRepository(gdb)
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offerings" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offerings"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(upsertRe).WillReturnRows(sqlmock.NewRows([]string{"id", "service_inventory_id"}).AddRow(id, id))
 	err = sor.CreateOrUpdate(ctx, testhelper.TestLogger(), &so, defaultAttrs, &MockServicePlanRepository{})
 
 	assert.Nil(t, err, "CreateOrUpdate failed")
@@ -284,10 +301,12 @@ func TestNoChange(t *testing.T) {
 	srcRef := "4"
 
 	defaultAttrs := makeDefaultAttrs(srcRef, false)
+	delete(defaultAttrs, "inventory")
 	extra := map[string]interface{}{
 		"ask_inventory_on_launch": true,
 		"ask_variables_on_launch": false,
-		"survey_enabled":          true,
+		"ask_tags_on_launch":      true,
+		"survey_enabled":          false,
 		"type":                    "job_template"}
 
 	encodedExtra, err := json.Marshal(extra)
@@ -295,14 +314,15 @@ func TestNoChange(t *testing.T) {
 		t.Fatalf("Error encoding extra data")
 	}
 	mt, _ := base.TowerTime(modifiedDateTime)
+	ct, _ := base.TowerTime(defaultAttrs["created"].(string))
 	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, srcRef, "Test", "", "Test Description", time.Now(), mt, time.Now(), time.Now(), encodedExtra)
+		AddRow(id, tenantID, sourceID, srcRef, "demo", "", "openshift", ct, mt, time.Now(), time.Now(), encodedExtra)
 	ctx := context.TODO()
 	sor := NewGORMRepository(gdb)
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offerings" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offerings"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
 	err = sor.CreateOrUpdate(ctx, testhelper.TestLogger(), &so, defaultAttrs, &MockServicePlanRepository{})
 
@@ -314,6 +334,48 @@ func TestNoChange(t *testing.T) {
 	assert.Equal(t, stats["deletes"], 0)
 }
 
+func TestExtraChangedWithoutModified(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	id := int64(1)
+	srcRef := "4"
+
+	defaultAttrs := makeDefaultAttrs(srcRef, false)
+	delete(defaultAttrs, "inventory")
+	// Tower did not bump modified when ask_tags_on_launch was toggled
+	extra := map[string]interface{}{
+		"ask_inventory_on_launch": true,
+		"ask_variables_on_launch": false,
+		"ask_tags_on_launch":      false,
+		"survey_enabled":          false,
+		"type":                    "job_template"}
+
+	encodedExtra, err := json.Marshal(extra)
+	if err != nil {
+		t.Fatalf("Error encoding extra data")
+	}
+	mt, _ := base.TowerTime(modifiedDateTime)
+	ct, _ := base.TowerTime(defaultAttrs["created"].(string))
+	rows := sqlmock.NewRows(columns).
+		AddRow(id, tenantID, sourceID, srcRef, "demo", "", "openshift", ct, mt, time.Now(), time.Now(), encodedExtra)
+	ctx := context.TODO()
+	sor := NewGORMRepository(gdb)
+	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
+	str := `SELECT * FROM "service_offerings" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offerings"."archived_at" IS NULL`
+	mock.ExpectQuery(regexp.QuoteMeta(str)).
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(rows)
+	mock.ExpectQuery(upsertRe).WillReturnRows(sqlmock.NewRows([]string{"id", "service_inventory_id"}).AddRow(id, id))
+	err = sor.CreateOrUpdate(ctx, testhelper.TestLogger(), &so, defaultAttrs, &MockServicePlanRepository{})
+
+	assert.Nil(t, err, "CreateOrUpdate failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	stats := sor.Stats()
+	assert.Equal(t, stats["adds"], 0)
+	assert.Equal(t, stats["updates"], 1)
+	assert.Equal(t, stats["deletes"], 0)
+}
+
 func TestCreateOrUpdateSurveyDisabled(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
@@ -336,11 +398,11 @@ func TestCreateOrUpdateSurveyDisabled(t *testing.T) {
 	ctx := context.TODO()
 	sor := NewGORMRepository(gdb)
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offerings" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offerings"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(upsertRe).WillReturnRows(sqlmock.NewRows([]string{"id", "service_inventory_id"}).AddRow(id, id))
 	mspr := &MockServicePlanRepository{}
 	err = sor.CreateOrUpdate(ctx, testhelper.TestLogger(), &so, defaultAttrs, mspr)
 
@@ -376,9 +438,9 @@ func TestCreateOrUpdateSurveyDisabledError(t *testing.T) {
 	ctx := context.TODO()
 	sor := NewGORMRepository(gdb)
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offerings" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offerings"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
 
 	mspr := &MockServicePlanRepository{err: fmt.Errorf("kaboom")}
@@ -389,33 +451,25 @@ func TestCreateOrUpdateSurveyDisabledError(t *testing.T) {
 	assert.Equal(t, mspr.deletesCalled, 0)
 }
 
+// archiveStr is the set-based soft delete of the objects that are gone from Tower
+var archiveStr = `UPDATE service_offerings SET archived_at = $1 WHERE tenant_id = $2 AND source_id = $3 AND archived_at IS NULL AND NOT (source_ref = ANY ($4::text[])) RETURNING id, source_ref`
+
+var archiveColumns = []string{"id", "source_ref"}
+
 func TestDeleteUnwantedMissing(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	id := int64(1)
 	srcRef := "2"
 
-	extra := map[string]interface{}{
-		"ask_inventory_on_launch": true,
-		"ask_variables_on_launch": false,
-		"survey_enabled":          true,
-		"type":                    "job_template"}
-	encodedExtra, err := json.Marshal(extra)
-	if err != nil {
-		t.Fatalf("Error encoding extra data")
-	}
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, srcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), time.Now(), encodedExtra)
-
 	ctx := context.TODO()
 	sor := NewGORMRepository(gdb)
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_offerings" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"2"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns))
 	sourceRefs := []string{srcRef}
-	err = sor.DeleteUnwanted(ctx, testhelper.TestLogger(), &so, sourceRefs, &MockServicePlanRepository{})
+	mspr := &MockServicePlanRepository{}
+	err := sor.DeleteUnwanted(ctx, testhelper.TestLogger(), &so, sourceRefs, mspr)
 
 	assert.Nil(t, err, "DeleteUnwantedMissing failed")
 	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteUnwanted")
@@ -423,6 +477,7 @@ func TestDeleteUnwantedMissing(t *testing.T) {
 	assert.Equal(t, stats["adds"], 0)
 	assert.Equal(t, stats["updates"], 0)
 	assert.Equal(t, stats["deletes"], 0)
+	assert.Equal(t, mspr.deletesCalled, 0)
 }
 
 func TestDeleteUnwantedMissingServicePlan(t *testing.T) {
@@ -431,43 +486,17 @@ func TestDeleteUnwantedMissingServicePlan(t *testing.T) {
 	id := int64(1)
 	srcRef := "2"
 
-	extra := map[string]interface{}{
-		"ask_inventory_on_launch": true,
-		"ask_variables_on_launch": false,
-		"survey_enabled":          true,
-		"type":                    "job_template"}
-	encodedExtra, err := json.Marshal(extra)
-	if err != nil {
-		t.Fatalf("Error encoding extra data")
-	}
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, srcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), time.Now(), encodedExtra)
-
-	// Can't use the same rows in multiple calls
-	rows2 := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, srcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), time.Now(), encodedExtra)
 	ctx := context.TODO()
 	sor := NewGORMRepository(gdb)
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_offerings" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	fetchStr := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
-	mock.ExpectQuery(regexp.QuoteMeta(fetchStr)).
-		WithArgs(srcRef, sourceID).
-		WillReturnRows(rows2)
-
-	markAsArchived := `UPDATE "service_offerings" SET "archived_at"=$1 WHERE "service_offerings"."id" = $2 AND "service_offerings"."archived_at" IS NULL`
-	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, id).
-		WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns).AddRow(id, srcRef))
 
 	keep := "4"
 	sourceRefs := []string{keep}
 	mspr := &MockServicePlanRepository{err: fmt.Errorf("kaboom")}
-	err = sor.DeleteUnwanted(ctx, testhelper.TestLogger(), &so, sourceRefs, mspr)
+	err := sor.DeleteUnwanted(ctx, testhelper.TestLogger(), &so, sourceRefs, mspr)
 	assert.NotNil(t, err, "TestDeleteUnwantedMissingServicePlan failed")
 	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteUnwanted")
 	stats := sor.Stats()
@@ -479,51 +508,25 @@ func TestDeleteUnwantedMissingServicePlan(t *testing.T) {
 func TestDeleteUnwanted(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	id := int64(1)
-	srcRef := "2"
 
-	extra := map[string]interface{}{
-		"ask_inventory_on_launch": true,
-		"ask_variables_on_launch": false,
-		"survey_enabled":          true,
-		"type":                    "job_template"}
-	encodedExtra, err := json.Marshal(extra)
-	if err != nil {
-		t.Fatalf("Error encoding extra data")
-	}
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, srcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), time.Now(), encodedExtra)
-
-	// Can't use the same rows in multiple calls
-	rows2 := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, srcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), time.Now(), encodedExtra)
 	ctx := context.TODO()
 	sor := NewGORMRepository(gdb)
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_offerings" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	fetchStr := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
-	mock.ExpectQuery(regexp.QuoteMeta(fetchStr)).
-		WithArgs(srcRef, sourceID).
-		WillReturnRows(rows2)
-
-	markAsArchived := `UPDATE "service_offerings" SET "archived_at"=$1 WHERE "service_offerings"."id" = $2 AND "service_offerings"."archived_at" IS NULL`
-	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, id).
-		WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4","5"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns).AddRow(int64(1), "2").AddRow(int64(3), "3"))
 
-	keep := "4"
-	sourceRefs := []string{keep}
-	err = sor.DeleteUnwanted(ctx, testhelper.TestLogger(), &so, sourceRefs, &MockServicePlanRepository{})
+	sourceRefs := []string{"4", "5"}
+	mspr := &MockServicePlanRepository{}
+	err := sor.DeleteUnwanted(ctx, testhelper.TestLogger(), &so, sourceRefs, mspr)
 	assert.Nil(t, err, "DeleteUnwanted failed")
 	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteUnwanted")
 	stats := sor.Stats()
 	assert.Equal(t, stats["adds"], 0)
 	assert.Equal(t, stats["updates"], 0)
-	assert.Equal(t, stats["deletes"], 1)
+	assert.Equal(t, stats["deletes"], 2)
+	// The Service Plans of both deleted Service Offerings are deleted
+	assert.Equal(t, mspr.deletesCalled, 2)
 }
 
 func TestDeleteUnwantedError(t *testing.T) {
@@ -533,9 +536,8 @@ func TestDeleteUnwantedError(t *testing.T) {
 	ctx := context.TODO()
 	sor := NewGORMRepository(gdb)
 	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_offerings" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4"}`).
 		WillReturnError(fmt.Errorf("kaboom"))
 
 	keep := "4"
@@ -544,89 +546,6 @@ func TestDeleteUnwantedError(t *testing.T) {
 	checkErrors(t, err, mock, sor, "DeleteUnwantedError", "kaboom")
 }
 
-func TestDeleteUnwantedErrorInDelete(t *testing.T) {
-	gdb, mock, teardown := testhelper.MockDBSetup(t)
-	defer teardown()
-	id := int64(1)
-	srcRef := "2"
-
-	extra := map[string]interface{}{
-		"ask_inventory_on_launch": true,
-		"ask_variables_on_launch": false,
-		"survey_enabled":          true,
-		"type":                    "job_template"}
-	encodedExtra, err := json.Marshal(extra)
-	if err != nil {
-		t.Fatalf("Error encoding extra data")
-	}
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, srcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), time.Now(), encodedExtra)
-
-	// Can't use the same rows in multiple calls
-	rows2 := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, srcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), time.Now(), encodedExtra)
-
-	ctx := context.TODO()
-	sor := NewGORMRepository(gdb)
-	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_offerings" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	fetchStr := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
-	mock.ExpectQuery(regexp.QuoteMeta(fetchStr)).
-		WithArgs(srcRef, sourceID).
-		WillReturnRows(rows2)
-
-	markAsArchived := `UPDATE "service_offerings" SET "archived_at"=$1 WHERE "service_offerings"."id" = $2 AND "service_offerings"."archived_at" IS NULL`
-	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, id).
-		WillReturnError(fmt.Errorf("kaboom"))
-
-	keep := "4"
-	sourceRefs := []string{keep}
-	err = sor.DeleteUnwanted(ctx, testhelper.TestLogger(), &so, sourceRefs, &MockServicePlanRepository{})
-	checkErrors(t, err, mock, sor, "DeleteUnwantedErrorInDelete", "kaboom")
-}
-
-func TestDeleteUnwantedMissingInstance(t *testing.T) {
-	gdb, mock, teardown := testhelper.MockDBSetup(t)
-	defer teardown()
-	id := int64(1)
-	srcRef := "2"
-
-	extra := map[string]interface{}{
-		"ask_inventory_on_launch": true,
-		"ask_variables_on_launch": false,
-		"survey_enabled":          true,
-		"type":                    "job_template"}
-	encodedExtra, err := json.Marshal(extra)
-	if err != nil {
-		t.Fatalf("Error encoding extra data")
-	}
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, srcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), time.Now(), encodedExtra)
-
-	ctx := context.TODO()
-	sor := NewGORMRepository(gdb)
-	so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_offerings" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	fetchStr := `SELECT * FROM "service_offerings" WHERE "service_offerings"."source_ref" = $1 AND "service_offerings"."source_id" = $2 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
-	mock.ExpectQuery(regexp.QuoteMeta(fetchStr)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(fmt.Errorf("kaboom"))
-
-	keep := "4"
-	sourceRefs := []string{keep}
-	err = sor.DeleteUnwanted(ctx, testhelper.TestLogger(), &so, sourceRefs, &MockServicePlanRepository{})
-	checkErrors(t, err, mock, sor, "TestDeleteUnwantedMissingInstance", "kaboom")
-}
-
 func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, sor Repository, where string, errMessage string) {
 	assert.NotNil(t, err, where)
 
@@ -640,3 +559,58 @@ func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, sor Repository,
 	assert.Equal(t, stats["updates"], 0)
 	assert.Equal(t, stats["deletes"], 0)
 }
+
+func TestInventoryReference(t *testing.T) {
+	for _, inventory := range []interface{}{json.Number("12"), "/api/v2/inventories/12/"} {
+		attrs := makeDefaultAttrs("4", false)
+		attrs["inventory"] = inventory
+		so := ServiceOffering{SourceID: sourceID, TenantID: tenantID}
+		err := so.makeObject(attrs)
+		assert.Nil(t, err, "makeObject failed")
+		assert.Equal(t, "12", so.ServiceInventorySourceRef)
+	}
+}
+
+func TestMakeObjectInvalidFields(t *testing.T) {
+	cases := []struct {
+		field string
+		value interface{}
+	}{
+		{"id", nil},
+		{"id", "4"},
+		{"id", json.Number("4.5")},
+		{"created", nil},
+		{"modified", json.Number("1")},
+		{"name", nil},
+		{"name", json.Number("1")},
+		{"description", nil},
+		{"description", false},
+		{"type", nil},
+		{"survey_enabled", nil},
+		{"survey_enabled", "true"},
+		{"ask_inventory_on_launch", nil},
+		{"ask_variables_on_launch", json.Number("0")},
+		{"ask_tags_on_launch", nil},
+	}
+	for _, tc := range cases {
+		attrs := make(map[string]interface{})
+		for k, v := range makeDefaultAttrs("4", false) {
+			attrs[k] = v
+		}
+		attrs[tc.field] = tc.value
+		so := ServiceOffering{}
+		err := so.makeObject(attrs)
+		var fieldErr *base.FieldError
+		if assert.True(t, errors.As(err, &fieldErr), "%s %v should be invalid", tc.field, tc.value) {
+			assert.Equal(t, tc.field, fieldErr.Field)
+		}
+	}
+}
+
+func TestMakeObjectNullInventory(t *testing.T) {
+	attrs := makeDefaultAttrs("4", false)
+	attrs["inventory"] = nil
+	so := ServiceOffering{}
+	assert.NoError(t, so.makeObject(attrs))
+	assert.Equal(t, "", so.ServiceInventorySourceRef, "A job template can prompt for its inventory")
+}
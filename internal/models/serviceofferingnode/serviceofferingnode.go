@@ -6,8 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"regexp"
-	"sort"
+	"time"
 
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceinventory"
@@ -21,7 +20,11 @@ import (
 // ErrIgnoreTowerObject is raised when we encounter an object that we dont need
 var ErrIgnoreTowerObject = errors.New("Ignoring non job template or workflow job template nodes")
 
-var inventoriesRe = regexp.MustCompile(`\/api\/v2\/inventories\/(\w)\/`)
+// unifiedJobTemplates maps the unified job type to the collection in the related URL
+var unifiedJobTemplates = map[string]string{
+	"job":          "job_templates",
+	"workflow_job": "workflow_job_templates",
+}
 
 // ServiceOfferingNode maps to the Workflow Job Template Node fron Ansible Tower
 type ServiceOfferingNode struct {
@@ -47,7 +50,10 @@ type ServiceOfferingNode struct {
 type Repository interface {
 	DeleteUnwanted(ctx context.Context, logger *logrus.Entry, so *ServiceOfferingNode, keepSourceRefs []string) error
 	CreateOrUpdate(ctx context.Context, logger *logrus.Entry, so *ServiceOfferingNode, attrs map[string]interface{}) error
+	BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*ServiceOfferingNode, error)
+	MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error
 	Stats() map[string]int
+	Changes() []base.Change
 }
 
 // gormRepository struct stores the DB handle and counters
@@ -56,6 +62,9 @@ type gormRepository struct {
 	updates int
 	creates int
 	deletes int
+	seen    int
+	seenIDs []int64
+	base.ChangeLog
 }
 
 // NewGORMRepository creates a new repository object
@@ -63,74 +72,159 @@ func NewGORMRepository(db *gorm.DB) Repository {
 	return &gormRepository{db: db}
 }
 
+// UseTransaction makes the repository work in another transaction, the
+// stats and changes so far are kept
+func (gr *gormRepository) UseTransaction(db *gorm.DB) {
+	gr.db = db
+}
+
 // Stats returns a map with the number of adds/updates/deletes
 func (gr *gormRepository) Stats() map[string]int {
-	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes}
+	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes, "seen": gr.seen}
 }
 
-// CreateOrUpdate a ServiceOfferingNode Object in the Database
+// MarkSeen sets last_seen_at on all the objects that were seen in this refresh
+func (gr *gormRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	err := base.UpdateLastSeen(ctx, gr.db, "service_offering_nodes", gr.seenIDs, seenAt)
+	if err != nil {
+		logger.Errorf("Error updating last seen for service offering nodes %v", err)
+		return err
+	}
+	gr.seenIDs = nil
+	return nil
+}
+
+// CreateOrUpdate a single ServiceOfferingNode Object in the Database
 func (gr *gormRepository) CreateOrUpdate(ctx context.Context, logger *logrus.Entry, son *ServiceOfferingNode, attrs map[string]interface{}) error {
-	err := son.makeObject(attrs)
+	objs, err := gr.BulkCreateOrUpdate(ctx, logger, son.TenantID, son.SourceID, []map[string]interface{}{attrs})
 	if err != nil {
-		logger.Errorf("Error creating a new service offering node object %v", err)
 		return err
 	}
-	var instance ServiceOfferingNode
-	err = gr.db.Where(&ServiceOfferingNode{SourceID: son.SourceID, Tower: base.Tower{SourceRef: son.SourceRef}}).First(&instance).Error
+	if len(objs) == 0 {
+		return ErrIgnoreTowerObject
+	}
+	*son = *objs[0]
+	return nil
+}
+
+// BulkCreateOrUpdate all the ServiceOfferingNode Objects from a page, the existing
+// objects are fetched in one query and the new or changed objects are written
+// with a batched upsert
+func (gr *gormRepository) BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*ServiceOfferingNode, error) {
+	objs := make([]*ServiceOfferingNode, 0, len(attrsList))
+	sourceRefs := make([]string, 0, len(attrsList))
+	for i, attrs := range attrsList {
+		son := &ServiceOfferingNode{TenantID: tenantID, SourceID: sourceID}
+		err := son.makeObject(attrs)
+		if err == ErrIgnoreTowerObject {
+			logger.Info("Ignoring Tower Object")
+			continue
+		} else if err != nil {
+			logger.Errorf("Error creating a new service offering node object %v", err)
+			return nil, base.NewInvalidObjectError(i, attrs, err)
+		}
+		objs = append(objs, son)
+		sourceRefs = append(sourceRefs, son.SourceRef)
+	}
+	if len(objs) == 0 {
+		return objs, nil
+	}
+
+	var instances []ServiceOfferingNode
+	err := gr.db.WithContext(ctx).Scopes(base.TenantScope(tenantID, sourceID)).Where("source_ref IN ?", sourceRefs).Find(&instances).Error
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		logger.Errorf("Error locating Service Offering Nodes %v", err)
+		return nil, err
+	}
+	existing := make(map[string]*ServiceOfferingNode, len(instances))
+	for i := range instances {
+		existing[instances[i].SourceRef] = &instances[i]
+	}
+
+	var upserts []*ServiceOfferingNode
+	var pending []base.Change
+	creates, updates := 0, 0
+	for _, son := range objs {
+		instance, ok := existing[son.SourceRef]
+		if !ok {
 			logger.Infof("Creating a new Service Offering Node %s", son.SourceRef)
-			if result := gr.db.Create(son); result.Error != nil {
-				return fmt.Errorf("Error creating service offering node : %v", result.Error.Error())
-			}
-		} else {
-			logger.Errorf("Error locating Service Offering Node %s %v", son.SourceRef, err)
-			return err
+			upserts = append(upserts, son)
+			creates++
+			pending = append(pending, base.Created(son.attributes()))
+			continue
 		}
-		gr.creates++
-	} else {
-		logger.Infof("Service Offering Node %s exists in DB with ID %d", son.SourceRef, instance.ID)
-		son.ID = instance.ID // Get the Existing ID for the object
-		if instance.SourceUpdatedAt != son.SourceUpdatedAt {
-			instance.SourceUpdatedAt = son.SourceUpdatedAt
-			instance.RootServiceOfferingSourceRef = son.RootServiceOfferingSourceRef
-			instance.ServiceOfferingSourceRef = son.ServiceOfferingSourceRef
-			instance.Name = son.Name
-			instance.ServiceInventorySourceRef = son.ServiceInventorySourceRef
-
-			logger.Infof("Saving Service Offering source_ref %s", son.SourceRef)
-			err := gr.db.Save(&instance).Error
+		changed, err := base.DetectChanges(instance.attributes(), son.attributes())
+		if err != nil {
+			logger.Errorf("Error comparing Service Offering Node %s %v", son.SourceRef, err)
+			return nil, err
+		}
+		if len(changed) > 0 {
+			logger.Infof("Updating Service Offering Node %s exists in DB with ID %d changed fields %v", son.SourceRef, instance.ID, changed)
+			upserts = append(upserts, son)
+			updates++
+			change, err := base.Updated(changed, instance.attributes(), son.attributes())
 			if err != nil {
-				logger.Errorf("Error Updating Service Offering Node  source_ref %s", son.SourceRef)
-				return err
+				logger.Errorf("Error comparing Service Offering Node %s %v", son.SourceRef, err)
+				return nil, err
+			}
+			pending = append(pending, change)
+		} else {
+			logger.Infof("Service Offering Node %s is in sync with Tower", son.SourceRef)
+			son.ID = instance.ID // Get the Existing ID for the object
+			if refined := instance.attributes().Refined(son.attributes()); len(refined) > 0 {
+				err := base.RefineTimestamps(ctx, gr.db, "service_offering_nodes", instance.ID, son.attributes().Values(refined))
+				if err != nil {
+					logger.Errorf("Error refining timestamps of Service Offering Node %s %v", son.SourceRef, err)
+					return nil, err
+				}
 			}
-			gr.updates++
 		}
 	}
-	return nil
+
+	if err := base.BulkUpsert(ctx, gr.db, upserts, (&ServiceOfferingNode{}).attributes().Columns()); err != nil {
+		return nil, fmt.Errorf("Error saving service offering nodes : %v", err.Error())
+	}
+	gr.creates += creates
+	gr.updates += updates
+	for i, obj := range upserts {
+		pending[i].ID, pending[i].SourceRef = obj.ID, obj.SourceRef
+		gr.Record(pending[i])
+	}
+	for _, son := range objs {
+		gr.seen++
+		gr.seenIDs = append(gr.seenIDs, son.ID)
+	}
+	return objs, nil
 }
 
 // DeleteUnwanted deletes any objects not listed in the keepSourceRefs
 // This is used to delete ServiceOfferingNode that exist in our database but have been
 // deleted from the Ansible Tower
 func (gr *gormRepository) DeleteUnwanted(ctx context.Context, logger *logrus.Entry, son *ServiceOfferingNode, keepSourceRefs []string) error {
-	results, err := son.getDeleteIDs(ctx, logger, gr.db, keepSourceRefs)
+	results, err := base.DeleteUnwanted(ctx, gr.db, "service_offering_nodes", son.TenantID, son.SourceID, keepSourceRefs)
 	if err != nil {
-		logger.Errorf("Error getting Delete IDs for service offering node %v", err)
+		logger.Errorf("Error deleting Service Offering Nodes %v", err)
 		return err
 	}
 	for _, res := range results {
-		logger.Infof("Attempting to delete ServiceOfferingNode with ID %d Source ref %s", res.ID, res.SourceRef)
-		result := gr.db.Delete(&ServiceOfferingNode{SourceID: son.SourceID, TenantID: son.TenantID, Tower: base.Tower{SourceRef: res.SourceRef}}, res.ID)
-		if result.Error != nil {
-			logger.Errorf("Error deleting Service Offering Node %d %s %v", res.ID, res.SourceRef, result.Error)
-			return result.Error
-		}
-		gr.deletes++
+		gr.Record(base.Change{Action: base.ActionDeleted, ID: res.ID, SourceRef: res.SourceRef})
+		logger.Infof("Deleted ServiceOfferingNode with ID %d Source ref %s", res.ID, res.SourceRef)
 	}
+	gr.deletes += len(results)
 	return nil
 }
 
+// attributes returns the columns that we compare to detect changes, the
+// links to other objects are refreshed in ProcessLinks
+func (son *ServiceOfferingNode) attributes() base.Attributes {
+	return base.Attributes{
+		"name":              son.Name,
+		"extra":             son.Extra,
+		"source_created_at": son.SourceCreatedAt,
+		"source_updated_at": son.SourceUpdatedAt,
+	}
+}
+
 func (son *ServiceOfferingNode) validateAttributes(attrs map[string]interface{}) error {
 	requiredAttrs := []string{"id",
 		"created",
@@ -157,51 +251,24 @@ func (son *ServiceOfferingNode) makeObject(attrs map[string]interface{}) error {
 		return err
 	}
 	extra := make(map[string]interface{})
+	fields := base.NewFieldReader(attrs)
 
-	extra["unified_job_type"] = attrs["unified_job_type"].(string)
-	son.UnifiedJobType = attrs["unified_job_type"].(string)
+	son.UnifiedJobType = fields.String("unified_job_type")
+	extra["unified_job_type"] = son.UnifiedJobType
 
-	valueString, err := json.Marshal(extra)
-	if err != nil {
+	son.SourceCreatedAt = fields.Time("created")
+	son.SourceUpdatedAt = fields.Time("modified")
+	son.SourceRef = fields.ID()
+	if err := fields.Err(); err != nil {
 		return err
 	}
-	son.Extra = datatypes.JSON(valueString)
-	son.SourceCreatedAt, err = base.TowerTime(attrs["created"].(string))
-	if err != nil {
-		return err
-	}
-
-	son.SourceUpdatedAt, err = base.TowerTime(attrs["modified"].(string))
+	valueString, err := json.Marshal(extra)
 	if err != nil {
 		return err
 	}
-	son.SourceRef = attrs["id"].(json.Number).String()
-	son.RootServiceOfferingSourceRef = attrs["workflow_job_template"].(json.Number).String()
-	son.ServiceOfferingSourceRef = attrs["unified_job_template"].(json.Number).String()
-
-	switch attrs["inventory"].(type) {
-	case string:
-		s := inventoriesRe.FindStringSubmatch(attrs["inventory"].(string))
-		if len(s) > 0 {
-			son.ServiceInventorySourceRef = s[1]
-		}
-	}
+	son.Extra = datatypes.JSON(valueString)
+	son.RootServiceOfferingSourceRef = base.ReferenceID(attrs, "workflow_job_template", "workflow_job_templates")
+	son.ServiceOfferingSourceRef = base.ReferenceID(attrs, "unified_job_template", unifiedJobTemplates[son.UnifiedJobType])
+	son.ServiceInventorySourceRef = base.ReferenceID(attrs, "inventory", "inventories")
 	return nil
 }
-
-func (son *ServiceOfferingNode) getDeleteIDs(ctx context.Context, logger *logrus.Entry, tx *gorm.DB, keepSourceRefs []string) ([]base.ResultIDRef, error) {
-	var result []base.ResultIDRef
-	var deleteResultIDRef []base.ResultIDRef
-	sort.Strings(keepSourceRefs)
-	length := len(keepSourceRefs)
-	if err := tx.Table("service_offering_nodes").Select("id, source_ref").Where("source_id = ? AND archived_at IS NULL", son.SourceID).Scan(&result).Error; err != nil {
-		logger.Errorf("Error fetching ServiceOfferingNode %v", err)
-		return deleteResultIDRef, err
-	}
-	for _, res := range result {
-		if !base.SourceRefExists(res.SourceRef, keepSourceRefs, length) {
-			deleteResultIDRef = append(deleteResultIDRef, res)
-		}
-	}
-	return deleteResultIDRef, nil
-}
@@ -3,6 +3,7 @@ package serviceofferingnode
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -13,7 +14,6 @@ import (
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/gorm"
 )
 
 var objectType = "workflow_job_template_node"
@@ -32,6 +32,11 @@ func makeDefaultAttrs(srcRef string, created string, jobtype string) map[string]
 	}
 }
 
+// upsertRe matches the batched INSERT ... ON CONFLICT used for creates and updates
+// its RETURNING clause lists the id and the nullable foreign keys in no fixed
+// order, so mocked rows carry the id in every column
+var upsertRe = `^INSERT INTO "service_offering_nodes" .* ON CONFLICT \("tenant_id","source_id","source_ref"\) DO UPDATE SET`
+
 var columns = []string{"id", "tenant_id", "source_id", "source_ref", "name",
 	"source_created_at", "source_updated_at", "created_at", "updated_at"}
 var tenantID = int64(99)
@@ -96,10 +101,10 @@ func TestCreateErrorLocatingRecord(t *testing.T) {
 	srcRef := "4"
 	attrs := makeDefaultAttrs(srcRef, "2020-01-08T10:22:59.423585Z", "job")
 	son := ServiceOfferingNode{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offering_nodes" WHERE "service_offering_nodes"."source_ref" = $1 AND "service_offering_nodes"."source_id" = $2 AND "service_offering_nodes"."archived_at" IS NULL ORDER BY "service_offering_nodes"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offering_nodes" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offering_nodes"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnError(fmt.Errorf("kaboom"))
 
 	err := sonr.CreateOrUpdate(ctx, testhelper.TestLogger(), &son, attrs)
@@ -114,11 +119,11 @@ func TestCreateError(t *testing.T) {
 	sonr := NewGORMRepository(gdb)
 	srcRef := "4"
 	attrs := makeDefaultAttrs(srcRef, "2020-01-08T10:22:59.423585Z", "job")
-	str := `SELECT * FROM "service_offering_nodes" WHERE "service_offering_nodes"."source_ref" = $1 AND "service_offering_nodes"."source_id" = $2 AND "service_offering_nodes"."archived_at" IS NULL ORDER BY "service_offering_nodes"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offering_nodes" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offering_nodes"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(gorm.ErrRecordNotFound)
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
 
 	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "service_offering_nodes"`)).
 		WithArgs(testhelper.AnyTime{}, testhelper.AnyTime{}, nil, srcRef, testhelper.AnyTime{},
@@ -154,11 +159,11 @@ func TestCreate(t *testing.T) {
 	attrs := makeDefaultAttrs(srcRef, "2020-01-08T10:22:59.423585Z", "job")
 	newID := int64(78)
 	son := ServiceOfferingNode{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offering_nodes" WHERE "service_offering_nodes"."source_ref" = $1 AND "service_offering_nodes"."source_id" = $2 AND "service_offering_nodes"."archived_at" IS NULL ORDER BY "service_offering_nodes"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offering_nodes" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offering_nodes"."archived_at" IS NULL`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
-		WillReturnError(gorm.ErrRecordNotFound)
+		WithArgs(tenantID, sourceID, srcRef).
+		WillReturnRows(sqlmock.NewRows(columns))
 
 	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "service_offering_nodes"`)).
 		WithArgs(testhelper.AnyTime{}, testhelper.AnyTime{}, nil, srcRef, testhelper.AnyTime{}, testhelper.AnyTime{},
@@ -190,11 +195,11 @@ func TestCreateOrUpdateError(t *testing.T) {
 	ctx := context.TODO()
 	sonr := NewGORMRepository(gdb)
 	son := ServiceOfferingNode{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offering_nodes" WHERE "service_offering_nodes"."source_ref" = $1 AND "service_offering_nodes"."source_id" = $2 AND "service_offering_nodes"."archived_at" IS NULL ORDER BY "service_offering_nodes"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offering_nodes" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offering_nodes"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnError(fmt.Errorf("kaboom"))
+	mock.ExpectQuery(upsertRe).WillReturnError(fmt.Errorf("kaboom"))
 
 	err := sonr.CreateOrUpdate(ctx, testhelper.TestLogger(), &son, attrs)
 
@@ -212,11 +217,11 @@ func TestCreateOrUpdate(t *testing.T) {
 	ctx := context.TODO()
 	sonr := NewGORMRepository(gdb)
 	son := ServiceOfferingNode{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offering_nodes" WHERE "service_offering_nodes"."source_ref" = $1 AND "service_offering_nodes"."source_id" = $2 AND "service_offering_nodes"."archived_at" IS NULL ORDER BY "service_offering_nodes"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offering_nodes" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offering_nodes"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(upsertRe).WillReturnRows(sqlmock.NewRows([]string{"id", "service_inventory_id", "service_offering_id", "root_service_offering_id"}).AddRow(id, id, id, id))
 	err := sonr.CreateOrUpdate(ctx, testhelper.TestLogger(), &son, attrs)
 
 	assert.Nil(t, err, "CreateOrUpdate failed")
@@ -234,15 +239,15 @@ func TestNoChange(t *testing.T) {
 	id := int64(1)
 	srcRef := "4"
 	mt, _ := base.TowerTime(modifiedDateTime)
-	attrs := makeDefaultAttrs(srcRef, "2020-01-08T10:22:59.423585Z", "job")
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, srcRef, "Test", time.Now(), mt, time.Now(), time.Now())
+	attrs := makeDefaultAttrs(srcRef, modifiedDateTime, "job")
+	rows := sqlmock.NewRows(append(columns, "extra")).
+		AddRow(id, tenantID, sourceID, srcRef, "", mt, mt, time.Now(), time.Now(), []byte(`{"unified_job_type":"job"}`))
 	ctx := context.TODO()
 	sonr := NewGORMRepository(gdb)
 	son := ServiceOfferingNode{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_offering_nodes" WHERE "service_offering_nodes"."source_ref" = $1 AND "service_offering_nodes"."source_id" = $2 AND "service_offering_nodes"."archived_at" IS NULL ORDER BY "service_offering_nodes"."id" LIMIT 1`
+	str := `SELECT * FROM "service_offering_nodes" WHERE (tenant_id = $1 AND source_id = $2) AND source_ref IN ($3) AND "service_offering_nodes"."archived_at" IS NULL`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
 	err := sonr.CreateOrUpdate(ctx, testhelper.TestLogger(), &son, attrs)
 
@@ -254,23 +259,23 @@ func TestNoChange(t *testing.T) {
 	assert.Equal(t, stats["deletes"], 0)
 }
 
+// archiveStr is the set-based soft delete of the objects that are gone from Tower
+var archiveStr = `UPDATE service_offering_nodes SET archived_at = $1 WHERE tenant_id = $2 AND source_id = $3 AND archived_at IS NULL AND NOT (source_ref = ANY ($4::text[])) RETURNING id, source_ref`
+
+var archiveColumns = []string{"id", "source_ref"}
+
 func TestDeleteUnwantedMissing(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	id := int64(1)
-	sourceRef := "2"
-
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, sourceRef, "Test", time.Now(), time.Now(), time.Now(), time.Now())
+	srcRef := "2"
 
 	ctx := context.TODO()
 	sonr := NewGORMRepository(gdb)
 	son := ServiceOfferingNode{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_offering_nodes" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-	sourceRefs := []string{sourceRef}
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"2"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns))
+	sourceRefs := []string{srcRef}
 	err := sonr.DeleteUnwanted(ctx, testhelper.TestLogger(), &son, sourceRefs)
 
 	assert.Nil(t, err, "DeleteUnwantedMissing failed")
@@ -285,23 +290,14 @@ func TestDeleteUnwanted(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
 	id := int64(1)
-	sourceRef := "2"
-
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, sourceRef, "Test", time.Now(), time.Now(), time.Now(), time.Now())
+	srcRef := "2"
 
 	ctx := context.TODO()
 	sonr := NewGORMRepository(gdb)
 	son := ServiceOfferingNode{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_offering_nodes" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	markAsArchived := `UPDATE "service_offering_nodes" SET "archived_at"=$1 WHERE "service_offering_nodes"."id" = $2 AND "service_offering_nodes"."archived_at" IS NULL`
-	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, sourceID).
-		WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns).AddRow(id, srcRef))
 
 	keep := "4"
 	sourceRefs := []string{keep}
@@ -314,50 +310,41 @@ func TestDeleteUnwanted(t *testing.T) {
 	assert.Equal(t, stats["deletes"], 1)
 }
 
-func TestDeleteUnwantedError(t *testing.T) {
+func TestDeleteUnwantedKeepList(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
 
 	ctx := context.TODO()
 	sonr := NewGORMRepository(gdb)
 	son := ServiceOfferingNode{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_offering_nodes" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnError(fmt.Errorf("kaboom"))
+	// The whole keep list is sent as a single array parameter
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4","5","6"}`).
+		WillReturnRows(sqlmock.NewRows(archiveColumns).AddRow(int64(1), "2").AddRow(int64(3), "3"))
 
-	keep := "4"
-	sourceRefs := []string{keep}
+	sourceRefs := []string{"4", "5", "6"}
 	err := sonr.DeleteUnwanted(ctx, testhelper.TestLogger(), &son, sourceRefs)
-	checkErrors(t, err, mock, sonr, "DeleteUnwantedError", "kaboom")
+	assert.Nil(t, err, "DeleteUnwanted failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteUnwanted")
+	stats := sonr.Stats()
+	assert.Equal(t, stats["deletes"], 2)
 }
 
-func TestDeleteUnwantedErrorInDelete(t *testing.T) {
+func TestDeleteUnwantedError(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	id := int64(1)
-	sourceRef := "2"
-
-	rows := sqlmock.NewRows(columns).
-		AddRow(id, tenantID, sourceID, sourceRef, "Test", time.Now(), time.Now(), time.Now(), time.Now())
 
 	ctx := context.TODO()
 	sonr := NewGORMRepository(gdb)
 	son := ServiceOfferingNode{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT id, source_ref FROM "service_offering_nodes" WHERE source_id = $1 AND archived_at IS NULL`
-	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sourceID).
-		WillReturnRows(rows)
-
-	markAsArchived := `UPDATE "service_offering_nodes" SET "archived_at"=$1 WHERE "service_offering_nodes"."id" = $2 AND "service_offering_nodes"."archived_at" IS NULL`
-	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, sourceID).
+	mock.ExpectQuery(regexp.QuoteMeta(archiveStr)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"4"}`).
 		WillReturnError(fmt.Errorf("kaboom"))
 
 	keep := "4"
 	sourceRefs := []string{keep}
 	err := sonr.DeleteUnwanted(ctx, testhelper.TestLogger(), &son, sourceRefs)
-	checkErrors(t, err, mock, sonr, "DeleteUnwantedErrorInDelete", "kaboom")
+	checkErrors(t, err, mock, sonr, "DeleteUnwantedError", "kaboom")
 }
 
 func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, sonr Repository, where string, errMessage string) {
@@ -373,3 +360,39 @@ func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, sonr Repository,
 	assert.Equal(t, stats["updates"], 0)
 	assert.Equal(t, stats["deletes"], 0)
 }
+
+func TestMakeObjectInvalidFields(t *testing.T) {
+	cases := []struct {
+		field string
+		value interface{}
+	}{
+		{"id", nil},
+		{"id", "4"},
+		{"id", json.Number("4.5")},
+		{"created", nil},
+		{"modified", json.Number("1")},
+	}
+	for _, tc := range cases {
+		attrs := make(map[string]interface{})
+		for k, v := range makeDefaultAttrs("4", "2020-01-08T10:22:59.423567Z", "job") {
+			attrs[k] = v
+		}
+		attrs[tc.field] = tc.value
+		son := ServiceOfferingNode{}
+		err := son.makeObject(attrs)
+		var fieldErr *base.FieldError
+		if assert.True(t, errors.As(err, &fieldErr), "%s %v should be invalid", tc.field, tc.value) {
+			assert.Equal(t, tc.field, fieldErr.Field)
+		}
+	}
+}
+
+func TestMakeObjectNullTemplate(t *testing.T) {
+	attrs := makeDefaultAttrs("4", "2020-01-08T10:22:59.423567Z", "job")
+	attrs["unified_job_template"] = nil
+	attrs["inventory"] = nil
+	son := ServiceOfferingNode{}
+	assert.NoError(t, son.makeObject(attrs))
+	assert.Equal(t, "", son.ServiceOfferingSourceRef)
+	assert.Equal(t, "", son.ServiceInventorySourceRef)
+}
@@ -3,11 +3,10 @@ package serviceplan
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"reflect"
+	"time"
 
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/sirupsen/logrus"
@@ -38,8 +37,11 @@ type DDFConverter interface {
 // Repository interface supports deleted unwanted objects and creating or updating object
 type Repository interface {
 	Delete(ctx context.Context, logger *logrus.Entry, sp *ServicePlan) error
+	DeleteBySourceRefs(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, sourceRefs []string) error
 	CreateOrUpdate(ctx context.Context, logger *logrus.Entry, sp *ServicePlan, converter DDFConverter, attrs map[string]interface{}, r io.Reader) error
+	MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error
 	Stats() map[string]int
+	Changes() []base.Change
 }
 
 // gormRepository struct stores the DB handle and counters
@@ -48,6 +50,9 @@ type gormRepository struct {
 	updates int
 	creates int
 	deletes int
+	seen    int
+	seenIDs []int64
+	base.ChangeLog
 }
 
 // NewGORMRepository creates a new repository object
@@ -55,67 +60,115 @@ func NewGORMRepository(db *gorm.DB) Repository {
 	return &gormRepository{db: db}
 }
 
+// UseTransaction makes the repository work in another transaction, the
+// stats and changes so far are kept
+func (gr *gormRepository) UseTransaction(db *gorm.DB) {
+	gr.db = db
+}
+
 // Stats returns a map with the number of adds/updates/deletes
 func (gr *gormRepository) Stats() map[string]int {
-	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes}
+	return map[string]int{"adds": gr.creates, "updates": gr.updates, "deletes": gr.deletes, "seen": gr.seen}
+}
+
+// MarkSeen sets last_seen_at on all the objects that were seen in this refresh
+func (gr *gormRepository) MarkSeen(ctx context.Context, logger *logrus.Entry, seenAt time.Time) error {
+	err := base.UpdateLastSeen(ctx, gr.db, "service_plans", gr.seenIDs, seenAt)
+	if err != nil {
+		logger.Errorf("Error updating last seen for service plans %v", err)
+		return err
+	}
+	gr.seenIDs = nil
+	return nil
 }
 
 func (gr *gormRepository) CreateOrUpdate(ctx context.Context, logger *logrus.Entry, sp *ServicePlan, converter DDFConverter, attrs map[string]interface{}, r io.Reader) error {
 	err := sp.makeObject(ctx, logger, converter, attrs, r)
 	if err != nil {
 		logger.Infof("Error creating a new service plan object %v", err)
-		return err
+		return base.NewInvalidObjectError(0, attrs, err)
 	}
 	var instance ServicePlan
-	err = gr.db.Where(&ServicePlan{SourceID: sp.SourceID, Tower: base.Tower{SourceRef: sp.SourceRef}}).First(&instance).Error
+	err = gr.db.WithContext(ctx).Scopes(base.SourceRefScope(sp.TenantID, sp.SourceID, sp.SourceRef)).First(&instance).Error
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			logger.Infof("Creating a new Survey Spec %s", sp.SourceRef)
-			if result := gr.db.Create(sp); result.Error != nil {
-				return fmt.Errorf("Error creating survey spec: %v", result.Error.Error())
-			}
-		} else {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
 			logger.Infof("Error locating Survey Spec %s %v", sp.SourceRef, err)
 			return err
 		}
+		logger.Infof("Creating a new Survey Spec %s", sp.SourceRef)
+		if err := base.BulkUpsert(ctx, gr.db, []*ServicePlan{sp}, sp.attributes().Columns()); err != nil {
+			return fmt.Errorf("Error creating survey spec: %v", err.Error())
+		}
 		gr.creates++
+		change := base.Created(sp.attributes())
+		change.ID, change.SourceRef = sp.ID, sp.SourceRef
+		gr.Record(change)
 	} else {
 		logger.Infof("Survey Spec %s exists in DB with ID %d", sp.SourceRef, instance.ID)
-		sp.ID = instance.ID // Get the Existing ID for the object
 
-		var data1 map[string]interface{}
-		var data2 map[string]interface{}
-		if err := json.Unmarshal(instance.CreateJSONSchema, &data1); err != nil {
-			logger.Errorf("Error Unmarshalling spec %v", err)
-			return err
-		}
-		if err = json.Unmarshal(sp.CreateJSONSchema, &data2); err != nil {
+		changed, err := base.DetectChanges(instance.attributes(), sp.attributes())
+		if err != nil {
 			logger.Errorf("Error Unmarshalling spec %v", err)
 			return err
 		}
-		if !reflect.DeepEqual(data1, data2) {
-			instance.CreateJSONSchema = sp.CreateJSONSchema
-			instance.Description = sp.Description
-			instance.Name = sp.Name
-
-			logger.Infof("Saving Survey Spec  source_ref %s", sp.SourceRef)
-			err := gr.db.Save(&instance).Error
+		if len(changed) > 0 {
+			logger.Infof("Saving Survey Spec  source_ref %s changed fields %v", sp.SourceRef, changed)
+			change, err := base.Updated(changed, instance.attributes(), sp.attributes())
+			if err != nil {
+				logger.Errorf("Error Unmarshalling spec %v", err)
+				return err
+			}
+			err = base.BulkUpsert(ctx, gr.db, []*ServicePlan{sp}, sp.attributes().Columns())
 			if err != nil {
 				logger.Errorf("Error Updating Service Plan  source_ref %s", sp.SourceRef)
 				return err
 			}
 			gr.updates++
+			change.ID, change.SourceRef = sp.ID, sp.SourceRef
+			gr.Record(change)
+		} else {
+			logger.Infof("Survey Spec %s is in sync with Tower", sp.SourceRef)
+			sp.ID = instance.ID // Get the Existing ID for the object
 		}
 	}
+	gr.seen++
+	gr.seenIDs = append(gr.seenIDs, sp.ID)
 	return nil
 }
 
 func (gr *gormRepository) Delete(ctx context.Context, logger *logrus.Entry, sp *ServicePlan) error {
-	err := gr.db.Model(&ServicePlan{}).Where("source_ref = ? AND source_id = ?", sp.SourceRef, sp.SourceID).Delete(&ServicePlan{}).Error
-	if err == nil {
+	result := gr.db.WithContext(ctx).Model(&ServicePlan{}).Scopes(base.SourceRefScope(sp.TenantID, sp.SourceID, sp.SourceRef)).Delete(&ServicePlan{})
+	if result.Error == nil {
 		gr.deletes++
+		if result.RowsAffected > 0 {
+			gr.Record(base.Change{Action: base.ActionDeleted, ID: sp.ID, SourceRef: sp.SourceRef})
+		}
+	}
+	return result.Error
+}
+
+// DeleteBySourceRefs deletes the ServicePlans of many ServiceOfferings in one statement
+func (gr *gormRepository) DeleteBySourceRefs(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, sourceRefs []string) error {
+	results, err := base.DeleteSourceRefs(ctx, gr.db, "service_plans", tenantID, sourceID, sourceRefs)
+	if err != nil {
+		logger.Errorf("Error deleting Service Plans %v", err)
+		return err
+	}
+	for _, res := range results {
+		gr.Record(base.Change{Action: base.ActionDeleted, ID: res.ID, SourceRef: res.SourceRef})
+		logger.Infof("Deleted ServicePlan with ID %d Source ref %s", res.ID, res.SourceRef)
+	}
+	gr.deletes += len(results)
+	return nil
+}
+
+// attributes returns the columns that we compare to detect changes
+func (sp *ServicePlan) attributes() base.Attributes {
+	return base.Attributes{
+		"name":               sp.Name,
+		"description":        sp.Description,
+		"create_json_schema": sp.CreateJSONSchema,
 	}
-	return err
 }
 
 func (sp *ServicePlan) validateAttributes(attrs map[string]interface{}) error {
@@ -134,14 +187,18 @@ func (sp *ServicePlan) makeObject(ctx context.Context, logger *logrus.Entry, con
 	if err != nil {
 		return err
 	}
+	fields := base.NewFieldReader(attrs)
+	sp.Description = fields.String("description")
+	sp.Name = fields.String("name")
+	sp.SourceRef = fields.ID()
+	if err := fields.Err(); err != nil {
+		return err
+	}
 	spec, err := converter.Convert(ctx, logger, r)
 	if err != nil {
 		logger.Errorf("Error converting service plan %v", err)
 		return err
 	}
 	sp.CreateJSONSchema = datatypes.JSON(spec)
-	sp.Description = attrs["description"].(string)
-	sp.Name = attrs["name"].(string)
-	sp.SourceRef = attrs["id"].(json.Number).String()
 	return nil
 }
@@ -3,6 +3,7 @@ package serviceplan
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
@@ -44,6 +45,11 @@ var defaultAttrs = map[string]interface{}{
 	"type":        objectType,
 }
 
+// upsertRe matches the batched INSERT ... ON CONFLICT used for creates and updates
+// its RETURNING clause lists the id and the nullable foreign keys in no fixed
+// order, so mocked rows carry the id in every column
+var upsertRe = `^INSERT INTO "service_plans" .* ON CONFLICT \("tenant_id","source_id","source_ref"\) DO UPDATE SET`
+
 var columns = []string{"id", "created_at", "updated_at", "archived_at", "source_ref",
 	"source_created_at", "source_updated_at", "last_seen_at", "name", "description", "extra",
 	"create_json_schema", "update_json_schema", "service_offering_id", "tenant_id", "source_id"}
@@ -84,10 +90,10 @@ func TestCreateErrorLocatingRecord(t *testing.T) {
 	scr := NewGORMRepository(gdb)
 	srcRef := "4"
 	sp := ServicePlan{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_plans" WHERE "service_plans"."source_ref" = $1 AND "service_plans"."source_id" = $2 AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
+	str := `SELECT * FROM "service_plans" WHERE (tenant_id = $1 AND source_id = $2 AND source_ref = $3) AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnError(fmt.Errorf("kaboom"))
 
 	mc := &MockConverter{data: mockData, err: nil}
@@ -102,10 +108,10 @@ func TestCreateError(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	srcRef := "4"
-	str := `SELECT * FROM "service_plans" WHERE "service_plans"."source_ref" = $1 AND "service_plans"."source_id" = $2 AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
+	str := `SELECT * FROM "service_plans" WHERE (tenant_id = $1 AND source_id = $2 AND source_ref = $3) AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
 
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnError(gorm.ErrRecordNotFound)
 	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "service_plans"`)).
 		WithArgs(testhelper.AnyTime{}, testhelper.AnyTime{}, nil, srcRef, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), defaultAttrs["name"].(string), defaultAttrs["description"].(string), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), tenantID, sourceID).
@@ -138,9 +144,9 @@ func TestCreate(t *testing.T) {
 	srcRef := "4"
 	newID := int64(78)
 	sp := ServicePlan{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_plans" WHERE "service_plans"."source_ref" = $1 AND "service_plans"."source_id" = $2 AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
+	str := `SELECT * FROM "service_plans" WHERE (tenant_id = $1 AND source_id = $2 AND source_ref = $3) AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnError(gorm.ErrRecordNotFound)
 	insertStr := `INSERT INTO "service_plans" ("created_at","updated_at","archived_at","source_ref","source_created_at","source_updated_at","last_seen_at","name","description","extra","create_json_schema","update_json_schema","tenant_id","source_id") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14)`
 
@@ -177,11 +183,11 @@ func TestCreateOrUpdateError(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sp := ServicePlan{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_plans" WHERE "service_plans"."source_ref" = $1 AND "service_plans"."source_id" = $2 AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
+	str := `SELECT * FROM "service_plans" WHERE (tenant_id = $1 AND source_id = $2 AND source_ref = $3) AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnError(fmt.Errorf("kaboom"))
+	mock.ExpectQuery(upsertRe).WillReturnError(fmt.Errorf("kaboom"))
 
 	mc := &MockConverter{data: mockData, err: nil}
 	err = scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sp, mc, defaultAttrs, mockReader)
@@ -200,13 +206,13 @@ func TestNoChange(t *testing.T) {
 	}
 
 	rows := sqlmock.NewRows(columns).
-		AddRow(id, time.Now(), time.Now(), nil, srcRef, time.Now(), time.Now(), time.Now(), "test_name", "test_desc", encodedExtra, mockData, mockData, nil, tenantID, sourceID)
+		AddRow(id, time.Now(), time.Now(), nil, srcRef, time.Now(), time.Now(), time.Now(), "demo", "openshift", encodedExtra, mockData, mockData, nil, tenantID, sourceID)
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sp := ServicePlan{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_plans" WHERE "service_plans"."source_ref" = $1 AND "service_plans"."source_id" = $2 AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
+	str := `SELECT * FROM "service_plans" WHERE (tenant_id = $1 AND source_id = $2 AND source_ref = $3) AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
 	mc := &MockConverter{data: mockData, err: nil}
 	err = scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sp, mc, defaultAttrs, mockReader)
@@ -233,11 +239,11 @@ func TestCreateOrUpdate(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sp := ServicePlan{SourceID: sourceID, TenantID: tenantID}
-	str := `SELECT * FROM "service_plans" WHERE "service_plans"."source_ref" = $1 AND "service_plans"."source_id" = $2 AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
+	str := `SELECT * FROM "service_plans" WHERE (tenant_id = $1 AND source_id = $2 AND source_ref = $3) AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
 	mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(srcRef, sourceID).
+		WithArgs(tenantID, sourceID, srcRef).
 		WillReturnRows(rows)
-	mock.ExpectExec("^UPDATE").WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectQuery(upsertRe).WillReturnRows(sqlmock.NewRows([]string{"id", "service_offering_id"}).AddRow(id, id))
 	mc := &MockConverter{data: mockData, err: nil}
 	err = scr.CreateOrUpdate(ctx, testhelper.TestLogger(), &sp, mc, defaultAttrs, mockReader)
 
@@ -247,7 +253,16 @@ func TestCreateOrUpdate(t *testing.T) {
 	assert.Equal(t, stats["adds"], 0)
 	assert.Equal(t, stats["updates"], 1)
 	assert.Equal(t, stats["deletes"], 0)
-
+	changes := scr.Changes()
+	assert.Len(t, changes, 1)
+	assert.Equal(t, []string{"create_json_schema", "description", "name"}, changes[0].Changed)
+	assert.Equal(t, []base.JSONChange{
+		{Path: "/fruits", Before: nil, After: []interface{}{"apple", "peach"}},
+		{Path: "/kind", Before: "test", After: nil},
+		{Path: "/page", Before: nil, After: 1.0},
+		{Path: "/type", Before: objectType, After: nil},
+		{Path: "/variables", Before: "", After: nil},
+	}, changes[0].Diffs["create_json_schema"], "The survey changes should be listed")
 }
 
 func TestDelete(t *testing.T) {
@@ -257,9 +272,9 @@ func TestDelete(t *testing.T) {
 	ctx := context.TODO()
 	scr := NewGORMRepository(gdb)
 	sp := ServicePlan{SourceID: sourceID, TenantID: tenantID, Tower: base.Tower{SourceRef: srcRef}}
-	markAsArchived := `UPDATE "service_plans" SET "archived_at"=$1 WHERE (source_ref = $2 AND source_id = $3) AND "service_plans"."archived_at" IS NULL`
+	markAsArchived := `UPDATE "service_plans" SET "archived_at"=$1 WHERE (tenant_id = $2 AND source_id = $3 AND source_ref = $4) AND "service_plans"."archived_at" IS NULL`
 	mock.ExpectExec(regexp.QuoteMeta(markAsArchived)).
-		WithArgs(testhelper.AnyTime{}, srcRef, sourceID).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, srcRef).
 		WillReturnResult(sqlmock.NewResult(100, 1))
 	err := scr.Delete(ctx, testhelper.TestLogger(), &sp)
 	assert.Nil(t, err, "Delete failed")
@@ -270,6 +285,34 @@ func TestDelete(t *testing.T) {
 	assert.Equal(t, stats["deletes"], 1)
 }
 
+func TestDeleteBySourceRefs(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := context.TODO()
+	scr := NewGORMRepository(gdb)
+	markAsArchived := `UPDATE service_plans SET archived_at = $1 WHERE tenant_id = $2 AND source_id = $3 AND archived_at IS NULL AND source_ref = ANY ($4::text[]) RETURNING id, source_ref`
+	// Only one of the Service Offerings had a survey
+	mock.ExpectQuery(regexp.QuoteMeta(markAsArchived)).
+		WithArgs(testhelper.AnyTime{}, tenantID, sourceID, `{"2","3"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "source_ref"}).AddRow(int64(7), "3"))
+	err := scr.DeleteBySourceRefs(ctx, testhelper.TestLogger(), tenantID, sourceID, []string{"2", "3"})
+	assert.Nil(t, err, "DeleteBySourceRefs failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteBySourceRefs")
+	stats := scr.Stats()
+	assert.Equal(t, stats["deletes"], 1)
+}
+
+func TestDeleteBySourceRefsNone(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := context.TODO()
+	scr := NewGORMRepository(gdb)
+	err := scr.DeleteBySourceRefs(ctx, testhelper.TestLogger(), tenantID, sourceID, nil)
+	assert.Nil(t, err, "DeleteBySourceRefs failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations for DeleteBySourceRefs")
+	assert.Equal(t, scr.Stats()["deletes"], 0)
+}
+
 func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, scr Repository, where string, errMessage string) {
 	assert.NotNil(t, err, where)
 
@@ -283,3 +326,31 @@ func checkErrors(t *testing.T, err error, mock sqlmock.Sqlmock, scr Repository,
 	assert.Equal(t, stats["updates"], 0)
 	assert.Equal(t, stats["deletes"], 0)
 }
+
+func TestMakeObjectInvalidFields(t *testing.T) {
+	cases := []struct {
+		field string
+		value interface{}
+	}{
+		{"id", nil},
+		{"id", "4"},
+		{"id", json.Number("4.5")},
+		{"name", nil},
+		{"name", json.Number("1")},
+		{"description", nil},
+		{"description", false},
+	}
+	for _, tc := range cases {
+		attrs := make(map[string]interface{})
+		for k, v := range defaultAttrs {
+			attrs[k] = v
+		}
+		attrs[tc.field] = tc.value
+		sp := ServicePlan{}
+		err := sp.makeObject(context.TODO(), testhelper.TestLogger(), &MockConverter{data: mockData}, attrs, strings.NewReader("hello"))
+		var fieldErr *base.FieldError
+		if assert.True(t, errors.As(err, &fieldErr), "%s %v should be invalid", tc.field, tc.value) {
+			assert.Equal(t, tc.field, fieldErr.Field)
+		}
+	}
+}
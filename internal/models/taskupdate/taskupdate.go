@@ -0,0 +1,144 @@
+package taskupdate
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrSuperseded is returned when an update is saved after a newer update of
+// the same task
+var ErrSuperseded = errors.New("a newer update of the task has been saved")
+
+// PendingUpdate is a task update that Catalog Inventory has not acknowledged
+// yet. A task has at most one, a newer update of the task replaces it.
+// CreatedAt is when the update was made, UpdatedAt when it was last saved or
+// attempted.
+type PendingUpdate struct {
+	TaskURL   string `gorm:"primaryKey"`
+	Payload   datatypes.JSON
+	Headers   datatypes.JSON
+	Attempts  int
+	LastError string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TableName of the pending task updates
+func (PendingUpdate) TableName() string {
+	return "tower_persister_pending_task_updates"
+}
+
+// Repository interface supports operations on the pending task updates
+type Repository interface {
+	Save(ctx context.Context, pu *PendingUpdate) error
+	Acknowledge(ctx context.Context, pu *PendingUpdate) error
+	Failed(ctx context.Context, pu *PendingUpdate, reason string) error
+	Discard(ctx context.Context, pu *PendingUpdate) error
+	Unacknowledged(ctx context.Context, before time.Time) ([]PendingUpdate, error)
+	WhileCurrent(ctx context.Context, pu *PendingUpdate, fn func(store Repository) error) (bool, error)
+}
+
+type gormRepository struct {
+	db *gorm.DB
+}
+
+// NewGORMRepository creates a new repository object
+func NewGORMRepository(db *gorm.DB) Repository {
+	return &gormRepository{db: db}
+}
+
+// saveSQL replaces the update of a task only with a newer one, GORM builds
+// the WHERE of an ON CONFLICT before DO UPDATE where it is an index predicate
+const saveSQL = `INSERT INTO tower_persister_pending_task_updates ` +
+	`(task_url, payload, headers, attempts, last_error, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?) ` +
+	`ON CONFLICT (task_url) DO UPDATE SET payload = excluded.payload, headers = excluded.headers, ` +
+	`attempts = excluded.attempts, last_error = excluded.last_error, created_at = excluded.created_at, updated_at = excluded.updated_at ` +
+	`WHERE tower_persister_pending_task_updates.created_at <= excluded.created_at`
+
+// Save records the update of a task, replacing an older update of the same
+// task. UpdatedAt identifies this update when it is acknowledged, it is
+// kept to the precision of the database. ErrSuperseded is returned when a
+// newer update of the task was saved first, e.g. by another persister.
+func (gr *gormRepository) Save(ctx context.Context, pu *PendingUpdate) error {
+	now := gr.db.NowFunc().Truncate(time.Microsecond)
+	pu.CreatedAt = now
+	pu.UpdatedAt = now
+	pu.Attempts = 0
+	pu.LastError = ""
+	result := gr.db.WithContext(ctx).Exec(saveSQL, pu.TaskURL, pu.Payload, pu.Headers, pu.Attempts, pu.LastError, pu.CreatedAt, pu.UpdatedAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSuperseded
+	}
+	return nil
+}
+
+// Acknowledge deletes an update that Catalog Inventory accepted, unless a
+// newer update of the task has been saved in the meantime
+func (gr *gormRepository) Acknowledge(ctx context.Context, pu *PendingUpdate) error {
+	return gr.delete(ctx, pu)
+}
+
+// Discard deletes an update that will never be accepted, unless a newer
+// update of the task has been saved in the meantime
+func (gr *gormRepository) Discard(ctx context.Context, pu *PendingUpdate) error {
+	return gr.delete(ctx, pu)
+}
+
+func (gr *gormRepository) delete(ctx context.Context, pu *PendingUpdate) error {
+	return gr.db.WithContext(ctx).
+		Where("task_url = ? AND updated_at = ?", pu.TaskURL, pu.UpdatedAt).
+		Delete(&PendingUpdate{}).Error
+}
+
+// Failed records a failed attempt to deliver an update. UpdatedAt is moved
+// on so the update waits a full redelivery delay before it is sent again.
+func (gr *gormRepository) Failed(ctx context.Context, pu *PendingUpdate, reason string) error {
+	now := gr.db.NowFunc().Truncate(time.Microsecond)
+	err := gr.db.WithContext(ctx).Model(&PendingUpdate{}).
+		Where("task_url = ? AND updated_at = ?", pu.TaskURL, pu.UpdatedAt).
+		UpdateColumns(map[string]interface{}{"attempts": gorm.Expr("attempts + 1"), "last_error": reason, "updated_at": now}).Error
+	if err != nil {
+		return err
+	}
+	pu.Attempts++
+	pu.LastError = reason
+	pu.UpdatedAt = now
+	return nil
+}
+
+// Unacknowledged finds the updates saved before a time, oldest first
+func (gr *gormRepository) Unacknowledged(ctx context.Context, before time.Time) ([]PendingUpdate, error) {
+	var updates []PendingUpdate
+	err := gr.db.WithContext(ctx).Where("updated_at < ?", before).Order("updated_at").Find(&updates).Error
+	return updates, err
+}
+
+// WhileCurrent locks an update as long as it is still the current update of
+// its task, i.e. it has not been replaced, attempted or acknowledged since it
+// was read, and calls fn with a repository in the transaction holding the
+// lock. A newer update of the task waits for fn to return before it is saved.
+// It reports false, without calling fn, when the update is no longer current
+// or is locked by another persister.
+func (gr *gormRepository) WhileCurrent(ctx context.Context, pu *PendingUpdate, fn func(store Repository) error) (bool, error) {
+	current := false
+	err := gr.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var updates []PendingUpdate
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("task_url = ? AND updated_at = ?", pu.TaskURL, pu.UpdatedAt).
+			Find(&updates).Error
+		if err != nil || len(updates) == 0 {
+			return err
+		}
+		current = true
+		return fn(&gormRepository{db: tx})
+	})
+	return current, err
+}
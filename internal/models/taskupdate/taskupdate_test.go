@@ -0,0 +1,147 @@
+package taskupdate
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+const taskURL = "http://www.example.com/task/1"
+
+var updatedAt = time.Date(2021, 3, 1, 10, 0, 0, 123456000, time.UTC)
+
+var saveStr = `INSERT INTO tower_persister_pending_task_updates (task_url, payload, headers, attempts, last_error, created_at, updated_at) ` +
+	`VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (task_url) DO UPDATE SET payload = excluded.payload, headers = excluded.headers, ` +
+	`attempts = excluded.attempts, last_error = excluded.last_error, created_at = excluded.created_at, updated_at = excluded.updated_at ` +
+	`WHERE tower_persister_pending_task_updates.created_at <= excluded.created_at`
+
+func TestSave(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	mock.ExpectExec(regexp.QuoteMeta(saveStr)).
+		WithArgs(taskURL, sqlmock.AnyArg(), sqlmock.AnyArg(), 0, "", testhelper.AnyTime{}, testhelper.AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	pu := &PendingUpdate{TaskURL: taskURL, Payload: []byte(`{}`), Headers: []byte(`{}`), Attempts: 3, LastError: "kaboom"}
+	err := NewGORMRepository(gdb).Save(context.TODO(), pu)
+	assert.Nil(t, err, "Save failed")
+	assert.Equal(t, 0, pu.Attempts)
+	assert.Equal(t, pu.UpdatedAt, pu.UpdatedAt.Truncate(time.Microsecond), "UpdatedAt should fit the database precision")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestSaveSuperseded(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	mock.ExpectExec(regexp.QuoteMeta(saveStr)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	pu := &PendingUpdate{TaskURL: taskURL, Payload: []byte(`{}`), Headers: []byte(`{}`)}
+	err := NewGORMRepository(gdb).Save(context.TODO(), pu)
+	assert.Equal(t, ErrSuperseded, err, "An older update should not replace a newer one")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestAcknowledge(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	deleteStr := `DELETE FROM "tower_persister_pending_task_updates" WHERE task_url = $1 AND updated_at = $2`
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(deleteStr)).WithArgs(taskURL, updatedAt).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := NewGORMRepository(gdb).Acknowledge(context.TODO(), &PendingUpdate{TaskURL: taskURL, UpdatedAt: updatedAt})
+	assert.Nil(t, err, "Acknowledge failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestFailed(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	updateStr := `UPDATE "tower_persister_pending_task_updates" SET "attempts"=attempts + 1,"last_error"=$1,"updated_at"=$2 WHERE task_url = $3 AND updated_at = $4`
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(updateStr)).WithArgs("kaboom", testhelper.AnyTime{}, taskURL, updatedAt).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	pu := &PendingUpdate{TaskURL: taskURL, UpdatedAt: updatedAt, Attempts: 1}
+	err := NewGORMRepository(gdb).Failed(context.TODO(), pu, "kaboom")
+	assert.Nil(t, err, "Failed failed")
+	assert.Equal(t, 2, pu.Attempts)
+	assert.Equal(t, "kaboom", pu.LastError)
+	assert.True(t, pu.UpdatedAt.After(updatedAt), "The update should wait for the next redelivery")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestDiscard(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	deleteStr := `DELETE FROM "tower_persister_pending_task_updates" WHERE task_url = $1 AND updated_at = $2`
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(deleteStr)).WithArgs(taskURL, updatedAt).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := NewGORMRepository(gdb).Discard(context.TODO(), &PendingUpdate{TaskURL: taskURL, UpdatedAt: updatedAt})
+	assert.Nil(t, err, "Discard failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestUnacknowledged(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	selectStr := `SELECT * FROM "tower_persister_pending_task_updates" WHERE updated_at < $1 ORDER BY updated_at`
+	mock.ExpectQuery(regexp.QuoteMeta(selectStr)).
+		WithArgs(testhelper.AnyTime{}).
+		WillReturnRows(sqlmock.NewRows([]string{"task_url", "payload", "attempts"}).AddRow(taskURL, []byte(`{"state":"completed"}`), 2))
+
+	updates, err := NewGORMRepository(gdb).Unacknowledged(context.TODO(), time.Now())
+	assert.Nil(t, err, "Unacknowledged failed")
+	assert.Equal(t, 1, len(updates))
+	assert.Equal(t, 2, updates[0].Attempts)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+var lockStr = `SELECT * FROM "tower_persister_pending_task_updates" WHERE task_url = $1 AND updated_at = $2 FOR UPDATE SKIP LOCKED`
+
+func TestWhileCurrent(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	deleteStr := `DELETE FROM "tower_persister_pending_task_updates" WHERE task_url = $1 AND updated_at = $2`
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(lockStr)).
+		WithArgs(taskURL, updatedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"task_url", "updated_at"}).AddRow(taskURL, updatedAt))
+	mock.ExpectExec(regexp.QuoteMeta(deleteStr)).WithArgs(taskURL, updatedAt).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	pu := &PendingUpdate{TaskURL: taskURL, UpdatedAt: updatedAt}
+	current, err := NewGORMRepository(gdb).WhileCurrent(context.TODO(), pu, func(store Repository) error {
+		return store.Acknowledge(context.TODO(), pu)
+	})
+	assert.Nil(t, err, "WhileCurrent failed")
+	assert.True(t, current, "The update should be current")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestWhileCurrentReplaced(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(lockStr)).
+		WithArgs(taskURL, updatedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"task_url", "updated_at"}))
+	mock.ExpectCommit()
+
+	called := false
+	current, err := NewGORMRepository(gdb).WhileCurrent(context.TODO(), &PendingUpdate{TaskURL: taskURL, UpdatedAt: updatedAt}, func(store Repository) error {
+		called = true
+		return nil
+	})
+	assert.Nil(t, err, "WhileCurrent failed")
+	assert.False(t, current, "A replaced update should not be current")
+	assert.False(t, called, "A replaced update should not be delivered")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
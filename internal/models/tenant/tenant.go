@@ -1,9 +1,182 @@
 package tenant
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
 // Tenant Definition
 type Tenant struct {
 	ID             int64 `gorm:"primaryKey"`
 	Name           string
 	ExternalTenant string
+	OrgID          string
 	Description    string
 }
+
+// Lookup is a way of finding the tenant of a message
+type Lookup string
+
+const (
+	// LookupID finds the tenant by the tenant_id of the message
+	LookupID Lookup = "id"
+	// LookupOrgID finds the tenant by the org id of the identity
+	LookupOrgID Lookup = "org_id"
+	// LookupAccount finds the tenant by the account number of the identity,
+	// the external tenant of tenants created before org ids
+	LookupAccount Lookup = "account"
+)
+
+// DefaultPrecedence trusts the tenant_id of the message and falls back to
+// the identity, by org id first since account numbers are going away
+var DefaultPrecedence = []Lookup{LookupID, LookupOrgID, LookupAccount}
+
+// ErrNotFound is returned when none of the lookups finds a tenant
+var ErrNotFound = errors.New("tenant not found")
+
+// ParsePrecedence validates a comma separated list of lookups, e.g.
+// "org_id,account,id". An empty list is the DefaultPrecedence.
+func ParsePrecedence(s string) ([]Lookup, error) {
+	if strings.TrimSpace(s) == "" {
+		return DefaultPrecedence, nil
+	}
+	var result []Lookup
+	seen := make(map[Lookup]bool)
+	for _, name := range strings.Split(s, ",") {
+		l := Lookup(strings.TrimSpace(name))
+		switch l {
+		case LookupID, LookupOrgID, LookupAccount:
+		default:
+			return nil, fmt.Errorf("unknown tenant lookup %q, expected id, org_id or account", name)
+		}
+		if seen[l] {
+			return nil, fmt.Errorf("tenant lookup %q is listed twice", l)
+		}
+		seen[l] = true
+		result = append(result, l)
+	}
+	return result, nil
+}
+
+// Keys identify the tenant of a message, the zero values are not looked up
+type Keys struct {
+	ID            int64
+	AccountNumber string
+	OrgID         string
+}
+
+// Repository interface supports operations on the tenants
+type Repository interface {
+	ByID(ctx context.Context, id int64) (*Tenant, error)
+	ByOrgID(ctx context.Context, orgID string) (*Tenant, error)
+	ByAccount(ctx context.Context, accountNumber string) (*Tenant, error)
+	BackfillOrgID(ctx context.Context, t *Tenant, orgID string) (bool, error)
+	HasOrgID(ctx context.Context) (bool, error)
+}
+
+type gormRepository struct {
+	db *gorm.DB
+}
+
+// NewGORMRepository creates a new repository object
+func NewGORMRepository(db *gorm.DB) Repository {
+	return &gormRepository{db: db}
+}
+
+// ByID finds a tenant by its id
+func (gr *gormRepository) ByID(ctx context.Context, id int64) (*Tenant, error) {
+	var t Tenant
+	if err := gr.db.WithContext(ctx).First(&t, id).Error; err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ByOrgID finds a tenant by its org id
+func (gr *gormRepository) ByOrgID(ctx context.Context, orgID string) (*Tenant, error) {
+	var t Tenant
+	if err := gr.db.WithContext(ctx).Where("org_id = ?", orgID).First(&t).Error; err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ByAccount finds a tenant by its external tenant, the account number
+func (gr *gormRepository) ByAccount(ctx context.Context, accountNumber string) (*Tenant, error) {
+	var t Tenant
+	if err := gr.db.WithContext(ctx).Where("external_tenant = ?", accountNumber).First(&t).Error; err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// BackfillOrgID sets the org id of a tenant that does not have one yet so it
+// can be found by org id from then on. It returns false if the tenant
+// already had an org id.
+func (gr *gormRepository) BackfillOrgID(ctx context.Context, t *Tenant, orgID string) (bool, error) {
+	result := gr.db.WithContext(ctx).Model(&Tenant{}).
+		Where("id = ? AND (org_id IS NULL OR org_id = '')", t.ID).
+		Update("org_id", orgID)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	t.OrgID = orgID
+	return true, nil
+}
+
+// HasOrgID checks whether Catalog Inventory, which owns the tenants table, has
+// added the org_id column yet
+func (gr *gormRepository) HasOrgID(ctx context.Context) (bool, error) {
+	var count int64
+	err := gr.db.WithContext(ctx).Raw("SELECT count(*) FROM information_schema.columns WHERE table_schema = CURRENT_SCHEMA() AND table_name = ? AND column_name = ?", "tenants", "org_id").Row().Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// WithoutOrgID removes the org id lookup from a precedence
+func WithoutOrgID(precedence []Lookup) []Lookup {
+	var result []Lookup
+	for _, l := range precedence {
+		if l != LookupOrgID {
+			result = append(result, l)
+		}
+	}
+	return result
+}
+
+// Resolve finds the tenant of a message with the first lookup, in order of
+// precedence, that has a key and a matching tenant. It returns the lookup
+// that found the tenant.
+func Resolve(ctx context.Context, repo Repository, precedence []Lookup, keys Keys) (*Tenant, Lookup, error) {
+	for _, l := range precedence {
+		var t *Tenant
+		var err error
+		switch {
+		case l == LookupID && keys.ID != 0:
+			t, err = repo.ByID(ctx, keys.ID)
+		case l == LookupOrgID && keys.OrgID != "":
+			t, err = repo.ByOrgID(ctx, keys.OrgID)
+		case l == LookupAccount && keys.AccountNumber != "":
+			t, err = repo.ByAccount(ctx, keys.AccountNumber)
+		default:
+			continue
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, l, fmt.Errorf("Error finding tenant by %s: %v", l, err)
+		}
+		return t, l, nil
+	}
+	return nil, "", fmt.Errorf("%w: id %d account %q org %q", ErrNotFound, keys.ID, keys.AccountNumber, keys.OrgID)
+}
@@ -0,0 +1,209 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+var tenantColumns = []string{"id", "external_tenant", "org_id"}
+
+func TestParsePrecedence(t *testing.T) {
+	lookups, err := ParsePrecedence("")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultPrecedence, lookups)
+
+	lookups, err = ParsePrecedence("org_id, account,id")
+	assert.NoError(t, err)
+	assert.Equal(t, []Lookup{LookupOrgID, LookupAccount, LookupID}, lookups)
+
+	_, err = ParsePrecedence("org_id,name")
+	assert.EqualError(t, err, `unknown tenant lookup "name", expected id, org_id or account`)
+	_, err = ParsePrecedence("id,id")
+	assert.Error(t, err)
+}
+
+func TestByID(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	selectStr := `SELECT * FROM "tenants" WHERE "tenants"."id" = $1 ORDER BY "tenants"."id" LIMIT 1`
+	mock.ExpectQuery(regexp.QuoteMeta(selectStr)).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(tenantColumns).AddRow(3, "0000001", nil))
+
+	tenant, err := NewGORMRepository(gdb).ByID(context.TODO(), 3)
+	assert.Nil(t, err, "ByID failed")
+	assert.Equal(t, &Tenant{ID: 3, ExternalTenant: "0000001"}, tenant)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestByOrgID(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	selectStr := `SELECT * FROM "tenants" WHERE org_id = $1 ORDER BY "tenants"."id" LIMIT 1`
+	mock.ExpectQuery(regexp.QuoteMeta(selectStr)).
+		WithArgs("1234").
+		WillReturnRows(sqlmock.NewRows(tenantColumns).AddRow(3, "0000001", "1234"))
+
+	tenant, err := NewGORMRepository(gdb).ByOrgID(context.TODO(), "1234")
+	assert.Nil(t, err, "ByOrgID failed")
+	assert.Equal(t, int64(3), tenant.ID)
+	assert.Equal(t, "1234", tenant.OrgID)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestByAccount(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	selectStr := `SELECT * FROM "tenants" WHERE external_tenant = $1 ORDER BY "tenants"."id" LIMIT 1`
+	mock.ExpectQuery(regexp.QuoteMeta(selectStr)).
+		WithArgs("0000001").
+		WillReturnRows(sqlmock.NewRows(tenantColumns))
+
+	_, err := NewGORMRepository(gdb).ByAccount(context.TODO(), "0000001")
+	assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func testBackfillOrgID(t *testing.T, rows int64) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	updateStr := `UPDATE "tenants" SET "org_id"=$1 WHERE id = $2 AND (org_id IS NULL OR org_id = '')`
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(updateStr)).
+		WithArgs("1234", 3).
+		WillReturnResult(sqlmock.NewResult(0, rows))
+	mock.ExpectCommit()
+
+	tenant := &Tenant{ID: 3}
+	filled, err := NewGORMRepository(gdb).BackfillOrgID(context.TODO(), tenant, "1234")
+	assert.Nil(t, err, "BackfillOrgID failed")
+	assert.Equal(t, rows == 1, filled)
+	assert.Equal(t, filled, tenant.OrgID == "1234", "Only a backfilled tenant gets the org id")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestBackfillOrgID(t *testing.T) {
+	testBackfillOrgID(t, 1)
+}
+
+func TestBackfillOrgIDAlreadySet(t *testing.T) {
+	testBackfillOrgID(t, 0)
+}
+
+func testHasOrgID(t *testing.T, count int64) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	selectStr := `SELECT count(*) FROM information_schema.columns WHERE table_schema = CURRENT_SCHEMA() AND table_name = $1 AND column_name = $2`
+	mock.ExpectQuery(regexp.QuoteMeta(selectStr)).
+		WithArgs("tenants", "org_id").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+
+	found, err := NewGORMRepository(gdb).HasOrgID(context.TODO())
+	assert.Nil(t, err, "HasOrgID failed")
+	assert.Equal(t, count == 1, found)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestHasOrgID(t *testing.T) {
+	testHasOrgID(t, 1)
+}
+
+func TestHasOrgIDMissing(t *testing.T) {
+	testHasOrgID(t, 0)
+}
+
+func TestWithoutOrgID(t *testing.T) {
+	assert.Equal(t, []Lookup{LookupID, LookupAccount}, WithoutOrgID(DefaultPrecedence))
+	assert.Nil(t, WithoutOrgID([]Lookup{LookupOrgID}))
+}
+
+type fakeRepository struct {
+	byID      map[int64]*Tenant
+	byOrgID   map[string]*Tenant
+	byAccount map[string]*Tenant
+	err       error
+	calls     []Lookup
+}
+
+func (fr *fakeRepository) find(l Lookup, t *Tenant) (*Tenant, error) {
+	fr.calls = append(fr.calls, l)
+	if fr.err != nil {
+		return nil, fr.err
+	}
+	if t == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return t, nil
+}
+
+func (fr *fakeRepository) ByID(ctx context.Context, id int64) (*Tenant, error) {
+	return fr.find(LookupID, fr.byID[id])
+}
+
+func (fr *fakeRepository) ByOrgID(ctx context.Context, orgID string) (*Tenant, error) {
+	return fr.find(LookupOrgID, fr.byOrgID[orgID])
+}
+
+func (fr *fakeRepository) ByAccount(ctx context.Context, accountNumber string) (*Tenant, error) {
+	return fr.find(LookupAccount, fr.byAccount[accountNumber])
+}
+
+func (fr *fakeRepository) BackfillOrgID(ctx context.Context, t *Tenant, orgID string) (bool, error) {
+	return false, nil
+}
+
+func (fr *fakeRepository) HasOrgID(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func TestResolve(t *testing.T) {
+	legacy := &Tenant{ID: 3, ExternalTenant: "0000001"}
+	migrated := &Tenant{ID: 4, ExternalTenant: "0000002", OrgID: "1234"}
+	repo := func() *fakeRepository {
+		return &fakeRepository{
+			byID:      map[int64]*Tenant{3: legacy, 4: migrated},
+			byOrgID:   map[string]*Tenant{"1234": migrated},
+			byAccount: map[string]*Tenant{"0000001": legacy, "0000002": migrated},
+		}
+	}
+	cases := []struct {
+		precedence []Lookup
+		keys       Keys
+		tenant     *Tenant
+		lookup     Lookup
+		calls      []Lookup
+	}{
+		{DefaultPrecedence, Keys{ID: 3, OrgID: "1234"}, legacy, LookupID, []Lookup{LookupID}},
+		{DefaultPrecedence, Keys{OrgID: "1234", AccountNumber: "0000002"}, migrated, LookupOrgID, []Lookup{LookupOrgID}},
+		{DefaultPrecedence, Keys{OrgID: "5678", AccountNumber: "0000001"}, legacy, LookupAccount, []Lookup{LookupOrgID, LookupAccount}},
+		{[]Lookup{LookupOrgID, LookupID}, Keys{ID: 3, OrgID: "1234"}, migrated, LookupOrgID, []Lookup{LookupOrgID}},
+		{[]Lookup{LookupOrgID}, Keys{ID: 3, AccountNumber: "0000001"}, nil, "", nil},
+	}
+	for i, tc := range cases {
+		fr := repo()
+		tenant, lookup, err := Resolve(context.TODO(), fr, tc.precedence, tc.keys)
+		if tc.tenant == nil {
+			assert.True(t, errors.Is(err, ErrNotFound), "case %d", i)
+		} else {
+			assert.NoError(t, err, "case %d", i)
+		}
+		assert.Equal(t, tc.tenant, tenant, "case %d", i)
+		assert.Equal(t, tc.lookup, lookup, "case %d", i)
+		assert.Equal(t, tc.calls, fr.calls, "case %d", i)
+	}
+}
+
+func TestResolveFailure(t *testing.T) {
+	fr := &fakeRepository{err: fmt.Errorf("Kaboom")}
+	_, _, err := Resolve(context.TODO(), fr, DefaultPrecedence, Keys{ID: 3, OrgID: "1234"})
+	assert.EqualError(t, err, "Error finding tenant by id: Kaboom")
+	assert.Equal(t, []Lookup{LookupID}, fr.calls, "A failed lookup is not a missing tenant")
+}
@@ -0,0 +1,131 @@
+package testhelper
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// CountingDBSetup opens a DB for benchmarks that accepts every statement
+// and counts them, it makes every object in a refresh a new object
+func CountingDBSetup(tb testing.TB) (*gorm.DB, *CountingConnector) {
+	cc := &CountingConnector{}
+	gdb, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(cc)}),
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		tb.Fatalf("Error opening database %v", err)
+	}
+	return gdb, cc
+}
+
+// CountingConnector is a database/sql driver that accepts every statement
+// and counts them. Inserts return a generated id for every row, lookups of
+// ids by Tower id find every Tower id and all other queries return nothing,
+// which makes every object in a refresh a new object.
+type CountingConnector struct {
+	statements int64
+	nextID     int64
+}
+
+// Connect satisfies driver.Connector
+func (c *CountingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &countingConn{c: c}, nil
+}
+
+// Driver satisfies driver.Connector
+func (c *CountingConnector) Driver() driver.Driver {
+	return nil
+}
+
+type countingConn struct {
+	c *CountingConnector
+}
+
+func (cc *countingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("Prepare not supported")
+}
+
+func (cc *countingConn) Close() error {
+	return nil
+}
+
+func (cc *countingConn) Begin() (driver.Tx, error) {
+	return cc, nil
+}
+
+func (cc *countingConn) Commit() error {
+	return nil
+}
+
+func (cc *countingConn) Rollback() error {
+	return nil
+}
+
+func (cc *countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	atomic.AddInt64(&cc.c.statements, 1)
+	return driver.RowsAffected(1), nil
+}
+
+func (cc *countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	atomic.AddInt64(&cc.c.statements, 1)
+	rows := &countingRows{}
+	switch {
+	case strings.HasPrefix(query, "INSERT"):
+		i := strings.LastIndex(query, " RETURNING ")
+		rows.columns = strings.Split(strings.ReplaceAll(query[i+len(" RETURNING "):], `"`, ""), ",")
+		for n := strings.Count(query, "),(") + 1; n > 0; n-- {
+			row := make([]driver.Value, len(rows.columns))
+			for j, column := range rows.columns {
+				if column == "id" {
+					row[j] = atomic.AddInt64(&cc.c.nextID, 1)
+				}
+			}
+			rows.values = append(rows.values, row)
+		}
+	case strings.HasPrefix(query, "SELECT id, source_ref"):
+		rows.columns = []string{"id", "source_ref"}
+		// The first two arguments are the tenant and the source
+		for _, arg := range args[2:] {
+			rows.values = append(rows.values, []driver.Value{atomic.AddInt64(&cc.c.nextID, 1), arg.Value})
+		}
+	default:
+		rows.columns = []string{"id"}
+	}
+	return rows, nil
+}
+
+type countingRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (cr *countingRows) Columns() []string {
+	return cr.columns
+}
+
+func (cr *countingRows) Close() error {
+	return nil
+}
+
+func (cr *countingRows) Next(dest []driver.Value) error {
+	if len(cr.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, cr.values[0])
+	cr.values = cr.values[1:]
+	return nil
+}
+
+// Statements returns the number of statements sent so far
+func (c *CountingConnector) Statements() int64 {
+	return atomic.LoadInt64(&c.statements)
+}
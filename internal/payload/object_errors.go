@@ -0,0 +1,74 @@
+package payload
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
+)
+
+// ErrorPolicy decides what a refresh does with a Tower object that can not
+// be converted into a catalog object
+type ErrorPolicy string
+
+const (
+	// ErrorPolicyAbort fails the refresh on the first invalid object
+	ErrorPolicyAbort ErrorPolicy = "abort"
+	// ErrorPolicySkip leaves the invalid objects out, records them and
+	// refreshes the rest
+	ErrorPolicySkip ErrorPolicy = "skip"
+)
+
+// ParseErrorPolicy validates the name of an ErrorPolicy
+func ParseErrorPolicy(name string) (ErrorPolicy, error) {
+	switch p := ErrorPolicy(name); p {
+	case ErrorPolicyAbort, ErrorPolicySkip:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown object error policy %q, expected abort or skip", name)
+}
+
+// ObjectError is an object that was skipped because it is invalid
+type ObjectError struct {
+	Type      string `json:"type"`
+	SourceRef string `json:"source_ref"`
+	File      string `json:"file"`
+	Reason    string `json:"reason"`
+}
+
+// ObjectErrors are the objects skipped in a refresh, only the first
+// maxErrors are kept, the totals count all of them
+type ObjectErrors struct {
+	Objects []ObjectError  `json:"objects"`
+	Total   int            `json:"total"`
+	ByType  map[string]int `json:"by_type"`
+}
+
+// SetErrorPolicy sets what happens to invalid objects, with ErrorPolicySkip
+// up to maxErrors of the skipped objects are kept
+func (bol *BillOfLading) SetErrorPolicy(policy ErrorPolicy, maxErrors int) {
+	bol.errorPolicy = policy
+	bol.maxErrors = maxErrors
+}
+
+// ObjectErrors returns the objects that were skipped
+func (bol *BillOfLading) ObjectErrors() ObjectErrors {
+	return bol.objectErrors
+}
+
+// skipInvalid checks if a failed batch can go on without the invalid object
+// and records the object if it can
+func (bol *BillOfLading) skipInvalid(objType string, err error) (*base.InvalidObjectError, bool) {
+	var invalid *base.InvalidObjectError
+	if bol.errorPolicy != ErrorPolicySkip || !errors.As(err, &invalid) {
+		return nil, false
+	}
+	bol.logger.Errorf("Skipping invalid %s source ref %s in %s %v", objType, invalid.SourceRef, bol.currentFile, invalid.Reason)
+	oe := &bol.objectErrors
+	oe.Total++
+	oe.ByType[objType]++
+	if len(oe.Objects) < bol.maxErrors {
+		oe.Objects = append(oe.Objects, ObjectError{Type: objType, SourceRef: invalid.SourceRef, File: bol.currentFile, Reason: invalid.Reason.Error()})
+	}
+	return invalid, true
+}
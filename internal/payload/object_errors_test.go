@@ -0,0 +1,223 @@
+package payload
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/mocks"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceinventory"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceplan"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// invalidInventoryRepository rejects the inventories with source ref 78
+type invalidInventoryRepository struct {
+	mocks.MockServiceInventoryRepository
+	batches int
+}
+
+func (r *invalidInventoryRepository) BulkCreateOrUpdate(ctx context.Context, logger *logrus.Entry, tenantID, sourceID int64, attrsList []map[string]interface{}) ([]*serviceinventory.ServiceInventory, error) {
+	r.batches++
+	for i, attrs := range attrsList {
+		if attrs["id"].(interface{ String() string }).String() == "78" {
+			return nil, base.NewInvalidObjectError(i, attrs, errors.New("Missing Required Attribute description"))
+		}
+	}
+	var objs []*serviceinventory.ServiceInventory
+	for _, attrs := range attrsList {
+		r.AddsCalled++
+		objs = append(objs, &serviceinventory.ServiceInventory{Tower: base.Tower{SourceRef: attrs["id"].(interface{ String() string }).String()}})
+	}
+	return objs, nil
+}
+
+// convertingServicePlanRepository converts the survey like the real
+// repository does
+type convertingServicePlanRepository struct {
+	mocks.MockServicePlanRepository
+}
+
+func (r *convertingServicePlanRepository) CreateOrUpdate(ctx context.Context, logger *logrus.Entry, sp *serviceplan.ServicePlan, converter serviceplan.DDFConverter, attrs map[string]interface{}, reader io.Reader) error {
+	if _, err := converter.Convert(ctx, logger, reader); err != nil {
+		return base.NewInvalidObjectError(0, attrs, err)
+	}
+	r.AddsCalled++
+	return nil
+}
+
+var unsupportedSurvey = `{
+    "name": "",
+    "description": "",
+    "spec": [{"question_name": "Cost Factor", "required": true, "type": "gobbledegook", "variable": "cost_factor"}]
+}`
+
+func TestParseErrorPolicy(t *testing.T) {
+	for _, name := range []string{"abort", "skip"} {
+		p, err := ParseErrorPolicy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, ErrorPolicy(name), p)
+	}
+	_, err := ParseErrorPolicy("ignore")
+	assert.Error(t, err)
+}
+
+func TestSkipInvalidObjects(t *testing.T) {
+	repos := dummyObjectRepos(nil, nil)
+	inventories := &invalidInventoryRepository{}
+	repos.serviceinventoryrepo = inventories
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, repos, nil)
+	bol.SetErrorPolicy(ErrorPolicySkip, 10)
+
+	err := bol.ProcessPage(context.TODO(), "/api/v2/inventories/", strings.NewReader(createPayload("inventory")))
+	assert.Nil(t, err, "/api/v2/inventories/")
+
+	assert.Equal(t, 2, inventories.batches, "The batch should be added again without the invalid object")
+	assert.ElementsMatch(t, []string{"73", "78"}, bol.inventorySourceRefs, "The invalid object should not be deleted")
+	assert.Equal(t, 1, bol.objectCounts["inventory"])
+	assert.Equal(t, ObjectErrors{
+		Objects: []ObjectError{{Type: "inventory", SourceRef: "78", File: "/api/v2/inventories/", Reason: "Missing Required Attribute description"}},
+		Total:   1,
+		ByType:  map[string]int{"inventory": 1},
+	}, bol.ObjectErrors())
+}
+
+func TestSkipInvalidSurvey(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	repos := dummyObjectRepos(nil, nil)
+	repos.serviceplanrepo = &convertingServicePlanRepository{}
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, repos, gdb)
+	bol.SetErrorPolicy(ErrorPolicySkip, 10)
+	page := `{"count": 1, "next": null, "previous": null, "results": [{"id": 10, "type": "job_template", "SurveyEnabled": true, "SourceRef": "10"}]}`
+
+	err := bol.ProcessPage(context.TODO(), "/api/v2/job_templates/", strings.NewReader(page))
+	assert.Nil(t, err, "/api/v2/job_templates/")
+	assert.Equal(t, []string{"10"}, bol.jobTemplateSurvey)
+	err = bol.ProcessPage(context.TODO(), "/api/v2/job_templates/10/survey_spec/page1.json", strings.NewReader(unsupportedSurvey))
+	assert.Nil(t, err, "survey_spec")
+
+	assert.Equal(t, ObjectErrors{
+		Objects: []ObjectError{{Type: "survey_spec", SourceRef: "10", File: "/api/v2/job_templates/10/survey_spec/page1.json", Reason: "Unsupported field type gobbledegook"}},
+		Total:   1,
+		ByType:  map[string]int{"survey_spec": 1},
+	}, bol.ObjectErrors())
+	// No service plan is looked up for the skipped survey
+	assert.Nil(t, bol.updateSurveyLink(context.TODO(), gdb), "The links of a skipped survey should not fail the refresh")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestSkipInvalidInventoryLink(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	repos := dummyObjectRepos(nil, nil)
+	repos.serviceinventoryrepo = &invalidInventoryRepository{}
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, repos, gdb)
+	bol.SetErrorPolicy(ErrorPolicySkip, 10)
+	inventories := `{"count": 1, "next": null, "previous": null, "results": [{"id": 78, "type": "inventory"}]}`
+	jobTemplates := `{"count": 1, "next": null, "previous": null, "results": [{"id": 10, "ID": 730, "type": "job_template", "ServiceInventorySourceRef": "78"}]}`
+
+	err := bol.ProcessPage(context.TODO(), "/api/v2/inventories/", strings.NewReader(inventories))
+	assert.Nil(t, err, "/api/v2/inventories/")
+	err = bol.ProcessPage(context.TODO(), "/api/v2/job_templates/", strings.NewReader(jobTemplates))
+	assert.Nil(t, err, "/api/v2/job_templates/")
+
+	// The skipped inventory is not in the catalog and the job template is
+	// left without one
+	mock.ExpectQuery(regexp.QuoteMeta(sourceRefStr("service_inventories", 1))).
+		WithArgs(tenantID, sourceID, "78").
+		WillReturnRows(sqlmock.NewRows(sourceRefColumns))
+	assert.Nil(t, bol.updateInventoryLink(context.TODO(), gdb), "The links to a skipped inventory should not fail the refresh")
+	assert.Equal(t, LinkStats{Skipped: 1}, bol.linkStats)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestMissingInventoryLink(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, dummyObjectRepos(nil, nil), gdb)
+	bol.SetErrorPolicy(ErrorPolicySkip, 10)
+	jobTemplates := `{"count": 1, "next": null, "previous": null, "results": [{"id": 10, "ID": 730, "type": "job_template", "ServiceInventorySourceRef": "78"}]}`
+
+	err := bol.ProcessPage(context.TODO(), "/api/v2/job_templates/", strings.NewReader(jobTemplates))
+	assert.Nil(t, err, "/api/v2/job_templates/")
+
+	// An inventory that was not skipped has to be in the catalog
+	mock.ExpectQuery(regexp.QuoteMeta(sourceRefStr("service_inventories", 1))).
+		WithArgs(tenantID, sourceID, "78").
+		WillReturnRows(sqlmock.NewRows(sourceRefColumns))
+	err = bol.updateInventoryLink(context.TODO(), gdb)
+	assert.EqualError(t, err, "Error finding service inventory by src ref 78 : record not found")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestSkipInvalidObjectsCap(t *testing.T) {
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, dummyObjectRepos(nil, nil), nil)
+	bol.SetErrorPolicy(ErrorPolicySkip, 1)
+	page := `{"count": 2, "next": null, "previous": null, "results": [{"id": 1}, {"id": 2}]}`
+
+	err := bol.ProcessPage(context.TODO(), "/api/v2/inventories/", strings.NewReader(page))
+	assert.Nil(t, err, "/api/v2/inventories/")
+
+	skipped := bol.ObjectErrors()
+	assert.Equal(t, 2, skipped.Total)
+	assert.Equal(t, map[string]int{"unknown": 2}, skipped.ByType)
+	assert.Equal(t, []ObjectError{{Type: "unknown", SourceRef: "1", File: "/api/v2/inventories/", Reason: "No type provided"}}, skipped.Objects)
+}
+
+func TestSkipObjectsWithoutID(t *testing.T) {
+	repos := dummyObjectRepos(nil, nil)
+	repos.serviceinventoryrepo = &invalidInventoryRepository{}
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, repos, nil)
+	bol.SetErrorPolicy(ErrorPolicySkip, 10)
+	page := `{"count": 4, "next": null, "previous": null, "results": [{"type": "inventory"}, {"id": "abc", "type": "inventory"}, {"id": 1.5, "type": "inventory"}, {"id": 73, "type": "inventory"}]}`
+
+	err := bol.ProcessPage(context.TODO(), "/api/v2/inventories/", strings.NewReader(page))
+	assert.Nil(t, err, "/api/v2/inventories/")
+	assert.Equal(t, []string{"73"}, bol.inventorySourceRefs)
+	assert.Equal(t, 1, bol.objectCounts["inventory"])
+
+	skipped := bol.ObjectErrors()
+	assert.Equal(t, 3, skipped.Total)
+	assert.Equal(t, []ObjectError{
+		{Type: "inventory", SourceRef: "", File: "/api/v2/inventories/", Reason: "No id provided"},
+		{Type: "inventory", SourceRef: "", File: "/api/v2/inventories/", Reason: "No id provided"},
+		{Type: "inventory", SourceRef: "", File: "/api/v2/inventories/", Reason: "Invalid id 1.5"},
+	}, skipped.Objects)
+}
+
+func TestSkipIDListWithoutID(t *testing.T) {
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, dummyObjectRepos(nil, nil), nil)
+	bol.SetErrorPolicy(ErrorPolicySkip, 10)
+	page := `{"count": 2, "next": null, "previous": null, "results": [{"name": "x"}, {"id": 73}]}`
+
+	err := bol.ProcessPage(context.TODO(), "/api/v2/inventories/id/", strings.NewReader(page))
+	assert.Nil(t, err, "/api/v2/inventories/id/")
+	assert.Equal(t, []string{"73"}, bol.inventorySourceRefs)
+	assert.Equal(t, 1, bol.ObjectErrors().Total)
+}
+
+func TestAbortOnObjectWithoutID(t *testing.T) {
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, dummyObjectRepos(nil, nil), nil)
+	page := `{"count": 1, "next": null, "previous": null, "results": [{"type": "inventory"}]}`
+
+	err := bol.ProcessPage(context.TODO(), "/api/v2/inventories/", strings.NewReader(page))
+	assert.EqualError(t, err, "Invalid object source ref : No id provided")
+}
+
+func TestAbortOnInvalidObject(t *testing.T) {
+	repos := dummyObjectRepos(nil, nil)
+	repos.serviceinventoryrepo = &invalidInventoryRepository{}
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, repos, nil)
+
+	err := bol.ProcessPage(context.TODO(), "/api/v2/inventories/", strings.NewReader(createPayload("inventory")))
+	assert.NotNil(t, err, "/api/v2/inventories/")
+	assert.Equal(t, 0, bol.ObjectErrors().Total)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/servicecredential"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/servicecredentialtype"
@@ -22,6 +23,7 @@ import (
 
 // WorkflowNode stores the workflow relations
 type WorkflowNode struct {
+	ID                           int64
 	SourceRef                    string
 	ServiceOfferingSourceRef     string
 	RootServiceOfferingSourceRef string
@@ -50,22 +52,37 @@ type BillOfLading struct {
 	serviceCredentialToCredentialTypeMap map[string][]int64
 	jobTemplateSurvey                    []string
 	workflowJobTemplateSurvey            []string
+	skipped                              map[string]map[string]bool
 	workflowNodes                        []WorkflowNode
 	jobTemplateSourceRefs                []string
 	inventorySourceRefs                  []string
 	credentialSourceRefs                 []string
 	credentialTypeSourceRefs             []string
 	workflowNodeSourceRefs               []string
+	refreshTime                          time.Time
+	phase                                Phase
+	filesProcessed                       int
+	objectCounts                         map[string]int
+	onProgress                           ProgressFunc
+	currentFile                          string
+	errorPolicy                          ErrorPolicy
+	maxErrors                            int
+	objectErrors                         ObjectErrors
+	linkStats                            LinkStats
+	bytesRead                            int64
+	phaseDurations                       map[Phase]time.Duration
+	towerVersion                         string
 }
 
 // Loader interface has a Page Handler, after we have handled all the pages
-// we handle links between objects and then get rid of any of the objects
-// not needed anymore
+// we handle links between objects, record which objects were seen and then
+// get rid of any of the objects not needed anymore
 type Loader interface {
 	ProcessPage(ctx context.Context, name string, r io.Reader) error
 	ProcessLinks(ctx context.Context, dbTransaction *gorm.DB) error
+	ProcessLastSeen(ctx context.Context) error
 	ProcessDeletes(ctx context.Context) error
-	GetStats(ctx context.Context) map[string]interface{}
+	GetStats(ctx context.Context) Stats
 }
 
 // MakeBillOfLading creates a BillOfLading
@@ -75,47 +92,34 @@ func MakeBillOfLading(logger *logrus.Entry, tenant *tenant.Tenant, source *sourc
 		source:        source,
 		repos:         repos,
 		dbTransaction: dbTransaction,
+		refreshTime:   time.Now().UTC(),
 		logger:        logger}
 	if bol.repos == nil {
 		bol.repos = defaultObjectRepos(dbTransaction)
 	}
 	bol.inventoryMap = make(map[string][]int64)
 	bol.serviceCredentialToCredentialTypeMap = make(map[string][]int64)
+	bol.objectCounts = make(map[string]int)
+	bol.skipped = make(map[string]map[string]bool)
+	bol.phaseDurations = make(map[Phase]time.Duration)
+	bol.errorPolicy = ErrorPolicyAbort
+	bol.objectErrors.ByType = make(map[string]int)
 	return &bol
 }
 
 // ProcessTar downloads a Tar file from a given URL and processes one page (file) at a time
 // from the compressed tar.
 func ProcessTar(ctx context.Context, logger *logrus.Entry, loader Loader, client *http.Client, dbTransaction *gorm.DB, url string, shutdown chan struct{}) error {
-
-	logger.Infof("Fetching URL %s", url)
-
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		logger.Errorf("Error creating new request %v", err)
-		return err
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		logger.Errorf("Error getting URL %s %v", url, err)
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		logger.Errorf("HTTP Status for URL %s %v", url, resp.StatusCode)
-		return fmt.Errorf("Download failed, HTTP Status Code %d", resp.StatusCode)
-	}
-
-	zr, err := gzip.NewReader(resp.Body)
+	tr, closer, err := openTar(ctx, logger, client, url)
 	if err != nil {
-		logger.Errorf("Error opening gzip %v", err)
 		return err
 	}
-	defer zr.Close()
-	tr := tar.NewReader(zr)
+	defer closer()
 	for {
+		if err := interrupted(ctx, shutdown); err != nil {
+			logger.Errorf("Stopped processing tar %v", err)
+			return err
+		}
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
@@ -136,12 +140,73 @@ func ProcessTar(ctx context.Context, logger *logrus.Entry, loader Loader, client
 
 	}
 
-	err = loader.ProcessLinks(ctx, dbTransaction)
+	return finishRefresh(ctx, logger, loader, dbTransaction)
+}
+
+// interrupted reports why a refresh has to stop, either ctx is done or the
+// persister is shutting down
+func interrupted(ctx context.Context, shutdown chan struct{}) error {
+	select {
+	case <-shutdown:
+		return ErrShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// openTar downloads a compressed Tar file, the returned function closes
+// the download. The download is cancelled when ctx is done.
+func openTar(ctx context.Context, logger *logrus.Entry, client *http.Client, url string) (*tar.Reader, func(), error) {
+	logger.Infof("Fetching URL %s", url)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		logger.Errorf("Error creating new request %v", err)
+		return nil, nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Errorf("Error getting URL %s %v", url, err)
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		logger.Errorf("HTTP Status for URL %s %v", url, resp.StatusCode)
+		return nil, nil, fmt.Errorf("Download failed, HTTP Status Code %d", resp.StatusCode)
+	}
+
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		logger.Errorf("Error opening gzip %v", err)
+		return nil, nil, err
+	}
+	closer := func() {
+		zr.Close()
+		resp.Body.Close()
+	}
+	return tar.NewReader(zr), closer, nil
+}
+
+// finishRefresh links the objects, records which objects were seen and
+// deletes the ones that are gone once all the pages have been processed
+func finishRefresh(ctx context.Context, logger *logrus.Entry, loader Loader, dbTransaction *gorm.DB) error {
+	err := loader.ProcessLinks(ctx, dbTransaction)
 	if err != nil {
 		logger.Errorf("Error in linking objects %v", err)
 		return err
 	}
 
+	err = loader.ProcessLastSeen(ctx)
+	if err != nil {
+		logger.Errorf("Error in updating last seen %v", err)
+		return err
+	}
+
 	err = loader.ProcessDeletes(ctx)
 	if err != nil {
 		logger.Errorf("Error in deleting objects %v", err)
@@ -150,6 +215,31 @@ func ProcessTar(ctx context.Context, logger *logrus.Entry, loader Loader, client
 	return nil
 }
 
+// transactional is a repository that can be moved to another transaction
+type transactional interface {
+	UseTransaction(db *gorm.DB)
+}
+
+// UseTransaction moves the refresh to another transaction, e.g. once a
+// chunked refresh committed a chunk. Everything the refresh collected so far
+// is kept.
+func (bol *BillOfLading) UseTransaction(dbTransaction *gorm.DB) {
+	bol.dbTransaction = dbTransaction
+	repos := []interface{}{
+		bol.repos.servicecredentialrepo,
+		bol.repos.servicecredentialtyperepo,
+		bol.repos.serviceinventoryrepo,
+		bol.repos.serviceplanrepo,
+		bol.repos.serviceofferingrepo,
+		bol.repos.serviceofferingnoderepo,
+	}
+	for _, repo := range repos {
+		if t, ok := repo.(transactional); ok {
+			t.UseTransaction(dbTransaction)
+		}
+	}
+}
+
 func defaultObjectRepos(dbTransaction *gorm.DB) *ObjectRepos {
 	return &ObjectRepos{
 		servicecredentialrepo:     servicecredential.NewGORMRepository(dbTransaction),
@@ -0,0 +1,121 @@
+package payload
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/sirupsen/logrus"
+)
+
+// benchObjects is the number of job templates and inventories in the
+// generated tarball
+const benchObjects = 2000
+
+// makeBenchTar builds a gzipped tarball with benchObjects inventories and
+// job templates, each job template uses one of the inventories. The objects
+// are split into pages of pageSize objects.
+func makeBenchTar(b *testing.B, pageSize int) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	addPage := func(name string, results []map[string]interface{}) {
+		data, err := json.Marshal(map[string]interface{}{
+			"count":    len(results),
+			"next":     nil,
+			"previous": nil,
+			"results":  results})
+		if err != nil {
+			b.Fatalf("Error encoding page %v", err)
+		}
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			b.Fatalf("Error writing tar header %v", err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			b.Fatalf("Error writing tar data %v", err)
+		}
+	}
+
+	for _, objType := range []string{"inventories", "job_templates"} {
+		var ids []map[string]interface{}
+		for page := 0; page*pageSize < benchObjects; page++ {
+			var results []map[string]interface{}
+			for i := page * pageSize; i < benchObjects && i < (page+1)*pageSize; i++ {
+				results = append(results, benchObject(objType, i+1))
+				ids = append(ids, map[string]interface{}{"id": i + 1})
+			}
+			addPage(fmt.Sprintf("/api/v2/%s/page%d.json", objType, page+1), results)
+		}
+		addPage(fmt.Sprintf("/api/v2/%s/id1.json", objType), ids)
+	}
+
+	if err := tw.Close(); err != nil {
+		b.Fatalf("Error closing tar %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		b.Fatalf("Error closing gzip %v", err)
+	}
+	return buf.Bytes()
+}
+
+func benchObject(objType string, id int) map[string]interface{} {
+	obj := map[string]interface{}{
+		"id":          id,
+		"name":        fmt.Sprintf("object %d", id),
+		"description": "generated",
+		"created":     "2020-01-08T10:22:59.423567Z",
+		"modified":    "2020-01-08T10:22:59.423585Z",
+	}
+	if objType == "inventories" {
+		obj["type"] = "inventory"
+		obj["kind"] = ""
+		obj["variables"] = ""
+		obj["host_filter"] = nil
+		obj["pending_deletion"] = false
+		obj["organization"] = 1
+		obj["inventory_sources_with_failures"] = 0
+		return obj
+	}
+	obj["type"] = "job_template"
+	obj["inventory"] = id
+	obj["ask_inventory_on_launch"] = false
+	obj["ask_variables_on_launch"] = false
+	obj["survey_enabled"] = false
+	return obj
+}
+
+// benchmarkProcessTar runs a complete refresh of the generated tarball and
+// reports the number of statements sent to the database
+func benchmarkProcessTar(b *testing.B, pageSize int) {
+	data := makeBenchTar(b, pageSize)
+	gdb, cc := testhelper.CountingDBSetup(b)
+	log := testhelper.TestLogger()
+	log.Logger.SetLevel(logrus.ErrorLevel)
+	ctx := context.TODO()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bol := MakeBillOfLading(log, &testTenant, &testSource, nil, gdb)
+		fc := fakeClient(nil, ioutil.NopCloser(bytes.NewReader(data)), http.StatusOK)
+		err := ProcessTar(ctx, log, bol, fc, gdb, "https://www.example.com/data.tar", nil)
+		if err != nil {
+			b.Fatalf("Error processing tar %v", err)
+		}
+	}
+	b.ReportMetric(float64(cc.Statements())/float64(b.N), "statements/op")
+}
+
+// BenchmarkProcessTar measures a complete refresh with pages of the size
+// Tower exports. BenchmarkBulkUpsert in the base package compares the batched
+// writes with writing one object at a time.
+func BenchmarkProcessTar(b *testing.B) {
+	benchmarkProcessTar(b, 200)
+}
@@ -3,40 +3,157 @@ package payload
 import (
 	"context"
 	"fmt"
+	"io"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 )
 
 // Reporter Interface returns a summary of what database changes were performed
 type Reporter interface {
-	GetStats(ctx context.Context) map[string]interface{}
+	GetStats(ctx context.Context) Stats
+}
+
+// ObjectStats counts what a refresh did with the objects of one type
+type ObjectStats struct {
+	Adds      int `json:"adds"`
+	Updates   int `json:"updates"`
+	Deletes   int `json:"deletes"`
+	Unchanged int `json:"unchanged"`
+	// Skipped objects are not needed in the catalog, e.g. workflow nodes
+	// that are not job templates or workflows
+	Skipped int `json:"skipped"`
+	// Errors are invalid objects left out by ErrorPolicySkip
+	Errors int `json:"errors"`
+}
+
+// LinkStats counts the links between objects that were saved
+type LinkStats struct {
+	ServiceInventories   int `json:"service_inventories"`
+	CredentialTypes      int `json:"credential_types"`
+	ServicePlans         int `json:"service_plans"`
+	ServiceOfferingNodes int `json:"service_offering_nodes"`
+	// Skipped counts the links left out because their target was skipped
+	Skipped int `json:"skipped"`
+}
+
+// PhaseSeconds is how long each phase of the refresh took
+type PhaseSeconds struct {
+	Pages    float64 `json:"pages"`
+	Links    float64 `json:"links"`
+	LastSeen float64 `json:"last_seen"`
+	Deletes  float64 `json:"deletes"`
+}
+
+// Stats of a refresh, they are sent back to the Catalog Inventory API in the
+// output of the task. Objects always has an entry for every catalog object
+// type so the schema does not depend on what Tower sent.
+type Stats struct {
+	Objects      map[string]ObjectStats `json:"objects"`
+	Links        LinkStats              `json:"links"`
+	FilesRead    int                    `json:"files_read"`
+	BytesRead    int64                  `json:"bytes_read"`
+	PhaseSeconds PhaseSeconds           `json:"phase_seconds"`
+	TowerVersion string                 `json:"tower_version"`
+}
+
+// statsTypes maps the Tower object types to the catalog object types
+var statsTypes = map[string]string{
+	"credential":                 "credentials",
+	"credential_type":            "credential_types",
+	"inventory":                  "inventories",
+	"survey_spec":                "service_plans",
+	"job_template":               "service_offerings",
+	"workflow_job_template":      "service_offerings",
+	"workflow_job_template_node": "service_offering_nodes",
 }
 
 // GetStats get counters for objects added/updated/deleted which can be set back to the
 // Catalog Inventory API
-func (bol *BillOfLading) GetStats(ctx context.Context) map[string]interface{} {
-	bol.logReports(ctx)
-	stats := map[string]interface{}{
+func (bol *BillOfLading) GetStats(ctx context.Context) Stats {
+	repoStats := map[string]map[string]int{
 		"credentials":            bol.repos.servicecredentialrepo.Stats(),
-		"credential_types":       bol.repos.servicecredentialrepo.Stats(),
+		"credential_types":       bol.repos.servicecredentialtyperepo.Stats(),
 		"inventories":            bol.repos.serviceinventoryrepo.Stats(),
 		"service_plans":          bol.repos.serviceplanrepo.Stats(),
-		"service_offering":       bol.repos.serviceofferingrepo.Stats(),
+		"service_offerings":      bol.repos.serviceofferingrepo.Stats(),
 		"service_offering_nodes": bol.repos.serviceofferingnoderepo.Stats(),
 	}
+	received := make(map[string]int)
+	for objType, n := range bol.objectCounts {
+		received[statsTypes[objType]] += n
+	}
+	invalid := make(map[string]int)
+	for objType, n := range bol.objectErrors.ByType {
+		invalid[statsTypes[objType]] += n
+	}
+
+	stats := Stats{
+		Objects:      make(map[string]ObjectStats, len(repoStats)),
+		Links:        bol.linkStats,
+		FilesRead:    bol.filesProcessed,
+		BytesRead:    bol.bytesRead,
+		TowerVersion: bol.towerVersion,
+		PhaseSeconds: PhaseSeconds{
+			Pages:    bol.phaseDurations[PhasePages].Seconds(),
+			Links:    bol.phaseDurations[PhaseLinks].Seconds(),
+			LastSeen: bol.phaseDurations[PhaseLastSeen].Seconds(),
+			Deletes:  bol.phaseDurations[PhaseDeletes].Seconds(),
+		},
+	}
+	for name, x := range repoStats {
+		objStats := ObjectStats{Adds: x["adds"], Updates: x["updates"], Deletes: x["deletes"], Errors: invalid[name]}
+		if unchanged := x["seen"] - x["adds"] - x["updates"]; unchanged > 0 {
+			objStats.Unchanged = unchanged
+		}
+		if skipped := received[name] - x["seen"]; skipped > 0 {
+			objStats.Skipped = skipped
+		}
+		stats.Objects[name] = objStats
+	}
+	bol.logReports(stats)
 	return stats
 }
 
+// Changes returns the catalog objects the refresh created, updated or
+// deleted keyed by the catalog object type
+func (bol *BillOfLading) Changes() map[string][]base.Change {
+	return map[string][]base.Change{
+		"credentials":            bol.repos.servicecredentialrepo.Changes(),
+		"credential_types":       bol.repos.servicecredentialtyperepo.Changes(),
+		"inventories":            bol.repos.serviceinventoryrepo.Changes(),
+		"service_plans":          bol.repos.serviceplanrepo.Changes(),
+		"service_offerings":      bol.repos.serviceofferingrepo.Changes(),
+		"service_offering_nodes": bol.repos.serviceofferingnoderepo.Changes(),
+	}
+}
+
 // logReports log the objects added/updated/deleted
-func (bol *BillOfLading) logReports(ctx context.Context) {
-	x := bol.repos.servicecredentialrepo.Stats()
-	bol.logger.Info(fmt.Sprintf("Credential Add %d Updates %d Deletes %d", x["adds"], x["updates"], x["deletes"]))
-	x = bol.repos.servicecredentialrepo.Stats()
-	bol.logger.Info(fmt.Sprintf("Credential Type Add %d Updates %d Deletes %d", x["adds"], x["updates"], x["deletes"]))
-	x = bol.repos.serviceinventoryrepo.Stats()
-	bol.logger.Info(fmt.Sprintf("Inventory Type Add %d Updates %d Deletes %d", x["adds"], x["updates"], x["deletes"]))
-	x = bol.repos.serviceplanrepo.Stats()
-	bol.logger.Info(fmt.Sprintf("Service Plan Add %d Updates %d Deletes %d", x["adds"], x["updates"], x["deletes"]))
-	x = bol.repos.serviceofferingrepo.Stats()
-	bol.logger.Info(fmt.Sprintf("Service Offering Add %d Updates %d Deletes %d", x["adds"], x["updates"], x["deletes"]))
-	x = bol.repos.serviceofferingnoderepo.Stats()
-	bol.logger.Info(fmt.Sprintf("Service Offering Node Add %d Updates %d Deletes %d", x["adds"], x["updates"], x["deletes"]))
+func (bol *BillOfLading) logReports(stats Stats) {
+	for _, name := range []string{"credentials", "credential_types", "inventories", "service_plans", "service_offerings", "service_offering_nodes"} {
+		x := stats.Objects[name]
+		bol.logger.Info(fmt.Sprintf("%s Adds %d Updates %d Deletes %d Unchanged %d Skipped %d Errors %d", name, x.Adds, x.Updates, x.Deletes, x.Unchanged, x.Skipped, x.Errors))
+	}
+	bol.logger.Info(fmt.Sprintf("Read %d files %d bytes from Tower %s", stats.FilesRead, stats.BytesRead, stats.TowerVersion))
+}
+
+// timePhase adds the time until the returned function is called to the
+// duration of a phase
+func (bol *BillOfLading) timePhase(phase Phase) func() {
+	started := time.Now()
+	return func() {
+		bol.phaseDurations[phase] += time.Since(started)
+	}
+}
+
+// countingReader counts the bytes read from a file in the tar
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
 }
@@ -2,6 +2,9 @@ package payload
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"strings"
 	"testing"
 
@@ -12,14 +15,74 @@ import (
 func TestGetStats(t *testing.T) {
 	ctx := context.TODO()
 	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, dummyObjectRepos(nil, nil), nil)
+	data := createPayload("inventory")
+	err := bol.ProcessPage(ctx, "/api/v2/inventories/", strings.NewReader(data))
+	assert.Nil(t, err, "/api/v2/inventories/")
+	stats := bol.GetStats(ctx)
+	assert.Equal(t, ObjectStats{Adds: 2}, stats.Objects["inventories"])
+	assert.Equal(t, 1, stats.FilesRead)
+	assert.Equal(t, int64(len(data)), stats.BytesRead)
+	assert.True(t, stats.PhaseSeconds.Pages > 0, "The pages phase should have been timed")
+}
+
+func TestGetStatsCredentialTypes(t *testing.T) {
+	ctx := context.TODO()
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, dummyObjectRepos(nil, nil), nil)
+	err := bol.ProcessPage(ctx, "/api/v2/credential_types/", strings.NewReader(createPayload("credential_type")))
+	assert.Nil(t, err, "/api/v2/credential_types/")
+	stats := bol.GetStats(ctx)
+	assert.Equal(t, ObjectStats{Adds: 2}, stats.Objects["credential_types"])
+	assert.Equal(t, ObjectStats{}, stats.Objects["credentials"])
+}
+
+func TestGetStatsErrors(t *testing.T) {
+	ctx := context.TODO()
+	repos := dummyObjectRepos(nil, nil)
+	repos.serviceinventoryrepo = &invalidInventoryRepository{}
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, repos, nil)
+	bol.SetErrorPolicy(ErrorPolicySkip, 10)
 	err := bol.ProcessPage(ctx, "/api/v2/inventories/", strings.NewReader(createPayload("inventory")))
 	assert.Nil(t, err, "/api/v2/inventories/")
-	stats := bol.GetStats(ctx)["inventories"]
-	v, ok := stats.(map[string]int)
-	if !ok {
-		t.Errorf("Stats is not an interface")
+
+	assert.Equal(t, ObjectStats{Adds: 1, Errors: 1}, bol.GetStats(ctx).Objects["inventories"])
+}
+
+func TestGetStatsTowerVersion(t *testing.T) {
+	ctx := context.TODO()
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, dummyObjectRepos(nil, nil), nil)
+	err := bol.ProcessPage(ctx, "/api/v2/config/", strings.NewReader(`{"version": "3.8.1", "time_zone": "UTC"}`))
+	assert.Nil(t, err, "/api/v2/config/")
+	assert.Equal(t, "3.8.1", bol.GetStats(ctx).TowerVersion)
+}
+
+func TestGetStatsSchema(t *testing.T) {
+	ctx := context.TODO()
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, dummyObjectRepos(nil, nil), nil)
+	b, err := json.Marshal(bol.GetStats(ctx))
+	assert.NoError(t, err)
+
+	var stats map[string]interface{}
+	assert.NoError(t, json.Unmarshal(b, &stats))
+	for _, key := range []string{"objects", "links", "files_read", "bytes_read", "phase_seconds", "tower_version"} {
+		assert.Contains(t, stats, key)
+	}
+	objects := stats["objects"].(map[string]interface{})
+	for _, name := range []string{"credentials", "credential_types", "inventories", "service_plans", "service_offerings", "service_offering_nodes"} {
+		assert.Equal(t, map[string]interface{}{"adds": 0.0, "updates": 0.0, "deletes": 0.0, "unchanged": 0.0, "skipped": 0.0, "errors": 0.0}, objects[name], name)
 	}
-	assert.Equal(t, v["adds"], 2, "inventories")
-	assert.Equal(t, v["deletes"], 0, "inventories")
-	assert.Equal(t, v["updates"], 0, "inventories")
+	assert.Equal(t, map[string]interface{}{"service_inventories": 0.0, "credential_types": 0.0, "service_plans": 0.0, "service_offering_nodes": 0.0, "skipped": 0.0}, stats["links"])
+	assert.Equal(t, map[string]interface{}{"pages": 0.0, "links": 0.0, "last_seen": 0.0, "deletes": 0.0}, stats["phase_seconds"])
+}
+
+func TestCountingReader(t *testing.T) {
+	cr := &countingReader{r: strings.NewReader("12345")}
+	b := make([]byte, 3)
+	n, err := cr.Read(b)
+	assert.Equal(t, 3, n)
+	assert.NoError(t, err)
+	_, err = cr.Read(b)
+	assert.NoError(t, err)
+	_, err = cr.Read(b)
+	assert.True(t, errors.Is(err, io.EOF))
+	assert.Equal(t, int64(5), cr.n)
 }
@@ -31,12 +31,14 @@ func dummyObjectRepos(addError error, deleteError error) *ObjectRepos {
 }
 
 type mockLoader struct {
-	pageError     error
-	linkerError   error
-	deleteError   error
-	pageCount     int
-	linkerCalled  bool
-	deletesCalled bool
+	pageError      error
+	linkerError    error
+	lastSeenError  error
+	deleteError    error
+	pageCount      int
+	linkerCalled   bool
+	lastSeenCalled bool
+	deletesCalled  bool
 }
 
 func (ml *mockLoader) ProcessPage(ctx context.Context, name string, r io.Reader) error {
@@ -49,16 +51,18 @@ func (ml *mockLoader) ProcessLinks(ctx context.Context, dbTransaction *gorm.DB)
 	return ml.linkerError
 }
 
+func (ml *mockLoader) ProcessLastSeen(ctx context.Context) error {
+	ml.lastSeenCalled = true
+	return ml.lastSeenError
+}
+
 func (ml *mockLoader) ProcessDeletes(ctx context.Context) error {
 	ml.deletesCalled = true
 	return ml.deleteError
 }
 
-func (ml *mockLoader) GetStats(ctx context.Context) map[string]interface{} {
-	x := map[string]interface{}{
-		"test": 1,
-	}
-	return x
+func (ml *mockLoader) GetStats(ctx context.Context) Stats {
+	return Stats{}
 }
 
 type fakeTransport struct {
@@ -123,6 +127,7 @@ func TestProcessTarSuccess(t *testing.T) {
 	assert.Nil(t, err, "Should have parsed payload")
 	assert.Equal(t, ml.pageCount, 14, "14 Pages should be processed")
 	assert.True(t, ml.linkerCalled, true, "Linker should get called")
+	assert.True(t, ml.lastSeenCalled, true, "Last seen should get called")
 	assert.True(t, ml.deletesCalled, true, "Deletes should get called")
 }
 
@@ -162,9 +167,41 @@ var errorCases = []struct {
 }{
 	{"Kaboom in Page Handler", mockLoader{pageError: fmt.Errorf("Kaboom in Page Handler")}},
 	{"Kaboom in Linker", mockLoader{linkerError: fmt.Errorf("Kaboom in Linker")}},
+	{"Kaboom in Last Seen", mockLoader{lastSeenError: fmt.Errorf("Kaboom in Last Seen")}},
 	{"Kaboom in Deletes", mockLoader{deleteError: fmt.Errorf("Kaboom in Deletes")}},
 }
 
+func processSample(t *testing.T, ctx context.Context, shutdown chan struct{}, ml *mockLoader) error {
+	f, err := os.Open("testdata/sample.tgz")
+	if err != nil {
+		t.Fatalf("Error opening file %s %v", "testdata/sample.tgz", err)
+	}
+	defer f.Close()
+	fc := fakeClient(t, f, http.StatusOK)
+	return ProcessTar(ctx, testhelper.TestLogger(), ml, fc, nil, "https://www.example.com/data.tar", shutdown)
+}
+
+func TestProcessTarCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ml := mockLoader{}
+	err := processSample(t, ctx, make(chan struct{}), &ml)
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, ml.pageCount, "0 Pages should be processed")
+	assert.False(t, ml.linkerCalled, "Linker should not get called")
+}
+
+func TestProcessTarShutdown(t *testing.T) {
+	shutdown := make(chan struct{})
+	close(shutdown)
+	ml := mockLoader{}
+	err := processSample(t, context.TODO(), shutdown, &ml)
+
+	assert.Equal(t, ErrShutdown, err)
+	assert.Equal(t, 0, ml.pageCount, "0 Pages should be processed")
+}
+
 func TestProcessFailures(t *testing.T) {
 	for _, tt := range errorCases {
 		ctx := context.TODO()
@@ -11,6 +11,8 @@ import (
 
 //ProcessDeletes deletes unwanted objects
 func (bol *BillOfLading) ProcessDeletes(ctx context.Context) error {
+	defer bol.timePhase(PhaseDeletes)()
+	bol.progressed(PhaseDeletes)
 	if len(bol.jobTemplateSourceRefs) > 0 {
 		so := &serviceoffering.ServiceOffering{SourceID: bol.source.ID, TenantID: bol.tenant.ID}
 		if err := bol.repos.serviceofferingrepo.DeleteUnwanted(ctx, bol.logger, so, bol.jobTemplateSourceRefs, bol.repos.serviceplanrepo); err != nil {
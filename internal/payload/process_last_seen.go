@@ -0,0 +1,29 @@
+package payload
+
+import (
+	"context"
+)
+
+//ProcessLastSeen stamps last_seen_at with the refresh time on every object
+//that was part of this refresh, including the ones that were unchanged
+func (bol *BillOfLading) ProcessLastSeen(ctx context.Context) error {
+	defer bol.timePhase(PhaseLastSeen)()
+	bol.progressed(PhaseLastSeen)
+	seenAt := bol.refreshTime
+	if err := bol.repos.servicecredentialtyperepo.MarkSeen(ctx, bol.logger, seenAt); err != nil {
+		return err
+	}
+	if err := bol.repos.servicecredentialrepo.MarkSeen(ctx, bol.logger, seenAt); err != nil {
+		return err
+	}
+	if err := bol.repos.serviceinventoryrepo.MarkSeen(ctx, bol.logger, seenAt); err != nil {
+		return err
+	}
+	if err := bol.repos.serviceofferingrepo.MarkSeen(ctx, bol.logger, seenAt); err != nil {
+		return err
+	}
+	if err := bol.repos.serviceplanrepo.MarkSeen(ctx, bol.logger, seenAt); err != nil {
+		return err
+	}
+	return bol.repos.serviceofferingnoderepo.MarkSeen(ctx, bol.logger, seenAt)
+}
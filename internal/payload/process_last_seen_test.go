@@ -0,0 +1,29 @@
+package payload
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/mocks"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessLastSeen(t *testing.T) {
+	ctx := context.TODO()
+	repos := dummyObjectRepos(nil, nil)
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, repos, nil)
+	err := bol.ProcessPage(ctx, "/api/v2/inventories/", strings.NewReader(createPayload("inventory")))
+	assert.Nil(t, err, "/api/v2/inventories/")
+	err = bol.ProcessLastSeen(ctx)
+	assert.Nil(t, err, "ProcessLastSeen")
+
+	assert.True(t, repos.serviceinventoryrepo.(*mocks.MockServiceInventoryRepository).MarkSeenCalled)
+	assert.True(t, repos.serviceofferingrepo.(*mocks.MockServiceOfferingRepository).MarkSeenCalled)
+	assert.True(t, repos.serviceofferingnoderepo.(*mocks.MockServiceOfferingNodeRepository).MarkSeenCalled)
+	assert.True(t, repos.serviceplanrepo.(*mocks.MockServicePlanRepository).MarkSeenCalled)
+	assert.True(t, repos.servicecredentialrepo.(*mocks.MockServiceCredentialRepository).MarkSeenCalled)
+	assert.True(t, repos.servicecredentialtyperepo.(*mocks.MockServiceCredentialTypeRepository).MarkSeenCalled)
+	assert.Equal(t, 2, bol.GetStats(ctx).Objects["inventories"].Adds)
+}
@@ -2,20 +2,17 @@ package payload
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
+	"sort"
 
-	"github.com/RedHatInsights/catalog_tower_persister/internal/models/servicecredential"
-	"github.com/RedHatInsights/catalog_tower_persister/internal/models/servicecredentialtype"
-	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceinventory"
-	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceoffering"
-	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceofferingnode"
-	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceplan"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"gorm.io/gorm"
 )
 
 //ProcessLinks builds the links between different objects
 func (bol *BillOfLading) ProcessLinks(ctx context.Context, dbTransaction *gorm.DB) error {
+	defer bol.timePhase(PhaseLinks)()
+	bol.progressed(PhaseLinks)
 	err := bol.updateInventoryLink(ctx, dbTransaction)
 	if err != nil {
 		return err
@@ -32,102 +29,168 @@ func (bol *BillOfLading) ProcessLinks(ctx context.Context, dbTransaction *gorm.D
 }
 
 func (bol *BillOfLading) updateServiceNodeLink(ctx context.Context, dbTransaction *gorm.DB) error {
+	if len(bol.workflowNodes) == 0 {
+		return nil
+	}
+	var sourceRefs []string
 	for _, w := range bol.workflowNodes {
-		var son serviceofferingnode.ServiceOfferingNode
-		if result := dbTransaction.Where("source_ref= ? AND tenant_id = ? AND source_id = ?", w.SourceRef, bol.tenant.ID, bol.source.ID).First(&son); result.Error != nil {
-			return fmt.Errorf("Error finding service offering node  %s : %v", w.SourceRef, result.Error.Error())
-		}
+		sourceRefs = append(sourceRefs, w.ServiceOfferingSourceRef, w.RootServiceOfferingSourceRef)
+	}
+	ids, err := base.SourceRefIDs(ctx, dbTransaction, "service_offerings", bol.tenant.ID, bol.source.ID, sourceRefs)
+	if err != nil {
+		return fmt.Errorf("Error finding service offerings for nodes : %v", err.Error())
+	}
 
-		var so serviceoffering.ServiceOffering
-		if result := dbTransaction.Where("source_ref= ? AND tenant_id = ? AND source_id = ?", w.ServiceOfferingSourceRef, bol.tenant.ID, bol.source.ID).First(&so); result.Error != nil {
-			return fmt.Errorf("Error finding service offering %s : %v", w.ServiceOfferingSourceRef, result.Error.Error())
+	var offeringLinks, rootLinks []base.Link
+	for _, w := range bol.workflowNodes {
+		soID, err := bol.linkTarget(ids, w.ServiceOfferingSourceRef, "service offering", "job_template", "workflow_job_template")
+		if err != nil {
+			return err
+		}
+		if soID != 0 {
+			offeringLinks = append(offeringLinks, base.Link{ID: w.ID, TargetID: soID})
 		}
-		var rso serviceoffering.ServiceOffering
-		if result := dbTransaction.Where("source_ref= ? AND tenant_id = ? AND source_id = ?", w.RootServiceOfferingSourceRef, bol.tenant.ID, bol.source.ID).First(&rso); result.Error != nil {
-			return fmt.Errorf("Error finding root service offering %s : %v", w.RootServiceOfferingSourceRef, result.Error.Error())
+		rsoID, err := bol.linkTarget(ids, w.RootServiceOfferingSourceRef, "root service offering", "workflow_job_template")
+		if err != nil {
+			return err
 		}
-		son.ServiceOfferingID = sql.NullInt64{Int64: so.ID, Valid: true}
-		son.RootServiceOfferingID = sql.NullInt64{Int64: rso.ID, Valid: true}
-		if result := dbTransaction.Save(&son); result.Error != nil {
-			return fmt.Errorf("Error saving service offering node  %s : %v", w.SourceRef, result.Error.Error())
+		if rsoID != 0 {
+			rootLinks = append(rootLinks, base.Link{ID: w.ID, TargetID: rsoID})
 		}
 	}
+
+	if err := base.UpdateLinks(ctx, dbTransaction, "service_offering_nodes", "service_offering_id", bol.tenant.ID, bol.source.ID, offeringLinks); err != nil {
+		return fmt.Errorf("Error saving service offering nodes : %v", err.Error())
+	}
+	if err := base.UpdateLinks(ctx, dbTransaction, "service_offering_nodes", "root_service_offering_id", bol.tenant.ID, bol.source.ID, rootLinks); err != nil {
+		return fmt.Errorf("Error saving service offering nodes : %v", err.Error())
+	}
+	bol.linkStats.ServiceOfferingNodes += len(offeringLinks)
 	return nil
 }
 
 func (bol *BillOfLading) updateSurveyLink(ctx context.Context, dbTransaction *gorm.DB) error {
-	for _, v := range bol.jobTemplateSurvey {
-		err := bol.setSurvey(ctx, dbTransaction, v)
-		if err != nil {
-			return err
+	var sourceRefs []string
+	for _, sourceRef := range append(append([]string{}, bol.jobTemplateSurvey...), bol.workflowJobTemplateSurvey...) {
+		if bol.wasSkipped(sourceRef, "survey_spec") {
+			bol.linkStats.Skipped++
+			continue
 		}
+		sourceRefs = append(sourceRefs, sourceRef)
+	}
+	if len(sourceRefs) == 0 {
+		return nil
+	}
+	planIDs, err := base.SourceRefIDs(ctx, dbTransaction, "service_plans", bol.tenant.ID, bol.source.ID, sourceRefs)
+	if err != nil {
+		return fmt.Errorf("Error finding service plans : %v", err.Error())
+	}
+	offeringIDs, err := base.SourceRefIDs(ctx, dbTransaction, "service_offerings", bol.tenant.ID, bol.source.ID, sourceRefs)
+	if err != nil {
+		return fmt.Errorf("Error finding service offerings : %v", err.Error())
 	}
-	for _, v := range bol.workflowJobTemplateSurvey {
-		err := bol.setSurvey(ctx, dbTransaction, v)
+
+	var links []base.Link
+	for _, sourceRef := range sourceRefs {
+		spID, ok := planIDs[sourceRef]
+		if !ok {
+			return fmt.Errorf("Error finding service plan %s : %v", sourceRef, gorm.ErrRecordNotFound)
+		}
+		soID, err := bol.linkTarget(offeringIDs, sourceRef, "service offering", "job_template", "workflow_job_template")
 		if err != nil {
 			return err
 		}
+		if soID != 0 {
+			links = append(links, base.Link{ID: spID, TargetID: soID})
+		}
+	}
+	if err := base.UpdateLinks(ctx, dbTransaction, "service_plans", "service_offering_id", bol.tenant.ID, bol.source.ID, links); err != nil {
+		return fmt.Errorf("Error saving service plans : %v", err.Error())
 	}
+	bol.linkStats.ServicePlans += len(links)
 	return nil
 }
 
-func (bol *BillOfLading) setSurvey(ctx context.Context, dbTransaction *gorm.DB, sourceRef string) error {
-	var sp serviceplan.ServicePlan
-	var so serviceoffering.ServiceOffering
-
-	if result := dbTransaction.Where("source_ref= ? AND tenant_id = ? AND source_id = ?", sourceRef, bol.tenant.ID, bol.source.ID).First(&sp); result.Error != nil {
-
-		return fmt.Errorf("Error finding service plan %s : %v", sourceRef, result.Error.Error())
+func (bol *BillOfLading) updateInventoryLink(ctx context.Context, dbTransaction *gorm.DB) error {
+	links, err := bol.resolveLinks(ctx, dbTransaction, "service_inventories", "service inventory", "inventory", bol.inventoryMap)
+	if err != nil {
+		return err
 	}
-
-	if result := dbTransaction.Where("source_ref= ? AND tenant_id = ? AND source_id = ?", sourceRef, bol.tenant.ID, bol.source.ID).First(&so); result.Error != nil {
-		return fmt.Errorf("Error finding service offering %s : %v", sourceRef, result.Error.Error())
+	if err := base.UpdateLinks(ctx, dbTransaction, "service_offerings", "service_inventory_id", bol.tenant.ID, bol.source.ID, links); err != nil {
+		return fmt.Errorf("Error saving service offerings : %v", err.Error())
 	}
+	bol.linkStats.ServiceInventories += len(links)
+	return nil
+}
 
-	sp.ServiceOfferingID = sql.NullInt64{Int64: so.ID, Valid: true}
-	if result := dbTransaction.Save(&sp); result.Error != nil {
-		return fmt.Errorf("Error saving service plan %s : %v", sourceRef, result.Error.Error())
+func (bol *BillOfLading) updateCredentialTypeLink(ctx context.Context, dbTransaction *gorm.DB) error {
+	links, err := bol.resolveLinks(ctx, dbTransaction, "service_credential_types", "service credential type", "credential_type", bol.serviceCredentialToCredentialTypeMap)
+	if err != nil {
+		return err
+	}
+	if err := base.UpdateLinks(ctx, dbTransaction, "service_credentials", "service_credential_type_id", bol.tenant.ID, bol.source.ID, links); err != nil {
+		return fmt.Errorf("Error saving service credentials : %v", err.Error())
 	}
+	bol.linkStats.CredentialTypes += len(links)
 	return nil
 }
 
-func (bol *BillOfLading) updateInventoryLink(ctx context.Context, dbTransaction *gorm.DB) error {
-	for k, v := range bol.inventoryMap {
-		var si serviceinventory.ServiceInventory
-		if result := dbTransaction.Where("source_ref= ? AND tenant_id = ? AND source_id = ?", k, bol.tenant.ID, bol.source.ID).First(&si); result.Error != nil {
-
-			return fmt.Errorf("Error finding service inventory by src ref %v : %v", k, result.Error.Error())
-		}
-		for _, id := range v {
-			var so serviceoffering.ServiceOffering
-			if result := dbTransaction.Where("ID = ?", id).First(&so); result.Error != nil {
-				return fmt.Errorf("Error finding service offering %v : %v", id, result.Error.Error())
-			}
-			so.ServiceInventoryID = sql.NullInt64{Int64: si.ID, Valid: true}
-			if result := dbTransaction.Save(&so); result.Error != nil {
-				return fmt.Errorf("Error saving service offering %v : %v", id, result.Error.Error())
+// resolveLinks looks up the targets of a link map, which is keyed by the
+// Tower id of the target and lists the database ids of the objects pointing
+// at it, and returns the links to be updated. The links to a skipped target
+// of objType are left out.
+func (bol *BillOfLading) resolveLinks(ctx context.Context, dbTransaction *gorm.DB, table, name, objType string, linkMap map[string][]int64) ([]base.Link, error) {
+	sourceRefs := make([]string, 0, len(linkMap))
+	for k := range linkMap {
+		sourceRefs = append(sourceRefs, k)
+	}
+	sort.Strings(sourceRefs)
+	ids, err := base.SourceRefIDs(ctx, dbTransaction, table, bol.tenant.ID, bol.source.ID, sourceRefs)
+	if err != nil {
+		return nil, fmt.Errorf("Error finding %s : %v", name, err.Error())
+	}
+	var links []base.Link
+	for _, k := range sourceRefs {
+		targetID, ok := ids[k]
+		if !ok {
+			if bol.wasSkipped(k, objType) {
+				bol.logger.Infof("Leaving out %d links to skipped %s %s", len(linkMap[k]), name, k)
+				bol.linkStats.Skipped += len(linkMap[k])
+				continue
 			}
+			return nil, fmt.Errorf("Error finding %s by src ref %v : %v", name, k, gorm.ErrRecordNotFound)
+		}
+		for _, id := range linkMap[k] {
+			links = append(links, base.Link{ID: id, TargetID: targetID})
 		}
 	}
-	return nil
+	return links, nil
 }
 
-func (bol *BillOfLading) updateCredentialTypeLink(ctx context.Context, dbTransaction *gorm.DB) error {
-	for k, v := range bol.serviceCredentialToCredentialTypeMap {
-		var sct servicecredentialtype.ServiceCredentialType
-		if result := dbTransaction.Where("source_ref= ? AND tenant_id = ? AND source_id = ?", k, bol.tenant.ID, bol.source.ID).First(&sct); result.Error != nil {
-			return fmt.Errorf("Error finding service cerdential type %v : %v", k, result.Error.Error())
-		}
-		for _, id := range v {
-			var sc servicecredential.ServiceCredential
-			if result := dbTransaction.Where("ID = ?", id).First(&sc); result.Error != nil {
-				return fmt.Errorf("Error finding service credential %v : %v", id, result.Error.Error())
-			}
-			sc.ServiceCredentialTypeID = sql.NullInt64{Int64: sct.ID, Valid: true}
-			if result := dbTransaction.Save(&sc); result.Error != nil {
-				return fmt.Errorf("Error saving service credential %v : %v", id, result.Error.Error())
-			}
+// linkTarget finds the database id of the target of a link in ids, the
+// target is 0 when the link has no target or its target was skipped as one
+// of objTypes
+func (bol *BillOfLading) linkTarget(ids map[string]int64, sourceRef, name string, objTypes ...string) (int64, error) {
+	if sourceRef == "" {
+		return 0, nil
+	}
+	if id, ok := ids[sourceRef]; ok {
+		return id, nil
+	}
+	if bol.wasSkipped(sourceRef, objTypes...) {
+		bol.logger.Infof("Leaving out the link to skipped %s %s", name, sourceRef)
+		bol.linkStats.Skipped++
+		return 0, nil
+	}
+	return 0, fmt.Errorf("Error finding %s %s : %v", name, sourceRef, gorm.ErrRecordNotFound)
+}
+
+// wasSkipped checks if an object of one of objTypes was skipped as invalid
+func (bol *BillOfLading) wasSkipped(sourceRef string, objTypes ...string) bool {
+	for _, objType := range objTypes {
+		if bol.skipped[objType][sourceRef] {
+			return true
 		}
 	}
-	return nil
+	return false
 }
@@ -6,7 +6,6 @@ import (
 	"regexp"
 	"strings"
 	"testing"
-	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
@@ -97,24 +96,17 @@ var testWorkflowNodeData = `{
    ]
    }`
 
-var serviceOfferingColumns = []string{"id", "tenant_id", "source_id", "source_ref", "name", "type_name",
-	"description", "source_created_at", "created_at", "updated_at",
-	"extra"}
-
-var servicePlanColumns = []string{"id", "created_at", "updated_at", "archived_at", "source_ref",
-	"source_created_at", "last_seen_at", "name", "description", "extra",
-	"create_json_schema", "update_json_schema", "service_offering_id", "tenant_id", "source_id"}
-var serviceCredentialTypeColumns = []string{"id", "created_at", "updated_at", "archived_at", "source_ref",
-	"source_created_at", "last_seen_at", "name", "description", "kind",
-	"namespace", "tenant_id", "source_id"}
-var serviceOfferingNodeColumns = []string{"id", "tenant_id", "source_id", "source_ref", "name",
-	"source_created_at", "created_at", "updated_at"}
-var serviceInventoryColumns = []string{"id", "created_at", "updated_at", "archived_at", "source_ref",
-	"source_created_at", "last_seen_at", "name", "description", "extra",
-	"tenant_id", "source_id"}
-var serviceCredentialColumns = []string{"id", "tenant_id", "source_id", "source_ref", "name", "type_name",
-	"description", "source_created_at", "created_at", "updated_at",
-	"service_credential_type_id"}
+var sourceRefColumns = []string{"id", "source_ref"}
+
+// sourceRefStr is the lookup of database ids by Tower id for a table
+func sourceRefStr(table string, count int) string {
+	params := make([]string, count)
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", i+3)
+	}
+	return fmt.Sprintf(`SELECT id, source_ref FROM "%s" WHERE (tenant_id = $1 AND source_id = $2) AND (source_ref IN (%s) AND archived_at IS NULL)`, table, strings.Join(params, ","))
+}
+
 var tenantID = testTenant.ID
 var sourceID = testSource.ID
 
@@ -138,7 +130,8 @@ func TestServiceInventoryLink(t *testing.T) {
 		mock: mock, t: t}
 
 	setInventoryMocks(&lc, &sit, nil, nil, nil)
-	checkSuccess(&lc)
+	bol := checkSuccess(&lc)
+	assert.Equal(t, LinkStats{ServiceInventories: 1}, bol.GetStats(context.TODO()).Links)
 }
 
 func TestServiceInventoryLinkError1(t *testing.T) {
@@ -161,7 +154,7 @@ func TestServiceInventoryLinkError1(t *testing.T) {
 func TestServiceInventoryLinkError2(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	errMessage := "Blow up during find"
+	errMessage := gorm.ErrRecordNotFound.Error()
 	sit := serviceInventoryTest{serviceInventorySrcRef: "55",
 		serviceInventoryID:    int64(567),
 		serviceOfferingID:     int64(730),
@@ -193,36 +186,34 @@ func TestServiceInventoryLinkError3(t *testing.T) {
 }
 
 func setInventoryMocks(lc *linkCommon, sit *serviceInventoryTest, err1, err2, errSave error) {
-	str := `SELECT * FROM "service_inventories" WHERE (source_ref= $1 AND tenant_id = $2 AND source_id = $3) AND "service_inventories"."archived_at" IS NULL ORDER BY "service_inventories"."id" LIMIT 1`
+	str := sourceRefStr("service_inventories", 1)
 	if err1 != nil {
 		lc.mock.ExpectQuery(regexp.QuoteMeta(str)).
-			WithArgs(sit.serviceInventorySrcRef, tenantID, sourceID).
+			WithArgs(tenantID, sourceID, sit.serviceInventorySrcRef).
 			WillReturnError(err1)
 		return
 	}
-	rows := sqlmock.NewRows(serviceInventoryColumns).
-		AddRow(sit.serviceInventoryID, time.Now(), time.Now(), nil, sit.serviceInventorySrcRef, time.Now(), time.Now(), "test_name", "test_desc", nil, tenantID, sourceID)
+	rows := sqlmock.NewRows(sourceRefColumns)
+	// A missing inventory is reported as record not found
+	if err2 == nil {
+		rows.AddRow(sit.serviceInventoryID, sit.serviceInventorySrcRef)
+	}
 	lc.mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sit.serviceInventorySrcRef, tenantID, sourceID).
+		WithArgs(tenantID, sourceID, sit.serviceInventorySrcRef).
 		WillReturnRows(rows)
-
-	soStr := `SELECT * FROM "service_offerings" WHERE ID = $1 AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
 	if err2 != nil {
-		lc.mock.ExpectQuery(regexp.QuoteMeta(soStr)).
-			WithArgs(sit.serviceOfferingID).
-			WillReturnError(err2)
 		return
 	}
-	soRows := sqlmock.NewRows(serviceOfferingColumns).
-		AddRow(sit.serviceOfferingID, tenantID, sourceID, sit.serviceOfferingSrcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), nil)
-	lc.mock.ExpectQuery(regexp.QuoteMeta(soStr)).
-		WithArgs(sit.serviceOfferingID).
-		WillReturnRows(soRows)
 
+	updateStr := `UPDATE service_offerings AS t SET service_inventory_id = v.target_id FROM (VALUES ($1::bigint, $2::bigint)) AS v(id, target_id) WHERE t.id = v.id AND t.tenant_id = $3 AND t.source_id = $4`
 	if errSave != nil {
-		lc.mock.ExpectExec("^UPDATE").WillReturnError(errSave)
+		lc.mock.ExpectExec(regexp.QuoteMeta(updateStr)).
+			WithArgs(sit.serviceOfferingID, sit.serviceInventoryID, tenantID, sourceID).
+			WillReturnError(errSave)
 	} else {
-		lc.mock.ExpectExec("^UPDATE").WillReturnResult(sqlmock.NewResult(100, 1))
+		lc.mock.ExpectExec(regexp.QuoteMeta(updateStr)).
+			WithArgs(sit.serviceOfferingID, sit.serviceInventoryID, tenantID, sourceID).
+			WillReturnResult(sqlmock.NewResult(100, 1))
 	}
 }
 
@@ -301,36 +292,39 @@ func TestServicePlanWorkflowLinkError3(t *testing.T) {
 }
 
 func setServicePlanMocks(lc *linkCommon, spt *servicePlanTest, err1, err2, errSave error) {
-	str := `SELECT * FROM "service_plans" WHERE (source_ref= $1 AND tenant_id = $2 AND source_id = $3) AND "service_plans"."archived_at" IS NULL ORDER BY "service_plans"."id" LIMIT 1`
+	str := sourceRefStr("service_plans", 1)
 	if err1 != nil {
 		lc.mock.ExpectQuery(regexp.QuoteMeta(str)).
-			WithArgs(spt.servicePlanSrcRef, tenantID, sourceID).
+			WithArgs(tenantID, sourceID, spt.servicePlanSrcRef).
 			WillReturnError(err1)
 		return
 	}
-	rows := sqlmock.NewRows(servicePlanColumns).
-		AddRow(spt.servicePlanID, time.Now(), time.Now(), nil, spt.servicePlanSrcRef, time.Now(), time.Now(), "test_name", "test_desc", nil, nil, nil, nil, tenantID, sourceID)
+	rows := sqlmock.NewRows(sourceRefColumns).AddRow(spt.servicePlanID, spt.servicePlanSrcRef)
 	lc.mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(spt.servicePlanSrcRef, tenantID, sourceID).
+		WithArgs(tenantID, sourceID, spt.servicePlanSrcRef).
 		WillReturnRows(rows)
 
-	soStr := `SELECT * FROM "service_offerings" WHERE (source_ref= $1 AND tenant_id = $2 AND source_id = $3) AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
+	soStr := sourceRefStr("service_offerings", 1)
 	if err2 != nil {
 		lc.mock.ExpectQuery(regexp.QuoteMeta(soStr)).
-			WithArgs(spt.serviceOfferingSrcRef, tenantID, sourceID).
+			WithArgs(tenantID, sourceID, spt.serviceOfferingSrcRef).
 			WillReturnError(err2)
 		return
 	}
-	soRows := sqlmock.NewRows(serviceOfferingColumns).
-		AddRow(spt.serviceOfferingID, tenantID, sourceID, spt.serviceOfferingSrcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), nil)
+	soRows := sqlmock.NewRows(sourceRefColumns).AddRow(spt.serviceOfferingID, spt.serviceOfferingSrcRef)
 	lc.mock.ExpectQuery(regexp.QuoteMeta(soStr)).
-		WithArgs(spt.serviceOfferingSrcRef, tenantID, sourceID).
+		WithArgs(tenantID, sourceID, spt.serviceOfferingSrcRef).
 		WillReturnRows(soRows)
 
+	updateStr := `UPDATE service_plans AS t SET service_offering_id = v.target_id FROM (VALUES ($1::bigint, $2::bigint)) AS v(id, target_id) WHERE t.id = v.id AND t.tenant_id = $3 AND t.source_id = $4`
 	if errSave != nil {
-		lc.mock.ExpectExec("^UPDATE").WillReturnError(errSave)
+		lc.mock.ExpectExec(regexp.QuoteMeta(updateStr)).
+			WithArgs(spt.servicePlanID, spt.serviceOfferingID, tenantID, sourceID).
+			WillReturnError(errSave)
 	} else {
-		lc.mock.ExpectExec("^UPDATE").WillReturnResult(sqlmock.NewResult(100, 1))
+		lc.mock.ExpectExec(regexp.QuoteMeta(updateStr)).
+			WithArgs(spt.servicePlanID, spt.serviceOfferingID, tenantID, sourceID).
+			WillReturnResult(sqlmock.NewResult(100, 1))
 	}
 }
 
@@ -442,7 +436,7 @@ func TestCredentialTypeLinkError1(t *testing.T) {
 func TestCredentialTypeLinkError2(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	errMessage := "Blow up during second find"
+	errMessage := gorm.ErrRecordNotFound.Error()
 	sct := serviceCredentialTest{credentialTypeSrcRef: "885",
 		credentialTypeID: int64(567),
 		credentialID:     int64(730),
@@ -472,36 +466,34 @@ func TestCredentialTypeLinkError3(t *testing.T) {
 }
 
 func setCredentialMocks(lc *linkCommon, sct *serviceCredentialTest, err1, err2, errSave error) {
-	str := `SELECT * FROM "service_credential_types" WHERE (source_ref= $1 AND tenant_id = $2 AND source_id = $3) AND "service_credential_types"."archived_at" IS NULL ORDER BY "service_credential_types"."id" LIMIT 1`
+	str := sourceRefStr("service_credential_types", 1)
 	if err1 != nil {
 		lc.mock.ExpectQuery(regexp.QuoteMeta(str)).
-			WithArgs(sct.credentialTypeSrcRef, tenantID, sourceID).
+			WithArgs(tenantID, sourceID, sct.credentialTypeSrcRef).
 			WillReturnError(err1)
 		return
 	}
-	rows := sqlmock.NewRows(serviceCredentialTypeColumns).
-		AddRow(sct.credentialTypeID, time.Now(), time.Now(), nil, sct.credentialTypeSrcRef, time.Now(), time.Now(), "test_name", "test_desc", "test_kind", "test_ns", tenantID, sourceID)
+	rows := sqlmock.NewRows(sourceRefColumns)
+	// A missing credential type is reported as record not found
+	if err2 == nil {
+		rows.AddRow(sct.credentialTypeID, sct.credentialTypeSrcRef)
+	}
 	lc.mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(sct.credentialTypeSrcRef, tenantID, sourceID).
+		WithArgs(tenantID, sourceID, sct.credentialTypeSrcRef).
 		WillReturnRows(rows)
-
-	credentialStr := `SELECT * FROM "service_credentials" WHERE ID = $1 AND "service_credentials"."archived_at" IS NULL ORDER BY "service_credentials"."id" LIMIT 1`
 	if err2 != nil {
-		lc.mock.ExpectQuery(regexp.QuoteMeta(credentialStr)).
-			WithArgs(sct.credentialID).
-			WillReturnError(err2)
 		return
 	}
-	credentialRows := sqlmock.NewRows(serviceCredentialColumns).
-		AddRow(sct.credentialID, tenantID, sourceID, sct.credentialSrcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), nil)
-	lc.mock.ExpectQuery(regexp.QuoteMeta(credentialStr)).
-		WithArgs(sct.credentialID).
-		WillReturnRows(credentialRows)
 
+	updateStr := `UPDATE service_credentials AS t SET service_credential_type_id = v.target_id FROM (VALUES ($1::bigint, $2::bigint)) AS v(id, target_id) WHERE t.id = v.id AND t.tenant_id = $3 AND t.source_id = $4`
 	if errSave != nil {
-		lc.mock.ExpectExec("^UPDATE").WillReturnError(errSave)
+		lc.mock.ExpectExec(regexp.QuoteMeta(updateStr)).
+			WithArgs(sct.credentialID, sct.credentialTypeID, tenantID, sourceID).
+			WillReturnError(errSave)
 	} else {
-		lc.mock.ExpectExec("^UPDATE").WillReturnResult(sqlmock.NewResult(100, 1))
+		lc.mock.ExpectExec(regexp.QuoteMeta(updateStr)).
+			WithArgs(sct.credentialID, sct.credentialTypeID, tenantID, sourceID).
+			WillReturnResult(sqlmock.NewResult(100, 1))
 	}
 }
 
@@ -518,7 +510,7 @@ func TestServiceNodeLink(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
 	snt := serviceNodeTest{sonSrcRef: "889",
-		sonID:        int64(567),
+		sonID:        int64(730),
 		parentSrcRef: "777",
 		parentID:     int64(568),
 		rootSrcRef:   "111",
@@ -535,7 +527,7 @@ func TestServiceNodeLinkError1(t *testing.T) {
 	defer teardown()
 	errMessage := "Blow up during first find"
 	snt := serviceNodeTest{sonSrcRef: "889",
-		sonID:        int64(567),
+		sonID:        int64(730),
 		parentSrcRef: "777",
 		parentID:     int64(568),
 		rootSrcRef:   "111",
@@ -550,9 +542,9 @@ func TestServiceNodeLinkError1(t *testing.T) {
 func TestServiceNodeLinkError2(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	errMessage := "Blow up during second find"
+	errMessage := gorm.ErrRecordNotFound.Error()
 	snt := serviceNodeTest{sonSrcRef: "889",
-		sonID:        int64(567),
+		sonID:        int64(730),
 		parentSrcRef: "777",
 		parentID:     int64(568),
 		rootSrcRef:   "111",
@@ -567,9 +559,9 @@ func TestServiceNodeLinkError2(t *testing.T) {
 func TestServiceNodeLinkError3(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	errMessage := "Blow up during third find"
+	errMessage := gorm.ErrRecordNotFound.Error()
 	snt := serviceNodeTest{sonSrcRef: "889",
-		sonID:        int64(567),
+		sonID:        int64(730),
 		parentSrcRef: "777",
 		parentID:     int64(568),
 		rootSrcRef:   "111",
@@ -586,7 +578,7 @@ func TestServiceNodeLinkError4(t *testing.T) {
 	defer teardown()
 	errMessage := "Blow up during save"
 	snt := serviceNodeTest{sonSrcRef: "889",
-		sonID:        int64(567),
+		sonID:        int64(730),
 		parentSrcRef: "777",
 		parentID:     int64(568),
 		rootSrcRef:   "111",
@@ -599,52 +591,45 @@ func TestServiceNodeLinkError4(t *testing.T) {
 }
 
 func setServiceNodeMocks(lc *linkCommon, snt *serviceNodeTest, err1, err2, err3, errSave error) {
-	str := `SELECT * FROM "service_offering_nodes" WHERE (source_ref= $1 AND tenant_id = $2 AND source_id = $3) AND "service_offering_nodes"."archived_at" IS NULL ORDER BY "service_offering_nodes"."id" LIMIT 1`
+	str := sourceRefStr("service_offerings", 2)
 	if err1 != nil {
 		lc.mock.ExpectQuery(regexp.QuoteMeta(str)).
-			WithArgs(snt.sonSrcRef, tenantID, sourceID).
+			WithArgs(tenantID, sourceID, snt.parentSrcRef, snt.rootSrcRef).
 			WillReturnError(err1)
 		return
 	}
-	rows := sqlmock.NewRows(serviceOfferingNodeColumns).
-		AddRow(snt.sonID, tenantID, sourceID, snt.sonSrcRef, "Test", time.Now(), time.Now(), time.Now())
+	// A missing parent or root offering is reported as record not found
+	rows := sqlmock.NewRows(sourceRefColumns)
+	if err2 == nil {
+		rows.AddRow(snt.parentID, snt.parentSrcRef)
+	}
+	if err3 == nil {
+		rows.AddRow(snt.rootID, snt.rootSrcRef)
+	}
 	lc.mock.ExpectQuery(regexp.QuoteMeta(str)).
-		WithArgs(snt.sonSrcRef, tenantID, sourceID).
+		WithArgs(tenantID, sourceID, snt.parentSrcRef, snt.rootSrcRef).
 		WillReturnRows(rows)
-
-	soStr := `SELECT * FROM "service_offerings" WHERE (source_ref= $1 AND tenant_id = $2 AND source_id = $3) AND "service_offerings"."archived_at" IS NULL ORDER BY "service_offerings"."id" LIMIT 1`
-	if err2 != nil {
-		lc.mock.ExpectQuery(regexp.QuoteMeta(soStr)).
-			WithArgs(snt.parentSrcRef, tenantID, sourceID).
-			WillReturnError(err2)
+	if err2 != nil || err3 != nil {
 		return
 	}
-	parent := sqlmock.NewRows(serviceOfferingColumns).
-		AddRow(snt.parentID, tenantID, sourceID, snt.parentSrcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), nil)
-	lc.mock.ExpectQuery(regexp.QuoteMeta(soStr)).
-		WithArgs(snt.parentSrcRef, tenantID, sourceID).
-		WillReturnRows(parent)
-
-	if err3 != nil {
-		lc.mock.ExpectQuery(regexp.QuoteMeta(soStr)).
-			WithArgs(snt.rootSrcRef, tenantID, sourceID).
-			WillReturnError(err3)
-		return
-	}
-	root := sqlmock.NewRows(serviceOfferingColumns).
-		AddRow(snt.rootID, tenantID, sourceID, snt.rootSrcRef, "Test", "", "Test Description", time.Now(), time.Now(), time.Now(), nil)
-	lc.mock.ExpectQuery(regexp.QuoteMeta(soStr)).
-		WithArgs(snt.rootSrcRef, tenantID, sourceID).
-		WillReturnRows(root)
 
+	updateStr := `UPDATE service_offering_nodes AS t SET service_offering_id = v.target_id FROM (VALUES ($1::bigint, $2::bigint)) AS v(id, target_id) WHERE t.id = v.id AND t.tenant_id = $3 AND t.source_id = $4`
 	if errSave != nil {
-		lc.mock.ExpectExec("^UPDATE").WillReturnError(errSave)
-	} else {
-		lc.mock.ExpectExec("^UPDATE").WillReturnResult(sqlmock.NewResult(100, 1))
+		lc.mock.ExpectExec(regexp.QuoteMeta(updateStr)).
+			WithArgs(snt.sonID, snt.parentID, tenantID, sourceID).
+			WillReturnError(errSave)
+		return
 	}
+	lc.mock.ExpectExec(regexp.QuoteMeta(updateStr)).
+		WithArgs(snt.sonID, snt.parentID, tenantID, sourceID).
+		WillReturnResult(sqlmock.NewResult(100, 1))
+	rootStr := `UPDATE service_offering_nodes AS t SET root_service_offering_id = v.target_id FROM (VALUES ($1::bigint, $2::bigint)) AS v(id, target_id) WHERE t.id = v.id AND t.tenant_id = $3 AND t.source_id = $4`
+	lc.mock.ExpectExec(regexp.QuoteMeta(rootStr)).
+		WithArgs(snt.sonID, snt.rootID, tenantID, sourceID).
+		WillReturnResult(sqlmock.NewResult(100, 1))
 }
 
-func checkSuccess(lc *linkCommon) {
+func checkSuccess(lc *linkCommon) *BillOfLading {
 	ctx := context.TODO()
 	repos := dummyObjectRepos(nil, nil)
 	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, repos, lc.gdb)
@@ -652,6 +637,7 @@ func checkSuccess(lc *linkCommon) {
 	assert.Nil(lc.t, err, lc.url)
 	err = bol.ProcessLinks(ctx, lc.gdb)
 	assert.Nil(lc.t, err, lc.url)
+	return bol
 }
 
 func checkErrors(lc *linkCommon, errMessage string) {
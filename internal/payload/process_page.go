@@ -9,11 +9,7 @@ import (
 	"regexp"
 	"strings"
 
-	"github.com/RedHatInsights/catalog_tower_persister/internal/models/servicecredential"
-	"github.com/RedHatInsights/catalog_tower_persister/internal/models/servicecredentialtype"
-	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceinventory"
-	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceoffering"
-	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceofferingnode"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/serviceplan"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/spec2ddf"
 )
@@ -29,6 +25,20 @@ var idObjTypeRe = regexp.MustCompile(`\/api\/v2\/(.*)\/id`)
 
 // ProcessPage handles one file at a time from the tar file
 func (bol *BillOfLading) ProcessPage(ctx context.Context, url string, r io.Reader) error {
+	defer bol.timePhase(PhasePages)()
+	bol.currentFile = url
+	cr := &countingReader{r: r}
+	err := bol.processPage(ctx, url, cr)
+	bol.bytesRead += cr.n
+	if err != nil {
+		return err
+	}
+	bol.filesProcessed++
+	bol.progressed(PhasePages)
+	return nil
+}
+
+func (bol *BillOfLading) processPage(ctx context.Context, url string, r io.Reader) error {
 	objectType, err := getObjectType(url)
 	if err != nil {
 		bol.logger.Errorf("%v", err)
@@ -49,26 +59,37 @@ func (bol *BillOfLading) ProcessPage(ctx context.Context, url string, r io.Reade
 		bol.logger.Errorf("Error decoding message body %s %v", url, err)
 		return err
 	}
+	// The config and ping endpoints describe the Tower itself
+	if objectType == "config" || objectType == "ping" {
+		if version, ok := pr["version"].(string); ok {
+			bol.towerVersion = version
+		}
+		return nil
+	}
 
 	if isListResults(pr) {
 		ids := strings.Contains(url, "/id")
 		bol.logger.Infof("Received %s objects idObject %v", pr["count"].(json.Number).String(), ids)
 		if val, ok := pr["results"]; ok {
-			for _, obj := range val.([]interface{}) {
-				if ids {
-					err = bol.addIDList(ctx, obj.(map[string]interface{}), objectType)
+			if ids {
+				for i, obj := range val.([]interface{}) {
+					err = bol.addIDList(ctx, i, obj.(map[string]interface{}), objectType)
 					if err != nil {
 						bol.logger.Errorf("Error adding ids %s", objectType)
 						bol.logger.Errorf("Error %v", err)
 						return err
 					}
-				} else {
-					err = bol.addObject(ctx, obj.(map[string]interface{}), url, nil)
-					if err != nil {
-						bol.logger.Errorf("Error adding object %s", objectType)
-						bol.logger.Errorf("Error %v", err)
-						return err
-					}
+				}
+			} else {
+				objs := make([]map[string]interface{}, 0, len(val.([]interface{})))
+				for _, obj := range val.([]interface{}) {
+					objs = append(objs, obj.(map[string]interface{}))
+				}
+				err = bol.addObjects(ctx, objs)
+				if err != nil {
+					bol.logger.Errorf("Error adding objects %s", objectType)
+					bol.logger.Errorf("Error %v", err)
+					return err
 				}
 			}
 		}
@@ -109,8 +130,34 @@ func idExists(ids []string, id string) bool {
 }
 
 // addIDList stores the ID of the current object based on its type so we can link can together
-func (bol *BillOfLading) addIDList(ctx context.Context, obj map[string]interface{}, objType string) error {
-	id := obj["id"].(json.Number).String()
+func (bol *BillOfLading) addIDList(ctx context.Context, index int, obj map[string]interface{}, objType string) error {
+	id, err := objectID(obj)
+	if err != nil {
+		err := &base.InvalidObjectError{Index: index, Reason: err}
+		if _, skipped := bol.skipInvalid(objType, err); skipped {
+			return nil
+		}
+		return err
+	}
+	return bol.addSourceRef(id, objType)
+}
+
+// objectID returns the Tower id of an object, catalog objects are kept and
+// linked by it so an object without a numeric id is invalid
+func objectID(obj map[string]interface{}) (string, error) {
+	id, ok := obj["id"].(json.Number)
+	if !ok {
+		return "", errors.New("No id provided")
+	}
+	if _, err := id.Int64(); err != nil {
+		return "", fmt.Errorf("Invalid id %s", id)
+	}
+	return id.String(), nil
+}
+
+// addSourceRef stores a Tower id based on the object type, objects that are
+// not in these lists get deleted at the end of the refresh
+func (bol *BillOfLading) addSourceRef(id string, objType string) error {
 	switch objType {
 	case "job_template", "job_templates":
 		if !idExists(bol.jobTemplateSourceRefs, id) {
@@ -146,7 +193,6 @@ func (bol *BillOfLading) addIDList(ctx context.Context, obj map[string]interface
 
 // addObject add an object into the Database
 func (bol *BillOfLading) addObject(ctx context.Context, obj map[string]interface{}, url string, r io.Reader) error {
-	var err error
 	if _, ok := obj["type"]; !ok {
 		// api/v2/job_templates/10/survey_spec
 		s := surveySpecRe.FindStringSubmatch(url)
@@ -174,83 +220,170 @@ func (bol *BillOfLading) addObject(ctx context.Context, obj map[string]interface
 			return errors.New("No type provided")
 		}
 	}
+	return bol.addTypedObjects(ctx, obj["type"].(string), []map[string]interface{}{obj}, r)
+}
 
-	bol.logger.Infof("Object Type %s Source Ref %s", obj["type"].(string), obj["id"].(json.Number).String())
-	srcRef := obj["id"].(json.Number).String()
-	switch objType := obj["type"].(string); objType {
-	case "job_template", "workflow_job_template":
-		so := &serviceoffering.ServiceOffering{SourceID: bol.source.ID, TenantID: bol.tenant.ID}
-		err = bol.repos.serviceofferingrepo.CreateOrUpdate(ctx, bol.logger, so, obj, bol.repos.serviceplanrepo)
-		if err != nil {
-			bol.logger.Errorf("Error adding %s:%s %v", objType, srcRef, err)
+// addObjects adds all the objects from a page into the Database, objects of
+// the same type are written together
+func (bol *BillOfLading) addObjects(ctx context.Context, objs []map[string]interface{}) error {
+	var objTypes []string
+	byType := make(map[string][]map[string]interface{})
+	for i, obj := range objs {
+		objType, ok := obj["type"].(string)
+		if !ok {
+			err := base.NewInvalidObjectError(i, obj, errors.New("No type provided"))
+			if _, skipped := bol.skipInvalid("unknown", err); skipped {
+				continue
+			}
 			return err
 		}
+		if _, ok := byType[objType]; !ok {
+			objTypes = append(objTypes, objType)
+		}
+		byType[objType] = append(byType[objType], obj)
+	}
+	for _, objType := range objTypes {
+		if err := bol.addTypedObjects(ctx, objType, byType[objType], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		if so.SurveyEnabled {
-			bol.logger.Infof("Survey Enabled for " + so.SourceRef)
-			if objType == "job_template" {
-				bol.jobTemplateSurvey = append(bol.jobTemplateSurvey, so.SourceRef)
-			} else {
-				bol.workflowJobTemplateSurvey = append(bol.workflowJobTemplateSurvey, so.SourceRef)
+// addTypedObjects adds a batch of objects of the same type into the Database,
+// with ErrorPolicySkip the batch is added again without an invalid object
+func (bol *BillOfLading) addTypedObjects(ctx context.Context, objType string, objs []map[string]interface{}, r io.Reader) error {
+	for {
+		err := bol.addValidObjects(ctx, objType, objs, r)
+		if err == nil {
+			return nil
+		}
+		invalid, ok := bol.skipInvalid(objType, err)
+		if !ok {
+			return err
+		}
+		// Keep the catalog object from a previous refresh instead of deleting it
+		if invalid.SourceRef != "" {
+			if err := bol.addSourceRef(invalid.SourceRef, objType); err != nil {
+				return err
 			}
+			// A skipped object may not exist in the catalog, the links
+			// to it are left out
+			if bol.skipped[objType] == nil {
+				bol.skipped[objType] = make(map[string]bool)
+			}
+			bol.skipped[objType][invalid.SourceRef] = true
+		}
+		objs = append(objs[:invalid.Index:invalid.Index], objs[invalid.Index+1:]...)
+		if len(objs) == 0 {
+			return nil
+		}
+	}
+}
+
+// addValidObjects adds a batch of objects of the same type into the Database
+// and keeps track of their ids and links
+func (bol *BillOfLading) addValidObjects(ctx context.Context, objType string, objs []map[string]interface{}, r io.Reader) error {
+	ids := make([]string, len(objs))
+	for i, obj := range objs {
+		id, err := objectID(obj)
+		if err != nil {
+			// There is no source ref to keep the catalog object by
+			return &base.InvalidObjectError{Index: i, Reason: err}
+		}
+		ids[i] = id
+		bol.logger.Infof("Object Type %s Source Ref %s", objType, id)
+	}
+	var sourceRefs []string
+	switch objType {
+	case "job_template", "workflow_job_template":
+		sos, err := bol.repos.serviceofferingrepo.BulkCreateOrUpdate(ctx, bol.logger, bol.tenant.ID, bol.source.ID, objs, bol.repos.serviceplanrepo)
+		if err != nil {
+			bol.logger.Errorf("Error adding %s %v", objType, err)
+			return err
 		}
+		for _, so := range sos {
+			if so.SurveyEnabled {
+				bol.logger.Infof("Survey Enabled for " + so.SourceRef)
+				if objType == "job_template" {
+					bol.jobTemplateSurvey = append(bol.jobTemplateSurvey, so.SourceRef)
+				} else {
+					bol.workflowJobTemplateSurvey = append(bol.workflowJobTemplateSurvey, so.SourceRef)
+				}
+			}
 
-		if so.ServiceInventorySourceRef != "" {
-			bol.inventoryMap[so.ServiceInventorySourceRef] = append(bol.inventoryMap[so.ServiceInventorySourceRef], so.ID)
+			if so.ServiceInventorySourceRef != "" {
+				bol.inventoryMap[so.ServiceInventorySourceRef] = append(bol.inventoryMap[so.ServiceInventorySourceRef], so.ID)
+			}
+			sourceRefs = append(sourceRefs, so.SourceRef)
 		}
 
 	case "inventory":
-		si := &serviceinventory.ServiceInventory{SourceID: bol.source.ID, TenantID: bol.tenant.ID}
-		err = bol.repos.serviceinventoryrepo.CreateOrUpdate(ctx, bol.logger, si, obj)
+		sis, err := bol.repos.serviceinventoryrepo.BulkCreateOrUpdate(ctx, bol.logger, bol.tenant.ID, bol.source.ID, objs)
 		if err != nil {
-			bol.logger.Errorf("Error adding %s:%s %v", objType, srcRef, err)
+			bol.logger.Errorf("Error adding %s %v", objType, err)
 			return err
 		}
+		for _, si := range sis {
+			sourceRefs = append(sourceRefs, si.SourceRef)
+		}
 
 	case "workflow_job_template_node":
-		son := &serviceofferingnode.ServiceOfferingNode{SourceID: bol.source.ID, TenantID: bol.tenant.ID}
-		err = bol.repos.serviceofferingnoderepo.CreateOrUpdate(ctx, bol.logger, son, obj)
-		if err == serviceofferingnode.ErrIgnoreTowerObject {
-			bol.logger.Info("Ignoring Tower Object")
-			return nil
-		} else if err != nil {
-			bol.logger.Errorf("Error adding %s:%s %v", objType, srcRef, err)
+		sons, err := bol.repos.serviceofferingnoderepo.BulkCreateOrUpdate(ctx, bol.logger, bol.tenant.ID, bol.source.ID, objs)
+		if err != nil {
+			bol.logger.Errorf("Error adding %s %v", objType, err)
 			return err
 		}
-
-		bol.workflowNodes = append(bol.workflowNodes, WorkflowNode{SourceRef: son.SourceRef,
-			ServiceOfferingSourceRef:     son.ServiceOfferingSourceRef,
-			RootServiceOfferingSourceRef: son.RootServiceOfferingSourceRef,
-			UnifiedJobType:               son.UnifiedJobType})
+		for _, son := range sons {
+			bol.workflowNodes = append(bol.workflowNodes, WorkflowNode{ID: son.ID,
+				SourceRef:                    son.SourceRef,
+				ServiceOfferingSourceRef:     son.ServiceOfferingSourceRef,
+				RootServiceOfferingSourceRef: son.RootServiceOfferingSourceRef,
+				UnifiedJobType:               son.UnifiedJobType})
+			sourceRefs = append(sourceRefs, son.SourceRef)
+		}
 	case "credential":
-		sc := &servicecredential.ServiceCredential{SourceID: bol.source.ID, TenantID: bol.tenant.ID}
-		err = bol.repos.servicecredentialrepo.CreateOrUpdate(ctx, bol.logger, sc, obj)
+		scs, err := bol.repos.servicecredentialrepo.BulkCreateOrUpdate(ctx, bol.logger, bol.tenant.ID, bol.source.ID, objs)
 		if err != nil {
-			bol.logger.Errorf("Error adding %s:%s %v", objType, srcRef, err)
+			bol.logger.Errorf("Error adding %s %v", objType, err)
 			return err
 		}
-
-		if sc.ServiceCredentialTypeSourceRef != "" {
-			bol.serviceCredentialToCredentialTypeMap[sc.ServiceCredentialTypeSourceRef] = append(bol.serviceCredentialToCredentialTypeMap[sc.ServiceCredentialTypeSourceRef], sc.ID)
+		for _, sc := range scs {
+			if sc.ServiceCredentialTypeSourceRef != "" {
+				bol.serviceCredentialToCredentialTypeMap[sc.ServiceCredentialTypeSourceRef] = append(bol.serviceCredentialToCredentialTypeMap[sc.ServiceCredentialTypeSourceRef], sc.ID)
+			}
+			sourceRefs = append(sourceRefs, sc.SourceRef)
 		}
 	case "credential_type":
-		sct := &servicecredentialtype.ServiceCredentialType{SourceID: bol.source.ID, TenantID: bol.tenant.ID}
-		err = bol.repos.servicecredentialtyperepo.CreateOrUpdate(ctx, bol.logger, sct, obj)
+		scts, err := bol.repos.servicecredentialtyperepo.BulkCreateOrUpdate(ctx, bol.logger, bol.tenant.ID, bol.source.ID, objs)
 		if err != nil {
-			bol.logger.Errorf("Error adding %s:%s %v", objType, srcRef, err)
+			bol.logger.Errorf("Error adding %s %v", objType, err)
 			return err
 		}
+		for _, sct := range scts {
+			sourceRefs = append(sourceRefs, sct.SourceRef)
+		}
 	case "survey_spec":
-		ss := &serviceplan.ServicePlan{SourceID: bol.source.ID, TenantID: bol.tenant.ID}
-
-		err = bol.repos.serviceplanrepo.CreateOrUpdate(ctx, bol.logger, ss, &spec2ddf.Converter{}, obj, r)
-		if err != nil {
-			bol.logger.Errorf("Error adding %s:%s %v", objType, srcRef, err)
+		// Survey specs are never returned in a list, there is one per page
+		for i, obj := range objs {
+			ss := &serviceplan.ServicePlan{SourceID: bol.source.ID, TenantID: bol.tenant.ID}
+			err := bol.repos.serviceplanrepo.CreateOrUpdate(ctx, bol.logger, ss, &spec2ddf.Converter{}, obj, r)
+			if err != nil {
+				bol.logger.Errorf("Error adding %s:%s %v", objType, ids[i], err)
+				return err
+			}
+			sourceRefs = append(sourceRefs, ids[i])
+		}
+	default:
+		sourceRefs = append(sourceRefs, ids...)
+	}
+	for _, id := range sourceRefs {
+		if err := bol.addSourceRef(id, objType); err != nil {
 			return err
 		}
 	}
-	err = bol.addIDList(ctx, obj, obj["type"].(string))
-	return err
+	bol.objectCounts[objType] += len(objs)
+	return nil
 }
 
 // getObjectType based on the file name which is akin to the URL request made to tower
@@ -0,0 +1,44 @@
+package payload
+
+// Phase is the step a refresh is in
+type Phase string
+
+const (
+	// PhasePages is processing the pages of the tar file
+	PhasePages Phase = "pages"
+	// PhaseLinks is linking the objects to each other
+	PhaseLinks Phase = "links"
+	// PhaseLastSeen is recording which objects were seen
+	PhaseLastSeen Phase = "last_seen"
+	// PhaseDeletes is deleting the objects that are gone
+	PhaseDeletes Phase = "deletes"
+)
+
+// Progress is how far a refresh has got
+type Progress struct {
+	Phase          Phase          `json:"phase"`
+	FilesProcessed int            `json:"files_processed"`
+	Objects        map[string]int `json:"objects"`
+}
+
+// ProgressFunc receives the progress of a refresh, it is called by the
+// goroutine doing the refresh and should not block
+type ProgressFunc func(progress Progress)
+
+// OnProgress sets the function that receives the progress of the refresh
+func (bol *BillOfLading) OnProgress(fn ProgressFunc) {
+	bol.onProgress = fn
+}
+
+// progressed records the current phase and reports the progress
+func (bol *BillOfLading) progressed(phase Phase) {
+	bol.phase = phase
+	if bol.onProgress == nil {
+		return
+	}
+	objects := make(map[string]int, len(bol.objectCounts))
+	for k, v := range bol.objectCounts {
+		objects[k] = v
+	}
+	bol.onProgress(Progress{Phase: phase, FilesProcessed: bol.filesProcessed, Objects: objects})
+}
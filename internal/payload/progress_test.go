@@ -0,0 +1,40 @@
+package payload
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgress(t *testing.T) {
+	ctx := context.TODO()
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, dummyObjectRepos(nil, nil), nil)
+	var events []Progress
+	bol.OnProgress(func(progress Progress) { events = append(events, progress) })
+
+	err := bol.ProcessPage(ctx, "/api/v2/inventories/", strings.NewReader(createPayload("inventory")))
+	assert.Nil(t, err, "/api/v2/inventories/")
+	err = bol.ProcessPage(ctx, "/api/v2/job_templates/", strings.NewReader(createPayload("job_template")))
+	assert.Nil(t, err, "/api/v2/job_templates/")
+	err = bol.ProcessLastSeen(ctx)
+	assert.Nil(t, err, "ProcessLastSeen")
+
+	assert.Equal(t, []Progress{
+		{Phase: PhasePages, FilesProcessed: 1, Objects: map[string]int{"inventory": 2}},
+		{Phase: PhasePages, FilesProcessed: 2, Objects: map[string]int{"inventory": 2, "job_template": 2}},
+		{Phase: PhaseLastSeen, FilesProcessed: 2, Objects: map[string]int{"inventory": 2, "job_template": 2}},
+	}, events)
+}
+
+func TestProgressFailedPage(t *testing.T) {
+	bol := MakeBillOfLading(testhelper.TestLogger(), &testTenant, &testSource, dummyObjectRepos(nil, nil), nil)
+	called := false
+	bol.OnProgress(func(progress Progress) { called = true })
+
+	err := bol.ProcessPage(context.TODO(), "/bogus", strings.NewReader(""))
+	assert.NotNil(t, err, "/bogus")
+	assert.False(t, called, "A failed page should not be reported")
+}
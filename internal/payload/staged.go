@@ -0,0 +1,124 @@
+package payload
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/checkpoint"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ErrShutdown is returned when a refresh stops because the persister is
+// shutting down, the pages staged by a chunked refresh are kept so the
+// refresh can be resumed
+var ErrShutdown = errors.New("refresh interrupted by shutdown")
+
+// StageTar downloads a Tar file and stages its pages, chunkSize pages are
+// committed at a time together with the checkpoint. Pages staged by an
+// earlier attempt of the same task are skipped.
+func StageTar(ctx context.Context, logger *logrus.Entry, checkpoints checkpoint.Repository, cp *checkpoint.Checkpoint, client *http.Client, url string, chunkSize int, shutdown chan struct{}) error {
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	if cp.PagesStaged > 0 {
+		logger.Infof("Resuming task %s after %d staged pages", cp.TaskURL, cp.PagesStaged)
+	}
+	tr, closer, err := openTar(ctx, logger, client, url)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	var chunk []checkpoint.StagedPage
+	position := 0
+	for {
+		if err := interrupted(ctx, shutdown); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Errorf("Error reading tar header %v", err)
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		position++
+		if position <= cp.PagesStaged {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			logger.Errorf("Error reading file %s %v", hdr.Name, err)
+			return err
+		}
+		chunk = append(chunk, checkpoint.StagedPage{TaskURL: cp.TaskURL, Position: position, Name: hdr.Name, Content: content})
+		if len(chunk) == chunkSize {
+			if err := checkpoints.StagePages(ctx, logger, cp, chunk); err != nil {
+				return err
+			}
+			chunk = nil
+		}
+	}
+	return checkpoints.StagePages(ctx, logger, cp, chunk)
+}
+
+// ChunkFunc commits the objects of the staged pages up to position applied
+// together with the checkpoint, it returns the transaction the refresh
+// continues in
+type ChunkFunc func(applied int) (*gorm.DB, error)
+
+// ProcessStaged processes the staged pages of a task in tar file order and
+// then finishes the refresh. commit is called after every chunkSize pages and
+// after the last page. The pages up to cp.PagesApplied were committed by an
+// earlier attempt, they are processed again in the first transaction so the
+// links and deletes know about their objects, which are unchanged.
+func ProcessStaged(ctx context.Context, logger *logrus.Entry, loader Loader, pages checkpoint.Repository, cp *checkpoint.Checkpoint, chunkSize int, dbTransaction *gorm.DB, commit ChunkFunc) error {
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	if cp.PagesApplied > 0 {
+		logger.Infof("Resuming task %s after %d applied pages", cp.TaskURL, cp.PagesApplied)
+	}
+	position, pending := 0, 0
+	err := pages.EachPage(ctx, cp.TaskURL, func(page *checkpoint.StagedPage) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		logger.Infof("Contents of staged %s", page.Name)
+		if err := loader.ProcessPage(ctx, page.Name, bytes.NewReader(page.Content)); err != nil {
+			logger.Errorf("Error handling file %s %v", page.Name, err)
+			return err
+		}
+		position = page.Position
+		if position <= cp.PagesApplied {
+			return nil
+		}
+		pending++
+		if pending < chunkSize {
+			return nil
+		}
+		pending = 0
+		var err error
+		dbTransaction, err = commit(position)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		if dbTransaction, err = commit(position); err != nil {
+			return err
+		}
+	}
+	return finishRefresh(ctx, logger, loader, dbTransaction)
+}
@@ -0,0 +1,187 @@
+package payload
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/checkpoint"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// memoryCheckpoints keeps the staged pages of one task in memory
+type memoryCheckpoints struct {
+	pages      []checkpoint.StagedPage
+	stageCalls int
+	stageError error
+}
+
+func (mc *memoryCheckpoints) Claim(ctx context.Context, logger *logrus.Entry, cp *checkpoint.Checkpoint, c checkpoint.Claimant) (bool, error) {
+	return true, nil
+}
+
+func (mc *memoryCheckpoints) StagePages(ctx context.Context, logger *logrus.Entry, cp *checkpoint.Checkpoint, pages []checkpoint.StagedPage) error {
+	if len(pages) == 0 {
+		return nil
+	}
+	mc.stageCalls++
+	if mc.stageError != nil {
+		return mc.stageError
+	}
+	mc.pages = append(mc.pages, pages...)
+	cp.PagesStaged += len(pages)
+	return nil
+}
+
+func (mc *memoryCheckpoints) Applied(ctx context.Context, logger *logrus.Entry, cp *checkpoint.Checkpoint, applied int) error {
+	cp.PagesApplied = applied
+	return nil
+}
+
+func (mc *memoryCheckpoints) EachPage(ctx context.Context, taskURL string, fn func(page *checkpoint.StagedPage) error) error {
+	for i := range mc.pages {
+		if err := fn(&mc.pages[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mc *memoryCheckpoints) Delete(ctx context.Context, logger *logrus.Entry, taskURL string) error {
+	mc.pages = nil
+	return nil
+}
+
+func (mc *memoryCheckpoints) Exists(ctx context.Context, taskURL string) (bool, error) {
+	return len(mc.pages) > 0, nil
+}
+
+func (mc *memoryCheckpoints) Unfinished(ctx context.Context, c checkpoint.Claimant) ([]checkpoint.Checkpoint, error) {
+	return nil, nil
+}
+
+func stageSample(t *testing.T, mc *memoryCheckpoints, cp *checkpoint.Checkpoint, shutdown chan struct{}) error {
+	f, err := os.Open("testdata/sample.tgz")
+	if err != nil {
+		t.Fatalf("Error opening file %s %v", "testdata/sample.tgz", err)
+	}
+	defer f.Close()
+	fc := fakeClient(t, f, http.StatusOK)
+	return StageTar(context.TODO(), testhelper.TestLogger(), mc, cp, fc, "https://www.example.com/data.tar", 5, shutdown)
+}
+
+func TestStageTar(t *testing.T) {
+	mc := &memoryCheckpoints{}
+	cp := &checkpoint.Checkpoint{TaskURL: "task1"}
+	err := stageSample(t, mc, cp, make(chan struct{}))
+
+	assert.Nil(t, err, "Should have staged payload")
+	assert.Equal(t, 14, cp.PagesStaged, "14 Pages should be staged")
+	assert.Equal(t, 3, mc.stageCalls, "Pages should be staged in chunks of 5")
+	assert.Equal(t, 1, mc.pages[0].Position)
+	assert.Equal(t, 14, mc.pages[13].Position)
+	assert.NotEmpty(t, mc.pages[13].Content)
+}
+
+func TestStageTarResume(t *testing.T) {
+	mc := &memoryCheckpoints{}
+	cp := &checkpoint.Checkpoint{TaskURL: "task1", PagesStaged: 10}
+	err := stageSample(t, mc, cp, make(chan struct{}))
+
+	assert.Nil(t, err, "Should have staged payload")
+	assert.Equal(t, 14, cp.PagesStaged, "14 Pages should be staged")
+	assert.Equal(t, 4, len(mc.pages), "Only the pages after the checkpoint should be staged")
+	assert.Equal(t, 11, mc.pages[0].Position)
+}
+
+func TestStageTarShutdown(t *testing.T) {
+	mc := &memoryCheckpoints{}
+	cp := &checkpoint.Checkpoint{TaskURL: "task1"}
+	shutdown := make(chan struct{})
+	close(shutdown)
+	err := stageSample(t, mc, cp, shutdown)
+
+	assert.Equal(t, ErrShutdown, err)
+	assert.Equal(t, 0, cp.PagesStaged)
+}
+
+func TestStageTarError(t *testing.T) {
+	mc := &memoryCheckpoints{stageError: fmt.Errorf("kaboom")}
+	cp := &checkpoint.Checkpoint{TaskURL: "task1"}
+	err := stageSample(t, mc, cp, make(chan struct{}))
+
+	assert.Equal(t, mc.stageError, err)
+	assert.Equal(t, 1, mc.stageCalls, "Staging should stop at the first error")
+}
+
+// recordCommits is a ChunkFunc that records the positions it commits at
+func recordCommits(commits *[]int, err error) ChunkFunc {
+	return func(applied int) (*gorm.DB, error) {
+		*commits = append(*commits, applied)
+		return nil, err
+	}
+}
+
+func TestProcessStaged(t *testing.T) {
+	mc := &memoryCheckpoints{}
+	cp := &checkpoint.Checkpoint{TaskURL: "task1"}
+	assert.Nil(t, stageSample(t, mc, cp, make(chan struct{})))
+
+	ml := mockLoader{}
+	var commits []int
+	err := ProcessStaged(context.TODO(), testhelper.TestLogger(), &ml, mc, cp, 5, nil, recordCommits(&commits, nil))
+	assert.Nil(t, err, "Should have processed the staged pages")
+	assert.Equal(t, 14, ml.pageCount, "14 Pages should be processed")
+	assert.Equal(t, []int{5, 10, 14}, commits, "Pages should be committed in chunks of 5")
+	assert.True(t, ml.linkerCalled, "Linker should get called")
+	assert.True(t, ml.lastSeenCalled, "Last seen should get called")
+	assert.True(t, ml.deletesCalled, "Deletes should get called")
+}
+
+func TestProcessStagedResume(t *testing.T) {
+	mc := &memoryCheckpoints{}
+	cp := &checkpoint.Checkpoint{TaskURL: "task1"}
+	assert.Nil(t, stageSample(t, mc, cp, make(chan struct{})))
+	cp.PagesApplied = 7
+
+	ml := mockLoader{}
+	var commits []int
+	err := ProcessStaged(context.TODO(), testhelper.TestLogger(), &ml, mc, cp, 5, nil, recordCommits(&commits, nil))
+	assert.Nil(t, err, "Should have processed the staged pages")
+	assert.Equal(t, 14, ml.pageCount, "The applied pages should be processed again")
+	assert.Equal(t, []int{12, 14}, commits, "The applied pages should not be committed again")
+	assert.True(t, ml.deletesCalled, "Deletes should get called")
+}
+
+func TestProcessStagedCommitError(t *testing.T) {
+	mc := &memoryCheckpoints{}
+	cp := &checkpoint.Checkpoint{TaskURL: "task1"}
+	assert.Nil(t, stageSample(t, mc, cp, make(chan struct{})))
+
+	ml := mockLoader{}
+	var commits []int
+	kaboom := fmt.Errorf("kaboom")
+	err := ProcessStaged(context.TODO(), testhelper.TestLogger(), &ml, mc, cp, 5, nil, recordCommits(&commits, kaboom))
+	assert.Equal(t, kaboom, err)
+	assert.Equal(t, 5, ml.pageCount, "Processing should stop at the failed commit")
+	assert.False(t, ml.linkerCalled, "Linker should not get called")
+}
+
+func TestProcessStagedPageError(t *testing.T) {
+	mc := &memoryCheckpoints{}
+	cp := &checkpoint.Checkpoint{TaskURL: "task1"}
+	assert.Nil(t, stageSample(t, mc, cp, make(chan struct{})))
+
+	ml := mockLoader{pageError: fmt.Errorf("Kaboom in Page Handler")}
+	var commits []int
+	err := ProcessStaged(context.TODO(), testhelper.TestLogger(), &ml, mc, cp, 5, nil, recordCommits(&commits, nil))
+	assert.Equal(t, ml.pageError, err)
+	assert.Equal(t, 1, ml.pageCount)
+	assert.Empty(t, commits, "Nothing should be committed")
+	assert.False(t, ml.linkerCalled, "Linker should not get called")
+}
@@ -0,0 +1,113 @@
+package sourcelock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Policy decides what a refresh does when another refresh of the same
+// source holds the lock
+type Policy string
+
+const (
+	// PolicyWait waits for the other refresh to finish
+	PolicyWait Policy = "wait"
+	// PolicySkip completes the task without refreshing, the other refresh
+	// supersedes it
+	PolicySkip Policy = "skip"
+	// PolicyFail fails the task
+	PolicyFail Policy = "fail"
+)
+
+// ErrLocked is returned when the source is locked by another refresh and
+// the policy does not wait
+var ErrLocked = errors.New("source is being refreshed by another task")
+
+// ErrShutdown is returned when the persister shuts down while waiting
+var ErrShutdown = errors.New("waiting for the source lock interrupted by shutdown")
+
+// pollInterval is how often a waiting refresh tries the lock again, it is
+// replaced in the tests
+var pollInterval = time.Second
+
+// ParsePolicy validates the name of a Policy
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case PolicyWait, PolicySkip, PolicyFail:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown source lock policy %q, expected wait, skip or fail", name)
+}
+
+// Lock is a PostgreSQL session level advisory lock keyed on the source id.
+// Session locks belong to a connection, so the lock keeps its own connection
+// out of the pool until it is released. The lock is also released by the
+// database if the persister dies and the connection drops.
+type Lock struct {
+	conn     *sql.Conn
+	sourceID int64
+	// Waited is how long it took to get the lock
+	Waited time.Duration
+}
+
+// Acquire locks a source. With PolicyWait it tries again every pollInterval
+// until it gets the lock, ctx is done or shutdown is closed, the other
+// policies return ErrLocked right away.
+func Acquire(ctx context.Context, db *gorm.DB, logger *logrus.Entry, sourceID int64, policy Policy, shutdown chan struct{}) (*Lock, error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	for {
+		var locked bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", sourceID).Scan(&locked); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if locked {
+			return &Lock{conn: conn, sourceID: sourceID, Waited: time.Since(started)}, nil
+		}
+		if policy != PolicyWait {
+			conn.Close()
+			return nil, ErrLocked
+		}
+		logger.Infof("Waiting for the refresh of source %d by another task", sourceID)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			return nil, ctx.Err()
+		case <-shutdown:
+			conn.Close()
+			return nil, ErrShutdown
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Release unlocks the source and returns the connection to the pool
+func (l *Lock) Release(logger *logrus.Entry) {
+	defer l.conn.Close()
+	var unlocked bool
+	if err := l.conn.QueryRowContext(context.Background(), "SELECT pg_advisory_unlock($1)", l.sourceID).Scan(&unlocked); err != nil {
+		logger.Errorf("Error unlocking source %d %v", l.sourceID, err)
+		// The connection might still hold the lock, make sure it is
+		// closed instead of going back to the pool
+		l.conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		return
+	}
+	if !unlocked {
+		logger.Errorf("Source %d was not locked", l.sourceID)
+	}
+}
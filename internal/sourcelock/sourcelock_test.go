@@ -0,0 +1,85 @@
+package sourcelock
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+const lockStr = "SELECT pg_try_advisory_lock($1)"
+const unlockStr = "SELECT pg_advisory_unlock($1)"
+
+func init() {
+	pollInterval = time.Millisecond
+}
+
+func expectLock(mock sqlmock.Sqlmock, locked bool) {
+	mock.ExpectQuery(regexp.QuoteMeta(lockStr)).
+		WithArgs(int64(77)).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(locked))
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, name := range []string{"wait", "skip", "fail"} {
+		p, err := ParsePolicy(name)
+		assert.Nil(t, err, "Policy %s should be valid", name)
+		assert.Equal(t, Policy(name), p)
+	}
+	_, err := ParsePolicy("queue")
+	assert.NotNil(t, err, "Policy queue should be invalid")
+}
+
+func TestAcquireAndRelease(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	expectLock(mock, true)
+	mock.ExpectQuery(regexp.QuoteMeta(unlockStr)).
+		WithArgs(int64(77)).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+	lock, err := Acquire(context.TODO(), gdb, testhelper.TestLogger(), 77, PolicyFail, make(chan struct{}))
+	assert.Nil(t, err, "Acquire failed")
+	lock.Release(testhelper.TestLogger())
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestAcquireWait(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	expectLock(mock, false)
+	expectLock(mock, false)
+	expectLock(mock, true)
+
+	lock, err := Acquire(context.TODO(), gdb, testhelper.TestLogger(), 77, PolicyWait, make(chan struct{}))
+	assert.Nil(t, err, "Acquire failed")
+	assert.NotNil(t, lock)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestAcquireSkip(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	expectLock(mock, false)
+
+	lock, err := Acquire(context.TODO(), gdb, testhelper.TestLogger(), 77, PolicySkip, make(chan struct{}))
+	assert.Equal(t, ErrLocked, err)
+	assert.Nil(t, lock)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestAcquireShutdown(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	expectLock(mock, false)
+	shutdown := make(chan struct{})
+	close(shutdown)
+
+	_, err := Acquire(context.TODO(), gdb, testhelper.TestLogger(), 77, PolicyWait, shutdown)
+	assert.Equal(t, ErrShutdown, err)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
@@ -0,0 +1,199 @@
+package staging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// schemaPrefix starts the name of every staging schema
+const schemaPrefix = "tower_persister_staging_"
+
+// link is a foreign key from a column to the id of another table
+type link struct {
+	column string
+	target string
+}
+
+// table is a catalog table with the links to the other catalog tables
+type table struct {
+	name  string
+	links []link
+}
+
+// tables lists the catalog tables of a source, every table comes after the
+// tables it links to so new rows can be inserted in this order
+var tables = []table{
+	{name: "service_inventories"},
+	{name: "service_credential_types"},
+	{name: "service_offerings", links: []link{
+		{column: "service_inventory_id", target: "service_inventories"}}},
+	{name: "service_credentials", links: []link{
+		{column: "service_credential_type_id", target: "service_credential_types"}}},
+	{name: "service_plans", links: []link{
+		{column: "service_offering_id", target: "service_offerings"}}},
+	{name: "service_offering_nodes", links: []link{
+		{column: "service_inventory_id", target: "service_inventories"},
+		{column: "service_offering_id", target: "service_offerings"},
+		{column: "root_service_offering_id", target: "service_offerings"}}},
+}
+
+// Area is the staging area of a task. It is a schema with a copy of every
+// catalog table holding the rows of one source. The refresh is loaded into
+// the copies without touching the live tables, which only change when the
+// area is promoted.
+type Area struct {
+	schema   string
+	tenantID int64
+	sourceID int64
+}
+
+// NewArea creates the Area of a task, the same task always gets the same
+// schema so a staging area left behind by a crash gets reused
+func NewArea(taskURL string, tenantID, sourceID int64) *Area {
+	sum := sha256.Sum256([]byte(taskURL))
+	return &Area{schema: schemaPrefix + hex.EncodeToString(sum[:8]), tenantID: tenantID, sourceID: sourceID}
+}
+
+// Create sets up the staging schema with a copy of the live rows of the source,
+// archived rows included. The copies keep the indexes of the live tables and
+// take their ids from the same sequences. A second, untouched copy is the
+// snapshot Promote compares the staged rows with.
+func (a *Area) Create(ctx context.Context, db *gorm.DB) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", a.schema)).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(fmt.Sprintf("CREATE SCHEMA %s", a.schema)).Error; err != nil {
+			return err
+		}
+		for _, t := range tables {
+			if err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING ALL)", a.staged(t.name), t.name)).Error; err != nil {
+				return err
+			}
+			err := tx.Exec(fmt.Sprintf("INSERT INTO %s SELECT * FROM %s WHERE tenant_id = ? AND source_id = ?", a.staged(t.name), t.name), a.tenantID, a.sourceID).Error
+			if err != nil {
+				return err
+			}
+			if err := tx.Exec(fmt.Sprintf("CREATE TABLE %s AS SELECT * FROM %s", a.snapshot(t.name), a.staged(t.name))).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Load runs fn in a transaction where the catalog tables resolve to the
+// staging copies, any other table resolves as usual
+func (a *Area) Load(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var path string
+		err := tx.Raw("SELECT set_config('search_path', ? || ', ' || current_setting('search_path'), true)", a.schema).Scan(&path).Error
+		if err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// Validate checks that every link in the staged rows points at a staged row
+func (a *Area) Validate(ctx context.Context, db *gorm.DB) error {
+	var problems []string
+	for _, t := range tables {
+		for _, l := range t.links {
+			var dangling int64
+			err := db.WithContext(ctx).Raw(fmt.Sprintf("SELECT count(*) FROM %s AS s WHERE s.%s IS NOT NULL AND NOT EXISTS (SELECT 1 FROM %s AS target WHERE target.id = s.%s)",
+				a.staged(t.name), l.column, a.staged(l.target), l.column)).Scan(&dangling).Error
+			if err != nil {
+				return err
+			}
+			if dangling > 0 {
+				problems = append(problems, fmt.Sprintf("%d %s with a missing %s", dangling, t.name, l.column))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Staged objects failed validation: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Promote copies the staged rows into the live tables in one transaction.
+// New rows are inserted first, in link order, and then the live rows that
+// the refresh changed are updated, which includes the archived ones. Only
+// the columns that differ from the snapshot are written, a column changed
+// in the live table since Create and left alone by the refresh keeps its
+// live value. then, when it is not nil, runs last in the same transaction.
+func (a *Area) Promote(ctx context.Context, db *gorm.DB, logger *logrus.Entry, then func(tx *gorm.DB) error) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		columns := make(map[string][]string)
+		for _, t := range tables {
+			var cols []string
+			err := tx.Raw("SELECT column_name FROM information_schema.columns WHERE table_schema = ? AND table_name = ? ORDER BY ordinal_position", a.schema, t.name).Scan(&cols).Error
+			if err != nil {
+				return err
+			}
+			columns[t.name] = cols
+		}
+		for _, t := range tables {
+			cols := strings.Join(columns[t.name], ", ")
+			result := tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s AS s WHERE NOT EXISTS (SELECT 1 FROM %s AS l WHERE l.id = s.id)",
+				t.name, cols, prefixed("s", columns[t.name]), a.staged(t.name), t.name))
+			if result.Error != nil {
+				return result.Error
+			}
+			logger.Infof("Promoted %d new %s", result.RowsAffected, t.name)
+		}
+		for _, t := range tables {
+			var updatable []string
+			for _, c := range columns[t.name] {
+				if c != "id" {
+					updatable = append(updatable, c)
+				}
+			}
+			changed := make([]string, len(updatable))
+			for i, c := range updatable {
+				changed[i] = fmt.Sprintf("CASE WHEN s.%s IS DISTINCT FROM b.%s THEN s.%s ELSE l.%s END", c, c, c, c)
+			}
+			result := tx.Exec(fmt.Sprintf("UPDATE %s AS l SET (%s) = (%s) FROM %s AS s JOIN %s AS b ON b.id = s.id WHERE l.id = s.id AND (%s) IS DISTINCT FROM (%s)",
+				t.name, strings.Join(updatable, ", "), strings.Join(changed, ", "), a.staged(t.name), a.snapshot(t.name), prefixed("s", updatable), prefixed("b", updatable)))
+			if result.Error != nil {
+				return result.Error
+			}
+			logger.Infof("Promoted %d changed %s", result.RowsAffected, t.name)
+		}
+		if then != nil {
+			return then(tx)
+		}
+		return nil
+	})
+}
+
+// Drop removes the staging schema
+func (a *Area) Drop(ctx context.Context, db *gorm.DB, logger *logrus.Entry) {
+	if err := db.WithContext(ctx).Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", a.schema)).Error; err != nil {
+		logger.Errorf("Error dropping staging schema %s %v", a.schema, err)
+	}
+}
+
+func (a *Area) staged(name string) string {
+	return a.schema + "." + name
+}
+
+// snapshot is the copy of the live rows taken by Create
+func (a *Area) snapshot(name string) string {
+	return a.schema + ".snapshot_" + name
+}
+
+func prefixed(alias string, columns []string) string {
+	result := make([]string, len(columns))
+	for i, c := range columns {
+		result[i] = alias + "." + c
+	}
+	return strings.Join(result, ", ")
+}
@@ -0,0 +1,152 @@
+package staging
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+const taskURL = "http://www.example.com/task/1"
+
+func TestNewArea(t *testing.T) {
+	a := NewArea(taskURL, 99, 1)
+	assert.Equal(t, a.schema, NewArea(taskURL, 99, 1).schema, "The same task should get the same schema")
+	assert.NotEqual(t, a.schema, NewArea(taskURL+"2", 99, 1).schema)
+	assert.True(t, strings.HasPrefix(a.schema, schemaPrefix))
+	assert.Equal(t, len(schemaPrefix)+16, len(a.schema))
+}
+
+func TestCreate(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	a := NewArea(taskURL, 99, 1)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DROP SCHEMA IF EXISTS " + a.schema + " CASCADE")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE SCHEMA " + a.schema)).WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, table := range tables {
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE " + a.schema + "." + table.name + " (LIKE " + table.name + " INCLUDING ALL)")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO "+a.schema+"."+table.name+" SELECT * FROM "+table.name+" WHERE tenant_id = $1 AND source_id = $2")).
+			WithArgs(int64(99), int64(1)).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE " + a.schema + ".snapshot_" + table.name + " AS SELECT * FROM " + a.schema + "." + table.name)).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+	}
+	mock.ExpectCommit()
+
+	err := a.Create(context.TODO(), gdb)
+	assert.Nil(t, err, "Create failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestLoad(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	a := NewArea(taskURL, 99, 1)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT set_config('search_path', $1 || ', ' || current_setting('search_path'), true)")).
+		WithArgs(a.schema).
+		WillReturnRows(sqlmock.NewRows([]string{"set_config"}).AddRow(a.schema + ", public"))
+	mock.ExpectCommit()
+
+	called := false
+	err := a.Load(context.TODO(), gdb, func(tx *gorm.DB) error {
+		called = true
+		return nil
+	})
+	assert.Nil(t, err, "Load failed")
+	assert.True(t, called, "The loader should get called")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func expectValidate(mock sqlmock.Sqlmock, a *Area, dangling int64) {
+	for _, table := range tables {
+		for _, l := range table.links {
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT count(*) FROM " + a.schema + "." + table.name + " AS s WHERE s." + l.column + " IS NOT NULL")).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(dangling))
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	a := NewArea(taskURL, 99, 1)
+	expectValidate(mock, a, 0)
+
+	err := a.Validate(context.TODO(), gdb)
+	assert.Nil(t, err, "Validate failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestValidateDangling(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	a := NewArea(taskURL, 99, 1)
+	expectValidate(mock, a, 2)
+
+	err := a.Validate(context.TODO(), gdb)
+	assert.NotNil(t, err, "Validate should have failed")
+	assert.Contains(t, err.Error(), "2 service_plans with a missing service_offering_id")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestPromote(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	a := NewArea(taskURL, 99, 1)
+	mock.ExpectBegin()
+	for _, table := range tables {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT column_name FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2 ORDER BY ordinal_position")).
+			WithArgs(a.schema, table.name).
+			WillReturnRows(sqlmock.NewRows([]string{"column_name"}).AddRow("id").AddRow("name").AddRow("archived_at"))
+	}
+	for _, table := range tables {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO " + table.name + " (id, name, archived_at) SELECT s.id, s.name, s.archived_at FROM " + a.schema + "." + table.name + " AS s WHERE NOT EXISTS (SELECT 1 FROM " + table.name + " AS l WHERE l.id = s.id)")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	for _, table := range tables {
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE " + table.name + " AS l SET (name, archived_at) = " +
+			"(CASE WHEN s.name IS DISTINCT FROM b.name THEN s.name ELSE l.name END, CASE WHEN s.archived_at IS DISTINCT FROM b.archived_at THEN s.archived_at ELSE l.archived_at END) " +
+			"FROM " + a.schema + "." + table.name + " AS s JOIN " + a.schema + ".snapshot_" + table.name + " AS b ON b.id = s.id " +
+			"WHERE l.id = s.id AND (s.name, s.archived_at) IS DISTINCT FROM (b.name, b.archived_at)")).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+	}
+	mock.ExpectCommit()
+
+	err := a.Promote(context.TODO(), gdb, testhelper.TestLogger(), nil)
+	assert.Nil(t, err, "Promote failed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestPromoteThenFails(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	a := NewArea(taskURL, 99, 1)
+	mock.ExpectBegin()
+	for _, table := range tables {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT column_name FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2 ORDER BY ordinal_position")).
+			WithArgs(a.schema, table.name).
+			WillReturnRows(sqlmock.NewRows([]string{"column_name"}).AddRow("id").AddRow("name"))
+	}
+	for _, table := range tables {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO " + table.name)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	for _, table := range tables {
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE " + table.name)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectRollback()
+
+	err := a.Promote(context.TODO(), gdb, testhelper.TestLogger(), func(tx *gorm.DB) error {
+		return errors.New("kaboom")
+	})
+	assert.EqualError(t, err, "kaboom", "The promoted rows should be rolled back with it")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
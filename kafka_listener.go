@@ -11,6 +11,8 @@ import (
 	"encoding/json"
 
 	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/identity"
 	"github.com/google/uuid"
 
 	"github.com/sirupsen/logrus"
@@ -24,10 +26,20 @@ type MessagePayload struct {
 	TaskURL  string `json:"task_url"`
 	DataURL  string `json:"data_url"`
 	Size     int64  `json:"size"`
+	// RefreshType is "incremental" for an incremental refresh, a message
+	// without it is a full refresh
+	RefreshType string `json:"refresh_type,omitempty"`
 }
 
-func startKafkaListener(dbContext DatabaseContext, logger *logrus.Logger, shutdown chan struct{}, wg *sync.WaitGroup, isReady *atomic.Value) {
-	cfg := config.Get()
+// fullRefresh reports whether the message is for a full refresh
+func (mp MessagePayload) fullRefresh() bool {
+	return mp.RefreshType != "incremental"
+}
+
+// startKafkaListener consumes messages until shutdown is closed, the workers
+// it starts are interrupted when interrupt is closed. cfg is the configuration
+// checked on startup, the workers get the same one.
+func startKafkaListener(cfg *config.TowerPersisterConfig, dbContext DatabaseContext, publisher events.Publisher, reporters *taskReporters, logger *logrus.Logger, shutdown, interrupt chan struct{}, wg *sync.WaitGroup, isReady *atomic.Value) {
 	defer logger.Info("Kafka Listener exiting")
 	defer wg.Done()
 	ctx := context.Background()
@@ -59,13 +71,53 @@ func startKafkaListener(dbContext DatabaseContext, logger *logrus.Logger, shutdo
 			logger.Errorf("Error subscribing to topic %v", err)
 		} else {
 			isReady.Store(true)
-			handleMessages(ctx, c, dbContext, logger, shutdown, wg)
+			dispatcher := newMessageDispatcher(cfg, dbContext, publisher, reporters, shutdown, interrupt, wg)
+			dl := newDeadLetters(cfg, publisher)
+			if cfg.ChunkedRefresh {
+				resumeCheckpoints(ctx, cfg, dbContext, logger, dispatcher, dl, wg)
+			}
+			handleMessages(ctx, cfg, c, dbContext, logger, dispatcher, dl, shutdown, wg)
 		}
 	}
 	c.Close()
 }
 
-func processMessage(ctx context.Context, dbContext DatabaseContext, logger *logrus.Logger, shutdown chan struct{}, wg *sync.WaitGroup, km *kafka.Message) {
+// newMessageDispatcher creates the dispatcher which starts a Persister Worker
+// for every message in turn, each message has been added to wg. The workers
+// publish their events with publisher, which can be nil, and report their
+// tasks with reporters. Once shutdown
+// is closed the waiting messages are not started any more and the running
+// workers are interrupted when interrupt is closed.
+func newMessageDispatcher(cfg *config.TowerPersisterConfig, dbContext DatabaseContext, publisher events.Publisher, reporters *taskReporters, shutdown, interrupt chan struct{}, wg *sync.WaitGroup) *sourceDispatcher {
+	run := func(qm queuedMessage) {
+		select {
+		case <-shutdown:
+			defer wg.Done()
+			if resumable(cfg, dbContext, qm) {
+				qm.logger.Infof("Shutting down, task %s will resume from its checkpoint", qm.payload.TaskURL)
+				return
+			}
+			qm.logger.Infof("Shutting down, task %s is not started", qm.payload.TaskURL)
+			interruptedTask(qm, taskPersister(reporters, qm))
+			return
+		default:
+		}
+		ctx := context.Background()
+		if qm.identity != nil {
+			ctx = identity.NewContext(ctx, qm.identity)
+		}
+		startPersisterWorker(ctx, cfg, dbContext, qm.logger, qm.payload, qm.headers, interrupt, wg, eventPersister(cfg, reporters, qm, publisher))
+	}
+	supersede := func(qm queuedMessage) {
+		defer wg.Done()
+		supersededTask(qm, taskPersister(reporters, qm))
+	}
+	return newSourceDispatcher(cfg.SourceQueueDepth, run, supersede)
+}
+
+// processMessage dispatches a message, a message without a valid identity
+// is rejected right away
+func processMessage(ctx context.Context, cfg *config.TowerPersisterConfig, dbContext DatabaseContext, logger *logrus.Logger, dispatcher *sourceDispatcher, dl *deadLetters, wg *sync.WaitGroup, km *kafka.Message) {
 	messageHeaders := make(map[string]string)
 	var messagePayload MessagePayload
 	requestID := uuid.New().String()
@@ -74,7 +126,7 @@ func processMessage(ctx context.Context, dbContext DatabaseContext, logger *logr
 		case "x-rh-insights-request-id":
 			messageHeaders[hdr.Key] = string(hdr.Value)
 			requestID = string(hdr.Value)
-		case "x-rh-identity", "event_type":
+		case "x-rh-identity", "event_type", taskReporterHeader:
 			messageHeaders[hdr.Key] = string(hdr.Value)
 		}
 	}
@@ -83,13 +135,19 @@ func processMessage(ctx context.Context, dbContext DatabaseContext, logger *logr
 	err := json.Unmarshal([]byte(string(km.Value)), &messagePayload)
 	if err != nil {
 		logEntry.Errorf("Error parsing message" + err.Error())
-	} else {
-		logEntry.Info("Received Kafka Message")
-		logEntry.Info(stats())
-		wg.Add(1)
-		ctx := context.Background()
-		go startPersisterWorker(ctx, dbContext, logEntry, messagePayload, messageHeaders, shutdown, wg, nil)
+		return
+	}
+
+	id, err := identity.Decode(messageHeaders["x-rh-identity"])
+	if err != nil {
+		dl.reject(logEntry, string(km.Key), km.Value, messageHeaders, err)
+		return
 	}
+	logEntry = logEntry.WithFields(id.Fields())
+	logEntry.Info("Received Kafka Message")
+	logEntry.Info(stats())
+	wg.Add(1)
+	dispatcher.dispatch(queuedMessage{logger: logEntry, payload: messagePayload, headers: messageHeaders, identity: id})
 }
 
 // stats
@@ -108,7 +166,7 @@ func bToMb(b uint64) uint64 {
 }
 
 // handleMessages handle Kafka Messages coming from Catalog Inventory API
-func handleMessages(ctx context.Context, c *kafka.Consumer, dbContext DatabaseContext, logger *logrus.Logger, shutdown chan struct{}, wg *sync.WaitGroup) {
+func handleMessages(ctx context.Context, cfg *config.TowerPersisterConfig, c *kafka.Consumer, dbContext DatabaseContext, logger *logrus.Logger, dispatcher *sourceDispatcher, dl *deadLetters, shutdown chan struct{}, wg *sync.WaitGroup) {
 	terminate := false
 	for !terminate {
 		select {
@@ -122,7 +180,7 @@ func handleMessages(ctx context.Context, c *kafka.Consumer, dbContext DatabaseCo
 				switch ev := ev.(type) {
 
 				case *kafka.Message:
-					processMessage(ctx, dbContext, logger, shutdown, wg, ev)
+					processMessage(ctx, cfg, dbContext, logger, dispatcher, dl, wg, ev)
 
 				case kafka.PartitionEOF:
 					terminate = true
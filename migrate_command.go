@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/migrations"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const migrateUsage = "Usage: catalog_tower_persister migrate up|down|status"
+
+// runMigrate handles the migrate sub command and returns the exit code
+// e.g. catalog_tower_persister migrate up
+func runMigrate(db *gorm.DB, dir string, log *logrus.Logger, args []string) int {
+	m, err := migrations.NewMigrator(db, dir)
+	if err != nil {
+		log.Errorf("Failed to load the migrations %v", err)
+		return 1
+	}
+	return migrate(context.Background(), m, log.WithFields(logrus.Fields{"command": "migrate"}), args, os.Stdout)
+}
+
+// migrator is the part of migrations.Migrator used by the migrate command
+type migrator interface {
+	Up(ctx context.Context, logger *logrus.Entry) error
+	Down(ctx context.Context, logger *logrus.Entry) error
+	Status(ctx context.Context) ([]migrations.Status, error)
+}
+
+func migrate(ctx context.Context, m migrator, logger *logrus.Entry, args []string, out io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintln(out, migrateUsage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "up":
+		err = m.Up(ctx, logger)
+	case "down":
+		err = m.Down(ctx, logger)
+	case "status":
+		var statuses []migrations.Status
+		statuses, err = m.Status(ctx)
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt.Valid {
+				state = "applied " + s.AppliedAt.Time.Format("2006-01-02T15:04:05Z07:00")
+			}
+			if s.Unknown {
+				state += " (unknown to this persister)"
+			}
+			fmt.Fprintf(out, "%4d %-30s %s\n", s.Version, s.Name, state)
+		}
+	default:
+		fmt.Fprintln(out, migrateUsage)
+		return 2
+	}
+	if err != nil {
+		logger.Errorf("Migrate %s failed %v", args[0], err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/migrations"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMigrator struct {
+	upCalled   bool
+	downCalled bool
+	err        error
+	statuses   []migrations.Status
+}
+
+func (fm *fakeMigrator) Up(ctx context.Context, logger *logrus.Entry) error {
+	fm.upCalled = true
+	return fm.err
+}
+
+func (fm *fakeMigrator) Down(ctx context.Context, logger *logrus.Entry) error {
+	fm.downCalled = true
+	return fm.err
+}
+
+func (fm *fakeMigrator) Status(ctx context.Context) ([]migrations.Status, error) {
+	return fm.statuses, fm.err
+}
+
+func TestMigrateUp(t *testing.T) {
+	fm := &fakeMigrator{}
+	var out bytes.Buffer
+	assert.Equal(t, 0, migrate(context.TODO(), fm, testhelper.TestLogger(), []string{"up"}, &out))
+	assert.True(t, fm.upCalled, "Up not called")
+}
+
+func TestMigrateDownError(t *testing.T) {
+	fm := &fakeMigrator{err: fmt.Errorf("kaboom")}
+	var out bytes.Buffer
+	assert.Equal(t, 1, migrate(context.TODO(), fm, testhelper.TestLogger(), []string{"down"}, &out))
+	assert.True(t, fm.downCalled, "Down not called")
+}
+
+func TestMigrateStatus(t *testing.T) {
+	applied := time.Date(2021, 1, 8, 10, 22, 59, 0, time.UTC)
+	fm := &fakeMigrator{statuses: []migrations.Status{
+		{Migration: migrations.Migration{Version: 1, Name: "first"}, AppliedAt: sql.NullTime{Time: applied, Valid: true}},
+		{Migration: migrations.Migration{Version: 2, Name: "second"}},
+	}}
+	var out bytes.Buffer
+	assert.Equal(t, 0, migrate(context.TODO(), fm, testhelper.TestLogger(), []string{"status"}, &out))
+	assert.Contains(t, out.String(), "applied 2021-01-08T10:22:59Z")
+	assert.Contains(t, out.String(), "second")
+	assert.Contains(t, out.String(), "pending")
+}
+
+func TestMigrateUsage(t *testing.T) {
+	fm := &fakeMigrator{}
+	var out bytes.Buffer
+	assert.Equal(t, 2, migrate(context.TODO(), fm, testhelper.TestLogger(), []string{"sideways"}, &out))
+	assert.Contains(t, out.String(), migrateUsage)
+	assert.False(t, fm.upCalled || fm.downCalled, "Nothing should have run")
+}
@@ -0,0 +1,114 @@
+-- The tables are shared with the Catalog Inventory service which may already
+-- have created them, so only the columns the persister uses are defined here
+-- and existing tables are left untouched. The tenants and sources tables
+-- belong to Catalog Inventory and have to exist before the persister is
+-- migrated. There is no down migration, the tables are never dropped.
+CREATE TABLE IF NOT EXISTS service_inventories (
+	id bigserial PRIMARY KEY,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL,
+	archived_at timestamp,
+	source_ref text,
+	source_created_at timestamp,
+	source_updated_at timestamp,
+	last_seen_at timestamp,
+	name text,
+	description text,
+	extra jsonb,
+	tenant_id bigint NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+	source_id bigint NOT NULL REFERENCES sources (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS index_service_inventories_on_archived_at ON service_inventories (archived_at);
+
+CREATE TABLE IF NOT EXISTS service_offerings (
+	id bigserial PRIMARY KEY,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL,
+	archived_at timestamp,
+	source_ref text,
+	source_created_at timestamp,
+	source_updated_at timestamp,
+	last_seen_at timestamp,
+	name text,
+	description text,
+	extra jsonb,
+	tenant_id bigint NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+	source_id bigint NOT NULL REFERENCES sources (id) ON DELETE CASCADE,
+	service_inventory_id bigint REFERENCES service_inventories (id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS index_service_offerings_on_archived_at ON service_offerings (archived_at);
+
+CREATE TABLE IF NOT EXISTS service_offering_nodes (
+	id bigserial PRIMARY KEY,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL,
+	archived_at timestamp,
+	source_ref text,
+	source_created_at timestamp,
+	source_updated_at timestamp,
+	last_seen_at timestamp,
+	name text,
+	extra jsonb,
+	tenant_id bigint NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+	source_id bigint NOT NULL REFERENCES sources (id) ON DELETE CASCADE,
+	service_inventory_id bigint REFERENCES service_inventories (id) ON DELETE SET NULL,
+	service_offering_id bigint REFERENCES service_offerings (id) ON DELETE SET NULL,
+	root_service_offering_id bigint REFERENCES service_offerings (id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS index_service_offering_nodes_on_archived_at ON service_offering_nodes (archived_at);
+
+CREATE TABLE IF NOT EXISTS service_plans (
+	id bigserial PRIMARY KEY,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL,
+	archived_at timestamp,
+	source_ref text,
+	source_created_at timestamp,
+	source_updated_at timestamp,
+	last_seen_at timestamp,
+	name text,
+	description text,
+	extra jsonb,
+	create_json_schema jsonb,
+	update_json_schema jsonb,
+	tenant_id bigint NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+	source_id bigint NOT NULL REFERENCES sources (id) ON DELETE CASCADE,
+	service_offering_id bigint REFERENCES service_offerings (id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS index_service_plans_on_archived_at ON service_plans (archived_at);
+
+CREATE TABLE IF NOT EXISTS service_credential_types (
+	id bigserial PRIMARY KEY,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL,
+	archived_at timestamp,
+	source_ref text,
+	source_created_at timestamp,
+	source_updated_at timestamp,
+	last_seen_at timestamp,
+	name text,
+	description text,
+	kind text,
+	namespace text,
+	tenant_id bigint NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+	source_id bigint NOT NULL REFERENCES sources (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS index_service_credential_types_on_archived_at ON service_credential_types (archived_at);
+
+CREATE TABLE IF NOT EXISTS service_credentials (
+	id bigserial PRIMARY KEY,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL,
+	archived_at timestamp,
+	source_ref text,
+	source_created_at timestamp,
+	source_updated_at timestamp,
+	last_seen_at timestamp,
+	name text,
+	type_name text,
+	description text,
+	tenant_id bigint NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+	source_id bigint NOT NULL REFERENCES sources (id) ON DELETE CASCADE,
+	service_credential_type_id bigint REFERENCES service_credential_types (id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS index_service_credentials_on_archived_at ON service_credentials (archived_at);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS index_service_inventories_on_tenant_source_ref;
+DROP INDEX IF EXISTS index_service_offerings_on_tenant_source_ref;
+DROP INDEX IF EXISTS index_service_offering_nodes_on_tenant_source_ref;
+DROP INDEX IF EXISTS index_service_plans_on_tenant_source_ref;
+DROP INDEX IF EXISTS index_service_credential_types_on_tenant_source_ref;
+DROP INDEX IF EXISTS index_service_credentials_on_tenant_source_ref;
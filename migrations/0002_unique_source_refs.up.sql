@@ -0,0 +1,118 @@
+-- The upserts resolve conflicts on (tenant_id, source_id, source_ref) which
+-- needs a unique index. Older persisters created a new row when an object
+-- came back after being archived. The rows may be referenced by Catalog
+-- Inventory, so the migration fails and lists the duplicates for an operator
+-- to merge instead of deleting them.
+DO $$
+DECLARE
+	duplicates text;
+BEGIN
+	SELECT string_agg(format('tenant %s source %s source_ref %s ids %s', tenant_id, source_id, source_ref, ids), '; ')
+	INTO duplicates
+	FROM (
+		SELECT tenant_id, source_id, source_ref, string_agg(id::text, ',' ORDER BY id) AS ids
+		FROM service_inventories
+		GROUP BY tenant_id, source_id, source_ref
+		HAVING count(*) > 1
+		ORDER BY tenant_id, source_id, source_ref
+		LIMIT 20) AS duplicated;
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION 'service_inventories has duplicated source refs, merge them before migrating: %', duplicates;
+	END IF;
+END $$;
+CREATE UNIQUE INDEX IF NOT EXISTS index_service_inventories_on_tenant_source_ref ON service_inventories (tenant_id, source_id, source_ref);
+
+DO $$
+DECLARE
+	duplicates text;
+BEGIN
+	SELECT string_agg(format('tenant %s source %s source_ref %s ids %s', tenant_id, source_id, source_ref, ids), '; ')
+	INTO duplicates
+	FROM (
+		SELECT tenant_id, source_id, source_ref, string_agg(id::text, ',' ORDER BY id) AS ids
+		FROM service_offerings
+		GROUP BY tenant_id, source_id, source_ref
+		HAVING count(*) > 1
+		ORDER BY tenant_id, source_id, source_ref
+		LIMIT 20) AS duplicated;
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION 'service_offerings has duplicated source refs, merge them before migrating: %', duplicates;
+	END IF;
+END $$;
+CREATE UNIQUE INDEX IF NOT EXISTS index_service_offerings_on_tenant_source_ref ON service_offerings (tenant_id, source_id, source_ref);
+
+DO $$
+DECLARE
+	duplicates text;
+BEGIN
+	SELECT string_agg(format('tenant %s source %s source_ref %s ids %s', tenant_id, source_id, source_ref, ids), '; ')
+	INTO duplicates
+	FROM (
+		SELECT tenant_id, source_id, source_ref, string_agg(id::text, ',' ORDER BY id) AS ids
+		FROM service_offering_nodes
+		GROUP BY tenant_id, source_id, source_ref
+		HAVING count(*) > 1
+		ORDER BY tenant_id, source_id, source_ref
+		LIMIT 20) AS duplicated;
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION 'service_offering_nodes has duplicated source refs, merge them before migrating: %', duplicates;
+	END IF;
+END $$;
+CREATE UNIQUE INDEX IF NOT EXISTS index_service_offering_nodes_on_tenant_source_ref ON service_offering_nodes (tenant_id, source_id, source_ref);
+
+DO $$
+DECLARE
+	duplicates text;
+BEGIN
+	SELECT string_agg(format('tenant %s source %s source_ref %s ids %s', tenant_id, source_id, source_ref, ids), '; ')
+	INTO duplicates
+	FROM (
+		SELECT tenant_id, source_id, source_ref, string_agg(id::text, ',' ORDER BY id) AS ids
+		FROM service_plans
+		GROUP BY tenant_id, source_id, source_ref
+		HAVING count(*) > 1
+		ORDER BY tenant_id, source_id, source_ref
+		LIMIT 20) AS duplicated;
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION 'service_plans has duplicated source refs, merge them before migrating: %', duplicates;
+	END IF;
+END $$;
+CREATE UNIQUE INDEX IF NOT EXISTS index_service_plans_on_tenant_source_ref ON service_plans (tenant_id, source_id, source_ref);
+
+DO $$
+DECLARE
+	duplicates text;
+BEGIN
+	SELECT string_agg(format('tenant %s source %s source_ref %s ids %s', tenant_id, source_id, source_ref, ids), '; ')
+	INTO duplicates
+	FROM (
+		SELECT tenant_id, source_id, source_ref, string_agg(id::text, ',' ORDER BY id) AS ids
+		FROM service_credential_types
+		GROUP BY tenant_id, source_id, source_ref
+		HAVING count(*) > 1
+		ORDER BY tenant_id, source_id, source_ref
+		LIMIT 20) AS duplicated;
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION 'service_credential_types has duplicated source refs, merge them before migrating: %', duplicates;
+	END IF;
+END $$;
+CREATE UNIQUE INDEX IF NOT EXISTS index_service_credential_types_on_tenant_source_ref ON service_credential_types (tenant_id, source_id, source_ref);
+
+DO $$
+DECLARE
+	duplicates text;
+BEGIN
+	SELECT string_agg(format('tenant %s source %s source_ref %s ids %s', tenant_id, source_id, source_ref, ids), '; ')
+	INTO duplicates
+	FROM (
+		SELECT tenant_id, source_id, source_ref, string_agg(id::text, ',' ORDER BY id) AS ids
+		FROM service_credentials
+		GROUP BY tenant_id, source_id, source_ref
+		HAVING count(*) > 1
+		ORDER BY tenant_id, source_id, source_ref
+		LIMIT 20) AS duplicated;
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION 'service_credentials has duplicated source refs, merge them before migrating: %', duplicates;
+	END IF;
+END $$;
+CREATE UNIQUE INDEX IF NOT EXISTS index_service_credentials_on_tenant_source_ref ON service_credentials (tenant_id, source_id, source_ref);
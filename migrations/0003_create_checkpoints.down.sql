@@ -0,0 +1,2 @@
+DROP TABLE tower_persister_staged_pages;
+DROP TABLE tower_persister_checkpoints;
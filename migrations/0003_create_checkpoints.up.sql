@@ -0,0 +1,23 @@
+-- Chunked refreshes stage the pages of a task and record how far they got, so
+-- an interrupted refresh can be resumed
+CREATE TABLE tower_persister_checkpoints (
+	task_url text PRIMARY KEY,
+	tenant_id bigint NOT NULL,
+	source_id bigint NOT NULL,
+	data_url text NOT NULL,
+	size bigint NOT NULL DEFAULT 0,
+	headers jsonb,
+	pages_staged integer NOT NULL DEFAULT 0,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL,
+	claimed_at timestamp NOT NULL,
+	claimed_by text NOT NULL
+);
+
+CREATE TABLE tower_persister_staged_pages (
+	task_url text NOT NULL REFERENCES tower_persister_checkpoints (task_url) ON DELETE CASCADE,
+	position integer NOT NULL,
+	name text NOT NULL,
+	content bytea NOT NULL,
+	PRIMARY KEY (task_url, position)
+);
@@ -0,0 +1 @@
+DROP TABLE tower_persister_pending_task_updates;
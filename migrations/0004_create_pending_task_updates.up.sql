@@ -0,0 +1,14 @@
+-- Task updates are kept until Catalog Inventory acknowledges them so they can
+-- be delivered again after a failure
+CREATE TABLE tower_persister_pending_task_updates (
+	task_url text PRIMARY KEY,
+	payload jsonb NOT NULL,
+	headers jsonb,
+	attempts integer NOT NULL DEFAULT 0,
+	last_error text NOT NULL DEFAULT '',
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL
+);
+
+CREATE INDEX index_tower_persister_pending_task_updates_on_updated_at
+	ON tower_persister_pending_task_updates (updated_at);
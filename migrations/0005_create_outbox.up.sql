@@ -0,0 +1,12 @@
+-- Change events are written in the transaction that changes the catalog
+-- objects and relayed to Kafka once it is committed, the id keeps the order
+-- they were written in
+CREATE TABLE tower_persister_outbox (
+	id bigserial PRIMARY KEY,
+	topic text NOT NULL,
+	event_key text NOT NULL,
+	event_type text NOT NULL,
+	payload jsonb NOT NULL,
+	headers jsonb,
+	created_at timestamp NOT NULL
+);
@@ -0,0 +1 @@
+DROP TABLE tower_persister_audit_log;
@@ -0,0 +1,24 @@
+-- Every change a refresh makes to a catalog object is kept for the audit
+-- retention so its history can be looked up later
+CREATE TABLE tower_persister_audit_log (
+	id bigserial PRIMARY KEY,
+	tenant_id bigint NOT NULL,
+	source_id bigint NOT NULL,
+	object_type text NOT NULL,
+	object_id bigint NOT NULL,
+	source_ref text NOT NULL,
+	action text NOT NULL,
+	changed_fields jsonb,
+	before jsonb,
+	after jsonb,
+	diffs jsonb,
+	request_id text NOT NULL DEFAULT '',
+	task_url text NOT NULL DEFAULT '',
+	created_at timestamp NOT NULL
+);
+
+CREATE INDEX index_tower_persister_audit_log_on_source_object
+	ON tower_persister_audit_log (source_id, object_type, source_ref, created_at);
+
+CREATE INDEX index_tower_persister_audit_log_on_created_at
+	ON tower_persister_audit_log (created_at);
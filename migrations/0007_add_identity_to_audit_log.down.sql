@@ -0,0 +1,3 @@
+ALTER TABLE tower_persister_audit_log
+	DROP COLUMN account_number,
+	DROP COLUMN org_id;
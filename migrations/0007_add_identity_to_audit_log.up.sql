@@ -0,0 +1,5 @@
+-- The account and organization of the x-rh-identity that requested the
+-- refresh, entries written before are left empty
+ALTER TABLE tower_persister_audit_log
+	ADD COLUMN account_number text NOT NULL DEFAULT '',
+	ADD COLUMN org_id text NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE tower_persister_checkpoints
+	DROP COLUMN pages_applied;
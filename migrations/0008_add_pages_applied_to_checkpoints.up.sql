@@ -0,0 +1,4 @@
+-- Chunked refreshes commit the objects of a chunk of staged pages together
+-- with the number of pages applied so far
+ALTER TABLE tower_persister_checkpoints
+	ADD COLUMN pages_applied integer NOT NULL DEFAULT 0;
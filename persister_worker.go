@@ -2,34 +2,49 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"runtime/debug"
 	"sync"
 	"time"
 
+	"github.com/RedHatInsights/catalog_tower_persister/config"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/catalogtask"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/checkpoint"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/source"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/payload"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/sourcelock"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/staging"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
 type defaultPersister struct {
-	catalogTask catalogtask.CatalogTask
+	reporter     catalogtask.Reporter
+	publisher    events.Publisher
+	eventTopic   string
+	eventTimeout time.Duration
+	requestID    string
+	deadLetters  *deadLetters
 }
 
 // Persister Interface needs to be able to process a Tar file and
 // also update the Task in the cloud.redhat.com
 type Persister interface {
 	ProcessTar(ctx context.Context, logger *logrus.Entry, loader payload.Loader, client *http.Client, dbTransaction *gorm.DB, url string, shutdown chan struct{}) error
-	TaskUpdater(logger *logrus.Entry, d map[string]interface{}, client *http.Client) error
+	StageTar(ctx context.Context, logger *logrus.Entry, checkpoints checkpoint.Repository, cp *checkpoint.Checkpoint, client *http.Client, url string, chunkSize int, shutdown chan struct{}) error
+	ProcessStaged(ctx context.Context, logger *logrus.Entry, loader payload.Loader, pages checkpoint.Repository, cp *checkpoint.Checkpoint, chunkSize int, dbTransaction *gorm.DB, commit payload.ChunkFunc) error
+	TaskUpdater(logger *logrus.Entry, d map[string]interface{}) error
+	PublishEvent(logger *logrus.Entry, event *events.SourceRefreshed) error
+	Reject(logger *logrus.Entry, message MessagePayload, headers map[string]string, reason error)
 }
 
 // startPersisterWorker when a message is received from Kafka we start a
-// Persister Worker.
-func startPersisterWorker(ctx context.Context, db DatabaseContext, logger *logrus.Entry, message MessagePayload, headers map[string]string, shutdown chan struct{}, wg *sync.WaitGroup, p Persister) {
+// Persister Worker. The worker stops when shutdown is closed.
+func startPersisterWorker(ctx context.Context, cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Entry, message MessagePayload, headers map[string]string, shutdown chan struct{}, wg *sync.WaitGroup, p Persister) {
 	defer logger.Info("Persister Worker finished")
 	defer wg.Done()
 	logger.Info("Persister Worker started")
@@ -41,15 +56,19 @@ func startPersisterWorker(ctx context.Context, db DatabaseContext, logger *logru
 			logger.Errorf("Panic occured %v", err)
 		}
 	}()
-	duration := 15 * time.Minute
-	newCtx, cancel := context.WithTimeout(context.Background(), duration)
+	newCtx, cancel := context.WithTimeout(ctx, cfg.WorkerTimeout)
 	defer cancel()
+	// An interrupt cancels the refresh, the database calls and the
+	// download stop where they are and the transaction is rolled back
+	go func() {
+		select {
+		case <-shutdown:
+			cancel()
+		case <-newCtx.Done():
+		}
+	}()
 
-	if p == nil {
-		p = &defaultPersister{catalogTask: catalogtask.MakeCatalogTask(ctx, logger, message.TaskURL, headers)}
-	}
-
-	tenant, source, err := setup(logger, db, message.TenantID, message.SourceID)
+	tenant, source, err := setup(newCtx, cfg, logger, db, message)
 	if err != nil {
 		logger.Errorf("Error setting up tenant and source %v", err)
 		err = updateTask(logger, "completed", "error", err.Error(), nil, p)
@@ -59,66 +78,224 @@ func startPersisterWorker(ctx context.Context, db DatabaseContext, logger *logru
 		return
 	}
 
+	// The identity is needed to update the task, a message sent on behalf
+	// of another tenant is never processed
+	if err := checkIdentity(newCtx, tenant); err != nil {
+		p.Reject(logger, message, headers, err)
+		return
+	}
+	backfillOrgID(newCtx, cfg, db, logger, tenant)
+
+	lock, output, err := lockSource(newCtx, cfg, db, logger, source.ID, shutdown)
+	if err != nil {
+		status, msg := failure(newCtx, cfg, err)
+		if errors.Is(err, sourcelock.ErrLocked) && sourcelock.Policy(cfg.SourceLockPolicy) == sourcelock.PolicySkip {
+			status, msg = "ok", fmt.Sprintf("Superseded, source %d is being refreshed by another task", source.ID)
+		}
+		if err := updateTask(logger, "completed", status, msg, output, p); err != nil {
+			logger.Errorf("Error updating task %v", err)
+		}
+		return
+	}
+	defer lock.Release(logger)
+
 	err = updateTask(logger, "running", "ok", fmt.Sprintf("Processing file size %d", message.Size), nil, p)
 	if err != nil {
 		logger.Errorf("Error updating task  to running state %v", err)
 		return
 	}
 
-	dbTransaction := db.DB.Begin()
-	bol := payload.MakeBillOfLading(logger, tenant, source, nil, dbTransaction)
-	err = p.ProcessTar(newCtx, logger, bol, &http.Client{}, dbTransaction, message.DataURL, shutdown)
+	if cfg.ChunkedRefresh {
+		processChunked(newCtx, cfg, db, logger, message, headers, tenant, source, output, shutdown, p)
+		return
+	}
+
+	commitRefresh(newCtx, cfg, db, logger, message.TaskURL, tenant, source, output, p, func(loader payload.Loader, dbTransaction *gorm.DB) error {
+		return p.ProcessTar(newCtx, logger, loader, &http.Client{}, dbTransaction, message.DataURL, shutdown)
+	})
+}
+
+// lockSource serializes the refreshes of a source with an advisory lock, the
+// returned output reports the lock in the task
+func lockSource(ctx context.Context, cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Entry, sourceID int64, shutdown chan struct{}) (*sourcelock.Lock, map[string]interface{}, error) {
+	policy := sourcelock.Policy(cfg.SourceLockPolicy)
+	if policy == "" {
+		policy = sourcelock.PolicyWait
+	}
+	report := map[string]interface{}{"policy": string(policy)}
+	output := map[string]interface{}{"source_lock": report}
+	lock, err := sourcelock.Acquire(ctx, db.DB, logger, sourceID, policy, shutdown)
 	if err != nil {
-		logger.Errorf("Rolling back database changes %v", err)
-		dbTransaction.Rollback()
-		err = updateTask(logger, "completed", "error", err.Error(), nil, p)
-		if err != nil {
-			logger.Errorf("Error updating task %v", err)
-		}
+		logger.Errorf("Error locking source %d %v", sourceID, err)
+		report["acquired"] = false
+		return nil, output, err
+	}
+	report["acquired"] = true
+	report["waited_seconds"] = lock.Waited.Seconds()
+	return lock, output, nil
+}
+
+// commitRefresh runs process in a transaction, commits it if process
+// succeeded and completes the task. With staged refreshes process runs
+// against a staging area which is then promoted to the live tables.
+// The stats or errors are added to output.
+func commitRefresh(ctx context.Context, cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Entry, taskURL string, tenant *tenant.Tenant, source *source.Source, output map[string]interface{}, p Persister, process func(loader payload.Loader, dbTransaction *gorm.DB) error) error {
+	var bol *payload.BillOfLading
+	var err error
+	reporter := startProgressReporter(logger, p, cfg.ProgressInterval)
+	if cfg.StagedRefresh {
+		bol, err = stageAndPromote(ctx, cfg, db, logger, taskURL, tenant, source, reporter.report, process)
 	} else {
-		dbTransaction.Commit()
-		logger.Info("Commited database changes")
-		err = updateTask(logger, "completed", "ok", "Success", bol.GetStats(newCtx), p)
-		if err != nil {
+		bol, err = processAndCommit(ctx, cfg, db, logger, taskURL, tenant, source, reporter.report, process)
+	}
+	reporter.stop()
+	if err != nil {
+		status, msg := failure(ctx, cfg, err)
+		if err := updateTask(logger, "completed", status, msg, output, p); err != nil {
 			logger.Errorf("Error updating task %v", err)
 		}
+		return err
 	}
+	completeRefresh(ctx, cfg, logger, taskURL, tenant, source, output, p, bol)
+	return nil
+}
+
+// completeRefresh publishes the refreshed event of a refresh that was
+// committed and completes its task with the stats in output
+func completeRefresh(ctx context.Context, cfg *config.TowerPersisterConfig, logger *logrus.Entry, taskURL string, tenant *tenant.Tenant, source *source.Source, output map[string]interface{}, p Persister, bol *payload.BillOfLading) {
+	stats := bol.GetStats(ctx)
+	if err := p.PublishEvent(logger, refreshedEvent(cfg, taskURL, tenant, source, stats, bol.Changes())); err != nil {
+		logger.Errorf("Error publishing the refreshed event %v", err)
+	}
+	msg := "Success"
+	output = withOutput(output, "stats", stats)
+	if skipped := bol.ObjectErrors(); skipped.Total > 0 {
+		msg = fmt.Sprintf("Success, skipped %d invalid objects", skipped.Total)
+		output = withOutput(output, "errors", skipped.Objects)
+		output = withOutput(output, "error_totals", map[string]interface{}{"total": skipped.Total, "by_type": skipped.ByType})
+	}
+	if err := updateTask(logger, "completed", "ok", msg, output, p); err != nil {
+		logger.Errorf("Error updating task %v", err)
+	}
+}
+
+// processAndCommit runs process in a transaction and commits it. The
+// transaction is not tied to ctx, only its statements are, so an interrupt
+// after the last statement cannot roll back the commit behind our back. A
+// failed begin or commit fails the refresh.
+func processAndCommit(ctx context.Context, cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Entry, taskURL string, tenant *tenant.Tenant, source *source.Source, onProgress payload.ProgressFunc, process func(loader payload.Loader, dbTransaction *gorm.DB) error) (*payload.BillOfLading, error) {
+	tx := db.DB.Begin()
+	if tx.Error != nil {
+		logger.Errorf("Error starting a database transaction %v", tx.Error)
+		return nil, tx.Error
+	}
+	dbTransaction := tx.WithContext(ctx)
+	bol := newBillOfLading(cfg, logger, tenant, source, dbTransaction, onProgress)
+	err := process(bol, dbTransaction)
+	if err == nil {
+		err = recordChanges(ctx, cfg, dbTransaction, logger, taskURL, tenant, source, bol.Changes())
+	}
+	if err != nil {
+		logger.Errorf("Rolling back database changes %v", err)
+		tx.Rollback()
+		return bol, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		logger.Errorf("Error committing database changes %v", err)
+		return bol, err
+	}
+	logger.Info("Commited database changes")
+	return bol, nil
+}
+
+// newBillOfLading makes the BillOfLading of a refresh with the configured
+// error policy
+func newBillOfLading(cfg *config.TowerPersisterConfig, logger *logrus.Entry, tenant *tenant.Tenant, source *source.Source, dbTransaction *gorm.DB, onProgress payload.ProgressFunc) *payload.BillOfLading {
+	bol := payload.MakeBillOfLading(logger, tenant, source, nil, dbTransaction)
+	bol.OnProgress(onProgress)
+	bol.SetErrorPolicy(payload.ErrorPolicy(cfg.ObjectErrorPolicy), cfg.MaxObjectErrors)
+	return bol
+}
+
+// stageAndPromote loads the refresh into a staging area, checks the links
+// of the staged objects and promotes them to the live tables in one short
+// transaction
+func stageAndPromote(ctx context.Context, cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Entry, taskURL string, tenant *tenant.Tenant, source *source.Source, onProgress payload.ProgressFunc, process func(loader payload.Loader, dbTransaction *gorm.DB) error) (*payload.BillOfLading, error) {
+	var bol *payload.BillOfLading
+	area := staging.NewArea(taskURL, tenant.ID, source.ID)
+	defer area.Drop(context.Background(), db.DB, logger)
+	if err := area.Create(ctx, db.DB); err != nil {
+		logger.Errorf("Error creating staging area %v", err)
+		return nil, err
+	}
+	err := area.Load(ctx, db.DB, func(tx *gorm.DB) error {
+		bol = newBillOfLading(cfg, logger, tenant, source, tx, onProgress)
+		return process(bol, tx)
+	})
+	if err != nil {
+		logger.Errorf("Error loading staging area %v", err)
+		return nil, err
+	}
+	if err := area.Validate(ctx, db.DB); err != nil {
+		logger.Errorf("Error validating staging area %v", err)
+		return nil, err
+	}
+	err = area.Promote(ctx, db.DB, logger, func(tx *gorm.DB) error {
+		return recordChanges(ctx, cfg, tx, logger, taskURL, tenant, source, bol.Changes())
+	})
+	if err != nil {
+		logger.Errorf("Error promoting staging area %v", err)
+		return nil, err
+	}
+	logger.Info("Promoted staged changes")
+	return bol, nil
+}
+
+// failure picks the task status and message for a refresh that failed with
+// err, a refresh that ran out of time gets a status of its own and one
+// interrupted by a shutdown says it will be retried
+func failure(ctx context.Context, cfg *config.TowerPersisterConfig, err error) (string, string) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded:
+		return "timedout", fmt.Sprintf("Refresh timed out after %v", cfg.WorkerTimeout)
+	case errors.Is(err, context.Canceled) || errors.Is(err, payload.ErrShutdown) || errors.Is(err, sourcelock.ErrShutdown):
+		return "error", interruptedMessage
+	}
+	return "error", err.Error()
 }
 
 // setup ensures we have a Tenant and Source object
-func setup(logger *logrus.Entry, db DatabaseContext, tenantID int64, sourceID int64) (*tenant.Tenant, *source.Source, error) {
+func setup(ctx context.Context, cfg *config.TowerPersisterConfig, logger *logrus.Entry, db DatabaseContext, message MessagePayload) (*tenant.Tenant, *source.Source, error) {
 	var err error
-	tenant, err := findTenant(db, tenantID)
+	tenant, err := findTenant(ctx, cfg, db, logger, message)
 	if err != nil {
 		logger.Errorf("Could not find tenant %v", err)
 		return nil, nil, err
 	}
 
-	source, err := findSource(db, sourceID)
+	source, err := findSource(ctx, db, message.SourceID)
 	if err != nil {
 		logger.Errorf("Could not find source %v", err)
 		return nil, nil, err
 	}
 
-	return tenant, source, nil
-}
-
-// findTenant finds a Tenant object from the Database. We get the TenantID from
-// the Catalog Inventory API in the Kafka Message Payload
-func findTenant(db DatabaseContext, tenantID int64) (*tenant.Tenant, error) {
-	tenant := tenant.Tenant{}
-	err := db.DB.First(&tenant, tenantID).Error
-	if err != nil {
-		return nil, fmt.Errorf("Error finding tenant: %v", err)
+	// The source id comes from the Kafka message and the tenant from the
+	// message or its identity, make sure they agree so we never write
+	// objects for a source into another tenant
+	if source.TenantID != tenant.ID {
+		err = fmt.Errorf("Source %d does not belong to tenant %d", source.ID, tenant.ID)
+		logger.Errorf("Tenant mismatch %v", err)
+		return nil, nil, err
 	}
-	return &tenant, nil
+
+	return tenant, source, nil
 }
 
 // findSource finds a Source object from the Database. We get the SourceID from
 // the Catalog Inventory API in the Kafka Message Payload
-func findSource(db DatabaseContext, sourceID int64) (*source.Source, error) {
+func findSource(ctx context.Context, db DatabaseContext, sourceID int64) (*source.Source, error) {
 	source := source.Source{}
-	err := db.DB.First(&source, sourceID).Error
+	err := db.DB.WithContext(ctx).First(&source, sourceID).Error
 	if err != nil {
 		return nil, fmt.Errorf("Error finding source: %v", err)
 	}
@@ -127,21 +304,31 @@ func findSource(db DatabaseContext, sourceID int64) (*source.Source, error) {
 
 // updateTask updates the Task Object in the Catalog Inventory API by making
 // a REST API call.
-func updateTask(logger *logrus.Entry, state, status, msg string, stats map[string]interface{}, p Persister) error {
+func updateTask(logger *logrus.Entry, state, status, msg string, output map[string]interface{}, p Persister) error {
 	data := map[string]interface{}{"status": status, "state": state, "message": msg}
-	if stats != nil {
-		data["output"] = map[string]interface{}{"stats": stats}
+	if status != "ok" {
+		output = withOutput(output, "errors", []string{msg})
+	}
+	if output != nil {
+		data["output"] = output
 	}
+	return p.TaskUpdater(logger, data)
+}
 
-	if status == "error" {
-		data["output"] = map[string]interface{}{"errors": []string{msg}}
+// withOutput returns a copy of the task output with key set to value
+func withOutput(output map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	result := map[string]interface{}{key: value}
+	for k, v := range output {
+		if k != key {
+			result[k] = v
+		}
 	}
-	return p.TaskUpdater(logger, data, &http.Client{})
+	return result
 }
 
-// TaskUpdater updates the Task object via REST API
-func (dp *defaultPersister) TaskUpdater(logger *logrus.Entry, data map[string]interface{}, client *http.Client) error {
-	err := dp.catalogTask.Update(data, client)
+// TaskUpdater sends an update of the task with its reporter
+func (dp *defaultPersister) TaskUpdater(logger *logrus.Entry, data map[string]interface{}) error {
+	err := dp.reporter.Report(data)
 	if err != nil {
 		logger.Errorf("Error updating catalog task %v", err)
 		return err
@@ -154,3 +341,14 @@ func (dp *defaultPersister) TaskUpdater(logger *logrus.Entry, data map[string]in
 func (dp *defaultPersister) ProcessTar(ctx context.Context, logger *logrus.Entry, loader payload.Loader, client *http.Client, dbTransaction *gorm.DB, url string, shutdown chan struct{}) error {
 	return payload.ProcessTar(ctx, logger, loader, client, dbTransaction, url, shutdown)
 }
+
+// StageTar stages the pages of a Tar file for a chunked refresh
+func (dp *defaultPersister) StageTar(ctx context.Context, logger *logrus.Entry, checkpoints checkpoint.Repository, cp *checkpoint.Checkpoint, client *http.Client, url string, chunkSize int, shutdown chan struct{}) error {
+	return payload.StageTar(ctx, logger, checkpoints, cp, client, url, chunkSize, shutdown)
+}
+
+// ProcessStaged creates objects in the DB from the staged pages of a task,
+// committing them a chunk at a time
+func (dp *defaultPersister) ProcessStaged(ctx context.Context, logger *logrus.Entry, loader payload.Loader, pages checkpoint.Repository, cp *checkpoint.Checkpoint, chunkSize int, dbTransaction *gorm.DB, commit payload.ChunkFunc) error {
+	return payload.ProcessStaged(ctx, logger, loader, pages, cp, chunkSize, dbTransaction, commit)
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/identity"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/checkpoint"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
 	"github.com/RedHatInsights/catalog_tower_persister/internal/payload"
 	"github.com/sirupsen/logrus"
@@ -21,6 +27,11 @@ type FakePersister struct {
 	taskUpdaterCalled bool
 	taskUpdaterError  error
 	loaderError       error
+	stagerCalled      bool
+	stagerError       error
+	chunks            []int
+	published         []*events.SourceRefreshed
+	rejected          []error
 }
 
 func (fp *FakePersister) ProcessTar(ctx context.Context, logger *logrus.Entry, loader payload.Loader, client *http.Client, dbTransaction *gorm.DB, url string, shutdown chan struct{}) error {
@@ -28,15 +39,39 @@ func (fp *FakePersister) ProcessTar(ctx context.Context, logger *logrus.Entry, l
 	return fp.loaderError
 }
 
-func (fp *FakePersister) TaskUpdater(logger *logrus.Entry, d map[string]interface{}, client *http.Client) error {
+func (fp *FakePersister) StageTar(ctx context.Context, logger *logrus.Entry, checkpoints checkpoint.Repository, cp *checkpoint.Checkpoint, client *http.Client, url string, chunkSize int, shutdown chan struct{}) error {
+	fp.stagerCalled = true
+	return fp.stagerError
+}
+
+func (fp *FakePersister) ProcessStaged(ctx context.Context, logger *logrus.Entry, loader payload.Loader, pages checkpoint.Repository, cp *checkpoint.Checkpoint, chunkSize int, dbTransaction *gorm.DB, commit payload.ChunkFunc) error {
+	fp.loaderCalled = true
+	for _, applied := range fp.chunks {
+		if _, err := commit(applied); err != nil {
+			return err
+		}
+	}
+	return fp.loaderError
+}
+
+func (fp *FakePersister) TaskUpdater(logger *logrus.Entry, d map[string]interface{}) error {
 	fp.taskUpdaterCalled = true
 	return fp.taskUpdaterError
 }
 
+func (fp *FakePersister) PublishEvent(logger *logrus.Entry, event *events.SourceRefreshed) error {
+	fp.published = append(fp.published, event)
+	return nil
+}
+
+func (fp *FakePersister) Reject(logger *logrus.Entry, message MessagePayload, headers map[string]string, reason error) {
+	fp.rejected = append(fp.rejected, reason)
+}
+
 func TestStartWorkerSuccess(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	ctx := context.TODO()
+	ctx := identityContext(testAccount)
 	headers := map[string]string{
 		"x-rh-insights-request-id": "abc",
 		"x-rh-identity":            "abc",
@@ -46,8 +81,11 @@ func TestStartWorkerSuccess(t *testing.T) {
 	tenantID := int64(888)
 	sourceID := int64(777)
 	tenantMock(mock, tenantID, nil)
-	sourceMock(mock, sourceID, nil)
+	sourceMock(mock, sourceID, tenantID, nil)
+	lockMock(mock, sourceID, true)
+	refreshMock(mock, true)
 
+	unlockMock(mock, sourceID)
 	var wg sync.WaitGroup
 	wg.Add(1)
 	mp := MessagePayload{TenantID: tenantID,
@@ -58,15 +96,55 @@ func TestStartWorkerSuccess(t *testing.T) {
 	fp := FakePersister{}
 
 	dc := DatabaseContext{DB: gdb}
-	startPersisterWorker(ctx, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
 	assert.Equal(t, fp.loaderCalled, true)
 	assert.Equal(t, fp.taskUpdaterCalled, true)
+	assert.Len(t, fp.published, 1)
+	assert.Equal(t, events.EventSourceRefreshed, fp.published[0].EventType)
+	assert.Equal(t, tenantID, fp.published[0].TenantID)
+	assert.Equal(t, sourceID, fp.published[0].SourceID)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestStartWorkerCommitFailure(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := identityContext(testAccount)
+	headers := map[string]string{"x-rh-insights-request-id": "abc"}
+	shutdown := make(chan struct{})
+	tenantID := int64(888)
+	sourceID := int64(777)
+	tenantMock(mock, tenantID, nil)
+	sourceMock(mock, sourceID, tenantID, nil)
+	lockMock(mock, sourceID, true)
+	mock.ExpectBegin()
+	mock.ExpectCommit().WillReturnError(fmt.Errorf("Kaboom"))
+	unlockMock(mock, sourceID)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp := MessagePayload{TenantID: tenantID,
+		SourceID: sourceID,
+		TaskURL:  "http://www.example.com",
+		DataURL:  "http://www.example.com",
+		Size:     int64(900)}
+	op := outputPersister{}
+
+	dc := DatabaseContext{DB: gdb}
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &op)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	assert.True(t, op.loaderCalled)
+	assert.Empty(t, op.published, "Nothing was saved")
+	last := op.updates[len(op.updates)-1]
+	assert.Equal(t, "completed", last["state"])
+	assert.Equal(t, "error", last["status"])
+	assert.Equal(t, "Kaboom", last["message"])
 }
 
 func TestStartWorkerLoaderFailure(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	ctx := context.TODO()
+	ctx := identityContext(testAccount)
 	headers := map[string]string{
 		"x-rh-insights-request-id": "abc",
 		"x-rh-identity":            "abc",
@@ -76,8 +154,11 @@ func TestStartWorkerLoaderFailure(t *testing.T) {
 	tenantID := int64(888)
 	sourceID := int64(777)
 	tenantMock(mock, tenantID, nil)
-	sourceMock(mock, sourceID, nil)
+	sourceMock(mock, sourceID, tenantID, nil)
+	lockMock(mock, sourceID, true)
+	refreshMock(mock, false)
 
+	unlockMock(mock, sourceID)
 	var wg sync.WaitGroup
 	wg.Add(1)
 	mp := MessagePayload{TenantID: tenantID,
@@ -88,16 +169,17 @@ func TestStartWorkerLoaderFailure(t *testing.T) {
 	fp := FakePersister{loaderError: fmt.Errorf("Kaboom")}
 
 	dc := DatabaseContext{DB: gdb}
-	startPersisterWorker(ctx, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
 
 	assert.Equal(t, fp.loaderCalled, true)
 	assert.Equal(t, fp.taskUpdaterCalled, true)
+	assert.Empty(t, fp.published, "A failed refresh changed nothing")
 }
 
 func TestStartWorkerTenantMissing(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	ctx := context.TODO()
+	ctx := identityContext(testAccount)
 	headers := map[string]string{
 		"x-rh-insights-request-id": "abc",
 		"x-rh-identity":            "abc",
@@ -107,7 +189,7 @@ func TestStartWorkerTenantMissing(t *testing.T) {
 	tenantID := int64(888)
 	sourceID := int64(777)
 	tenantMock(mock, tenantID, fmt.Errorf("Kaboom"))
-	sourceMock(mock, sourceID, nil)
+	sourceMock(mock, sourceID, tenantID, nil)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -119,7 +201,7 @@ func TestStartWorkerTenantMissing(t *testing.T) {
 	fp := FakePersister{}
 
 	dc := DatabaseContext{DB: gdb}
-	startPersisterWorker(ctx, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
 	assert.Equal(t, fp.loaderCalled, false)
 	assert.Equal(t, fp.taskUpdaterCalled, true)
 }
@@ -127,7 +209,37 @@ func TestStartWorkerTenantMissing(t *testing.T) {
 func TestStartWorkerSourceMissing(t *testing.T) {
 	gdb, mock, teardown := testhelper.MockDBSetup(t)
 	defer teardown()
-	ctx := context.TODO()
+	ctx := identityContext(testAccount)
+	headers := map[string]string{
+		"x-rh-insights-request-id": "abc",
+		"x-rh-identity":            "abc",
+		"event_type":               "abc",
+	}
+	shutdown := make(chan struct{})
+	tenantID := int64(888)
+	sourceID := int64(777)
+	tenantMock(mock, tenantID, nil)
+	sourceMock(mock, sourceID, tenantID, fmt.Errorf("Kaboom"))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp := MessagePayload{TenantID: tenantID,
+		SourceID: sourceID,
+		TaskURL:  "http://www.example.com",
+		DataURL:  "http://www.example.com",
+		Size:     int64(900)}
+	fp := FakePersister{}
+
+	dc := DatabaseContext{DB: gdb}
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	assert.Equal(t, fp.loaderCalled, false)
+	assert.Equal(t, fp.taskUpdaterCalled, true)
+}
+
+func TestStartWorkerSourceTenantMismatch(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := identityContext(testAccount)
 	headers := map[string]string{
 		"x-rh-insights-request-id": "abc",
 		"x-rh-identity":            "abc",
@@ -135,9 +247,10 @@ func TestStartWorkerSourceMissing(t *testing.T) {
 	}
 	shutdown := make(chan struct{})
 	tenantID := int64(888)
+	otherTenantID := int64(999)
 	sourceID := int64(777)
 	tenantMock(mock, tenantID, nil)
-	sourceMock(mock, sourceID, fmt.Errorf("Kaboom"))
+	sourceMock(mock, sourceID, otherTenantID, nil)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -149,18 +262,397 @@ func TestStartWorkerSourceMissing(t *testing.T) {
 	fp := FakePersister{}
 
 	dc := DatabaseContext{DB: gdb}
-	startPersisterWorker(ctx, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	assert.Equal(t, fp.loaderCalled, false)
+	assert.Equal(t, fp.taskUpdaterCalled, true)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestStartWorkerChunked(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := identityContext(testAccount)
+	headers := map[string]string{"x-rh-insights-request-id": "abc"}
+	shutdown := make(chan struct{})
+	tenantID := int64(888)
+	sourceID := int64(777)
+	tenantMock(mock, tenantID, nil)
+	sourceMock(mock, sourceID, tenantID, nil)
+	lockMock(mock, sourceID, true)
+	mock.ExpectQuery("^INSERT INTO tower_persister_checkpoints").
+		WillReturnRows(sqlmock.NewRows([]string{"pages_staged", "pages_applied"}).AddRow(3, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "tower_persister_checkpoints" WHERE task_url = $1`)).
+		WithArgs("http://www.example.com/task").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	unlockMock(mock, sourceID)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp := MessagePayload{TenantID: tenantID,
+		SourceID: sourceID,
+		TaskURL:  "http://www.example.com/task",
+		DataURL:  "http://www.example.com",
+		Size:     int64(900)}
+	fp := FakePersister{}
+
+	dc := DatabaseContext{DB: gdb}
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute, ChunkedRefresh: true, ChunkSize: 5}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	assert.Equal(t, fp.stagerCalled, true)
+	assert.Equal(t, fp.loaderCalled, true)
+	assert.Equal(t, fp.taskUpdaterCalled, true)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestStartWorkerChunkedBusy(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := identityContext(testAccount)
+	headers := map[string]string{"x-rh-insights-request-id": "abc"}
+	shutdown := make(chan struct{})
+	tenantID := int64(888)
+	sourceID := int64(777)
+	tenantMock(mock, tenantID, nil)
+	sourceMock(mock, sourceID, tenantID, nil)
+	lockMock(mock, sourceID, true)
+	// Another worker holds a fresh claim on the task
+	mock.ExpectQuery("^INSERT INTO tower_persister_checkpoints").
+		WillReturnRows(sqlmock.NewRows([]string{"pages_staged", "pages_applied"}))
+
+	unlockMock(mock, sourceID)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp := MessagePayload{TenantID: tenantID,
+		SourceID: sourceID,
+		TaskURL:  "http://www.example.com/task",
+		DataURL:  "http://www.example.com",
+		Size:     int64(900)}
+	fp := FakePersister{}
+
+	dc := DatabaseContext{DB: gdb}
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute, ChunkedRefresh: true, ChunkSize: 5}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	assert.Equal(t, fp.stagerCalled, false)
 	assert.Equal(t, fp.loaderCalled, false)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+var appliedStr = `UPDATE "tower_persister_checkpoints" SET "claimed_at"=$1,"pages_applied"=$2,"updated_at"=$3 WHERE task_url = $4 AND claimed_by = $5`
+
+// chunkMock expects the transaction of a chunk, which moves the checkpoint
+// past the applied pages
+func chunkMock(mock sqlmock.Sqlmock, applied int) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(appliedStr)).
+		WithArgs(testhelper.AnyTime{}, applied, testhelper.AnyTime{}, "http://www.example.com/task", "persister-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func chunkedWorker(t *testing.T, staged, applied int, fp Persister, expect func(mock sqlmock.Sqlmock)) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := identityContext(testAccount)
+	headers := map[string]string{"x-rh-insights-request-id": "abc"}
+	tenantID := int64(888)
+	sourceID := int64(777)
+	tenantMock(mock, tenantID, nil)
+	sourceMock(mock, sourceID, tenantID, nil)
+	lockMock(mock, sourceID, true)
+	mock.ExpectQuery("^INSERT INTO tower_persister_checkpoints").
+		WillReturnRows(sqlmock.NewRows([]string{"pages_staged", "pages_applied"}).AddRow(staged, applied))
+	expect(mock)
+	unlockMock(mock, sourceID)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp := MessagePayload{TenantID: tenantID,
+		SourceID: sourceID,
+		TaskURL:  "http://www.example.com/task",
+		DataURL:  "http://www.example.com",
+		Size:     int64(900)}
+
+	cfg := &config.TowerPersisterConfig{Hostname: "persister-1", WorkerTimeout: time.Minute, ChunkedRefresh: true, ChunkSize: 5}
+	startPersisterWorker(ctx, cfg, DatabaseContext{DB: gdb}, testhelper.TestLogger(), mp, headers, make(chan struct{}), &wg, fp)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestStartWorkerChunkedCommits(t *testing.T) {
+	op := outputPersister{FakePersister: FakePersister{chunks: []int{5, 10, 12}}}
+	chunkedWorker(t, 0, 0, &op, func(mock sqlmock.Sqlmock) {
+		chunkMock(mock, 5)
+		chunkMock(mock, 10)
+		chunkMock(mock, 12)
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "tower_persister_checkpoints" WHERE task_url = $1`)).
+			WithArgs("http://www.example.com/task").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	})
+	assert.True(t, op.stagerCalled)
+	assert.Equal(t, 1, len(op.published))
+	last := op.updates[len(op.updates)-1]
+	assert.Equal(t, "completed", last["state"])
+	assert.Equal(t, "ok", last["status"])
+}
+
+func TestStartWorkerChunkedShutdown(t *testing.T) {
+	op := outputPersister{FakePersister: FakePersister{chunks: []int{5}, loaderError: payload.ErrShutdown}}
+	chunkedWorker(t, 12, 0, &op, func(mock sqlmock.Sqlmock) {
+		chunkMock(mock, 5)
+		// The chunk being applied is rolled back and the checkpoint kept
+		refreshMock(mock, false)
+	})
+	assert.Empty(t, op.published, "The refresh is not finished")
+	last := op.updates[len(op.updates)-1]
+	assert.Equal(t, "running", last["state"], "The task should stay running until it is resumed")
+	assert.Equal(t, "ok", last["status"])
+	assert.Equal(t, "Refresh interrupted by shutdown after applying 5 of 12 staged pages, it will resume", last["message"])
+}
+
+func TestStartWorkerChunkedResume(t *testing.T) {
+	op := outputPersister{FakePersister: FakePersister{chunks: []int{12}}}
+	chunkedWorker(t, 12, 5, &op, func(mock sqlmock.Sqlmock) {
+		chunkMock(mock, 12)
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "tower_persister_checkpoints" WHERE task_url = $1`)).
+			WithArgs("http://www.example.com/task").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	})
+	assert.False(t, op.stagerCalled, "All the pages were staged before")
+	assert.Equal(t, "completed", op.updates[len(op.updates)-1]["state"])
+}
+
+func TestStartWorkerChunkedClaimLost(t *testing.T) {
+	op := outputPersister{FakePersister: FakePersister{chunks: []int{5}}}
+	chunkedWorker(t, 12, 0, &op, func(mock sqlmock.Sqlmock) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(appliedStr)).
+			WithArgs(testhelper.AnyTime{}, 5, testhelper.AnyTime{}, "http://www.example.com/task", "persister-1").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+	})
+	assert.Empty(t, op.published)
+	assert.Equal(t, "running", op.updates[len(op.updates)-1]["state"], "The task is left to the persister that took it over")
+}
+
+func TestCheckRefreshMode(t *testing.T) {
+	assert.Nil(t, checkRefreshMode(&config.TowerPersisterConfig{ChunkedRefresh: true}))
+	assert.Nil(t, checkRefreshMode(&config.TowerPersisterConfig{StagedRefresh: true}))
+	assert.Error(t, checkRefreshMode(&config.TowerPersisterConfig{ChunkedRefresh: true, StagedRefresh: true}))
+}
+
+func TestStartWorkerStaged(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := identityContext(testAccount)
+	headers := map[string]string{"x-rh-insights-request-id": "abc"}
+	shutdown := make(chan struct{})
+	tenantID := int64(888)
+	sourceID := int64(777)
+	tenantMock(mock, tenantID, nil)
+	sourceMock(mock, sourceID, tenantID, nil)
+	lockMock(mock, sourceID, true)
+	mock.ExpectBegin()
+	mock.ExpectExec("^DROP SCHEMA IF EXISTS tower_persister_staging_").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^CREATE SCHEMA tower_persister_staging_").WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < 6; i++ {
+		mock.ExpectExec("^CREATE TABLE tower_persister_staging_").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^INSERT INTO tower_persister_staging_").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^CREATE TABLE tower_persister_staging_[0-9a-f]+\\.snapshot_").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT set_config('search_path'")).
+		WillReturnRows(sqlmock.NewRows([]string{"set_config"}).AddRow("staged"))
+	mock.ExpectCommit()
+	for i := 0; i < 6; i++ {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT count(*) FROM tower_persister_staging_")).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	}
+	mock.ExpectBegin()
+	for i := 0; i < 6; i++ {
+		mock.ExpectQuery("^SELECT column_name FROM information_schema.columns").
+			WillReturnRows(sqlmock.NewRows([]string{"column_name"}).AddRow("id").AddRow("name"))
+	}
+	for i := 0; i < 6; i++ {
+		mock.ExpectExec("^INSERT INTO service_").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	for i := 0; i < 6; i++ {
+		mock.ExpectExec("^UPDATE service_").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectCommit()
+	mock.ExpectExec("^DROP SCHEMA IF EXISTS tower_persister_staging_").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	unlockMock(mock, sourceID)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp := MessagePayload{TenantID: tenantID,
+		SourceID: sourceID,
+		TaskURL:  "http://www.example.com/task",
+		DataURL:  "http://www.example.com",
+		Size:     int64(900)}
+	fp := FakePersister{}
+
+	dc := DatabaseContext{DB: gdb}
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute, StagedRefresh: true}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	assert.Equal(t, fp.loaderCalled, true)
 	assert.Equal(t, fp.taskUpdaterCalled, true)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+type outputPersister struct {
+	FakePersister
+	updates []map[string]interface{}
+}
+
+func (op *outputPersister) TaskUpdater(logger *logrus.Entry, d map[string]interface{}) error {
+	op.updates = append(op.updates, d)
+	return nil
+}
+
+func testSourceLocked(t *testing.T, policy string) map[string]interface{} {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := identityContext(testAccount)
+	headers := map[string]string{"x-rh-insights-request-id": "abc"}
+	shutdown := make(chan struct{})
+	tenantID := int64(888)
+	sourceID := int64(777)
+	tenantMock(mock, tenantID, nil)
+	sourceMock(mock, sourceID, tenantID, nil)
+	lockMock(mock, sourceID, false)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp := MessagePayload{TenantID: tenantID,
+		SourceID: sourceID,
+		TaskURL:  "http://www.example.com/task",
+		DataURL:  "http://www.example.com",
+		Size:     int64(900)}
+	op := outputPersister{}
+
+	dc := DatabaseContext{DB: gdb}
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute, SourceLockPolicy: policy}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &op)
+	assert.Equal(t, false, op.loaderCalled, "The source should not get refreshed")
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	assert.Equal(t, 1, len(op.updates), "Only the completed update should be sent")
+	assert.Equal(t, "completed", op.updates[0]["state"])
+	output := op.updates[0]["output"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"policy": policy, "acquired": false}, output["source_lock"])
+	return op.updates[0]
+}
+
+func TestStartWorkerSourceLockedSkip(t *testing.T) {
+	update := testSourceLocked(t, "skip")
+	assert.Equal(t, "ok", update["status"])
+	assert.Equal(t, "Superseded, source 777 is being refreshed by another task", update["message"])
+}
+
+func TestStartWorkerSourceLockedFail(t *testing.T) {
+	update := testSourceLocked(t, "fail")
+	assert.Equal(t, "error", update["status"])
+	output := update["output"].(map[string]interface{})
+	assert.Equal(t, []string{"source is being refreshed by another task"}, output["errors"])
+}
+
+func testStartWorkerRejected(t *testing.T, ctx context.Context) *FakePersister {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	headers := map[string]string{"x-rh-insights-request-id": "abc"}
+	shutdown := make(chan struct{})
+	tenantID := int64(888)
+	sourceID := int64(777)
+	tenantMock(mock, tenantID, nil)
+	sourceMock(mock, sourceID, tenantID, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp := MessagePayload{TenantID: tenantID,
+		SourceID: sourceID,
+		TaskURL:  "http://www.example.com/task",
+		DataURL:  "http://www.example.com",
+		Size:     int64(900)}
+	fp := FakePersister{}
+
+	dc := DatabaseContext{DB: gdb}
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	assert.False(t, fp.loaderCalled, "The source should not get refreshed")
+	assert.False(t, fp.taskUpdaterCalled, "The task of another tenant should not get updated")
+	return &fp
+}
+
+func TestStartWorkerIdentityMismatch(t *testing.T) {
+	fp := testStartWorkerRejected(t, identityContext("0000002"))
+	assert.Len(t, fp.rejected, 1)
+	assert.True(t, errors.Is(fp.rejected[0], identity.ErrMismatch))
+}
+
+func TestStartWorkerIdentityMissing(t *testing.T) {
+	fp := testStartWorkerRejected(t, context.TODO())
+	assert.Equal(t, []error{identity.ErrMissing}, fp.rejected)
+}
+
+func TestFailure(t *testing.T) {
+	cfg := &config.TowerPersisterConfig{WorkerTimeout: time.Minute}
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	cases := []struct {
+		ctx    context.Context
+		err    error
+		status string
+		msg    string
+	}{
+		{context.TODO(), fmt.Errorf("Kaboom"), "error", "Kaboom"},
+		{expired, fmt.Errorf("driver: bad connection"), "timedout", "Refresh timed out after 1m0s"},
+		{context.TODO(), fmt.Errorf("query failed: %w", context.DeadlineExceeded), "timedout", "Refresh timed out after 1m0s"},
+		{context.TODO(), context.Canceled, "error", interruptedMessage},
+		{context.TODO(), payload.ErrShutdown, "error", interruptedMessage},
+	}
+	for _, tc := range cases {
+		status, msg := failure(tc.ctx, cfg, tc.err)
+		assert.Equal(t, tc.status, status)
+		assert.Equal(t, tc.msg, msg)
+	}
 }
 
-var tenantColumns = []string{"id"}
-var sourceColumns = []string{"id"}
+const testAccount = "0000001"
+
+var tenantColumns = []string{"id", "external_tenant"}
+var sourceColumns = []string{"id", "tenant_id"}
+
+func identityContext(account string) context.Context {
+	return identity.NewContext(context.TODO(), &identity.Identity{AccountNumber: account, Type: "User"})
+}
+
+func lockMock(mock sqlmock.Sqlmock, sourceID int64, locked bool) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_try_advisory_lock($1)")).
+		WithArgs(sourceID).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(locked))
+}
+
+// refreshMock expects the transaction of a refresh, which ends in a commit
+// or a rollback
+func refreshMock(mock sqlmock.Sqlmock, commit bool) {
+	mock.ExpectBegin()
+	if commit {
+		mock.ExpectCommit()
+	} else {
+		mock.ExpectRollback()
+	}
+}
+
+func unlockMock(mock sqlmock.Sqlmock, sourceID int64) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).
+		WithArgs(sourceID).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+}
 
 func tenantMock(mock sqlmock.Sqlmock, id int64, err error) {
 	tStr := `SELECT * FROM "tenants" WHERE "tenants"."id" = $1 ORDER BY "tenants"."id" LIMIT 1`
 	if err == nil {
-		tRows := sqlmock.NewRows(tenantColumns).AddRow(id)
+		tRows := sqlmock.NewRows(tenantColumns).AddRow(id, testAccount)
 		mock.ExpectQuery(regexp.QuoteMeta(tStr)).
 			WithArgs(id).
 			WillReturnRows(tRows)
@@ -171,10 +663,10 @@ func tenantMock(mock sqlmock.Sqlmock, id int64, err error) {
 	}
 }
 
-func sourceMock(mock sqlmock.Sqlmock, id int64, err error) {
+func sourceMock(mock sqlmock.Sqlmock, id int64, tenantID int64, err error) {
 	sStr := `SELECT * FROM "sources" WHERE "sources"."id" = $1 ORDER BY "sources"."id" LIMIT 1`
 	if err == nil {
-		sRows := sqlmock.NewRows(sourceColumns).AddRow(id)
+		sRows := sqlmock.NewRows(sourceColumns).AddRow(id, tenantID)
 		mock.ExpectQuery(regexp.QuoteMeta(sStr)).
 			WithArgs(id).
 			WillReturnRows(sRows)
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/payload"
+	"github.com/sirupsen/logrus"
+)
+
+// progressReporter sends the progress of a refresh to Catalog Inventory.
+// The refresh records its progress without waiting, the reporter sends the
+// latest progress every interval from its own goroutine so a slow Catalog
+// Inventory does not hold up the refresh.
+type progressReporter struct {
+	logger   *logrus.Entry
+	p        Persister
+	mu       sync.Mutex
+	latest   *payload.Progress
+	done     chan struct{}
+	finished chan struct{}
+}
+
+// startProgressReporter starts reporting every interval, an interval of 0
+// turns progress reporting off
+func startProgressReporter(logger *logrus.Entry, p Persister, interval time.Duration) *progressReporter {
+	pr := &progressReporter{logger: logger, p: p, done: make(chan struct{}), finished: make(chan struct{})}
+	if interval <= 0 {
+		close(pr.finished)
+		return pr
+	}
+	go func() {
+		defer close(pr.finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pr.done:
+				return
+			case <-ticker.C:
+				pr.send()
+			}
+		}
+	}()
+	return pr
+}
+
+// report records the progress, it is sent with the next tick
+func (pr *progressReporter) report(progress payload.Progress) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.latest = &progress
+}
+
+// send updates the task with the progress recorded since the last send
+func (pr *progressReporter) send() {
+	pr.mu.Lock()
+	progress := pr.latest
+	pr.latest = nil
+	pr.mu.Unlock()
+	if progress == nil {
+		return
+	}
+	msg := fmt.Sprintf("Processing %s, %d files processed", progress.Phase, progress.FilesProcessed)
+	if err := updateTask(pr.logger, "running", "ok", msg, map[string]interface{}{"progress": progress}, pr.p); err != nil {
+		pr.logger.Errorf("Error updating task progress %v", err)
+	}
+}
+
+// stop stops reporting and waits for an update being sent, so it can not
+// overwrite the update that completes the task
+func (pr *progressReporter) stop() {
+	select {
+	case <-pr.done:
+	default:
+		close(pr.done)
+	}
+	<-pr.finished
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/payload"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncPersister records the task updates sent from the reporter goroutine
+type syncPersister struct {
+	FakePersister
+	mu      sync.Mutex
+	updates []map[string]interface{}
+}
+
+func (sp *syncPersister) TaskUpdater(logger *logrus.Entry, d map[string]interface{}) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.updates = append(sp.updates, d)
+	return nil
+}
+
+func (sp *syncPersister) count() int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return len(sp.updates)
+}
+
+func TestProgressReporter(t *testing.T) {
+	sp := &syncPersister{}
+	pr := startProgressReporter(testhelper.TestLogger(), sp, time.Millisecond)
+	progress := payload.Progress{Phase: payload.PhasePages, FilesProcessed: 3, Objects: map[string]int{"inventory": 7}}
+	pr.report(progress)
+	for sp.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	pr.stop()
+
+	assert.Equal(t, 1, sp.count(), "Unchanged progress should not be sent again")
+	assert.Equal(t, map[string]interface{}{
+		"state":   "running",
+		"status":  "ok",
+		"message": "Processing pages, 3 files processed",
+		"output":  map[string]interface{}{"progress": &progress},
+	}, sp.updates[0])
+}
+
+func TestProgressReporterOff(t *testing.T) {
+	sp := &syncPersister{}
+	pr := startProgressReporter(testhelper.TestLogger(), sp, 0)
+	pr.report(payload.Progress{Phase: payload.PhasePages, FilesProcessed: 1})
+	pr.stop()
+	pr.stop()
+
+	assert.Equal(t, 0, sp.count())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/source"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/payload"
+	"github.com/sirupsen/logrus"
+)
+
+// eventPersister creates the Persister that runs the refresh of a message
+// and publishes its events
+func eventPersister(cfg *config.TowerPersisterConfig, reporters *taskReporters, qm queuedMessage, publisher events.Publisher) Persister {
+	dp := taskPersister(reporters, qm)
+	dp.deadLetters = newDeadLetters(cfg, publisher)
+	dp.publisher = publisher
+	dp.eventTopic = cfg.KafkaEventTopic
+	dp.eventTimeout = cfg.EventPublishTimeout
+	dp.requestID = qm.headers["x-rh-insights-request-id"]
+	return dp
+}
+
+// refreshedEvent describes what a committed refresh changed, the changes are
+// keyed by the catalog object type like the stats
+func refreshedEvent(cfg *config.TowerPersisterConfig, taskURL string, tenant *tenant.Tenant, source *source.Source, stats payload.Stats, changes map[string][]base.Change) *events.SourceRefreshed {
+	event := &events.SourceRefreshed{
+		EventType:   events.EventSourceRefreshed,
+		TenantID:    tenant.ID,
+		SourceID:    source.ID,
+		TaskURL:     taskURL,
+		Status:      "ok",
+		Changes:     make(map[string]events.Counts, len(stats.Objects)),
+		RefreshedAt: time.Now().UTC(),
+	}
+	for name, x := range stats.Objects {
+		event.Changes[name] = events.Counts{Adds: x.Adds, Updates: x.Updates, Deletes: x.Deletes}
+	}
+	if cfg.RefreshEventSourceRefs {
+		event.SourceRefs = make(map[string]events.SourceRefs)
+		for name, typeChanges := range changes {
+			refs := events.SourceRefs{Created: []string{}, Updated: []string{}, Deleted: []string{}}
+			for _, c := range typeChanges {
+				switch c.Action {
+				case base.ActionCreated:
+					refs.Created = append(refs.Created, c.SourceRef)
+				case base.ActionUpdated:
+					refs.Updated = append(refs.Updated, c.SourceRef)
+				case base.ActionDeleted:
+					refs.Deleted = append(refs.Deleted, c.SourceRef)
+				}
+			}
+			event.SourceRefs[name] = refs
+		}
+	}
+	return event
+}
+
+// PublishEvent sends the event of a committed refresh, nothing is sent when
+// no event topic is configured
+func (dp *defaultPersister) PublishEvent(logger *logrus.Entry, event *events.SourceRefreshed) error {
+	if dp.publisher == nil || dp.eventTopic == "" {
+		return nil
+	}
+	event.RequestID = dp.requestID
+	msg, err := event.Message(dp.eventTopic)
+	if err != nil {
+		return err
+	}
+	// The refresh is committed, its context might be about to time out
+	ctx, cancel := context.WithTimeout(context.Background(), dp.eventTimeout)
+	defer cancel()
+	return dp.publisher.Publish(ctx, msg)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/base"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/source"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/payload"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakePublisher struct {
+	messages []events.Message
+	err      error
+}
+
+func (fp *fakePublisher) Publish(ctx context.Context, msg events.Message) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("publishing without a timeout")
+	}
+	fp.messages = append(fp.messages, msg)
+	return fp.err
+}
+
+func (fp *fakePublisher) Close() {}
+
+var eventStats = payload.Stats{Objects: map[string]payload.ObjectStats{
+	"inventories":       {Adds: 1, Deletes: 1, Unchanged: 4},
+	"service_offerings": {Updates: 2},
+}}
+
+var eventChanges = map[string][]base.Change{
+	"inventories": {
+		{Action: base.ActionCreated, ID: 10, SourceRef: "5"},
+		{Action: base.ActionDeleted, ID: 11, SourceRef: "6"},
+	},
+	"service_offerings": {
+		{Action: base.ActionUpdated, ID: 20, SourceRef: "7"},
+		{Action: base.ActionUpdated, ID: 21, SourceRef: "8"},
+	},
+}
+
+func TestRefreshedEvent(t *testing.T) {
+	event := refreshedEvent(&config.TowerPersisterConfig{}, "/tasks/1", &tenant.Tenant{ID: 3}, &source.Source{ID: 4}, eventStats, eventChanges)
+
+	assert.Equal(t, events.EventSourceRefreshed, event.EventType)
+	assert.Equal(t, int64(3), event.TenantID)
+	assert.Equal(t, int64(4), event.SourceID)
+	assert.Equal(t, "/tasks/1", event.TaskURL)
+	assert.Equal(t, "ok", event.Status)
+	assert.Equal(t, map[string]events.Counts{
+		"inventories":       {Adds: 1, Deletes: 1},
+		"service_offerings": {Updates: 2},
+	}, event.Changes)
+	assert.Nil(t, event.SourceRefs)
+}
+
+func TestRefreshedEventSourceRefs(t *testing.T) {
+	event := refreshedEvent(&config.TowerPersisterConfig{RefreshEventSourceRefs: true}, "/tasks/1", &tenant.Tenant{ID: 3}, &source.Source{ID: 4}, eventStats, eventChanges)
+
+	assert.Equal(t, map[string]events.SourceRefs{
+		"inventories":       {Created: []string{"5"}, Updated: []string{}, Deleted: []string{"6"}},
+		"service_offerings": {Created: []string{}, Updated: []string{"7", "8"}, Deleted: []string{}},
+	}, event.SourceRefs)
+}
+
+func TestPublishEvent(t *testing.T) {
+	fp := &fakePublisher{}
+	dp := &defaultPersister{publisher: fp, eventTopic: "events", eventTimeout: time.Second, requestID: "abc"}
+	event := &events.SourceRefreshed{EventType: events.EventSourceRefreshed, SourceID: 4}
+
+	assert.NoError(t, dp.PublishEvent(testhelper.TestLogger(), event))
+	assert.Len(t, fp.messages, 1)
+	assert.Equal(t, "events", fp.messages[0].Topic)
+	assert.Equal(t, "abc", fp.messages[0].Headers["x-rh-insights-request-id"])
+}
+
+func TestPublishEventDisabled(t *testing.T) {
+	dp := &defaultPersister{}
+	assert.NoError(t, dp.PublishEvent(testhelper.TestLogger(), &events.SourceRefreshed{}))
+}
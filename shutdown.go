@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// interruptGrace is how long interrupted workers get to roll back and report
+// their tasks before the persister exits anyway
+var interruptGrace = 5 * time.Second
+
+// interruptedMessage is the task message of a refresh stopped by a shutdown
+const interruptedMessage = "Refresh interrupted by shutdown, will be retried"
+
+// drainWorkers waits for the workers in wg once the persister is shutting
+// down. The running workers get drainTimeout to finish, the ones still
+// running after that are interrupted by closing interrupt. It reports if all
+// the workers finished.
+func drainWorkers(logger *logrus.Logger, wg *sync.WaitGroup, interrupt chan struct{}, drainTimeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	logger.Infof("Draining workers for up to %v", drainTimeout)
+	select {
+	case <-done:
+		logger.Info("All workers finished")
+		return true
+	case <-time.After(drainTimeout):
+	}
+
+	logger.Info("Drain deadline passed, interrupting the running workers")
+	close(interrupt)
+	select {
+	case <-done:
+		logger.Info("All interrupted workers stopped")
+		return true
+	case <-time.After(interruptGrace):
+		logger.Error("Workers did not stop after being interrupted")
+		return false
+	}
+}
+
+// interruptedTask completes the task of a message that was never started
+// because the persister is shutting down
+func interruptedTask(qm queuedMessage, p Persister) {
+	if err := updateTask(qm.logger, "completed", "error", interruptedMessage, nil, p); err != nil {
+		qm.logger.Errorf("Error updating task %v", err)
+	}
+}
+
+// taskPersister creates the Persister that reports the task of a message
+func taskPersister(reporters *taskReporters, qm queuedMessage) *defaultPersister {
+	return &defaultPersister{reporter: reporters.reporter(qm)}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainWorkersFinished(t *testing.T) {
+	var wg sync.WaitGroup
+	interrupt := make(chan struct{})
+	wg.Add(1)
+	go wg.Done()
+
+	assert.True(t, drainWorkers(logrus.New(), &wg, interrupt, time.Minute))
+	select {
+	case <-interrupt:
+		t.Error("Workers that finish in time should not be interrupted")
+	default:
+	}
+}
+
+func TestDrainWorkersInterrupted(t *testing.T) {
+	var wg sync.WaitGroup
+	interrupt := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-interrupt
+	}()
+
+	assert.True(t, drainWorkers(logrus.New(), &wg, interrupt, time.Millisecond))
+}
+
+func TestDrainWorkersStuck(t *testing.T) {
+	defer func(grace time.Duration) { interruptGrace = grace }(interruptGrace)
+	interruptGrace = time.Millisecond
+	var wg sync.WaitGroup
+	wg.Add(1)
+	defer wg.Done()
+
+	assert.False(t, drainWorkers(logrus.New(), &wg, make(chan struct{}), time.Millisecond))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/identity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	sourceQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "catalog_tower_persister_source_queue_depth",
+		Help: "The number of messages of a source waiting or running",
+	}, []string{"source_id"})
+	supersededMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "catalog_tower_persister_superseded_messages_total",
+		Help: "The number of queued messages dropped because newer messages of the same source superseded them",
+	})
+)
+
+// queuedMessage is a Kafka message waiting for its turn
+type queuedMessage struct {
+	logger   *logrus.Entry
+	payload  MessagePayload
+	headers  map[string]string
+	identity *identity.Identity
+}
+
+// sourceDispatcher processes the messages of a source one at a time in the
+// order they arrived, the messages of different sources run in parallel.
+// Catalog Inventory keys the messages by source so the messages of a source
+// arrive in order on one partition, the dispatcher keeps that order once the
+// messages are handed to goroutines. When more than maxPending messages of a
+// source are waiting the oldest waiting one is dropped, a newer refresh
+// of the same source supersedes it. The newest full refresh is never dropped,
+// the incremental refreshes waiting behind it only carry changes on top of it.
+type sourceDispatcher struct {
+	mu         sync.Mutex
+	queues     map[int64][]queuedMessage
+	maxPending int
+	run        func(qm queuedMessage)
+	supersede  func(qm queuedMessage)
+}
+
+func newSourceDispatcher(maxPending int, run, supersede func(qm queuedMessage)) *sourceDispatcher {
+	return &sourceDispatcher{queues: make(map[int64][]queuedMessage), maxPending: maxPending, run: run, supersede: supersede}
+}
+
+// dispatch queues a message behind the other messages of its source
+func (sd *sourceDispatcher) dispatch(qm queuedMessage) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sourceID := qm.payload.SourceID
+	q, active := sd.queues[sourceID]
+	// The first message in the queue is running
+	if sd.maxPending > 0 && len(q) > sd.maxPending {
+		var queued bool
+		if q, queued = sd.collapse(q, qm); !queued {
+			return
+		}
+	}
+	sd.queues[sourceID] = append(q, qm)
+	sourceQueueDepth.WithLabelValues(strconv.FormatInt(sourceID, 10)).Set(float64(len(sd.queues[sourceID])))
+	if active {
+		qm.logger.Infof("Queued behind %d messages of source %d", len(q), sourceID)
+		return
+	}
+	go sd.drain(sourceID)
+}
+
+// collapse drops a waiting message to make room for qm, the oldest one
+// unless it is the newest full refresh. When the newest full refresh is the
+// only waiting message qm is dropped instead and is not to be queued.
+func (sd *sourceDispatcher) collapse(q []queuedMessage, qm queuedMessage) ([]queuedMessage, bool) {
+	newestFull := -1
+	if !qm.payload.fullRefresh() {
+		for i := len(q) - 1; i > 0; i-- {
+			if q[i].payload.fullRefresh() {
+				newestFull = i
+				break
+			}
+		}
+	}
+	drop := 1
+	if drop == newestFull {
+		drop++
+	}
+	if drop == len(q) {
+		supersededMessages.Inc()
+		qm.logger.Infof("Task %s is dropped, full refresh task %s of the source is waiting", qm.payload.TaskURL, q[newestFull].payload.TaskURL)
+		go sd.supersede(qm)
+		return q, false
+	}
+	dropped := q[drop]
+	q = append(q[:drop], q[drop+1:]...)
+	supersededMessages.Inc()
+	dropped.logger.Infof("Task %s is superseded by task %s", dropped.payload.TaskURL, qm.payload.TaskURL)
+	go sd.supersede(dropped)
+	return q, true
+}
+
+// drain runs the messages of a source until its queue is empty
+func (sd *sourceDispatcher) drain(sourceID int64) {
+	label := strconv.FormatInt(sourceID, 10)
+	for {
+		sd.mu.Lock()
+		qm := sd.queues[sourceID][0]
+		sd.mu.Unlock()
+
+		sd.run(qm)
+
+		sd.mu.Lock()
+		q := sd.queues[sourceID][1:]
+		if len(q) == 0 {
+			delete(sd.queues, sourceID)
+			sourceQueueDepth.DeleteLabelValues(label)
+			sd.mu.Unlock()
+			return
+		}
+		sd.queues[sourceID] = q
+		sourceQueueDepth.WithLabelValues(label).Set(float64(len(q)))
+		sd.mu.Unlock()
+	}
+}
+
+// supersededTask completes the task of a dropped message
+func supersededTask(qm queuedMessage, p Persister) {
+	msg := fmt.Sprintf("Superseded by a newer refresh of source %d", qm.payload.SourceID)
+	if err := updateTask(qm.logger, "completed", "ok", msg, nil, p); err != nil {
+		qm.logger.Errorf("Error updating task %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder records the tasks run by a sourceDispatcher, the tasks of source
+// 1 wait until release is closed
+type recorder struct {
+	mu         sync.Mutex
+	ran        []string
+	superseded []string
+	release    chan struct{}
+	wg         sync.WaitGroup
+}
+
+func (r *recorder) run(qm queuedMessage) {
+	defer r.wg.Done()
+	if qm.payload.SourceID == 1 {
+		<-r.release
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ran = append(r.ran, qm.payload.TaskURL)
+}
+
+func (r *recorder) supersede(qm queuedMessage) {
+	defer r.wg.Done()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.superseded = append(r.superseded, qm.payload.TaskURL)
+}
+
+func (r *recorder) dispatch(sd *sourceDispatcher, sourceID int64, taskURL string) {
+	r.dispatchRefresh(sd, sourceID, taskURL, "")
+}
+
+func (r *recorder) dispatchRefresh(sd *sourceDispatcher, sourceID int64, taskURL string, refreshType string) {
+	r.wg.Add(1)
+	sd.dispatch(queuedMessage{logger: testhelper.TestLogger(), payload: MessagePayload{SourceID: sourceID, TaskURL: taskURL, RefreshType: refreshType}})
+}
+
+func TestSourceDispatcherOrder(t *testing.T) {
+	r := &recorder{release: make(chan struct{})}
+	sd := newSourceDispatcher(5, r.run, r.supersede)
+	r.dispatch(sd, 1, "task1")
+	r.dispatch(sd, 1, "task2")
+	r.dispatch(sd, 1, "task3")
+
+	// Another source does not wait for source 1
+	r.dispatch(sd, 2, "other")
+	for {
+		r.mu.Lock()
+		n := len(r.ran)
+		r.mu.Unlock()
+		if n == 1 {
+			break
+		}
+	}
+	close(r.release)
+	r.wg.Wait()
+
+	assert.Equal(t, []string{"other", "task1", "task2", "task3"}, r.ran)
+	assert.Empty(t, r.superseded)
+	for {
+		sd.mu.Lock()
+		n := len(sd.queues)
+		sd.mu.Unlock()
+		if n == 0 {
+			break
+		}
+	}
+}
+
+func TestSourceDispatcherSupersede(t *testing.T) {
+	r := &recorder{release: make(chan struct{})}
+	sd := newSourceDispatcher(1, r.run, r.supersede)
+	r.dispatch(sd, 1, "task1")
+	r.dispatch(sd, 1, "task2")
+	r.dispatch(sd, 1, "task3")
+	close(r.release)
+	r.wg.Wait()
+
+	assert.Equal(t, []string{"task1", "task3"}, r.ran)
+	assert.Equal(t, []string{"task2"}, r.superseded)
+}
+
+func TestSourceDispatcherKeepsFullRefresh(t *testing.T) {
+	r := &recorder{release: make(chan struct{})}
+	sd := newSourceDispatcher(2, r.run, r.supersede)
+	r.dispatchRefresh(sd, 1, "full1", "full")
+	r.dispatchRefresh(sd, 1, "incr1", "incremental")
+	r.dispatchRefresh(sd, 1, "full2", "full")
+	// incr1 is superseded by full2
+	r.dispatchRefresh(sd, 1, "incr2", "incremental")
+	// full2 is the newest full refresh, incr2 waiting behind it is dropped
+	r.dispatchRefresh(sd, 1, "incr3", "incremental")
+	close(r.release)
+	r.wg.Wait()
+
+	assert.Equal(t, []string{"full1", "full2", "incr3"}, r.ran)
+	assert.ElementsMatch(t, []string{"incr1", "incr2"}, r.superseded)
+}
+
+func TestSourceDispatcherDropsIncrementalBehindFullRefresh(t *testing.T) {
+	r := &recorder{release: make(chan struct{})}
+	sd := newSourceDispatcher(1, r.run, r.supersede)
+	r.dispatchRefresh(sd, 1, "incr1", "incremental")
+	r.dispatchRefresh(sd, 1, "full1", "full")
+	r.dispatchRefresh(sd, 1, "incr2", "incremental")
+	close(r.release)
+	r.wg.Wait()
+
+	assert.Equal(t, []string{"incr1", "full1"}, r.ran)
+	assert.Equal(t, []string{"incr2"}, r.superseded)
+}
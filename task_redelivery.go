@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/catalogtask"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/taskupdate"
+	"github.com/sirupsen/logrus"
+)
+
+func taskRetryPolicy(cfg *config.TowerPersisterConfig) catalogtask.RetryPolicy {
+	return catalogtask.RetryPolicy{
+		MaxAttempts:    cfg.TaskUpdateMaxAttempts,
+		Backoff:        cfg.TaskUpdateBackoff,
+		MaxBackoff:     cfg.TaskUpdateMaxBackoff,
+		AttemptTimeout: cfg.TaskUpdateTimeout,
+		MaxDeliveries:  cfg.TaskUpdateMaxDeliveries,
+	}
+}
+
+// newCatalogTask creates the CatalogTask of a message, its updates are
+// retried and kept in the database until they are acknowledged
+func newCatalogTask(cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Entry, taskURL string, headers map[string]string) catalogtask.CatalogTask {
+	return catalogtask.MakeCatalogTask(context.Background(), logger, taskURL, headers, taskRetryPolicy(cfg), taskupdate.NewGORMRepository(db.DB))
+}
+
+// startTaskRedelivery delivers the unacknowledged task updates again every
+// TaskRedeliveryInterval until shutdown. Updates are left alone while the
+// worker that saved them could still be retrying them.
+func startTaskRedelivery(cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Logger, shutdown chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-shutdown
+		cancel()
+	}()
+	policy := taskRetryPolicy(cfg)
+	olderThan := time.Duration(policy.MaxAttempts) * (policy.AttemptTimeout + policy.MaxBackoff)
+	store := taskupdate.NewGORMRepository(db.DB)
+	ticker := time.NewTicker(cfg.TaskRedeliveryInterval)
+	defer ticker.Stop()
+	for {
+		catalogtask.Redeliver(ctx, logrus.NewEntry(logger), store, policy, &http.Client{}, olderThan)
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+		}
+	}
+}
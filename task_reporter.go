@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/catalogtask"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/events"
+)
+
+// taskReporterHeader lets a message pick the backend its task updates are
+// sent to instead of the configured one, among the backends allowed in
+// TaskReporterHeader
+const taskReporterHeader = "task_reporter"
+
+// taskReporters makes the Reporter of every message
+type taskReporters struct {
+	cfg       *config.TowerPersisterConfig
+	db        DatabaseContext
+	publisher events.Publisher
+	sink      *catalogtask.WriterSink
+}
+
+// checkTaskReporter validates the configured task reporter and the ones a
+// message may pick with the header
+func checkTaskReporter(cfg *config.TowerPersisterConfig) error {
+	backend, err := catalogtask.ParseBackend(cfg.TaskReporter)
+	if err != nil {
+		return err
+	}
+	if backend == catalogtask.BackendKafka && cfg.KafkaTaskTopic == "" {
+		return fmt.Errorf("the kafka task reporter needs a task topic")
+	}
+	_, err = headerBackends(cfg)
+	return err
+}
+
+// headerBackends parses the comma separated list of backends a message may
+// pick with the header, none by default
+func headerBackends(cfg *config.TowerPersisterConfig) (map[catalogtask.Backend]bool, error) {
+	allowed := make(map[catalogtask.Backend]bool)
+	if strings.TrimSpace(cfg.TaskReporterHeader) == "" {
+		return allowed, nil
+	}
+	for _, name := range strings.Split(cfg.TaskReporterHeader, ",") {
+		backend, err := catalogtask.ParseBackend(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		allowed[backend] = true
+	}
+	return allowed, nil
+}
+
+// openTaskReportFile opens the file the file reporter appends to, stdout
+// when no file is configured
+func openTaskReportFile(cfg *config.TowerPersisterConfig) (*os.File, error) {
+	if cfg.TaskReportFile == "" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(cfg.TaskReportFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// backend picks the backend of a message, the one named in its header if it
+// is allowed and available or else the configured one
+func (tr *taskReporters) backend(qm queuedMessage) catalogtask.Backend {
+	configured := catalogtask.Backend(tr.cfg.TaskReporter)
+	name, ok := qm.headers[taskReporterHeader]
+	if !ok || name == "" {
+		return configured
+	}
+	requested, err := catalogtask.ParseBackend(name)
+	if err != nil {
+		qm.logger.Errorf("Ignoring the %s header %v", taskReporterHeader, err)
+		return configured
+	}
+	if allowed, _ := headerBackends(tr.cfg); requested != configured && !allowed[requested] {
+		qm.logger.Errorf("Ignoring the %s header, the %s task reporter is not allowed", taskReporterHeader, requested)
+		return configured
+	}
+	if requested == catalogtask.BackendKafka && (tr.publisher == nil || tr.cfg.KafkaTaskTopic == "") {
+		qm.logger.Errorf("Ignoring the %s header, no task topic is configured", taskReporterHeader)
+		return configured
+	}
+	return requested
+}
+
+// reporter makes the Reporter of a message
+func (tr *taskReporters) reporter(qm queuedMessage) catalogtask.Reporter {
+	switch tr.backend(qm) {
+	case catalogtask.BackendKafka:
+		return catalogtask.NewKafkaReporter(tr.publisher, tr.cfg.KafkaTaskTopic, qm.payload.TaskURL, qm.headers, tr.cfg.EventPublishTimeout)
+	case catalogtask.BackendFile:
+		return tr.sink.Reporter(qm.payload.TaskURL)
+	}
+	return catalogtask.NewRESTReporter(newCatalogTask(tr.cfg, tr.db, qm.logger, qm.payload.TaskURL, qm.headers), &http.Client{})
+}
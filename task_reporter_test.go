@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/catalogtask"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func reporterMessage(headers map[string]string) queuedMessage {
+	return queuedMessage{logger: testhelper.TestLogger(), payload: MessagePayload{TaskURL: "/tasks/1"}, headers: headers}
+}
+
+func TestCheckTaskReporter(t *testing.T) {
+	assert.NoError(t, checkTaskReporter(&config.TowerPersisterConfig{TaskReporter: "rest"}))
+	assert.NoError(t, checkTaskReporter(&config.TowerPersisterConfig{TaskReporter: "kafka", KafkaTaskTopic: "updates"}))
+	assert.Error(t, checkTaskReporter(&config.TowerPersisterConfig{TaskReporter: "kafka"}), "Kafka needs a topic")
+	assert.Error(t, checkTaskReporter(&config.TowerPersisterConfig{TaskReporter: "fax"}))
+	assert.NoError(t, checkTaskReporter(&config.TowerPersisterConfig{TaskReporter: "rest", TaskReporterHeader: "kafka, file"}))
+	assert.Error(t, checkTaskReporter(&config.TowerPersisterConfig{TaskReporter: "rest", TaskReporterHeader: "kafka,fax"}))
+}
+
+func TestTaskReporterBackend(t *testing.T) {
+	tr := &taskReporters{cfg: &config.TowerPersisterConfig{TaskReporter: "rest"}}
+	assert.Equal(t, catalogtask.BackendREST, tr.backend(reporterMessage(nil)))
+	assert.Equal(t, catalogtask.BackendREST, tr.backend(reporterMessage(map[string]string{taskReporterHeader: "file"})), "The header is ignored unless allowed")
+	assert.Equal(t, catalogtask.BackendREST, tr.backend(reporterMessage(map[string]string{taskReporterHeader: "rest"})))
+
+	tr.cfg.TaskReporterHeader = "file,kafka"
+	assert.Equal(t, catalogtask.BackendFile, tr.backend(reporterMessage(map[string]string{taskReporterHeader: "file"})))
+	assert.Equal(t, catalogtask.BackendREST, tr.backend(reporterMessage(map[string]string{taskReporterHeader: "fax"})), "An unknown backend should be ignored")
+	assert.Equal(t, catalogtask.BackendREST, tr.backend(reporterMessage(map[string]string{taskReporterHeader: "kafka"})), "Kafka needs a topic")
+
+	tr.cfg.KafkaTaskTopic = "updates"
+	tr.publisher = &fakePublisher{}
+	assert.Equal(t, catalogtask.BackendKafka, tr.backend(reporterMessage(map[string]string{taskReporterHeader: "kafka"})))
+
+	tr.cfg.TaskReporterHeader = "kafka"
+	assert.Equal(t, catalogtask.BackendREST, tr.backend(reporterMessage(map[string]string{taskReporterHeader: "file"})), "File is not allowed")
+}
+
+func TestTaskPersisterReporter(t *testing.T) {
+	var out bytes.Buffer
+	fp := &fakePublisher{}
+	tr := &taskReporters{
+		cfg:       &config.TowerPersisterConfig{TaskReporter: "file", TaskReporterHeader: "kafka", KafkaTaskTopic: "updates", EventPublishTimeout: time.Second},
+		publisher: fp,
+		sink:      catalogtask.NewWriterSink(&out),
+	}
+	assert.NoError(t, updateTask(testhelper.TestLogger(), "running", "ok", "Processing", nil, taskPersister(tr, reporterMessage(nil))))
+	var update map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &update))
+	assert.Equal(t, "/tasks/1", update["task_url"])
+	assert.Equal(t, "running", update["state"])
+
+	qm := reporterMessage(map[string]string{taskReporterHeader: "kafka", "x-rh-identity": "abc"})
+	assert.NoError(t, updateTask(testhelper.TestLogger(), "completed", "ok", "Success", nil, taskPersister(tr, qm)))
+	assert.Len(t, fp.messages, 1)
+	assert.Equal(t, "updates", fp.messages[0].Topic)
+	assert.Equal(t, "/tasks/1", fp.messages[0].Key)
+}
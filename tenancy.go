@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/identity"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
+	"github.com/sirupsen/logrus"
+)
+
+// tenantKeys are what the tenant of a message can be found by, the tenant_id
+// of the message and the account and org id of its identity
+func tenantKeys(ctx context.Context, message MessagePayload) tenant.Keys {
+	keys := tenant.Keys{ID: message.TenantID}
+	if id, ok := identity.FromContext(ctx); ok {
+		keys.AccountNumber = id.AccountNumber
+		keys.OrgID = id.OrgID
+	}
+	return keys
+}
+
+// findTenant finds the tenant of a message with the configured lookups, the
+// precedence was checked on startup
+func findTenant(ctx context.Context, cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Entry, message MessagePayload) (*tenant.Tenant, error) {
+	precedence, err := tenant.ParsePrecedence(cfg.TenantLookup)
+	if err != nil {
+		return nil, err
+	}
+	t, lookup, err := tenant.Resolve(ctx, tenant.NewGORMRepository(db.DB), precedence, tenantKeys(ctx, message))
+	if err != nil {
+		return nil, err
+	}
+	if lookup != tenant.LookupID {
+		logger.Infof("Found tenant %d by %s", t.ID, lookup)
+	}
+	return t, nil
+}
+
+// checkTenantOrgID turns off the org id lookup and backfill until Catalog
+// Inventory, which owns the tenants table, has added the org_id column
+func checkTenantOrgID(ctx context.Context, cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Entry) error {
+	precedence, err := tenant.ParsePrecedence(cfg.TenantLookup)
+	if err != nil {
+		return err
+	}
+	found, err := tenant.NewGORMRepository(db.DB).HasOrgID(ctx)
+	if err != nil {
+		return fmt.Errorf("Error checking the tenants org_id column %v", err)
+	}
+	if found {
+		return nil
+	}
+	precedence = tenant.WithoutOrgID(precedence)
+	if len(precedence) == 0 {
+		return fmt.Errorf("tenants have no org_id column, the tenant lookup needs id or account")
+	}
+	names := make([]string, len(precedence))
+	for i, l := range precedence {
+		names[i] = string(l)
+	}
+	logger.Warnf("Tenants have no org_id column yet, looking up tenants by %s without org id backfill", strings.Join(names, ","))
+	cfg.TenantLookup = strings.Join(names, ",")
+	cfg.TenantOrgIDBackfill = false
+	return nil
+}
+
+// backfillOrgID sets the org id of the identity on a tenant created before
+// org ids, so it can be found by org id from then on. The identity has been
+// checked against the tenant, a failure only costs a slower lookup next time.
+func backfillOrgID(ctx context.Context, cfg *config.TowerPersisterConfig, db DatabaseContext, logger *logrus.Entry, t *tenant.Tenant) {
+	id, ok := identity.FromContext(ctx)
+	if !cfg.TenantOrgIDBackfill || !ok || id.OrgID == "" || t.OrgID != "" {
+		return
+	}
+	filled, err := tenant.NewGORMRepository(db.DB).BackfillOrgID(ctx, t, id.OrgID)
+	if err != nil {
+		logger.Errorf("Error backfilling the org id of tenant %d %v", t.ID, err)
+		return
+	}
+	if filled {
+		logger.Infof("Backfilled org id %s of tenant %d", id.OrgID, t.ID)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/RedHatInsights/catalog_tower_persister/config"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/identity"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/tenant"
+	"github.com/RedHatInsights/catalog_tower_persister/internal/models/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantKeys(t *testing.T) {
+	message := MessagePayload{TenantID: 888, SourceID: 777}
+	assert.Equal(t, tenant.Keys{ID: 888}, tenantKeys(context.TODO(), message))
+
+	ctx := identity.NewContext(context.TODO(), &identity.Identity{AccountNumber: testAccount, OrgID: "1234", Type: "User"})
+	assert.Equal(t, tenant.Keys{ID: 888, AccountNumber: testAccount, OrgID: "1234"}, tenantKeys(ctx, message))
+}
+
+func TestFindTenantInvalidLookup(t *testing.T) {
+	_, err := findTenant(context.TODO(), &config.TowerPersisterConfig{TenantLookup: "name"}, DatabaseContext{}, testhelper.TestLogger(), MessagePayload{})
+	assert.Error(t, err)
+}
+
+func TestBackfillOrgIDDisabled(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := identity.NewContext(context.TODO(), &identity.Identity{AccountNumber: testAccount, OrgID: "1234", Type: "User"})
+
+	backfillOrgID(ctx, &config.TowerPersisterConfig{}, DatabaseContext{DB: gdb}, testhelper.TestLogger(), &tenant.Tenant{ID: 888})
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func expectOrgIDColumn(mock sqlmock.Sqlmock, count int64) {
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM information_schema.columns WHERE table_schema = CURRENT_SCHEMA() AND table_name = $1 AND column_name = $2`)).
+		WithArgs("tenants", "org_id").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+}
+
+func TestCheckTenantOrgID(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	expectOrgIDColumn(mock, 1)
+
+	cfg := &config.TowerPersisterConfig{TenantLookup: "id,org_id,account", TenantOrgIDBackfill: true}
+	assert.NoError(t, checkTenantOrgID(context.TODO(), cfg, DatabaseContext{DB: gdb}, testhelper.TestLogger()))
+	assert.Equal(t, "id,org_id,account", cfg.TenantLookup)
+	assert.True(t, cfg.TenantOrgIDBackfill)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+func TestCheckTenantWithoutOrgID(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	expectOrgIDColumn(mock, 0)
+	expectOrgIDColumn(mock, 0)
+
+	cfg := &config.TowerPersisterConfig{TenantLookup: "id,org_id,account", TenantOrgIDBackfill: true}
+	assert.NoError(t, checkTenantOrgID(context.TODO(), cfg, DatabaseContext{DB: gdb}, testhelper.TestLogger()))
+	assert.Equal(t, "id,account", cfg.TenantLookup, "The org id lookup needs the column")
+	assert.False(t, cfg.TenantOrgIDBackfill, "The backfill needs the column")
+
+	cfg = &config.TowerPersisterConfig{TenantLookup: "org_id"}
+	assert.Error(t, checkTenantOrgID(context.TODO(), cfg, DatabaseContext{DB: gdb}, testhelper.TestLogger()))
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+}
+
+// A message without a tenant_id from a tenant created before org ids is
+// found by its account number and the tenant gets the org id
+func TestStartWorkerTenantByAccount(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := identity.NewContext(context.TODO(), &identity.Identity{AccountNumber: testAccount, OrgID: "1234", Type: "User"})
+	headers := map[string]string{"x-rh-insights-request-id": "abc"}
+	shutdown := make(chan struct{})
+	tenantID := int64(888)
+	sourceID := int64(777)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "tenants" WHERE org_id = $1 ORDER BY "tenants"."id" LIMIT 1`)).
+		WithArgs("1234").
+		WillReturnRows(sqlmock.NewRows(tenantColumns))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "tenants" WHERE external_tenant = $1 ORDER BY "tenants"."id" LIMIT 1`)).
+		WithArgs(testAccount).
+		WillReturnRows(sqlmock.NewRows(tenantColumns).AddRow(tenantID, testAccount))
+	sourceMock(mock, sourceID, tenantID, nil)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "tenants" SET "org_id"=$1 WHERE id = $2 AND (org_id IS NULL OR org_id = '')`)).
+		WithArgs("1234", tenantID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	lockMock(mock, sourceID, true)
+	refreshMock(mock, true)
+	unlockMock(mock, sourceID)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp := MessagePayload{SourceID: sourceID,
+		TaskURL: "http://www.example.com",
+		DataURL: "http://www.example.com",
+		Size:    int64(900)}
+	fp := FakePersister{}
+
+	dc := DatabaseContext{DB: gdb}
+	startPersisterWorker(ctx, &config.TowerPersisterConfig{WorkerTimeout: time.Minute, TenantOrgIDBackfill: true}, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	assert.True(t, fp.loaderCalled)
+	assert.Len(t, fp.published, 1)
+	assert.Equal(t, tenantID, fp.published[0].TenantID)
+}
+
+// Without the org_id column the workers get the checked configuration and
+// never look tenants up by org id
+func TestStartWorkerTenantWithoutOrgIDColumn(t *testing.T) {
+	gdb, mock, teardown := testhelper.MockDBSetup(t)
+	defer teardown()
+	ctx := identity.NewContext(context.TODO(), &identity.Identity{AccountNumber: testAccount, OrgID: "1234", Type: "User"})
+	headers := map[string]string{"x-rh-insights-request-id": "abc"}
+	shutdown := make(chan struct{})
+	tenantID := int64(888)
+	sourceID := int64(777)
+	expectOrgIDColumn(mock, 0)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "tenants" WHERE external_tenant = $1 ORDER BY "tenants"."id" LIMIT 1`)).
+		WithArgs(testAccount).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "external_tenant"}).AddRow(tenantID, testAccount))
+	sourceMock(mock, sourceID, tenantID, nil)
+	lockMock(mock, sourceID, true)
+	refreshMock(mock, true)
+	unlockMock(mock, sourceID)
+
+	dc := DatabaseContext{DB: gdb}
+	cfg := &config.TowerPersisterConfig{WorkerTimeout: time.Minute, TenantOrgIDBackfill: true}
+	assert.NoError(t, checkTenantOrgID(context.TODO(), cfg, dc, testhelper.TestLogger()))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp := MessagePayload{SourceID: sourceID,
+		TaskURL: "http://www.example.com",
+		DataURL: "http://www.example.com",
+		Size:    int64(900)}
+	fp := FakePersister{}
+	startPersisterWorker(ctx, cfg, dc, testhelper.TestLogger(), mp, headers, shutdown, &wg, &fp)
+	assert.NoError(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations")
+	assert.True(t, fp.loaderCalled)
+	assert.Len(t, fp.published, 1)
+	assert.Equal(t, tenantID, fp.published[0].TenantID)
+}